@@ -0,0 +1,2480 @@
+package bench
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestWorker(params StressParameters) *StressWorker {
+	if params.RequestMethod == "" {
+		params.RequestMethod = http.MethodGet
+	}
+	if params.RequestHttpType == "" {
+		params.RequestHttpType = TYPE_HTTP1
+	}
+	if params.Timeout == 0 {
+		params.Timeout = 3000
+	}
+	if params.Duration == 0 {
+		params.Duration = 60
+	}
+	params.Cmd = CMD_START
+	return New(params)
+}
+
+func TestHTTP1ConcurrencyNotSerialized(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	worker := newTestWorker(StressParameters{
+		N:    50,
+		C:    50,
+		Urls: []string{srv.URL},
+	})
+	worker.Start()
+	result := worker.Wait()
+	if result == nil || result.LatsTotal < 50 {
+		t.Fatalf("expected at least 50 responses, got %+v", result)
+	}
+	// With a pool capped at 10 connections the 50 workers would queue for
+	// several rounds of delay.
+	if worker.totalTime > 3*delay {
+		t.Fatalf("requests serialized, total time %v", worker.totalTime)
+	}
+}
+
+func TestConnectionReuseStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	for _, disableKeepAlives := range []bool{false, true} {
+		worker := newTestWorker(StressParameters{
+			N:                 20,
+			C:                 1,
+			DisableKeepAlives: disableKeepAlives,
+			Urls:              []string{srv.URL},
+		})
+		worker.Start()
+		result := worker.Wait()
+		if result.NewConns+result.ReusedConns != result.LatsTotal {
+			t.Fatalf("keepalive disabled %v: traced %d+%d connections for %d requests",
+				disableKeepAlives, result.NewConns, result.ReusedConns, result.LatsTotal)
+		}
+		if disableKeepAlives && result.ReusedConns != 0 {
+			t.Fatalf("expected no reused connections, got %d", result.ReusedConns)
+		}
+		if !disableKeepAlives && result.NewConns != 1 {
+			t.Fatalf("expected a single new connection, got %d", result.NewConns)
+		}
+	}
+}
+
+func TestMaxBodyRead(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(make([]byte, size))
+	}))
+	defer srv.Close()
+
+	const n, limit = 10, 10 << 10
+	for _, tc := range []struct {
+		size     int
+		skip     bool
+		read     int64
+		newConns int64
+	}{
+		{size: 200 << 10, read: limit, newConns: 1},       // The rest is drained, the connection reused
+		{size: 2 << 20, read: limit, newConns: n},         // Too long to drain, every connection closed
+		{size: 2 << 20, skip: true, read: 0, newConns: n}, // Not read at all
+	} {
+		params := StressParameters{Urls: []string{fmt.Sprintf("%s/?size=%d", srv.URL, tc.size)}, N: n, C: 1}
+		if params.SkipBody = tc.skip; !tc.skip {
+			params.MaxBodyRead = limit
+		}
+		worker := newTestWorker(params)
+		worker.Start()
+		stressResult := worker.Wait()
+		if stressResult.LatsTotal != n || stressResult.SizeTotal != n*tc.read || (tc.read > 0 && stressResult.SizeMax != tc.read) {
+			t.Fatalf("size %d, skip %v: %d responses, %d bytes counted, largest %d, want %d of %d bytes",
+				tc.size, tc.skip, stressResult.LatsTotal, stressResult.SizeTotal, stressResult.SizeMax, n, tc.read)
+		}
+		if stressResult.NewConns != tc.newConns || stressResult.ReusedConns != n-tc.newConns {
+			t.Fatalf("size %d, skip %v: %d new and %d reused connections, want %d new",
+				tc.size, tc.skip, stressResult.NewConns, stressResult.ReusedConns, tc.newConns)
+		}
+	}
+}
+
+func TestExactRequestCount(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct{ n, c int }{{100, 30}, {7, 20}, {1, 1}, {64, 8}} {
+		atomic.StoreInt64(&hits, 0)
+		worker := newTestWorker(StressParameters{
+			N:    tc.n,
+			C:    tc.c,
+			Urls: []string{srv.URL},
+		})
+		worker.Start()
+		stressResult := worker.Wait()
+		if got := atomic.LoadInt64(&hits); got != int64(tc.n) {
+			t.Fatalf("-n %d -c %d: server saw %d requests", tc.n, tc.c, got)
+		}
+		if stressResult.Attempted != int64(tc.n) || stressResult.LatsTotal != int64(tc.n) {
+			t.Fatalf("-n %d -c %d: attempted %d, completed %d",
+				tc.n, tc.c, stressResult.Attempted, stressResult.LatsTotal)
+		}
+		if stressResult.StopReason != STOP_REQUESTS {
+			t.Fatalf("-n %d -c %d: stopped by %q", tc.n, tc.c, stressResult.StopReason)
+		}
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	worker := newTestWorker(StressParameters{C: 2, Urls: []string{srv.URL}})
+	worker.Options.Verbose = VERBOSE_ERROR + 1
+	begin := time.Now()
+	stressResult := worker.Run(ctx)
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Fatalf("canceled run took %v", elapsed)
+	}
+	if stressResult == nil || stressResult.StopReason != STOP_STOPPED {
+		t.Fatalf("result %+v", stressResult)
+	}
+}
+
+func TestDurationAbortsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	// Accepts and reads, but never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	for _, params := range []StressParameters{
+		{C: 2, Duration: 1, Timeout: 300000, Urls: []string{srv.URL}},
+		{C: 2, Duration: 1, Timeout: 300000, Urls: []string{ln.Addr().String()}, RequestHttpType: TYPE_TCP, RequestBody: "ping"},
+	} {
+		worker := newTestWorker(params)
+		begin := time.Now()
+		stressResult := worker.Run(context.Background())
+		if elapsed := time.Since(begin); elapsed > 3*time.Second {
+			t.Fatalf("%s: stopped after %v", params.RequestHttpType, elapsed)
+		}
+		if stressResult == nil || stressResult.StopReason != STOP_DURATION || stressResult.ErrCode != 0 {
+			t.Fatalf("%s: result %+v", params.RequestHttpType, stressResult)
+		}
+	}
+}
+
+func TestMultipartFormUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "photo.jpg")
+	if err := ioutil.WriteFile(file, bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var fileSize int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("sum") != "6" {
+			http.Error(w, "bad field", http.StatusBadRequest)
+			return
+		}
+		f, h, err := r.FormFile("file")
+		if err != nil || h.Header.Get("Content-Type") != "image/jpeg" {
+			http.Error(w, "bad file", http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		n, _ := io.Copy(ioutil.Discard, f)
+		atomic.StoreInt64(&fileSize, n)
+	}))
+	defer srv.Close()
+
+	worker := newTestWorker(StressParameters{
+		N:             1,
+		C:             1,
+		RequestMethod: http.MethodPost,
+		FormFields:    []string{"sum={{ intSum 1 2 3 }}"},
+		FormFiles:     []string{"file=@" + file + ";type=image/jpeg"},
+		Urls:          []string{srv.URL},
+	})
+	worker.Start()
+	result := worker.Wait()
+	if result.StatusCodeDist[http.StatusOK] == 0 {
+		t.Fatalf("upload rejected: %v", result.StatusCodeDist)
+	}
+	if atomic.LoadInt64(&fileSize) != 4096 {
+		t.Fatalf("expected 4096 file bytes, got %d", fileSize)
+	}
+	if result.SizeTotal <= 4096 {
+		t.Fatalf("expected sent bytes in SizeTotal, got %d", result.SizeTotal)
+	}
+}
+
+func TestCompressBodyGzip(t *testing.T) {
+	body := strings.Repeat("hello world ", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != COMPRESS_GZIP {
+			http.Error(w, "not gzip", http.StatusBadRequest)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if data, err := ioutil.ReadAll(zr); err != nil || string(data) != body {
+			http.Error(w, "bad body", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	worker := newTestWorker(StressParameters{
+		N:             4,
+		C:             1,
+		RequestMethod: http.MethodPost,
+		RequestBody:   body,
+		CompressBody:  COMPRESS_GZIP,
+		Urls:          []string{srv.URL},
+	})
+	worker.Start()
+	result := worker.Wait()
+	if result.StatusCodeDist[http.StatusOK] != int(result.LatsTotal) {
+		t.Fatalf("gzip body rejected: %v", result.StatusCodeDist)
+	}
+	if result.BodyRawTotal != result.LatsTotal*int64(len(body)) {
+		t.Fatalf("expected %d raw bytes, got %d", result.LatsTotal*int64(len(body)), result.BodyRawTotal)
+	}
+	if result.BodyZipTotal <= 0 || result.BodyZipTotal >= result.BodyRawTotal {
+		t.Fatalf("expected compressed bytes below %d, got %d", result.BodyRawTotal, result.BodyZipTotal)
+	}
+}
+
+func TestBodyStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "big.bin")
+	data := make([]byte, 3<<20+17)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	type upload struct {
+		contentLength int64
+		chunked       bool
+		received      int
+		intact        bool
+	}
+	var lock sync.Mutex
+	var uploads []upload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == COMPRESS_GZIP {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		received, _ := ioutil.ReadAll(body)
+		chunked := len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+		lock.Lock()
+		uploads = append(uploads, upload{r.ContentLength, chunked, len(received), bytes.Equal(received, data)})
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	// The file size is the Content-Length of a plain body, a gzipped one is
+	// compressed on the fly and sent chunked.
+	for _, compress := range []string{"", COMPRESS_GZIP} {
+		uploads = nil
+		worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 3, C: 1, RequestMethod: http.MethodPost,
+			BodyStream: path, CompressBody: compress})
+		worker.Start()
+		stressResult := worker.Wait()
+		if stressResult.StatusCodeDist[http.StatusOK] != 3 || len(uploads) != 3 {
+			t.Fatalf("gzip %q: status codes %v, %d uploads", compress, stressResult.StatusCodeDist, len(uploads))
+		}
+		for _, u := range uploads {
+			if u.received != len(data) || !u.intact {
+				t.Fatalf("gzip %q: received %d intact %v, want %d bytes", compress, u.received, u.intact, len(data))
+			}
+			if compress == "" && (u.contentLength != int64(len(data)) || u.chunked) {
+				t.Fatalf("Content-Length %d, chunked %v, want %d", u.contentLength, u.chunked, len(data))
+			}
+			if compress != "" && (u.contentLength != -1 || !u.chunked) {
+				t.Fatalf("gzip: Content-Length %d, chunked %v", u.contentLength, u.chunked)
+			}
+		}
+		if compress == "" && stressResult.SentTotal != 3*int64(len(data)) {
+			t.Fatalf("sent %d bytes, want %d", stressResult.SentTotal, 3*len(data))
+		}
+		if compress != "" && stressResult.BodyRawTotal != 3*int64(len(data)) {
+			t.Fatalf("gzip: %d raw bytes, want %d", stressResult.BodyRawTotal, 3*len(data))
+		}
+	}
+}
+
+func TestSaveResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "backend exploded", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	worker := newTestWorker(StressParameters{
+		N:                  10,
+		C:                  1,
+		SaveResponses:      dir,
+		SaveResponsesCount: 3,
+		Urls:               []string{srv.URL + "/?id={{ intSum 1 2 }}"},
+	})
+	worker.Start()
+	worker.Wait()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected 3 saved responses, got %d", len(files))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"GET " + srv.URL + "/?id=3", "500 Internal Server Error", "backend exploded"} {
+		if !strings.Contains(string(data), expected) {
+			t.Fatalf("saved response missing %q:\n%s", expected, data)
+		}
+	}
+}
+
+func TestVerifySha256(t *testing.T) {
+	payload := []byte("object payload")
+	sum := sha256.Sum256(payload)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Sha256", hex.EncodeToString(sum[:]))
+		if r.URL.Query().Get("corrupt") != "" {
+			w.Write([]byte("0bject payload"))
+			return
+		}
+		w.Write(payload)
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		url     string
+		params  StressParameters
+		corrupt bool
+	}{
+		{srv.URL, StressParameters{VerifySha256: hex.EncodeToString(sum[:])}, false},
+		{srv.URL, StressParameters{VerifySha256Header: "X-Content-Sha256"}, false},
+		{srv.URL + "/?corrupt=1", StressParameters{VerifySha256Header: "X-Content-Sha256"}, true},
+	} {
+		tc.params.N, tc.params.C, tc.params.Urls = 5, 1, []string{tc.url}
+		worker := newTestWorker(tc.params)
+		worker.Start()
+		result := worker.Wait()
+		if corrupt := result.Corrupt == result.LatsTotal; corrupt != tc.corrupt || (!tc.corrupt && result.Corrupt != 0) {
+			t.Fatalf("%s: %d of %d responses corrupt", tc.url, result.Corrupt, result.LatsTotal)
+		}
+		if tc.corrupt && result.ErrorDist[ErrCorrupt.Error()] != int(result.Corrupt) {
+			t.Fatalf("expected corrupt responses in ErrorDist, got %v", result.ErrorDist)
+		}
+	}
+}
+
+func TestUrlMethods(t *testing.T) {
+	var lock sync.Mutex
+	seen := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		seen[r.URL.Path] = r.Method + " " + string(body)
+		lock.Unlock()
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", "100") // Of the body a GET would get
+		}
+	}))
+	defer server.Close()
+
+	worker := newTestWorker(StressParameters{
+		Urls:          []string{server.URL + "/patch", server.URL + "/default", server.URL + "/head"},
+		UrlMethods:    []string{http.MethodPatch, "", http.MethodHead},
+		N:             100,
+		C:             2,
+		RequestMethod: http.MethodPut,
+		RequestBody:   "{}",
+	})
+	worker.Start()
+	stressResult := worker.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	if seen["/patch"] != "PATCH {}" || seen["/default"] != "PUT {}" || !strings.HasPrefix(seen["/head"], "HEAD") {
+		t.Fatalf("requests %v", seen)
+	}
+	if worker.Err() != nil || stressResult.StatusCodeDist[http.StatusOK] != 100 || stressResult.LengthMismatch != 0 {
+		t.Fatalf("err %v, codes %v, %d mismatches", worker.Err(), stressResult.StatusCodeDist, stressResult.LengthMismatch)
+	}
+}
+
+func TestLatencyExcludingConnect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 20, C: 2, DisableKeepAlives: true})
+	worker.Start()
+	stressResult := worker.Wait()
+	if stressResult.RequestTotal != 20 || stressResult.NewConns != 20 {
+		t.Fatalf("%d requests timed, %d new connections", stressResult.RequestTotal, stressResult.NewConns)
+	}
+	_, excluded, _, _, _ := latsStats(stressResult.RequestLats)
+	if _, included, _, _, _ := latsStats(stressResult.Lats); excluded > included {
+		t.Fatalf("mean %4.3f ms excluding connect, above the %4.3f ms including it", excluded, included)
+	}
+	var out bytes.Buffer
+	stressResult.Print(&out, 0)
+	if !strings.Contains(out.String(), "(including connect)") || !strings.Contains(out.String(), "(excluding connect") {
+		t.Fatalf("no latency distributions in\n%s", out.String())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+	for value, want := range map[string]time.Duration{
+		"2": 2 * time.Second,
+		now.Add(time.Hour).UTC().Format(http.TimeFormat):  time.Hour,
+		now.Add(-time.Hour).UTC().Format(http.TimeFormat): 0,
+	} {
+		if wait, ok := retryAfter(value, now); !ok || wait < want-time.Second || wait > want {
+			t.Fatalf("retryAfter(%q) = %v, %v, want %v", value, wait, ok, want)
+		}
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		t.Fatal("retryAfter accepted soon")
+	}
+
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1)%2 == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	// The hour is capped to RetryAfterMax.
+	start := time.Now()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 4, C: 1, RespectRetryAfter: true, RetryAfterMax: 100})
+	worker.Start()
+	stressResult := worker.Wait()
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("run took %v, want two pauses of 100ms", elapsed)
+	}
+	if stressResult.ThrottledTotal != 2 || stressResult.BackoffTotal < 2*SCALE_NUM/10 || stressResult.BackoffTotal > SCALE_NUM ||
+		stressResult.StatusCodeDist[http.StatusTooManyRequests] != 2 {
+		t.Fatalf("%d throttled, backoff %d, codes %v", stressResult.ThrottledTotal, stressResult.BackoffTotal, stressResult.StatusCodeDist)
+	}
+
+	// A stop cuts the pause short, only the time slept counts.
+	atomic.StoreInt64(&hits, 0)
+	worker = newTestWorker(StressParameters{Urls: []string{server.URL}, N: 2, C: 1, RespectRetryAfter: true, RetryAfterMax: 5000})
+	time.AfterFunc(300*time.Millisecond, func() { worker.Stop(false, nil) })
+	worker.Start()
+	if stressResult = worker.Wait(); stressResult.ThrottledTotal != 1 || stressResult.BackoffTotal > 2*SCALE_NUM {
+		t.Fatalf("%d throttled, backoff %d after a stop", stressResult.ThrottledTotal, stressResult.BackoffTotal)
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gap := 20 * time.Millisecond
+		if r.URL.Path == "/stall" {
+			gap = 300 * time.Millisecond
+		}
+		for i := 0; i < 5; i++ {
+			if i > 0 {
+				time.Sleep(gap)
+			}
+			w.Write([]byte("data: token\n\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 4, C: 2, StreamMetrics: true, StreamIdleTimeout: 200})
+	worker.Start()
+	stressResult := worker.Wait()
+	if worker.Err() != nil || stressResult.StreamTotal != 4 || stressResult.StreamChunks < 16 || stressResult.StreamGaps != 4 {
+		t.Fatalf("err %v, %d streams, %d chunks, %d gaps", worker.Err(), stressResult.StreamTotal, stressResult.StreamChunks, stressResult.StreamGaps)
+	}
+	if _, mean, _, _, _ := latsStats(stressResult.StreamGapLats); mean < 15 || mean > 60 {
+		t.Fatalf("mean gap %4.1f ms, want about 20", mean)
+	}
+	if _, mean, _, _, _ := latsStats(stressResult.StreamLats); mean < 60 || mean > 240 {
+		t.Fatalf("mean stream duration %4.1f ms, want about 80", mean)
+	}
+	var out bytes.Buffer
+	stressResult.Print(&out, 0)
+	if !strings.Contains(out.String(), "Stream metrics:") || !strings.Contains(out.String(), "Inter-chunk gap:") {
+		t.Fatalf("no stream metrics in\n%s", out.String())
+	}
+
+	worker = newTestWorker(StressParameters{Urls: []string{server.URL + "/stall"}, N: 2, C: 2, StreamMetrics: true, StreamIdleTimeout: 100})
+	worker.Start()
+	stressResult = worker.Wait()
+	if worker.Err() != nil || stressResult.ErrorDist[ErrStreamStall.Error()] != 2 || stressResult.StreamTotal != 0 {
+		t.Fatalf("stall: err %v, errors %v, %d streams", worker.Err(), stressResult.ErrorDist, stressResult.StreamTotal)
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(bytes.Repeat([]byte("a"), 1000))
+	zw.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/head":
+			w.Header().Set("Content-Length", "1000")
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", strconv.Itoa(gzipped.Len()))
+			w.Write(gzipped.Bytes())
+		case "/short":
+			// The server closes the connection after the 10 bytes.
+			w.Header().Set("Content-Length", "100")
+			w.Write(bytes.Repeat([]byte("a"), 10))
+		}
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		method, path     string
+		tolerance        int64
+		size, mismatches int64
+	}{
+		{http.MethodHead, "/head", 0, 0, 0},
+		{http.MethodGet, "/gzip", 0, 1000, 0},
+		{http.MethodGet, "/short", 0, 10, 1},
+		{http.MethodGet, "/short", 90, 10, 0},
+	} {
+		worker := newTestWorker(StressParameters{Urls: []string{server.URL + c.path}, N: 1, C: 1,
+			RequestMethod: c.method, LengthTolerance: c.tolerance})
+		worker.Start()
+		stressResult := worker.Wait()
+		if stressResult.SizeTotal != c.size || stressResult.LengthMismatch != c.mismatches {
+			t.Fatalf("%s %s tolerance %d: size %d, %d mismatches, want %d and %d", c.method, c.path, c.tolerance,
+				stressResult.SizeTotal, stressResult.LengthMismatch, c.size, c.mismatches)
+		}
+		// The summary shows what the mismatched responses declared and sent.
+		if c.mismatches > 0 {
+			var buf bytes.Buffer
+			stressResult.Print(&buf, 0)
+			if stressResult.LengthDeclared != 100 || stressResult.LengthReceived != 10 ||
+				!strings.Contains(buf.String(), "(100 bytes declared, 10 received)") {
+				t.Fatalf("declared %d, received %d:\n%s", stressResult.LengthDeclared, stressResult.LengthReceived, buf.String())
+			}
+		}
+	}
+}
+
+func TestSizeDistCombine(t *testing.T) {
+	for size, bucket := range map[int64]int{0: 0, 1: 1, 2: 2, 3: 2, 1023: 10, 1024: 11} {
+		if b := sizeBucket(size); b != bucket {
+			t.Fatalf("sizeBucket(%d): expected %d, got %d", size, bucket, b)
+		}
+	}
+
+	newResult := func(sizes ...int64) *StressResult {
+		stressResult := &StressResult{
+			ErrorDist:      make(map[string]int),
+			StatusCodeDist: make(map[int]int),
+			Lats:           make(map[string]int64),
+			SizeDist:       make(map[int]int64),
+			Fastest:        int64(INT_MAX),
+			SizeMin:        int64(INT_MAX),
+		}
+		for _, size := range sizes {
+			stressResult.result(&result{statusCode: http.StatusOK, contentLength: size})
+		}
+		return stressResult
+	}
+	results := []*StressResult{newResult(100, 3000), newResult(10, 100)}
+	results[0].Combine(results[1:]...)
+	if results[0].SizeMin != 10 || results[0].SizeMax != 3000 {
+		t.Fatalf("expected sizes in [10, 3000], got [%d, %d]", results[0].SizeMin, results[0].SizeMax)
+	}
+	if results[0].SizeDist[sizeBucket(100)] != 2 || results[0].SizeDist[sizeBucket(3000)] != 1 {
+		t.Fatalf("unexpected size distribution %v", results[0].SizeDist)
+	}
+}
+
+func TestPrintDistributions(t *testing.T) {
+	result := &StressResult{
+		StatusCodeDist: map[int]int{503: 2, 200: 10, 404: 1},
+		ErrorDist: map[string]int{
+			"dial tcp: connection refused":  3,
+			"EOF":                           3,
+			"context deadline exceeded":     7,
+			strings.Repeat("x", 30) + "END": 1,
+		},
+	}
+
+	var codes bytes.Buffer
+	result.printStatusCodes(&codes)
+	expected := "\nStatus code distribution:\n" +
+		"  [200]\t10 responses\n" +
+		"  [404]\t1 responses\n" +
+		"  [503]\t2 responses\n"
+	if codes.String() != expected {
+		t.Fatalf("status codes:\nexpected %q\ngot      %q", expected, codes.String())
+	}
+
+	var errs bytes.Buffer
+	result.printErrors(&errs, 30)
+	expected = "\nError distribution:\n" +
+		"  [7]\tcontext deadline exceeded\n" +
+		"  [3]\tEOF\n" +
+		"  [3]\tdial tcp: connection refused\n" +
+		"  [1]\t" + strings.Repeat("x", 30) + "(+3 more chars)\n"
+	if errs.String() != expected {
+		t.Fatalf("errors:\nexpected %q\ngot      %q", expected, errs.String())
+	}
+}
+
+func TestStdDevDistributedMatchesSingle(t *testing.T) {
+	newResult := func() *StressResult {
+		return &StressResult{
+			ErrorDist:      make(map[string]int),
+			StatusCodeDist: make(map[int]int),
+			Lats:           make(map[string]int64),
+			SizeDist:       make(map[int]int64),
+			Slowest:        int64(INT_MIN),
+			Fastest:        int64(INT_MAX),
+			SizeMin:        int64(INT_MAX),
+		}
+	}
+	samples := []time.Duration{10, 12, 15, 20, 50, 11, 13, 300, 14, 16}
+	single, nodes := []*StressResult{newResult()}, []*StressResult{newResult(), newResult(), newResult()}
+	for i, ms := range samples {
+		res := &result{statusCode: http.StatusOK, duration: ms * time.Millisecond}
+		single[0].result(res)
+		nodes[i%len(nodes)].result(res)
+	}
+	single[0].Combine()
+	nodes[0].Combine(nodes[1:]...)
+
+	if single[0].StdDev <= 0 {
+		t.Fatalf("expected a positive std dev, got %d", single[0].StdDev)
+	}
+	if single[0].StdDev != nodes[0].StdDev || math.Abs(single[0].CV-nodes[0].CV) > 1e-9 {
+		t.Fatalf("single std dev %d cv %f, distributed std dev %d cv %f",
+			single[0].StdDev, single[0].CV, nodes[0].StdDev, nodes[0].CV)
+	}
+}
+
+func TestPeakRpsMergedTimeline(t *testing.T) {
+	a := &StressResult{Timeline: map[int64]int64{100: 5, 101: 30, 102: 5}}
+	b := &StressResult{Timeline: map[int64]int64{101: 20, 102: 40, 103: 10}}
+	a.Combine(b)
+	// Merged per second, 101 holds 50 responses while neither worker
+	// alone went above 40.
+	if a.PeakRps != 50 || a.PeakSecond != 1 {
+		t.Fatalf("expected peak 50 at 1s, got %d at %ds", a.PeakRps, a.PeakSecond)
+	}
+	// Four seconds are too short for a 10 second peak.
+	if a.PeakRps10s != 0 {
+		t.Fatalf("expected no sustained peak, got %f", a.PeakRps10s)
+	}
+	var out bytes.Buffer
+	a.Print(&out, 0)
+	if strings.Contains(out.String(), "Peak 10s RPS") {
+		t.Fatalf("printed a 10s peak of a 4s run:\n%s", out.String())
+	}
+
+	for second := int64(104); second < 112; second++ {
+		a.Timeline[second] = 20
+	}
+	a.Combine()
+	// 101 to 110 hold 50+45+10+7*20.
+	if a.PeakRps10s != 24.5 {
+		t.Fatalf("expected sustained peak %f, got %f", 24.5, a.PeakRps10s)
+	}
+}
+
+func TestQpsGlobalTokens(t *testing.T) {
+	tokens, err := newTokenServer("127.0.0.1:0", &rateSchedule{start: time.Now(), base: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokens.Close()
+	start := tokens.schedule.start
+	if got := tokens.grant(start.Add(500*time.Millisecond), 80); got != 50 {
+		t.Fatalf("expected 50 tokens after 500ms, got %d", got)
+	}
+	if got := tokens.grant(start.Add(500*time.Millisecond), 80); got != 0 {
+		t.Fatalf("expected no tokens left, got %d", got)
+	}
+	// Ten idle seconds only allow one second of burst.
+	if got := tokens.grant(start.Add(10500*time.Millisecond), 1000); got != 100 {
+		t.Fatalf("expected a burst of 100 tokens, got %d", got)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	fleet, err := newTokenServer("127.0.0.1:0", &rateSchedule{start: time.Now(), base: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fleet.Close()
+	worker := newTestWorker(StressParameters{
+		N:         40,
+		C:         4,
+		Qps:       25,
+		QpsGlobal: fleet.listener.Addr().String(),
+		Urls:      []string{srv.URL},
+	})
+	worker.Start()
+	stressResult := worker.Wait()
+	if stressResult.LatsTotal != 40 {
+		t.Fatalf("expected 40 responses, got %d", stressResult.LatsTotal)
+	}
+	if worker.totalTime < 300*time.Millisecond {
+		t.Fatalf("40 requests at 100 qps took only %v", worker.totalTime)
+	}
+}
+
+func TestBurstSchedule(t *testing.T) {
+	params := &StressParameters{Qps: 10, BurstRate: 100, BurstDuration: 2000, BurstInterval: 10000}
+	schedule := newRateSchedule(params, 2)
+	start := schedule.start
+	if schedule.inBurst(start.Add(7*time.Second)) || !schedule.inBurst(start.Add(9*time.Second)) ||
+		schedule.inBurst(start.Add(11*time.Second)) {
+		t.Fatal("burst window should be the last 2s of every 10s")
+	}
+	if next := schedule.next(start.Add(time.Second), nil); next.Sub(start) != time.Second+50*time.Millisecond {
+		t.Fatalf("base rate of 2 conns at 10 qps should send every 50ms, got %v", next.Sub(start))
+	}
+	if next := schedule.next(start.Add(9*time.Second), nil); next.Sub(start) != 9*time.Second+5*time.Millisecond {
+		t.Fatalf("burst rate of 2 conns at 100 qps should send every 5ms, got %v", next.Sub(start))
+	}
+	// Two periods of 8s at 20 qps and 2s at 200 qps, then 1s of base rate.
+	if got := schedule.accrued(start.Add(21 * time.Second)); math.Abs(got-(2*(8*20+2*200)+20)) > 1e-6 {
+		t.Fatalf("accrued %v tokens", got)
+	}
+
+	// Without a duration or an interval the burst window is undefined, the
+	// run is refused instead of dividing by a zero interval.
+	for _, bad := range []StressParameters{
+		{Qps: 10, BurstRate: 100, BurstDuration: 2000},
+		{Qps: 10, BurstRate: 100, BurstInterval: 10000},
+		{Qps: 10, BurstRate: 100, BurstDuration: 2000, BurstInterval: 2000},
+	} {
+		if err := bad.CheckBurst(); err == nil {
+			t.Fatalf("burst of %dms every %dms accepted", bad.BurstDuration, bad.BurstInterval)
+		}
+		if _, err := ServeTokens("127.0.0.1:0", &bad); err == nil {
+			t.Fatalf("tokens served for a burst of %dms every %dms", bad.BurstDuration, bad.BurstInterval)
+		}
+		bad.Urls, bad.N, bad.C = []string{"http://127.0.0.1:1/"}, 5, 1
+		worker := newTestWorker(bad)
+		worker.Start()
+		worker.Wait()
+		if err := worker.Err(); err == nil || !strings.Contains(err.Error(), "invalid burst") {
+			t.Fatalf("burst of %dms every %dms ran: %v", bad.BurstDuration, bad.BurstInterval, err)
+		}
+	}
+	if err := params.CheckBurst(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestsPerConn(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	worker := newTestWorker(StressParameters{
+		N:               25,
+		C:               1,
+		RequestsPerConn: 10,
+		Urls:            []string{srv.URL},
+	})
+	worker.Start()
+	stressResult := worker.Wait()
+	if stressResult.NewConns != 3 || stressResult.ReusedConns != 22 {
+		t.Fatalf("expected 3 new and 22 reused connections, got %d and %d",
+			stressResult.NewConns, stressResult.ReusedConns)
+	}
+	if stressResult.Reconnects != 2 {
+		t.Fatalf("expected 2 reconnects, got %d", stressResult.Reconnects)
+	}
+}
+
+func TestPoissonSchedule(t *testing.T) {
+	schedule := newRateSchedule(&StressParameters{Qps: 100, RateDistribution: RATE_POISSON}, 1)
+	rnd := rand.New(rand.NewSource(1))
+	const count = 20000
+	next, distinct := schedule.start, make(map[time.Duration]bool)
+	for i := 0; i < count; i++ {
+		prev := next
+		next = schedule.next(prev, rnd)
+		distinct[next.Sub(prev)] = true
+	}
+	// The mean gap stays 10ms, but the gaps are not constant.
+	mean := next.Sub(schedule.start) / count
+	if mean < 9500*time.Microsecond || mean > 10500*time.Microsecond {
+		t.Fatalf("mean poisson gap %v, expected about 10ms", mean)
+	}
+	if len(distinct) < count/2 {
+		t.Fatalf("only %d distinct gaps", len(distinct))
+	}
+}
+
+func TestDnsRefresh(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	resolver := New(StressParameters{})
+	cache := newDnsCache(time.Minute, resolver.lookupHost, resolver.logf)
+	addrs, err := cache.lookup(context.Background(), "localhost")
+	if err != nil || len(addrs) == 0 {
+		t.Fatalf("lookup localhost: %v %v", addrs, err)
+	}
+	if cached, _ := cache.lookup(context.Background(), "localhost"); &cached[0] != &addrs[0] {
+		t.Fatal("expected the cached addresses within the ttl")
+	}
+	cache.expire()
+	if fresh, _ := cache.lookup(context.Background(), "localhost"); len(fresh) == 0 || &fresh[0] == &addrs[0] {
+		t.Fatal("expected a new lookup once expired by a refresh")
+	}
+
+	// A request every 50ms with a refresh every 100ms redials several times.
+	worker := newTestWorker(StressParameters{
+		N:          10,
+		C:          1,
+		Think:      50,
+		DnsRefresh: 100,
+		Urls:       []string{strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)},
+	})
+	worker.Start()
+	stressResult := worker.Wait()
+	if stressResult.LatsTotal != 10 {
+		t.Fatalf("expected 10 responses, got %+v", stressResult.ErrorDist)
+	}
+	if stressResult.NewConns < 3 {
+		t.Fatalf("expected idle connections to be closed on refresh, got %d new connections", stressResult.NewConns)
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	traceparent := regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`)
+	b3 := regexp.MustCompile(`^[0-9a-f]{32}-[0-9a-f]{16}-1$`)
+	var lock sync.Mutex
+	traceIds := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if v := r.Header.Get("traceparent"); traceparent.MatchString(v) {
+			traceIds[v[3:35]] = true
+		} else if v := r.Header.Get("b3"); b3.MatchString(v) {
+			traceIds[v[:32]] = true
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	for _, propagation := range []string{TRACE_W3C, TRACE_B3} {
+		traceIds = make(map[string]bool)
+		worker := newTestWorker(StressParameters{
+			N:                20,
+			C:                4,
+			TracePropagation: propagation,
+			Headers:          map[string][]string{"X-Test": {"1"}},
+			Urls:             []string{srv.URL},
+		})
+		worker.Start()
+		stressResult := worker.Wait()
+		if stressResult.StatusCodeDist[http.StatusOK] != 20 {
+			t.Fatalf("%s: invalid trace headers, got %v", propagation, stressResult.StatusCodeDist)
+		}
+		if len(traceIds) != 20 {
+			t.Fatalf("%s: expected 20 distinct trace ids, got %d", propagation, len(traceIds))
+		}
+	}
+}
+
+func benchmarkResult(i int) *result {
+	return &result{
+		statusCode:    http.StatusOK,
+		duration:      time.Duration(i%1000) * time.Microsecond,
+		end:           time.Now(),
+		contentLength: 1024,
+	}
+}
+
+// BenchmarkResultChannel records through one channel and collector goroutine,
+// as all workers did before the results were sharded.
+func BenchmarkResultChannel(b *testing.B) {
+	results := make(chan *result, 2*runtime.GOMAXPROCS(0)+1)
+	collected := NewStressResult()
+	done := make(chan struct{})
+	go func() {
+		for res := range results {
+			collected.result(res)
+		}
+		close(done)
+	}()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			results <- benchmarkResult(i)
+		}
+	})
+	close(results)
+	<-done
+}
+
+// BenchmarkResultSharded records into one result per worker, combined once.
+func BenchmarkResultSharded(b *testing.B) {
+	var lock sync.Mutex
+	var shards []*StressResult
+	b.RunParallel(func(pb *testing.PB) {
+		shard := NewStressResult()
+		for i := 0; pb.Next(); i++ {
+			shard.record(benchmarkResult(i))
+		}
+		lock.Lock()
+		shards = append(shards, shard)
+		lock.Unlock()
+	})
+	NewStressResult().Combine(shards...)
+}
+
+// TestResultMarshalConcurrent polls Snapshot, as -ui does, while the workers
+// record into their shards, then marshals the merged result.
+func TestResultMarshalConcurrent(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%10 == 0 {
+			w.WriteHeader(http.StatusTeapot)
+		}
+		w.Write(make([]byte, 1024))
+	}))
+	defer server.Close()
+
+	const n = 2000
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: n, C: 8})
+	worker.Options.Live = true
+	done, polled := make(chan struct{}), make(chan error)
+	go func() {
+		var last int64
+		for {
+			select {
+			case <-done:
+				polled <- nil
+				return
+			default:
+			}
+			body, err := json.Marshal(worker.Snapshot())
+			if err != nil {
+				polled <- err
+				return
+			}
+			var snapshot StressResult
+			if err := json.Unmarshal(body, &snapshot); err != nil {
+				polled <- fmt.Errorf("torn snapshot %q: %v", body, err)
+				return
+			}
+			if snapshot.LatsTotal < last {
+				polled <- fmt.Errorf("lats total went back from %d to %d", last, snapshot.LatsTotal)
+				return
+			}
+			last = snapshot.LatsTotal
+		}
+	}()
+	worker.Start()
+	stressResult := worker.Wait()
+	close(done)
+	if err := <-polled; err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := stressResult.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var collected StressResult
+	if err := json.Unmarshal(body, &collected); err != nil {
+		t.Fatal(err)
+	}
+	if collected.LatsTotal != n || collected.SizeTotal != n*1024 {
+		t.Fatalf("expected %d responses of 1KB, got %d and %d bytes", n, collected.LatsTotal, collected.SizeTotal)
+	}
+	if collected.StatusCodeDist[http.StatusOK] != n*9/10 || collected.StatusCodeDist[http.StatusTeapot] != n/10 {
+		t.Fatalf("unexpected status codes %v", collected.StatusCodeDist)
+	}
+}
+
+func BenchmarkDoClient(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("x"), 2048))
+	}))
+	defer srv.Close()
+
+	for _, body := range []string{"", `{"id": {{ randomNum 10 }}}`} {
+		name := "GET"
+		if body != "" {
+			name = "POST"
+		}
+		b.Run(name, func(b *testing.B) {
+			worker := newTestWorker(StressParameters{
+				C:           1,
+				RequestBody: body,
+				Headers:     map[string][]string{"Accept": {"application/json"}},
+				Urls:        []string{srv.URL + "/{{ randomNum 100 }}"},
+			})
+			worker.bodyTemplate = template.Must(template.New("body").Funcs(fnMap).Parse(body))
+			worker.urlTemplates = []*template.Template{template.Must(template.New("url").Funcs(fnMap).Parse(worker.RequestParams.Urls[0]))}
+			client := worker.getClient(nil)
+			defer worker.closeClient(client)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := worker.doClient(client, &result{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestIdHeader(t *testing.T) {
+	var lock sync.Mutex
+	ids := make(map[string]bool)
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		lock.Lock()
+		ids[id] = true
+		lock.Unlock()
+		if atomic.AddInt64(&hits, 1)%5 == 0 {
+			id = "stale-" + id
+		}
+		w.Header().Set("X-Request-Id", id)
+	}))
+	defer server.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 20, C: 1, RequestIdHeader: "X-Request-Id"})
+	worker.Start()
+	stressResult := worker.Wait()
+	if len(ids) != 20 {
+		t.Fatalf("%d distinct request ids for 20 requests", len(ids))
+	}
+	for id := range ids {
+		if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+			t.Fatalf("not a UUID v4: %q", id)
+		}
+	}
+	if stressResult.EchoMismatch != 4 || stressResult.ErrorDist[ErrEchoMismatch.Error()] != 4 {
+		t.Fatalf("echo mismatches %d, errors %v", stressResult.EchoMismatch, stressResult.ErrorDist)
+	}
+	if failed, total := stressResult.Failures(); failed != 4 || total != 20 {
+		t.Fatalf("failures %d/%d, want 4/20", failed, total)
+	}
+}
+
+func TestBearerFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	seen := make(map[string]int)
+	var worker *StressWorker
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		auth := r.Header.Get("Authorization")
+		if seen[auth]++; auth == "Bearer first" && seen[auth] == 1 {
+			// Rotated by an agent, with a later mtime on coarse filesystems.
+			ioutil.WriteFile(path, []byte("second\n"), 0600)
+			later := time.Now().Add(time.Second)
+			os.Chtimes(path, later, later)
+		} else if auth == "Bearer second" {
+			worker.Stop(false, nil)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	worker = newTestWorker(StressParameters{Urls: []string{server.URL}, C: 1, Duration: 5, BearerFile: path})
+	worker.Start()
+	worker.Wait()
+	if seen["Bearer first"] == 0 || seen["Bearer second"] == 0 || len(seen) != 2 {
+		t.Fatalf("authorization headers %v", seen)
+	}
+
+	params := StressParameters{Bearer: "t0ken"}
+	if strings.Contains(params.String(), "t0ken") {
+		t.Fatalf("token printed: %s", params.String())
+	}
+}
+
+func TestOAuth2Refresh(t *testing.T) {
+	// The first token lives 1s, its refresh after 0.5s and the retry when it
+	// expires fail, the workers then wait for the attempt 1s later.
+	var issued int64
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "read write" || id != "bench" || secret != "s3cret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch n := atomic.AddInt64(&issued, 1); n {
+		case 2, 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":1}`, n)
+		}
+	}))
+	defer tokens.Close()
+
+	var lock sync.Mutex
+	seen := make(map[string]int)
+	var expiredAt time.Time
+	var late int
+	var worker *StressWorker
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		auth := r.Header.Get("Authorization")
+		seen[auth]++
+		if expiredAt.IsZero() {
+			expiredAt = time.Now().Add(time.Second)
+		} else if auth == "Bearer token-1" && time.Since(expiredAt) > 100*time.Millisecond {
+			late++
+		}
+		if auth == "Bearer token-4" {
+			worker.Stop(false, nil)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	worker = newTestWorker(StressParameters{Urls: []string{server.URL}, C: 1, Duration: 5, OAuth2TokenUrl: tokens.URL,
+		OAuth2ClientId: "bench", OAuth2ClientSecret: "s3cret", OAuth2Scopes: []string{"read", "write"}})
+	worker.Start()
+	stressResult := worker.Wait()
+	if seen["Bearer token-1"] == 0 || seen["Bearer token-4"] == 0 || len(seen) != 2 || late > 0 {
+		t.Fatalf("authorization headers %v, %d sent with the expired token", seen, late)
+	}
+	if stressResult.OAuth2Failures != 2 || len(stressResult.ErrorDist) != 0 {
+		t.Fatalf("%d refresh failures, errors %v", stressResult.OAuth2Failures, stressResult.ErrorDist)
+	}
+	if params := worker.RequestParams.String(); strings.Contains(params, "s3cret") {
+		t.Fatalf("secret printed: %s", params)
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	for url, want := range map[string]string{
+		"http://h/p":                 "http://h/p?page=2",
+		"http://h/p?a=1&page=9#top":  "http://h/p?a=1&page=2#top",
+		"http://h/p?page&pages=1":    "http://h/p?pages=1&page=2",
+		"http://h/p?a=1&":            "http://h/p?a=1&page=2",
+		"http://h/p?pager=1&page=1&": "http://h/p?pager=1&page=2",
+	} {
+		if got := addQuery(url, "page=2"); got != want {
+			t.Fatalf("addQuery(%q) = %q, want %q", url, got, want)
+		}
+	}
+
+	var lock sync.Mutex
+	pages, sorts := make(map[string]int), make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		query := r.URL.Query()
+		if query.Get("id") != "7" || len(query["page"]) != 1 {
+			t.Errorf("request %s", r.URL)
+		}
+		pages[query.Get("page")]++
+		sorts[query.Get("sort by")]++
+	}))
+	defer server.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL + "/?id={{ intSum 3 4 }}&page=0"}, N: 100, C: 2,
+		Query: []QueryParam{{Name: "page", Min: 1, Max: 3}, {Name: "sort by", Choices: []string{"asc", "a&b"}}}})
+	worker.Start()
+	worker.Wait()
+	if len(pages) != 3 || pages["1"] == 0 || pages["3"] == 0 || len(sorts) != 2 || sorts["a&b"] == 0 {
+		t.Fatalf("pages %v, sorts %v", pages, sorts)
+	}
+}
+
+func TestCacheBust(t *testing.T) {
+	for url, want := range map[string]string{
+		"http://h/p":         `^http://h/p\?_cb=[0-9a-z]+$`,
+		"http://h/p?a=1":     `^http://h/p\?a=1&_cb=[0-9a-z]+$`,
+		"http://h/p?":        `^http://h/p\?_cb=[0-9a-z]+$`,
+		"http://h/p?a=1#top": `^http://h/p\?a=1&_cb=[0-9a-z]+#top$`,
+		"http://h/p#top":     `^http://h/p\?_cb=[0-9a-z]+#top$`,
+	} {
+		if got := cacheBust(url, "_cb"); !regexp.MustCompile(want).MatchString(got) {
+			t.Fatalf("cacheBust(%q) = %q", url, got)
+		}
+	}
+
+	var lock sync.Mutex
+	busters := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.URL.Query().Get("id") != "7" || r.Header.Get("Cache-Control") != "no-cache" || r.Header.Get("Pragma") != "no-cache" {
+			t.Errorf("request %s %v", r.URL, r.Header)
+		}
+		busters[r.URL.Query().Get("nocache")] = true
+	}))
+	defer server.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL + "/?id={{ intSum 3 4 }}"}, N: 20, C: 2,
+		CacheBust: "nocache", NoCacheHeaders: true})
+	worker.Start()
+	worker.Wait()
+	if len(busters) != 20 {
+		t.Fatalf("%d distinct cache busters for 20 requests", len(busters))
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/etag" {
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else {
+			w.Header().Set("Last-Modified", modified)
+			if r.Header.Get("If-Modified-Since") == modified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/etag", "/last-modified"} {
+		worker := newTestWorker(StressParameters{Urls: []string{server.URL + path}, N: 10, C: 1, Conditional: true})
+		worker.Start()
+		stressResult := worker.Wait()
+		if stressResult.Conditional != 9 || stressResult.NotModified != 9 || stressResult.SavedSize != 9000 ||
+			stressResult.StatusCodeDist[http.StatusNotModified] != 9 || stressResult.StatusCodeDist[http.StatusOK] != 1 {
+			t.Fatalf("%s: %d conditional, %d not modified, %d saved, status codes %v", path, stressResult.Conditional,
+				stressResult.NotModified, stressResult.SavedSize, stressResult.StatusCodeDist)
+		}
+	}
+}
+
+func TestCaptureHeader(t *testing.T) {
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&hits, 1) % 4 {
+		case 0:
+			w.Header().Set("X-Cache", "MISS")
+		case 1:
+		default:
+			w.Header().Set("X-Cache", "HIT")
+		}
+	}))
+	defer server.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 40, C: 2, CaptureHeaders: []string{"X-Cache"}})
+	worker.Start()
+	stressResult := worker.Wait()
+	dist := stressResult.HeaderDist["X-Cache"]
+	if dist["HIT"] != 20 || dist["MISS"] != 10 || dist[HEADER_ABSENT] != 10 {
+		t.Fatalf("X-Cache distribution %v", dist)
+	}
+	var lats int64
+	for _, c := range stressResult.HeaderLats["X-Cache"]["HIT"] {
+		lats += c
+	}
+	if lats != 20 {
+		t.Fatalf("%d HIT latencies, want 20", lats)
+	}
+}
+
+func TestSlowRequests(t *testing.T) {
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1)%3 == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL + "/slow"}, N: 30, C: 3, SlowThreshold: 40})
+	worker.Start()
+	stressResult := worker.Wait()
+	if len(stressResult.SlowRequests) != 10 {
+		t.Fatalf("%d slow requests, want 10: %+v", len(stressResult.SlowRequests), stressResult.SlowRequests)
+	}
+	for i, slow := range stressResult.SlowRequests {
+		if slow.Url != server.URL+"/slow" || slow.StatusCode != http.StatusOK || slow.Duration < 40*SCALE_NUM/1000 {
+			t.Fatalf("slow request %+v", slow)
+		}
+		if i > 0 && slow.Duration > stressResult.SlowRequests[i-1].Duration {
+			t.Fatalf("slow requests not sorted: %+v", stressResult.SlowRequests)
+		}
+	}
+
+	var top StressResult
+	for i := 1; i <= 50; i++ {
+		top.addSlowRequest(SlowRequest{Duration: int64(i * 7 % 50)})
+	}
+	if len(top.SlowRequests) != SLOW_KEEP || top.SlowRequests[0].Duration != 49 || top.SlowRequests[SLOW_KEEP-1].Duration != 30 {
+		t.Fatalf("top slow requests %+v", top.SlowRequests)
+	}
+}
+
+func TestTargetConcurrency(t *testing.T) {
+	groups := []TargetGroup{{Prefix: "/slow", C: 2}, {Prefix: "/fast", C: 6}}
+	urls := []string{"http://127.0.0.1/slow/a", "http://127.0.0.1/fast/b", "http://127.0.0.1/fast/c", "http://127.0.0.1/other"}
+	pools, err := targetPools(&StressParameters{Urls: urls, C: 10, TargetConcurrency: groups})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 3 || pools[0].workers != 2 || len(pools[1].urls) != 2 || pools[2].name != TARGET_DEFAULT || pools[2].workers != 2 {
+		t.Fatalf("pools %+v %+v %+v", pools[0], pools[1], pools[2])
+	}
+	if assigned := assignWorkers(pools, 3); assigned[0] != pools[0] || assigned[1] != pools[1] || assigned[2] != pools[2] {
+		t.Fatal("every pool should get a worker when n < c")
+	}
+	for _, bad := range []StressParameters{
+		{Urls: urls, C: 8, TargetConcurrency: groups},      // nothing left for /other
+		{Urls: urls[:3], C: 10, TargetConcurrency: groups}, // 2 connections unused
+		{Urls: urls, C: 6, TargetConcurrency: groups},      // more than -c
+	} {
+		if _, err := targetPools(&bad); err == nil {
+			t.Fatalf("accepted %+v", bad)
+		}
+	}
+
+	// The slow target holds its only worker until the fast ones sent 50
+	// requests, with shared workers it would soon hold all of them.
+	var fastHits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slow") {
+			for atomic.LoadInt64(&fastHits) < 50 {
+				time.Sleep(time.Millisecond)
+			}
+			return
+		}
+		atomic.AddInt64(&fastHits, 1)
+	}))
+	defer server.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL + "/slow", server.URL + "/fast"}, N: 60, C: 3,
+		TargetConcurrency: []TargetGroup{{Prefix: "/slow", C: 1}, {Prefix: "/fast", C: 2}}})
+	worker.Start()
+	stressResult := worker.Wait()
+	if stressResult.TargetDist["/slow"] < 1 || stressResult.TargetDist["/fast"] < 50 || stressResult.LatsTotal != 60 {
+		t.Fatalf("targets %v", stressResult.TargetDist)
+	}
+}
+
+func TestCompressedBytes(t *testing.T) {
+	body := strings.Repeat("compressible ", 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(body))
+		zw.Close()
+	}))
+	defer server.Close()
+
+	for _, disable := range []bool{false, true} {
+		worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 10, C: 2, DisableCompression: disable})
+		worker.Start()
+		stressResult := worker.Wait()
+		if stressResult.SizeTotal != int64(10*len(body)) {
+			t.Fatalf("disable %v: %d bytes decoded, want %d", disable, stressResult.SizeTotal, 10*len(body))
+		}
+		if compressed := stressResult.WireTotal < stressResult.SizeTotal/10; compressed == disable {
+			t.Fatalf("disable %v: %d bytes on the wire", disable, stressResult.WireTotal)
+		}
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	body := strings.Repeat("compressible ", 1000)
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write([]byte(body))
+	zw.Close()
+	var asked atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked.Store(r.Header.Get("Accept-Encoding"))
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte(body))
+			return
+		}
+		// The Content-Length is the compressed size.
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(zipped.Len()))
+		w.Write(zipped.Bytes())
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		encoding     string
+		noDecompress bool
+		header       string
+		size, wire   int
+		mode         string
+	}{
+		{"", false, "gzip", len(body), zipped.Len(), "gzip, decompressed"},
+		{ACCEPT_GZIP, true, "gzip", zipped.Len(), zipped.Len(), "gzip, not decompressed"},
+		{ACCEPT_BR, false, "br", len(body), len(body), "br, not decompressed"},
+		{ACCEPT_IDENTITY, false, "identity", len(body), len(body), "identity"},
+		{ACCEPT_NONE, false, "", len(body), len(body), "none"},
+	} {
+		worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 10, C: 2,
+			AcceptEncoding: tc.encoding, NoDecompress: tc.noDecompress})
+		worker.Start()
+		stressResult := worker.Wait()
+		if got := asked.Load().(string); got != tc.header {
+			t.Fatalf("%q: sent Accept-Encoding %q, want %q", tc.encoding, got, tc.header)
+		}
+		if stressResult.SizeTotal != int64(10*tc.size) || stressResult.WireTotal != int64(10*tc.wire) {
+			t.Fatalf("%q no-decompress %v: %d bytes, %d on the wire, want %d, %d",
+				tc.encoding, tc.noDecompress, stressResult.SizeTotal, stressResult.WireTotal, 10*tc.size, 10*tc.wire)
+		}
+		if stressResult.LengthMismatch != 0 {
+			t.Fatalf("%q no-decompress %v: %d Content-Length mismatches", tc.encoding, tc.noDecompress, stressResult.LengthMismatch)
+		}
+		var buf bytes.Buffer
+		stressResult.Print(&buf, 0)
+		if !strings.Contains(buf.String(), "Accept-Encoding:\t"+tc.mode+"\n") {
+			t.Fatalf("summary without the %q mode:\n%s", tc.mode, buf.String())
+		}
+	}
+}
+
+func TestPerWorkerBreakdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	params := StressParameters{Urls: []string{server.URL + "/bad", server.URL + "/ok"}, N: 60, C: 3, PerWorkerBreakdown: true,
+		TargetConcurrency: []TargetGroup{{Prefix: "/bad", C: 1}, {Prefix: "/ok", C: 2}}}
+	worker := newTestWorker(params)
+	worker.Start()
+	stressResult := worker.Wait()
+	if len(stressResult.Workers) != 3 {
+		t.Fatalf("workers %+v", stressResult.Workers)
+	}
+	var requests, failing int64
+	for _, v := range stressResult.Workers {
+		requests += v.Requests
+		if v.Errors > 0 && v.Errors == v.Requests {
+			failing++
+		} else if v.Errors > 0 {
+			t.Fatalf("worker %+v", v)
+		}
+	}
+	if requests != 60 || failing != 1 {
+		t.Fatalf("%d requests, %d failing workers: %+v", requests, failing, stressResult.Workers)
+	}
+	var buf bytes.Buffer
+	stressResult.Print(&buf, 0)
+	if !regexp.MustCompile(`\nWorkers:\n  \[0\]\t\d+ requests\t\d+ errors\t\d\.\d{3} secs\n`).MatchString(buf.String()) {
+		t.Fatalf("summary without the workers:\n%s", buf.String())
+	}
+
+	// The coordinator keeps the results of the -W workers apart.
+	data, err := stressResult.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coordinator := New(params)
+	for _, node := range []string{"127.0.0.1:12710", "127.0.0.1:12711"} {
+		nodeResult := &StressResult{}
+		json.Unmarshal(data, nodeResult)
+		nodeResult.Node = node
+		coordinator.Append(nodeResult)
+	}
+	combined := coordinator.Wait()
+	if combined.LatsTotal != 120 || combined.Workers != nil || len(combined.Nodes) != 2 {
+		t.Fatalf("combined %d requests, %d workers, %d nodes", combined.LatsTotal, len(combined.Workers), len(combined.Nodes))
+	}
+	for i, node := range combined.Nodes {
+		if node.LatsTotal != 60 || node.StatusCodeDist[http.StatusOK] != stressResult.StatusCodeDist[http.StatusOK] || len(node.Workers) != 3 {
+			t.Fatalf("node %d: %d requests, %v, %d workers", i, node.LatsTotal, node.StatusCodeDist, len(node.Workers))
+		}
+	}
+	buf.Reset()
+	combined.Print(&buf, 0)
+	if !strings.Contains(buf.String(), "\nNodes:\n  [127.0.0.1:12710]\t60 requests\t") {
+		t.Fatalf("summary without the nodes:\n%s", buf.String())
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	var probes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&probes, 1) <= 3 || r.URL.Path == "/never" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL + "/{{ randomNum 3 }}"}, N: 10, C: 1})
+	if err := worker.WaitReady(context.Background(), 5*time.Second, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&probes); n != 4 {
+		t.Fatalf("%d probes, want 4", n)
+	}
+	// The run starts from scratch, the probes are in no distribution.
+	worker.Start()
+	stressResult := worker.Wait()
+	if stressResult.LatsTotal != 10 || stressResult.StatusCodeDist[http.StatusServiceUnavailable] != 0 {
+		t.Fatalf("%d requests, status codes %v", stressResult.LatsTotal, stressResult.StatusCodeDist)
+	}
+
+	worker = newTestWorker(StressParameters{Urls: []string{server.URL + "/never"}, N: 10, C: 1})
+	start := time.Now()
+	err := worker.WaitReady(context.Background(), 600*time.Millisecond, http.StatusOK)
+	if !errors.Is(err, ErrNotReady) || !strings.Contains(err.Error(), "status 503") || time.Since(start) > 2*time.Second {
+		t.Fatalf("err %v after %v", err, time.Since(start))
+	}
+
+	// The probes carry the -H headers and the bearer token of the run.
+	guarded := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "k-1" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer guarded.Close()
+	worker = newTestWorker(StressParameters{
+		Urls:    []string{guarded.URL},
+		Headers: map[string][]string{"X-Api-Key": {"k-{{ intSum 0 1 }}"}},
+		Bearer:  "secret",
+		N:       1, C: 1,
+	})
+	if err := worker.WaitReady(context.Background(), 600*time.Millisecond, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProtoMismatch(t *testing.T) {
+	stressResult := NewStressResult()
+	stressResult.HttpType = TYPE_HTTP2
+	for i := 0; i < 10; i++ {
+		proto := "HTTP/1.1"
+		if i == 0 {
+			proto = "HTTP/2.0"
+		}
+		stressResult.record(&result{statusCode: http.StatusOK, duration: time.Millisecond, proto: proto})
+	}
+	var buf bytes.Buffer
+	stressResult.Print(&buf, 0)
+	if !strings.Contains(buf.String(), "HTTP/1.1 90.0%, HTTP/2.0 10.0%") ||
+		!strings.Contains(buf.String(), "requested -http http2 but most responses used HTTP/1.1") {
+		t.Fatalf("summary without the protocol warning:\n%s", buf.String())
+	}
+}
+
+func TestTimeoutCategories(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+	// Accepts connections but never answers the TLS handshake.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	// Sends the headers at once and the body after 300ms.
+	slowBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("late"))
+	}))
+	defer slowBody.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	for _, tc := range []struct {
+		params StressParameters
+		want   error
+	}{
+		{StressParameters{Urls: []string{server.URL}, ResponseTimeout: 50}, ErrResponseTimeout},
+		{StressParameters{Urls: []string{"https://" + silent.Addr().String()}, TlsTimeout: 50}, ErrTlsTimeout},
+		{StressParameters{Urls: []string{slowBody.URL}, ResponseTimeout: 100, Timeout: 200}, ErrRequestTimeout},
+	} {
+		if tc.params.N, tc.params.C = 1, 1; tc.params.Timeout == 0 {
+			tc.params.Timeout = 2000
+		}
+		worker := newTestWorker(tc.params)
+		worker.Start()
+		stressResult := worker.Wait()
+		if stressResult.ErrorDist[tc.want.Error()] != 1 {
+			t.Fatalf("%s: error distribution %v, want %q", tc.params.Urls[0], stressResult.ErrorDist, tc.want)
+		}
+	}
+}
+
+func TestValidateUrls(t *testing.T) {
+	worker := newTestWorker(StressParameters{Urls: []string{"http://a b/"}, N: 10, C: 2})
+	worker.Start()
+	if stressResult := worker.Wait(); worker.Err() != ErrUrl || stressResult.LatsTotal != 0 {
+		t.Fatalf("once: err %v, %d requests", worker.Err(), stressResult.LatsTotal)
+	}
+
+	worker = newTestWorker(StressParameters{Urls: []string{"http://a b/"}, N: 10, C: 2, ValidateUrls: VALIDATE_OFF})
+	worker.Start()
+	if stressResult := worker.Wait(); worker.Err() != nil || stressResult.ErrorDist[ErrInvalidUrl.Error()] != 10 {
+		t.Fatalf("off: err %v, error distribution %v", worker.Err(), stressResult.ErrorDist)
+	}
+}
+
+func TestUrlServerNames(t *testing.T) {
+	var lock sync.Mutex
+	seen := make(map[string]int)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		seen[r.URL.Path+" "+r.Host+" "+r.TLS.ServerName]++
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	worker := newTestWorker(StressParameters{
+		Urls:           []string{server.URL + "/shop", server.URL + "/plain"},
+		UrlHosts:       []string{"shop.example.com", ""},
+		UrlServerNames: []string{"shop.example.com", ""},
+		N:              40,
+		C:              2,
+	})
+	worker.Start()
+	if worker.Wait(); worker.Err() != nil {
+		t.Fatal(worker.Err())
+	}
+	host := strings.TrimPrefix(server.URL, "https://")
+	if len(seen) != 2 || seen["/shop shop.example.com shop.example.com"] == 0 || seen["/plain "+host+" "] == 0 {
+		t.Fatalf("requests %v", seen)
+	}
+}
+
+func TestHttp2WithoutTimeout(t *testing.T) {
+	var h2 int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			atomic.AddInt32(&h2, 1)
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// Timeout 0 means no limit, not a handshake deadline of now.
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, RequestHttpType: TYPE_HTTP2, N: 5, C: 1})
+	worker.RequestParams.Timeout = 0 // Set by newTestWorker
+	worker.Start()
+	stressResult := worker.Wait()
+	if stressResult.StatusCodeDist[http.StatusOK] != 5 || atomic.LoadInt32(&h2) != 5 || len(stressResult.ErrorDist) != 0 {
+		t.Fatalf("%d http2 requests, status codes %v, errors %v", h2, stressResult.StatusCodeDist, stressResult.ErrorDist)
+	}
+}
+
+func TestBadRequestConstruction(t *testing.T) {
+	params := StressParameters{Urls: []string{"http://127.0.0.1:1/{{ random 1 9 }}"}, RequestMethod: "BAD METHOD", N: 10, C: 2}
+	if err := params.CheckTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	worker := newTestWorker(params)
+	worker.Start()
+	if stressResult := worker.Wait(); worker.Err() != nil || stressResult.ErrorDist[ErrBadRequest.Error()] != 10 {
+		t.Fatalf("err %v, error distribution %v", worker.Err(), stressResult.ErrorDist)
+	}
+
+	client := worker.getClient(nil)
+	defer worker.closeClient(client)
+	_, _, err := worker.doClient(client, &result{})
+	if !errors.Is(err, ErrBadRequest) || !strings.Contains(err.Error(), "BAD METHOD http://127.0.0.1:1/") {
+		t.Fatalf("err %v", err)
+	}
+}
+
+func TestAbOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "test/1.0")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL + "/path?q=1"}, N: 20, C: 2, Output: OUTPUT_AB})
+	worker.Start()
+	stressResult := worker.Wait()
+	stressResult.Output = OUTPUT_AB
+	var buf bytes.Buffer
+	stressResult.WriteOutput(&buf)
+	for _, want := range []string{
+		"Server Software:        test/1.0\n",
+		"Server Port:            " + server.URL[strings.LastIndex(server.URL, ":")+1:] + "\n",
+		"Document Path:          /path?q=1\n",
+		"Document Length:        5 bytes\n",
+		"Concurrency Level:      2\n",
+		"Complete requests:      20\n",
+		"Failed requests:        0\n",
+		"HTML transferred:       100 bytes\n",
+		"\nConnect:",
+		"\nWaiting:",
+		" 100%",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("ab output without %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	replay := []ReplayEntry{{Method: "GET", Url: 0}, {Method: "POST", Url: 1, Offset: 2000}, {Method: "DELETE", Url: 0, Offset: 4000}}
+
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL + "/a", server.URL + "/b"}, C: 2,
+		Replay: replay, ReplaySpeed: 20})
+	start := time.Now()
+	worker.Start()
+	stressResult := worker.Wait()
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || stressResult.LatsTotal != 3 {
+		t.Fatalf("%d requests in %v, want 3 in 200ms", stressResult.LatsTotal, elapsed)
+	}
+	if want := []string{"GET /a", "POST /b", "DELETE /a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+
+	got = nil
+	worker = newTestWorker(StressParameters{Urls: []string{server.URL + "/a", server.URL + "/b"}, N: 30, C: 2, Replay: replay})
+	worker.Start()
+	if stressResult = worker.Wait(); stressResult.LatsTotal != 30 {
+		t.Fatalf("%d random replay requests, want 30", stressResult.LatsTotal)
+	}
+	for _, request := range got {
+		if request != "GET /a" && request != "POST /b" && request != "DELETE /a" {
+			t.Fatalf("unexpected request %s", request)
+		}
+	}
+}
+
+func TestUploadThroughput(t *testing.T) {
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		atomic.AddInt64(&received, n)
+	}))
+	defer server.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 20, C: 2, RequestMethod: http.MethodPost,
+		RequestBody: strings.Repeat("x", 1000)})
+	worker.Start()
+	stressResult := worker.Wait()
+	if stressResult.SentTotal != 20000 || stressResult.SentTotal != atomic.LoadInt64(&received) || stressResult.SentPerSec <= 0 {
+		t.Fatalf("sent %d bytes at %f/sec, server received %d", stressResult.SentTotal, stressResult.SentPerSec, received)
+	}
+	var buf bytes.Buffer
+	stressResult.Print(&buf, 0)
+	if !strings.Contains(buf.String(), "Sent/sec:") {
+		t.Fatalf("summary without Sent/sec:\n%s", buf.String())
+	}
+}
+
+func TestSocketOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 1, C: 1, TcpDelay: true, SoRcvbuf: 65536, SoSndbuf: 65536})
+	conn, err := worker.dial(context.Background(), worker.newDialer(time.Second), "tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		if runtime.GOOS != "linux" {
+			return
+		}
+		// Linux doubles the requested size for its bookkeeping.
+		if size, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil || size < 65536 {
+			t.Errorf("SO_RCVBUF %d, %v", size, err)
+		}
+		if nodelay, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY); err != nil || nodelay != 0 {
+			t.Errorf("TCP_NODELAY %d, %v", nodelay, err)
+		}
+	})
+	worker.Start()
+	if stressResult := worker.Wait(); stressResult.LatsTotal != 1 {
+		t.Fatalf("%d requests with the socket options", stressResult.LatsTotal)
+	}
+}
+
+// TestPortExhaustion runs without keep-alive from a single local port, the
+// workers waiting for it back off and the run completes instead of failing.
+func TestPortExhaustion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, C: 4, Duration: 2, Timeout: 3000,
+		DisableKeepAlives: true, LocalAddrs: []string{"127.0.0.1"}, LocalPortMin: port, LocalPortMax: port})
+	worker.Start()
+	stressResult := worker.Wait()
+	if worker.Err() != nil {
+		t.Fatalf("run failed: %v", worker.Err())
+	}
+	if stressResult.LatsTotal == 0 || stressResult.ErrorDist[ErrPortExhaustion.Error()] == 0 {
+		t.Fatalf("%d responses, errors %v", stressResult.LatsTotal, stressResult.ErrorDist)
+	}
+	var out bytes.Buffer
+	stressResult.Print(&out, 0)
+	if !strings.Contains(out.String(), "-local-port-range") {
+		t.Fatalf("no port exhaustion guidance in\n%s", out.String())
+	}
+}
+
+// serveDns answers every A query with ip and every other query without
+// records, or nothing at all if ip is nil.
+func serveDns(t *testing.T, ip net.IP) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if ip == nil || n < 12 {
+				continue
+			}
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5 // Root label, type and class
+			if end > n {
+				continue
+			}
+			resp := append([]byte{buf[0], buf[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, buf[12:end]...)
+			if buf[end-4] == 0 && buf[end-3] == 1 { // A
+				resp[7] = 1
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, ip.To4()...)
+			}
+			conn.WriteTo(resp, from)
+		}
+	}()
+	return conn
+}
+
+func TestDnsServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	url := "http://bench.test:" + port + "/"
+
+	dns := serveDns(t, net.IPv4(127, 0, 0, 1))
+	defer dns.Close()
+	worker := newTestWorker(StressParameters{Urls: []string{url}, N: 3, C: 1, DnsServer: dns.LocalAddr().String()})
+	worker.Start()
+	if stressResult := worker.Wait(); stressResult.LatsTotal != 3 {
+		t.Fatalf("-dns-server: %d responses, errors %v", stressResult.LatsTotal, stressResult.ErrorDist)
+	}
+
+	silent := serveDns(t, nil)
+	defer silent.Close()
+	worker = newTestWorker(StressParameters{Urls: []string{url}, N: 1, C: 1, DnsServer: silent.LocalAddr().String(), DnsTimeout: 200})
+	worker.Start()
+	if stressResult := worker.Wait(); stressResult.ErrorDist[ErrDnsTimeout.Error()] != 1 {
+		t.Fatalf("-dns-timeout: errors %v", stressResult.ErrorDist)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	for _, drain := range []int64{0, 1000} {
+		worker := newTestWorker(StressParameters{Urls: []string{server.URL}, C: 2, Duration: 1, Timeout: 3000, Drain: drain})
+		worker.Start()
+		stressResult := worker.Wait()
+		if worker.Err() != nil || stressResult.InFlight == 0 {
+			t.Fatalf("drain %d: err %v, %d in flight", drain, worker.Err(), stressResult.InFlight)
+		}
+		if drain == 0 && stressResult.Drained != 0 {
+			t.Fatalf("drain 0: %d drained, want them aborted", stressResult.Drained)
+		}
+		if drain > 0 && stressResult.Drained != stressResult.InFlight {
+			t.Fatalf("drain %d: %d drained of %d in flight", drain, stressResult.Drained, stressResult.InFlight)
+		}
+		// The drain window is not part of the duration the rates use.
+		if float64(stressResult.Duration)/SCALE_NUM > 1.2 || stressResult.LatsTotal > 8 {
+			t.Fatalf("drain %d: %4.3f secs, %d responses", drain, float64(stressResult.Duration)/SCALE_NUM, stressResult.LatsTotal)
+		}
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	// At most 40 of the 200 requests/sec the limiter allows.
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, C: 2, Qps: 100, Duration: 2, Timeout: 3000})
+	worker.Start()
+	stressResult := worker.Wait()
+	if stressResult.Connections != 2 || len(stressResult.BusyTimeline) == 0 {
+		t.Fatalf("%d connections, busy timeline %v", stressResult.Connections, stressResult.BusyTimeline)
+	}
+	var out bytes.Buffer
+	stressResult.Print(&out, 0)
+	if !strings.Contains(out.String(), "Utilization:") || !strings.Contains(out.String(), "-c is the bottleneck") {
+		t.Fatalf("no utilization hint in\n%s", out.String())
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+	}))
+	defer server.Close()
+
+	params := StressParameters{Urls: []string{server.URL}, N: 3, C: 1, RequestMethod: http.MethodPost, RequestBody: "{{ randomStrin 10 }}"}
+	if err := params.CheckTemplates(); err == nil || !strings.Contains(err.Error(), "body:1") {
+		t.Fatalf("syntax error %v, want its position", err)
+	}
+	worker := newTestWorker(params)
+	worker.Start()
+	if stressResult := worker.Wait(); worker.Err() == nil || stressResult.Attempted != 0 {
+		t.Fatalf("syntax error: err %v, %d attempted", worker.Err(), stressResult.Attempted)
+	}
+
+	// Int63n panics on an empty range.
+	params.RequestBody = "{{ random 5 5 }}"
+	if err := params.CheckTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	worker = newTestWorker(params)
+	worker.Start()
+	if stressResult := worker.Wait(); worker.Err() != nil || stressResult.ErrorDist[ErrTemplate.Error()] != 3 {
+		t.Fatalf("function error: err %v, errors %v", worker.Err(), stressResult.ErrorDist)
+	}
+	if n := atomic.LoadInt64(&hits); n != 0 {
+		t.Fatalf("%d requests sent with a failed template", n)
+	}
+}
+
+func TestTemplateIndexes(t *testing.T) {
+	var lock sync.Mutex
+	seen := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		seen[r.URL.Query().Get("w")+" "+string(body)]++
+		lock.Unlock()
+	}))
+	defer server.Close()
+	requests := func() map[string]int {
+		lock.Lock()
+		defer lock.Unlock()
+		r := seen
+		seen = make(map[string]int)
+		return r
+	}
+
+	params := StressParameters{
+		Urls:          []string{server.URL + "?w={{ workerIndex }}/{{ workerCount }}"},
+		N:             400,
+		C:             4,
+		RequestMethod: http.MethodPost,
+		RequestBody:   "{{ intSum (goroutineIndex) 10 }}",
+	}
+	if err := params.CheckTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	worker := newTestWorker(params)
+	worker.Start()
+	if stressResult := worker.Wait(); worker.Err() != nil || stressResult.StatusCodeDist[http.StatusOK] != 400 {
+		t.Fatalf("single node: err %v, codes %v", worker.Err(), stressResult.StatusCodeDist)
+	}
+	got := requests()
+	for i := 0; i < 4; i++ {
+		if key := fmt.Sprintf("0/1 %d", 10+i); got[key] == 0 {
+			t.Fatalf("no request %q in %v", key, got)
+		}
+	}
+	if len(got) != 4 {
+		t.Fatalf("requests %v, want one key per goroutine", got)
+	}
+
+	params.WorkerIndex, params.WorkerCount, params.C = 2, 3, 1
+	worker = newTestWorker(params)
+	worker.Start()
+	worker.Wait()
+	if got = requests(); len(got) != 1 || got["2/3 10"] != 400 {
+		t.Fatalf("distributed worker requests %v", got)
+	}
+
+	// The ws handshake renders the headers with the index of its goroutine.
+	var upgrader websocket.Upgrader
+	wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		lock.Lock()
+		seen[r.Header.Get("X-Goroutine")]++
+		lock.Unlock()
+		for {
+			kind, message, err := c.ReadMessage()
+			if err != nil || c.WriteMessage(kind, message) != nil {
+				return
+			}
+		}
+	}))
+	defer wsServer.Close()
+	worker = newTestWorker(StressParameters{
+		Urls:            []string{"ws" + strings.TrimPrefix(wsServer.URL, "http")},
+		N:               8,
+		C:               2,
+		RequestHttpType: TYPE_WS,
+		RequestBody:     "ping",
+		Headers:         map[string][]string{"X-Goroutine": {"{{ goroutineIndex }}"}},
+	})
+	worker.Start()
+	worker.Wait()
+	if got = requests(); len(got) != 2 || got["0"] != 1 || got["1"] != 1 {
+		t.Fatalf("ws handshakes %v, want one per goroutine", got)
+	}
+}
+
+func TestLiveSnapshot(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%4 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 40, C: 2})
+	if snapshot := worker.Snapshot(); snapshot.StatusCodeDist != nil || snapshot.Lats != nil {
+		t.Fatalf("snapshot without Live %+v", snapshot)
+	}
+	worker = newTestWorker(StressParameters{Urls: []string{server.URL}, N: 40, C: 2})
+	worker.Options.Live = true
+	worker.Start()
+	worker.Wait()
+	snapshot := worker.Snapshot()
+	var lats int64
+	for _, n := range snapshot.Lats {
+		lats += n
+	}
+	if snapshot.LatsTotal != 40 || lats != 40 || snapshot.StatusCodeDist[200] != 30 ||
+		snapshot.StatusCodeDist[503] != 10 || len(snapshot.ErrorDist) != 0 {
+		t.Fatalf("snapshot %d completed, %d lats, status codes %v, errors %v",
+			snapshot.LatsTotal, lats, snapshot.StatusCodeDist, snapshot.ErrorDist)
+	}
+}
+
+func TestRequestCounters(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		bodies = append(bodies, string(body)+" "+r.URL.Query().Get("req"))
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	// The functions and the data of the templates give the same values.
+	params := StressParameters{
+		Urls:          []string{server.URL + "?req={{ .GlobalRequest }}"},
+		N:             40,
+		C:             4,
+		RequestMethod: http.MethodPost,
+		RequestBody: "{{ goroutineIndex }} {{ iteration }} {{ globalRequest }} {{ totalRequests }} " +
+			"{{ .Iteration }} {{ .GlobalRequest }} {{ .TotalRequests }}",
+	}
+	if err := params.CheckTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	worker := newTestWorker(params)
+	worker.Start()
+	worker.Wait()
+	if len(bodies) != 40 {
+		t.Fatalf("%d requests", len(bodies))
+	}
+	iterations := make(map[int64][]int64)
+	requests := make(map[int64]bool)
+	for _, body := range bodies {
+		var goroutine, iteration, request, total, dataIteration, dataRequest, dataTotal, urlRequest int64
+		if _, err := fmt.Sscan(body, &goroutine, &iteration, &request, &total, &dataIteration, &dataRequest, &dataTotal,
+			&urlRequest); err != nil || total != 40 || request < 0 || request >= 40 {
+			t.Fatalf("body %q, err %v", body, err)
+		}
+		if dataIteration != iteration || dataRequest != request || dataTotal != total || urlRequest != request {
+			t.Fatalf("body %q, the data differs from the functions", body)
+		}
+		iterations[goroutine] = append(iterations[goroutine], iteration)
+		requests[request] = true
+	}
+	if len(requests) != 40 {
+		t.Fatalf("%d distinct global requests, want 40", len(requests))
+	}
+	for goroutine, list := range iterations {
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		for i, iteration := range list {
+			if iteration != int64(i) {
+				t.Fatalf("goroutine %d iterations %v", goroutine, list)
+			}
+		}
+	}
+}
+
+// TestResultMemory feeds ten million results, a tenth of them failing with a
+// distinct error and another tenth with a distinct -capture-header value,
+// and checks the memory stays flat.
+func TestResultMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test")
+	}
+	const total, batch = 10000000, 1000000
+	collected := NewStressResult()
+	heap := func() uint64 {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+	var first uint64
+	for done := 0; done < total; done += batch {
+		shard := NewStressResult()
+		for i := done; i < done+batch; i++ {
+			// Spread over 0 to 19 hours, 7 milliseconds apart.
+			res := &result{statusCode: http.StatusOK, duration: time.Duration(i*7) * time.Millisecond}
+			switch i % 10 {
+			case 0:
+				res.err = fmt.Errorf("dial tcp 127.0.0.1:%d: connection refused", i)
+			case 1:
+				res.captured = map[string]string{"X-Request-Id": strconv.Itoa(i)}
+			}
+			shard.result(res)
+		}
+		collected.Combine(shard)
+		if done == 0 {
+			first = heap()
+		}
+	}
+	if last := heap(); last > first+16<<20 {
+		t.Fatalf("heap grew from %d to %d bytes", first, last)
+	}
+	if len(collected.ErrorDist) > RESULT_CARDINALITY || len(collected.HeaderDist["X-Request-Id"]) > RESULT_CARDINALITY {
+		t.Fatalf("%d errors, %d header values kept", len(collected.ErrorDist), len(collected.HeaderDist["X-Request-Id"]))
+	}
+	// 10000 milliseconds below 10s and at most 9000 keys in each decade above.
+	if len(collected.Lats) > 10001+4*9000 {
+		t.Fatalf("%d latencies kept", len(collected.Lats))
+	}
+	for d, want := range map[time.Duration]string{
+		1234 * time.Millisecond:      "1.234",
+		9999 * time.Millisecond:      "9.999",
+		12345678 * time.Millisecond:  "12340.000",
+		time.Duration(math.MaxInt64): "9223000000.000",
+	} {
+		if key := latencyKey(d); key != want {
+			t.Fatalf("latencyKey(%v) = %s, want %s", d, key, want)
+		}
+	}
+	var errs int
+	for _, c := range collected.ErrorDist {
+		errs += c
+	}
+	if errs != total/10 || collected.LatsTotal != total-total/10 {
+		t.Fatalf("%d errors, %d responses after folding", errs, collected.LatsTotal)
+	}
+}
+
+func TestRequestErrorsContinue(t *testing.T) {
+	var served int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&served, 1)%2 == 0 {
+			time.Sleep(300 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 20, C: 2, Timeout: 100})
+	worker.Start()
+	stressResult := worker.Wait()
+	if err := worker.Err(); err != nil {
+		t.Fatalf("run stopped by %v", err)
+	}
+	timedOut := int64(stressResult.ErrorDist[ErrRequestTimeout.Error()])
+	if timedOut != 10 || stressResult.TimedOutTotal != timedOut {
+		t.Fatalf("%d timed out, %v, want 10", stressResult.TimedOutTotal, stressResult.ErrorDist)
+	}
+	if stressResult.LatsTotal != 10 || len(stressResult.ErrorDist) != 1 {
+		t.Fatalf("%d completed, %v, want 10 of 20", stressResult.LatsTotal, stressResult.ErrorDist)
+	}
+
+	// A refused connection fails each request without stopping the run either.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	worker = newTestWorker(StressParameters{Urls: []string{"http://" + listener.Addr().String()}, N: 6, C: 2, Timeout: 1000})
+	worker.Start()
+	stressResult = worker.Wait()
+	failed, _ := stressResult.Failures()
+	if err := worker.Err(); err != nil || failed != 6 {
+		t.Fatalf("%d of 6 refused, %v, stopped by %v", failed, stressResult.ErrorDist, err)
+	}
+}
+
+func TestTimedOut(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		case "/reset":
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+
+	// The timeouts and the resets are collected by separate runs, combined
+	// below.
+	var results []*StressResult
+	for _, path := range []string{"/slow", "/reset", "/"} {
+		worker := newTestWorker(StressParameters{Urls: []string{server.URL + path}, N: 10, C: 1, Timeout: 100})
+		worker.Start()
+		results = append(results, worker.Wait())
+	}
+	if results[0].TimedOutTotal != 10 || results[0].ErrorDist[ErrRequestTimeout.Error()] != 10 {
+		t.Fatalf("%d timed out: %v", results[0].TimedOutTotal, results[0].ErrorDist)
+	}
+	if results[1].TimedOutTotal != 0 || len(results[1].ErrorDist) == 0 {
+		t.Fatalf("%d of the resets timed out: %v", results[1].TimedOutTotal, results[1].ErrorDist)
+	}
+	stressResult := NewStressResult()
+	stressResult.Combine(results...)
+	failed, total := stressResult.Failures()
+	timedOut := results[0].TimedOutTotal
+	if stressResult.TimedOutTotal != timedOut || stressResult.Timeout != 100 {
+		t.Fatalf("combined %d timed out after %dms, want %d", stressResult.TimedOutTotal, stressResult.Timeout, timedOut)
+	}
+	if rate := stressResult.TimeoutRate(); rate != float64(timedOut)*100/float64(total) {
+		t.Fatalf("timeout rate %g%%", rate)
+	}
+	var buf bytes.Buffer
+	stressResult.Print(&buf, 0)
+	for _, line := range []string{
+		fmt.Sprintf("Timeout:\t100ms, %d requests timed out", timedOut),
+		fmt.Sprintf("Timed out:\t%d of %d failed requests hit a client-side timeout (-t 100ms)", timedOut, failed),
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("summary without %q:\n%s", line, buf.String())
+		}
+	}
+
+	if !isTimeout(context.DeadlineExceeded) || !isTimeout(fmt.Errorf("read: %w", ErrConnectTimeout)) || isTimeout(errors.New("connection reset")) {
+		t.Fatal("wrong timeout classification")
+	}
+}
+
+func TestFewerRequestsThanWorkers(t *testing.T) {
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+	}))
+	defer server.Close()
+
+	worker := newTestWorker(StressParameters{Urls: []string{server.URL}, N: 1, C: 100})
+	worker.Start()
+	stressResult := worker.Wait()
+	if n := atomic.LoadInt64(&hits); n != 1 || stressResult.LatsTotal != 1 {
+		t.Fatalf("%d requests hit the server, %d recorded, want 1", n, stressResult.LatsTotal)
+	}
+}
+
+func TestHostBottlenecks(t *testing.T) {
+	open, limit, ok := openFiles()
+	if !ok {
+		t.Skip("open files not available on this platform")
+	}
+	if open == 0 || limit == 0 {
+		t.Fatalf("%d open files, limit %d", open, limit)
+	}
+	if from, to, err := raiseFileLimit(limit); err != nil || from != limit || to != limit {
+		t.Fatalf("raised from %d to %d, err %v", from, to, err)
+	}
+
+	host := newHostStats()
+	host.peakFiles = host.fileLimit // As if every file was used at some point
+	warnings := host.bottlenecks(time.Now())
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "Open files:\t") {
+		t.Fatalf("warnings %q", warnings)
+	}
+	stressResult := NewStressResult()
+	stressResult.Bottlenecks = warnings
+	var buf bytes.Buffer
+	stressResult.Print(&buf, 0)
+	if !strings.Contains(buf.String(), "WARNING, the load generator may be the bottleneck:\n  Open files:\t") {
+		t.Fatalf("summary without the warning:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,150 @@
+package bench
+
+import (
+	"math/rand"
+	gourl "net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ========================= function begin =========================
+// template functions
+func intSum(v ...int64) int64 {
+	var r int64
+	for _, r1 := range v {
+		r += int64(r1)
+	}
+	return r
+}
+
+func random(min, max int64) int64 {
+	rand.Seed(time.Now().UnixNano())
+	return rand.Int63n(max-min) + min
+}
+
+func formatTime(now time.Time, fmt string) string {
+	switch fmt {
+	case "YMD":
+		return now.Format("20060201")
+	case "HMS":
+		return now.Format("150405")
+	default:
+		return now.Format("20060201-150405")
+	}
+}
+
+func uuidStr() string {
+	if out, err := exec.Command("uuidgen").Output(); err != nil {
+		return randomString(10)
+	} else {
+		return string(out)
+	}
+}
+
+// YMD = yyyyMMdd, HMS = HHmmss, YMDHMS = yyyyMMdd-HHmmss
+func date(fmt string) string {
+	return formatTime(time.Now(), fmt)
+}
+
+func randomDate(fmt string) string {
+	return formatTime(time.Unix(rand.Int63n(time.Now().Unix()-94608000)+94608000, 0), fmt)
+}
+
+func escape(u string) string {
+	return gourl.QueryEscape(u)
+}
+
+const (
+	letterIdxBits  = 6                    // 6 bits to represent a letter index
+	letterIdxMask  = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
+	letterIdxMax   = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
+	letterBytes    = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	letterNumBytes = "0123456789"
+)
+
+var (
+	fnSrc = &lockedSource{src: rand.NewSource(time.Now().UnixNano())} // for functions
+	fnMap = template.FuncMap{
+		"intSum":       intSum,
+		"random":       random,
+		"randomDate":   randomDate,
+		"randomString": randomString,
+		"randomNum":    randomNum,
+		"date":         date,
+		"UUID":         UUID,
+		"escape":       escape,
+		"getEnv":       getEnv,
+		// Overridden per run and per worker goroutine, see runWorkers
+		"workerIndex":    func() int64 { return 0 },
+		"workerCount":    func() int64 { return 1 },
+		"goroutineIndex": func() int64 { return 0 },
+		"iteration":      func() int64 { return 0 },
+		"globalRequest":  func() int64 { return 0 },
+		"totalRequests":  func() int64 { return 0 },
+	}
+	fnUUID = uuidStr()
+)
+
+// lockedSource is a rand.Source for the functions, which every worker
+// executes concurrently.
+type lockedSource struct {
+	lock sync.Mutex
+	src  rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.src.Seed(seed)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	for i, cache, remain := n-1, fnSrc.Int63(), letterIdxMax; i >= 0; {
+		if remain == 0 {
+			cache, remain = fnSrc.Int63(), letterIdxMax
+		}
+		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
+			b[i] = letterBytes[idx]
+			i--
+		}
+		cache >>= letterIdxBits
+		remain--
+	}
+	return string(b)
+}
+
+func randomNum(n int) string {
+	b := make([]byte, n)
+	for i, cache, remain := n-1, fnSrc.Int63(), letterIdxMax; i >= 0; {
+		if remain == 0 {
+			cache, remain = fnSrc.Int63(), letterIdxMax
+		}
+		if idx := int(cache & letterIdxMask); idx < len(letterNumBytes) {
+			b[i] = letterNumBytes[idx]
+			i--
+		}
+		cache >>= letterIdxBits
+		remain--
+	}
+	return string(b)
+}
+
+func UUID() string {
+	return fnUUID
+}
+
+func getEnv(key string) string {
+	return os.Getenv(key)
+}
+
+// ========================= function end =========================
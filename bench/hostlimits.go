@@ -0,0 +1,58 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package bench
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// processCPU returns the user and system CPU time of the process.
+func processCPU() (time.Duration, bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, false
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), true
+}
+
+// openFiles returns the number of open files of the process and its soft
+// RLIMIT_NOFILE.
+func openFiles() (open, limit uint64, ok bool) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, false
+	}
+	dir, err := os.Open("/dev/fd")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil || len(names) == 0 {
+		return 0, 0, false
+	}
+	return uint64(len(names) - 1), rlimit.Cur, true // Without the one of dir
+}
+
+// raiseFileLimit raises the soft RLIMIT_NOFILE to want, at most to the hard
+// limit, and returns the soft limits before and after.
+func raiseFileLimit(want uint64) (from, to uint64, err error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, err
+	}
+	from = rlimit.Cur
+	if from >= want {
+		return from, from, nil
+	}
+	if rlimit.Cur = want; want > rlimit.Max {
+		rlimit.Cur = rlimit.Max
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return from, from, err
+	}
+	return from, rlimit.Cur, nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package bench
+
+import (
+	"errors"
+	"time"
+)
+
+// processCPU is not available on this platform, see hostlimits.go.
+func processCPU() (time.Duration, bool) {
+	return 0, false
+}
+
+func openFiles() (open, limit uint64, ok bool) {
+	return 0, 0, false
+}
+
+func raiseFileLimit(want uint64) (from, to uint64, err error) {
+	return 0, 0, errors.New("the open files limit is not supported on this platform")
+}
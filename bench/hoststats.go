@@ -0,0 +1,80 @@
+package bench
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const (
+	HOST_CPU_BUSY     = 0.9         // Share of GOMAXPROCS busy on average over a run warned about
+	HOST_FILES_USED   = 0.9         // Share of the open files limit used at the peak warned about
+	HOST_GC_PAUSE     = 0.02        // Share of a run spent in GC pauses warned about
+	HOST_MIN_RUN      = time.Second // Shorter runs are not checked for CPU and GC
+	FILE_LIMIT_MARGIN = 64          // Open files besides the sockets of -c, see raiseFileLimit
+)
+
+// hostStats samples the load of the process running the workers, so a run
+// limited by the client itself rather than by the target says so.
+type hostStats struct {
+	start, last          time.Time
+	cpu, lastCPU         time.Duration // processCPU at start and at the last sample
+	cpuOk                bool
+	pauseNs              uint64 // runtime.MemStats PauseTotalNs and NumGC at start
+	numGC                uint32
+	peakCPU              float64 // Highest share of GOMAXPROCS busy between two samples
+	peakFiles, fileLimit uint64
+}
+
+func newHostStats() *hostStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	h := &hostStats{start: time.Now(), pauseNs: mem.PauseTotalNs, numGC: mem.NumGC}
+	h.cpu, h.cpuOk = processCPU()
+	h.last, h.lastCPU = h.start, h.cpu
+	h.sample(h.start)
+	return h
+}
+
+// sample records the CPU busy since the last sample and the open files.
+func (h *hostStats) sample(now time.Time) {
+	if cpu, ok := processCPU(); ok && now.After(h.last) {
+		busy := float64(cpu-h.lastCPU) / float64(now.Sub(h.last)) / float64(runtime.GOMAXPROCS(0))
+		if busy > h.peakCPU {
+			h.peakCPU = busy
+		}
+		h.last, h.lastCPU = now, cpu
+	}
+	if open, limit, ok := openFiles(); ok {
+		if open > h.peakFiles {
+			h.peakFiles = open
+		}
+		h.fileLimit = limit
+	}
+}
+
+// bottlenecks returns a warning for every limit of the client the run came
+// near, see HOST_CPU_BUSY, HOST_FILES_USED and HOST_GC_PAUSE.
+func (h *hostStats) bottlenecks(now time.Time) []string {
+	h.sample(now)
+	var warnings []string
+	elapsed := now.Sub(h.start)
+	if cpu, ok := processCPU(); ok && h.cpuOk && elapsed >= HOST_MIN_RUN {
+		procs := runtime.GOMAXPROCS(0)
+		if busy := float64(cpu-h.cpu) / float64(elapsed) / float64(procs); busy >= HOST_CPU_BUSY {
+			warnings = append(warnings, fmt.Sprintf("CPU:\t%.0f%% of GOMAXPROCS %d busy on average (peak %.0f%%), "+
+				"the client adds latency of its own, add -W workers or lower -c", busy*100, procs, h.peakCPU*100))
+		}
+	}
+	if h.fileLimit > 0 && float64(h.peakFiles) >= HOST_FILES_USED*float64(h.fileLimit) {
+		warnings = append(warnings, fmt.Sprintf("Open files:\t%d of the limit of %d at the peak, "+
+			"new connections fail once it is reached, raise it with ulimit -n", h.peakFiles, h.fileLimit))
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	if pause := time.Duration(mem.PauseTotalNs - h.pauseNs); elapsed >= HOST_MIN_RUN && float64(pause) >= HOST_GC_PAUSE*float64(elapsed) {
+		warnings = append(warnings, fmt.Sprintf("GC:\t%v paused in %d collections, %.1f%% of the run, "+
+			"raise GOGC or lower -c", pause, mem.NumGC-h.numGC, float64(pause)*100/float64(elapsed)))
+	}
+	return warnings
+}
@@ -0,0 +1,78 @@
+package bench
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	LIVE_WINDOW = 5   // Seconds of latencies in the Lats of a live Snapshot
+	LIVE_ERRORS = 100 // Distinct errors kept by a live Snapshot, the others are counted as other
+)
+
+// liveStats holds the interim metrics of Snapshot beyond the atomic
+// counters, for -ui. Every shard has its own, so the workers do not contend
+// on one lock, and Snapshot merges them with fill. It is only kept with
+// Options.Live.
+type liveStats struct {
+	lock        sync.Mutex
+	statusCodes map[int]int
+	errors      map[string]int
+	lats        [LIVE_WINDOW]liveSecond
+}
+
+// liveSecond holds the latencies in milliseconds of the requests ended
+// within one second, turned into Lats keys by fill only.
+type liveSecond struct {
+	unix int64
+	lats map[int64]int64
+}
+
+func newLiveStats() *liveStats {
+	return &liveStats{statusCodes: make(map[int]int), errors: make(map[string]int)}
+}
+
+func (l *liveStats) add(res *result) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if res.err != nil {
+		key := res.err.Error()
+		if _, ok := l.errors[key]; !ok && len(l.errors) >= LIVE_ERRORS {
+			key = "other"
+		}
+		l.errors[key]++
+		return
+	}
+	l.statusCodes[res.statusCode]++
+	now := time.Now().Unix()
+	second := &l.lats[now%LIVE_WINDOW]
+	if second.unix != now {
+		second.unix, second.lats = now, make(map[int64]int64)
+	}
+	second.lats[int64(res.duration/time.Millisecond)]++
+}
+
+// fill adds the status codes and errors so far to snapshot, and the
+// latencies of the requests ended in the last LIVE_WINDOW seconds to Lats.
+func (l *liveStats) fill(snapshot *StressResult) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for code, n := range l.statusCodes {
+		snapshot.StatusCodeDist[code] += n
+	}
+	for err, n := range l.errors {
+		if _, ok := snapshot.ErrorDist[err]; !ok && len(snapshot.ErrorDist) >= LIVE_ERRORS {
+			err = "other"
+		}
+		snapshot.ErrorDist[err] += n
+	}
+	now := time.Now().Unix()
+	for _, second := range l.lats {
+		if now-second.unix >= LIVE_WINDOW {
+			continue
+		}
+		for ms, n := range second.lats {
+			snapshot.Lats[latencyKey(time.Duration(ms)*time.Millisecond)] += n
+		}
+	}
+}
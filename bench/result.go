@@ -0,0 +1,1457 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	gourl "net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlowRequest is one of the slowest requests of StressResult.SlowRequests.
+type SlowRequest struct {
+	Url        string `json:"url"`
+	Duration   int64  `json:"duration"`
+	StatusCode int    `json:"status_code"`
+}
+
+// WorkerStats is the share of one worker goroutine of StressResult.Workers.
+type WorkerStats struct {
+	Index    int   `json:"index"`
+	Requests int64 `json:"requests"` // Completed
+	Errors   int64 `json:"errors"`   // Failed, see Failures
+	Average  int64 `json:"average"`  // Mean latency of the completed requests
+}
+
+// RunMeta identifies the run of a result, so a saved result says what was
+// tested.
+type RunMeta struct {
+	Version        string            `json:"version"` // Of http_bench
+	Commit         string            `json:"commit"`  // Git commit http_bench was built from
+	BuildDate      string            `json:"build_date"`
+	Hostname       string            `json:"hostname"`
+	GoMaxProcs     int               `json:"gomaxprocs"`
+	StartTime      time.Time         `json:"start_time"`
+	Params         *StressParameters `json:"params"`          // Resolved parameters, without the secrets and the inputs counted below
+	ReplayRequests int               `json:"replay_requests"` // Of the -access-log, not in Params
+	Bodies         int               `json:"bodies"`          // Of -body-file, not in Params
+	HeaderPools    map[string]int    `json:"header_pools"`    // Lines of each -H-random or -user-agent-file name, not in Params
+}
+
+// Build describes the build of http_bench which made the run.
+func (m *RunMeta) Build() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", m.Version, m.Commit, m.BuildDate)
+}
+
+type StressResult struct {
+	ErrCode   int     `json:"err_code"`
+	ErrMsg    string  `json:"err_msg"`
+	AvgTotal  int64   `json:"avg_total"`
+	Fastest   int64   `json:"fastest"`
+	Slowest   int64   `json:"slowest"`
+	Average   int64   `json:"average"`
+	StdDev    int64   `json:"std_dev"`
+	CV        float64 `json:"cv"` // Coefficient of variation, StdDev / Average
+	Rps       int64   `json:"rps"`
+	TargetQps int64   `json:"target_qps"` // Total -q rate of all connections, 0 if unlimited
+
+	ErrorDist      map[string]int                         `json:"error_dist"`
+	StatusCodeDist map[int]int                            `json:"status_code_dist"`
+	Lats           map[string]int64                       `json:"lats"`
+	SizeDist       map[int]int64                          `json:"size_dist"` // Response sizes in log2 buckets, see sizeBucket
+	SizeMin        int64                                  `json:"size_min"`
+	SizeMax        int64                                  `json:"size_max"`
+	LatsTotal      int64                                  `json:"lats_total"`
+	Attempted      int64                                  `json:"attempted"`         // Requests sent, LatsTotal of them got a response
+	InFlight       int64                                  `json:"in_flight"`         // Requests in flight when Duration expired
+	Drained        int64                                  `json:"drained"`           // InFlight requests completed within -drain, not counted in the other stats
+	DrainFailed    int64                                  `json:"drain_failed"`      // InFlight requests failed within -drain, the others were aborted
+	LatsSquare     float64                                `json:"lats_square"`       // Sum of the squared latencies
+	CorrectedLats  map[string]int64                       `json:"corrected_lats"`    // Latencies from the intended send time under -q
+	CorrectedTotal int64                                  `json:"corrected_total"`   // Number of CorrectedLats samples
+	Timeline       map[int64]int64                        `json:"timeline"`          // Responses completed per unix second
+	TimelineLats   map[int64]int64                        `json:"timeline_lats"`     // Sum of the latencies of the Timeline responses
+	BurstTimeline  map[int64]int64                        `json:"burst_timeline"`    // Timeline responses sent during a -burst window
+	Burst          string                                 `json:"burst"`             // -burst schedule, empty if none
+	RateDist       string                                 `json:"rate_distribution"` // Inter-arrival distribution under -q, empty if not rate limited
+	PeakRps        int64                                  `json:"peak_rps"`          // Max responses completed in one second
+	PeakSecond     int64                                  `json:"peak_second"`       // Seconds from the first response to PeakRps
+	PeakRps10s     float64                                `json:"peak_rps_10s"`      // Max average RPS over 10 consecutive seconds, 0 for shorter runs
+	BusyTimeline   map[int64]int64                        `json:"busy_timeline"`     // Requests in flight sampled every unix second
+	Connections    int                                    `json:"connections"`       // C the BusyTimeline utilization is relative to
+	SizeTotal      int64                                  `json:"size_total"`        // Decoded response bytes plus SentTotal
+	Duration       int64                                  `json:"duration"`
+	Output         string                                 `json:"output"`
+	StopReason     string                                 `json:"stop_reason"` // One of the STOP_* conditions which ended the run
+	WsMode         string                                 `json:"ws_mode"`
+	HttpType       string                                 `json:"http_type"`  // Requested -http type of an http run
+	Encoding       string                                 `json:"encoding"`   // Accept-Encoding mode of an http run and whether the bodies were decoded
+	ProtoDist      map[string]int64                       `json:"proto_dist"` // Responses per negotiated protocol, e.g. HTTP/1.1
+	RecvConns      int                                    `json:"recv_conns"`
+	Think          string                                 `json:"think"`         // Think time between iterations, empty if none
+	ThinkWorkers   int                                    `json:"think_workers"` // Workers pacing with the think time
+	QuicConns      int64                                  `json:"quic_conns"`
+	Quic0RTTConns  int64                                  `json:"quic_0rtt_conns"`
+	H2Conns        int64                                  `json:"h2_conns"`
+	H2PeakStreams  int64                                  `json:"h2_peak_streams"`    // Sum of the peak concurrent streams of every shared connection
+	SentTotal      int64                                  `json:"sent_total"`         // Uploaded bytes, also counted in SizeTotal
+	SentPerSec     float64                                `json:"sent_bytes_per_sec"` // SentTotal over Duration
+	BodyRawTotal   int64                                  `json:"body_raw_total"`     // Request body bytes before -compress-body
+	BodyZipTotal   int64                                  `json:"body_zip_total"`     // Request body bytes after -compress-body
+	WireTotal      int64                                  `json:"wire_total"`         // Response body bytes received, before decompression
+	NewConns       int64                                  `json:"new_conns"`
+	Reconnects     int64                                  `json:"reconnects"`              // Clients recreated by -requests-per-conn or -dns-refresh
+	ReconnectTotal int64                                  `json:"reconnect_total"`         // Sum of the Reconnects times
+	ThrottledTotal int64                                  `json:"throttled_total"`         // 429 and 503 responses with a Retry-After under -respect-retry-after
+	BackoffTotal   int64                                  `json:"backoff_total"`           // Sum of the pauses after the ThrottledTotal responses, as slept
+	TimedOutTotal  int64                                  `json:"timed_out_total"`         // Requests aborted by a client-side timeout, also counted in ErrorDist
+	Timeout        int64                                  `json:"timeout"`                 // Timeout in ms of the run, see TimedOutTotal
+	Bottlenecks    []string                               `json:"bottlenecks"`             // Limits of the client the run came near, printed as a warning
+	Corrupt        int64                                  `json:"corrupt_responses"`       // Responses failing -verify-sha256, also counted in ErrorDist
+	EchoMismatch   int64                                  `json:"echo_mismatches"`         // Responses echoing another -request-id-header, also counted in ErrorDist
+	LengthMismatch int64                                  `json:"content_length_mismatch"` // Responses whose body differs from the Content-Length, not failed
+	LengthDeclared int64                                  `json:"content_length_declared"` // Content-Length total of the LengthMismatch responses
+	LengthReceived int64                                  `json:"content_length_received"` // Body bytes received of the LengthMismatch responses, on the wire
+	OAuth2Failures int64                                  `json:"oauth2_failures"`         // Failed OAuth2 token refreshes
+	Conditional    int64                                  `json:"conditional"`             // Requests sent with the validators of -conditional-requests
+	NotModified    int64                                  `json:"not_modified"`            // 304 responses to the Conditional requests
+	CondSize       int64                                  `json:"cond_size"`               // Response bytes of the Conditional requests
+	SavedSize      int64                                  `json:"saved_size"`              // Body bytes the NotModified responses did not download again
+	ReusedConns    int64                                  `json:"reused_conns"`
+	HeaderDist     map[string]map[string]int64            `json:"header_dist"`      // Responses per value of each -capture-header
+	SlowRequests   []SlowRequest                          `json:"slow_requests"`    // The SLOW_KEEP slowest requests above -slow-threshold, slowest first
+	TargetDist     map[string]int64                       `json:"target_dist"`      // Responses per -target-concurrency pool
+	TargetLats     map[string]map[string]int64            `json:"target_lats"`      // Lats per -target-concurrency pool
+	HeaderLats     map[string]map[string]map[string]int64 `json:"header_lats"`      // Lats per value of each -capture-header
+	Url            string                                 `json:"url"`              // First url of an -o ab run
+	Concurrency    int                                    `json:"concurrency"`      // Connections of an -o ab run
+	ServerSoftware string                                 `json:"server_software"`  // Server header of the first response under -o ab
+	DocumentLength int64                                  `json:"document_length"`  // Body size of the first response under -o ab
+	ConnectLats    map[string]int64                       `json:"connect_lats"`     // Connection setup times under -o ab, 0 if reused
+	ProcessingLats map[string]int64                       `json:"processing_lats"`  // Latencies less the connection setup under -o ab
+	WaitingLats    map[string]int64                       `json:"waiting_lats"`     // From the request written to the first response byte under -o ab
+	RequestLats    map[string]int64                       `json:"request_lats"`     // Lats from the connection ready, excluding the connect time of new connections
+	RequestTotal   int64                                  `json:"request_total"`    // Responses in RequestLats, the http ones
+	StreamTotal    int64                                  `json:"stream_total"`     // Responses read chunk by chunk under -stream-metrics
+	StreamChunks   int64                                  `json:"stream_chunks"`    // Body chunks of the StreamTotal responses
+	StreamGaps     int64                                  `json:"stream_gaps"`      // StreamTotal responses of more than one chunk
+	StreamTtfcLats map[string]int64                       `json:"stream_ttfc_lats"` // From the request sent to the first body chunk
+	StreamGapLats  map[string]int64                       `json:"stream_gap_lats"`  // Mean gap between the body chunks of each of the StreamGaps responses
+	StreamLats     map[string]int64                       `json:"stream_lats"`      // From the first to the last body chunk
+	MaxCardinality int                                    `json:"max_cardinality"`  // Cap of ErrorDist and every HeaderDist, 0 means RESULT_CARDINALITY
+	Labels         map[string]string                      `json:"labels"`           // The -label pairs of the run
+	Meta           *RunMeta                               `json:"meta"`             // Set by the coordinator, nil in the -W worker results
+	Workers        []WorkerStats                          `json:"workers"`          // Per goroutine with -per-worker-breakdown
+	Node           string                                 `json:"node"`             // Address of the -W worker, or the -url host, which ran it
+	Nodes          []*StressResult                        `json:"nodes"`            // The -W worker results before Combine with -per-worker-breakdown, or the -url host ones
+	rdLock         sync.RWMutex                           `json:"-"`                // Guards a result shared between goroutines, see result
+	live           *liveStats                             `json:"-"`                // Of the worker of a shard with Options.Live
+}
+
+// protoPrefix is the resp.Proto prefix expected for each -http type.
+var protoPrefix = map[string]string{
+	TYPE_HTTP1: "HTTP/1.",
+	TYPE_HTTP2: "HTTP/2",
+	TYPE_HTTP3: "HTTP/3",
+}
+
+// Print writes the summary of the result to w, errors longer than
+// errorWidth (if > 0) are truncated.
+func (result *StressResult) Print(w io.Writer, errorWidth int) {
+	result.rdLock.RLock()
+	defer result.rdLock.RUnlock()
+
+	if len(result.Lats) > 0 {
+		fmt.Fprintf(w, "\nSummary:\n")
+		if result.WsMode != "" {
+			fmt.Fprintf(w, "  WS mode:\t%s\n", result.WsMode)
+		}
+		fmt.Fprintf(w, "  Total:\t%4.3f secs\n", float32(result.Duration)/SCALE_NUM)
+		if result.Meta != nil {
+			fmt.Fprintf(w, "  Version:\t%s\n", result.Meta.Build())
+		}
+		if len(result.Labels) > 0 {
+			fmt.Fprintf(w, "  Labels:\t%s\n", FormatLabels(result.Labels))
+		}
+		if result.StopReason != "" {
+			fmt.Fprintf(w, "  Stopped by:\t%s\n", result.StopReason)
+		}
+		if len(result.ProtoDist) > 0 {
+			result.printProtocols(w)
+		}
+		if result.Attempted > 0 {
+			fmt.Fprintf(w, "  Requests:\t%d attempted, %d completed\n", result.Attempted, result.LatsTotal)
+		}
+		if result.Timeout > 0 || result.TimedOutTotal > 0 {
+			fmt.Fprintf(w, "  Timeout:\t%dms, %d requests timed out\n", result.Timeout, result.TimedOutTotal)
+		}
+		if result.InFlight > 0 {
+			aborted := result.InFlight - result.Drained - result.DrainFailed
+			if aborted < 0 {
+				aborted = 0 // Sent while the cutoff happened
+			}
+			fmt.Fprintf(w, "  In flight:\t%d at the cutoff, %d drained, %d failed, %d aborted\n",
+				result.InFlight, result.Drained, result.DrainFailed, aborted)
+		}
+		fmt.Fprintf(w, "  Slowest:\t%4.3f secs\n", float32(result.Slowest)/SCALE_NUM)
+		fmt.Fprintf(w, "  Fastest:\t%4.3f secs\n", float32(result.Fastest)/SCALE_NUM)
+		fmt.Fprintf(w, "  Average:\t%4.3f secs\n", float32(result.Average)/SCALE_NUM)
+		fmt.Fprintf(w, "  Std dev:\t%4.3f secs\n", float32(result.StdDev)/SCALE_NUM)
+		fmt.Fprintf(w, "  CV:\t\t%4.2f%%\n", result.CV*100)
+		fmt.Fprintf(w, "  Requests/sec:\t%4.3f\n", float32(result.Rps)/SCALE_NUM)
+		if result.TargetQps > 0 && result.Burst != "" {
+			fmt.Fprintf(w, "  Target QPS:\t%d outside bursts (achieved %4.3f overall)\n", result.TargetQps, float32(result.Rps)/SCALE_NUM)
+		} else if result.TargetQps > 0 {
+			fmt.Fprintf(w, "  Target QPS:\t%d (achieved %4.3f)\n", result.TargetQps, float32(result.Rps)/SCALE_NUM)
+		}
+		if len(result.BusyTimeline) > 0 && result.Connections > 0 {
+			result.printUtilization(w)
+		}
+		if result.PeakRps > 0 {
+			fmt.Fprintf(w, "  Peak RPS:\t%d (at %ds)\n", result.PeakRps, result.PeakSecond)
+			if result.PeakRps10s > 0 {
+				fmt.Fprintf(w, "  Peak 10s RPS:\t%4.3f\n", result.PeakRps10s)
+			}
+		}
+		if result.SizeTotal > 1073741824 {
+			fmt.Fprintf(w, "  Total data:\t%4.3f GB\n", float64(result.SizeTotal)/1073741824)
+		} else if result.SizeTotal > 1048576 {
+			fmt.Fprintf(w, "  Total data:\t%4.3f MB\n", float64(result.SizeTotal)/1048576)
+		} else if result.SizeTotal > 1024 {
+			fmt.Fprintf(w, "  Total data:\t%4.3f KB\n", float64(result.SizeTotal)/1024)
+		} else if result.SizeTotal > 0 {
+			fmt.Fprintf(w, "  Total data:\t%4.3f bytes\n", float64(result.SizeTotal))
+		} else {
+			// pass
+		}
+		if result.Encoding != "" {
+			fmt.Fprintf(w, "  Accept-Encoding:\t%s\n", result.Encoding)
+		}
+		decoded := result.SizeTotal - result.SentTotal
+		if result.WireTotal > 0 && result.WireTotal != decoded {
+			fmt.Fprintf(w, "  Wire data:\t%s (%s decoded)\n", formatBytes(float64(result.WireTotal)), formatBytes(float64(decoded)))
+		}
+		fmt.Fprintf(w, "  Size/request:\t%d bytes\n", result.SizeTotal/result.LatsTotal)
+		if result.Duration > 0 {
+			// The wire bytes, so the rate does not depend on -disable-compression.
+			received := decoded
+			if result.WireTotal > 0 {
+				received = result.WireTotal
+			}
+			fmt.Fprintf(w, "  Received/sec:\t%s\n", formatBytes(float64(received)*SCALE_NUM/float64(result.Duration)))
+			if result.SentTotal > 0 {
+				fmt.Fprintf(w, "  Sent/sec:\t%s\n", formatBytes(result.SentPerSec))
+			}
+		}
+		if result.RecvConns > 0 && result.Duration > 0 {
+			fmt.Fprintf(w, "  Msgs/sec/conn:\t%4.3f\n", float64(result.Rps)/SCALE_NUM/float64(result.RecvConns))
+			fmt.Fprintf(w, "  Throughput:\t%4.3f KB/sec\n", float64(result.SizeTotal)*SCALE_NUM/float64(result.Duration)/1024)
+		}
+		if result.ThinkWorkers > 0 && result.Duration > 0 {
+			fmt.Fprintf(w, "  Think time:\t%s\n", result.Think)
+			fmt.Fprintf(w, "  Iterations/sec/worker:\t%4.3f\n", float64(result.Rps)/SCALE_NUM/float64(result.ThinkWorkers))
+		}
+		if result.QuicConns > 0 {
+			fmt.Fprintf(w, "  QUIC 0-RTT:\t%d/%d connections\n", result.Quic0RTTConns, result.QuicConns)
+		}
+		if result.NewConns+result.ReusedConns > 0 {
+			fmt.Fprintf(w, "  Connections:\t%d new, %d reused\n", result.NewConns, result.ReusedConns)
+		}
+		if result.Reconnects > 0 {
+			fmt.Fprintf(w, "  Reconnects:\t%d (avg %4.3f secs)\n", result.Reconnects, float32(result.ReconnectTotal/result.Reconnects)/SCALE_NUM)
+		}
+		if result.ThrottledTotal > 0 {
+			fmt.Fprintf(w, "  Throttled:\t%d responses with Retry-After, %4.3f secs backing off\n",
+				result.ThrottledTotal, float64(result.BackoffTotal)/SCALE_NUM)
+		}
+		if result.Corrupt > 0 {
+			fmt.Fprintf(w, "  Corrupt:\t%d responses\n", result.Corrupt)
+		}
+		if result.EchoMismatch > 0 {
+			fmt.Fprintf(w, "  Echo mismatch:\t%d responses\n", result.EchoMismatch)
+		}
+		if result.LengthMismatch > 0 {
+			fmt.Fprintf(w, "  Content-Length mismatch:\t%d responses, the body received differs from the header (%d bytes declared, %d received)\n",
+				result.LengthMismatch, result.LengthDeclared, result.LengthReceived)
+		}
+		if result.OAuth2Failures > 0 {
+			fmt.Fprintf(w, "  OAuth2 errors:\t%d token refreshes failed\n", result.OAuth2Failures)
+		}
+		if result.Conditional > 0 {
+			fmt.Fprintf(w, "  Conditional:\t%d requests, %d not modified (304), %d full\n", result.Conditional,
+				result.NotModified, result.Conditional-result.NotModified)
+			if full := result.SavedSize + result.CondSize; full > 0 {
+				fmt.Fprintf(w, "  Saved:\t%s of %s (%4.1f%%)\n", formatBytes(float64(result.SavedSize)),
+					formatBytes(float64(full)), float64(result.SavedSize)*100/float64(full))
+			}
+		}
+		if result.H2Conns > 0 {
+			fmt.Fprintf(w, "  H2 conns:\t%d\n", result.H2Conns)
+			fmt.Fprintf(w, "  Streams/conn:\t%4.3f (peak)\n", float64(result.H2PeakStreams)/float64(result.H2Conns))
+		}
+		if result.SentTotal > 0 || result.BodyZipTotal > 0 {
+			result.printUpload(w)
+		}
+		result.printStatusCodes(w)
+		result.printHeaderDist(w)
+		if len(result.TargetDist) > 0 {
+			printValueDist(w, "Target distribution", result.TargetDist, result.TargetLats)
+		}
+		result.printLatencies(w)
+		if result.StreamTotal > 0 {
+			result.printStream(w)
+		}
+		if len(result.SizeDist) > 0 {
+			result.printSizes(w)
+		}
+		if result.Burst != "" && len(result.Timeline) > 0 {
+			result.printTimeline(w)
+		}
+		if len(result.Workers) > 0 || len(result.Nodes) > 0 {
+			result.printWorkers(w)
+		}
+	}
+
+	if len(result.ErrorDist) > 0 {
+		result.printErrors(w, errorWidth)
+	}
+	if len(result.SlowRequests) > 0 {
+		result.printSlowRequests(w)
+	}
+	if len(result.Bottlenecks) > 0 {
+		fmt.Fprintf(w, "\nWARNING, the load generator may be the bottleneck:\n")
+		for _, warning := range result.Bottlenecks {
+			fmt.Fprintf(w, "  %s\n", warning)
+		}
+	}
+}
+
+// FormatLabels returns labels as sorted key=value pairs.
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// WriteOutput writes the result to w in the Output format, csv, json or ab.
+func (result *StressResult) WriteOutput(w io.Writer) {
+	result.WriteFormat(w, result.Output)
+}
+
+// WriteFormat writes the result to w in format, csv, json or ab.
+func (result *StressResult) WriteFormat(w io.Writer, format string) {
+	result.rdLock.RLock()
+	defer result.rdLock.RUnlock()
+
+	switch format {
+	case OUTPUT_CSV:
+		fmt.Fprintf(w, "Duration,Count\n")
+		for duration, val := range result.Lats {
+			fmt.Fprintf(w, "%s,%d\n", duration, val/SCALE_NUM)
+		}
+	case OUTPUT_JSON:
+		if data, err := json.Marshal(result); err == nil {
+			w.Write(append(data, '\n'))
+		}
+	case OUTPUT_AB:
+		result.printAb(w)
+	}
+}
+
+// printAb writes the report of Apache Bench, so the parsers of its output
+// work unchanged. Header bytes are not counted in Total transferred.
+func (result *StressResult) printAb(w io.Writer) {
+	host, port, path := result.Url, "", "/"
+	if u, err := gourl.Parse(result.Url); err == nil && u.Host != "" {
+		host, port = u.Hostname(), u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" || u.Scheme == "wss" {
+				port = "443"
+			}
+		}
+		if path = u.RequestURI(); path == "" {
+			path = "/"
+		}
+	}
+	failed, _ := result.Failures()
+	secs := float64(result.Duration) / SCALE_NUM
+	html := result.SizeTotal - result.SentTotal
+	transferred := html
+	if result.WireTotal > 0 {
+		transferred = result.WireTotal
+	}
+
+	fmt.Fprintf(w, "Server Software:        %s\n", result.ServerSoftware)
+	fmt.Fprintf(w, "Server Hostname:        %s\n", host)
+	fmt.Fprintf(w, "Server Port:            %s\n\n", port)
+	fmt.Fprintf(w, "Document Path:          %s\n", path)
+	fmt.Fprintf(w, "Document Length:        %d bytes\n\n", result.DocumentLength)
+	fmt.Fprintf(w, "Concurrency Level:      %d\n", result.Concurrency)
+	fmt.Fprintf(w, "Time taken for tests:   %.3f seconds\n", secs)
+	fmt.Fprintf(w, "Complete requests:      %d\n", result.LatsTotal)
+	fmt.Fprintf(w, "Failed requests:        %d\n", failed)
+	fmt.Fprintf(w, "Total transferred:      %d bytes\n", transferred)
+	fmt.Fprintf(w, "HTML transferred:       %d bytes\n", html)
+	if result.LatsTotal > 0 && secs > 0 {
+		fmt.Fprintf(w, "Requests per second:    %.2f [#/sec] (mean)\n", float64(result.LatsTotal)/secs)
+		fmt.Fprintf(w, "Time per request:       %.3f [ms] (mean)\n", float64(result.Concurrency)*secs*1000/float64(result.LatsTotal))
+		fmt.Fprintf(w, "Time per request:       %.3f [ms] (mean, across all concurrent requests)\n", secs*1000/float64(result.LatsTotal))
+		fmt.Fprintf(w, "Transfer rate:          %.2f [Kbytes/sec] received\n", float64(transferred)/1024/secs)
+	}
+	if result.LatsTotal == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\nConnection Times (ms)\n")
+	fmt.Fprintf(w, "              min  mean[+/-sd] median   max\n")
+	for _, row := range []struct {
+		name string
+		lats map[string]int64
+	}{
+		{"Connect:", result.ConnectLats},
+		{"Processing:", result.ProcessingLats},
+		{"Waiting:", result.WaitingLats},
+		{"Total:", result.Lats},
+	} {
+		if row.lats == nil {
+			continue
+		}
+		min, mean, sd, median, max := latsStats(row.lats)
+		fmt.Fprintf(w, "%-11s %5.0f %4.0f %5.1f %6.0f %7.0f\n", row.name, min, mean, sd, median, max)
+	}
+
+	pctls := []int{50, 66, 75, 80, 90, 95, 98, 99}
+	data := LatencyPercentiles(result.Lats, result.LatsTotal, pctls)
+	fmt.Fprintf(w, "\nPercentage of the requests served within a certain time (ms)\n")
+	for i, pctl := range pctls {
+		secs, _ := strconv.ParseFloat(strings.TrimSpace(data[i]), 64)
+		fmt.Fprintf(w, " %3d%%  %5.0f\n", pctl, secs*1000)
+	}
+	fmt.Fprintf(w, " 100%%  %5.0f (longest request)\n", float64(result.Slowest)/SCALE_NUM*1000)
+}
+
+// latsStats returns the min, mean, standard deviation, median and max in ms
+// of a latency map keyed by seconds.
+func latsStats(lats map[string]int64) (min, mean, sd, median, max float64) {
+	var count int64
+	var sum, square float64
+	min = math.MaxFloat64
+	for key, c := range lats {
+		secs, _ := strconv.ParseFloat(strings.TrimSpace(key), 64)
+		ms := secs * 1000
+		count += c
+		sum += ms * float64(c)
+		square += ms * ms * float64(c)
+		min = math.Min(min, ms)
+		max = math.Max(max, ms)
+	}
+	if count == 0 {
+		return 0, 0, 0, 0, 0
+	}
+	mean = sum / float64(count)
+	sd = math.Sqrt(math.Max(square/float64(count)-mean*mean, 0))
+	median, _ = strconv.ParseFloat(strings.TrimSpace(LatencyPercentiles(lats, count, []int{50})[0]), 64)
+	return min, mean, sd, median * 1000, max
+}
+
+// PrintQuiet writes the single line summary of -quiet to w.
+func (result *StressResult) PrintQuiet(w io.Writer) {
+	result.rdLock.RLock()
+	defer result.rdLock.RUnlock()
+
+	failed, _ := result.Failures()
+	p50, p99 := "0", "0"
+	if result.LatsTotal > 0 {
+		data := LatencyPercentiles(result.Lats, result.LatsTotal, []int{50, 99})
+		p50, p99 = strings.TrimSpace(data[0]), strings.TrimSpace(data[1])
+	}
+	fmt.Fprintf(w, "rps=%.3f p50=%s p99=%s errors=%d bytes=%d\n",
+		float64(result.Rps)/SCALE_NUM, p50, p99, failed, result.SizeTotal)
+}
+
+// Failures returns the number of failed requests, those with a transport
+// error, a 5xx status, a corrupt body or a mismatched request id echo, out
+// of total.
+func (result *StressResult) Failures() (failed, total int64) {
+	for _, count := range result.ErrorDist {
+		failed += int64(count)
+	}
+	total = result.LatsTotal + failed - result.Corrupt - result.EchoMismatch // Those responses are in both
+	for code, count := range result.StatusCodeDist {
+		if code >= 500 {
+			failed += int64(count)
+		}
+	}
+	if failed > total {
+		failed = total
+	}
+	return failed, total
+}
+
+// ErrorRate returns the percentage of failed requests, see failures.
+func (result *StressResult) ErrorRate() float64 {
+	failed, total := result.Failures()
+	if total <= 0 {
+		return 0
+	}
+	return float64(failed) * 100 / float64(total)
+}
+
+// TimeoutRate returns the percentage of requests aborted by a client-side
+// timeout, see TimedOutTotal.
+func (result *StressResult) TimeoutRate() float64 {
+	_, total := result.Failures()
+	if total <= 0 {
+		return 0
+	}
+	return float64(result.TimedOutTotal) * 100 / float64(total)
+}
+
+// ExitCode returns one of the EXIT_* codes for the outcome of the run, result
+// may be nil if nothing was collected.
+func (result *StressResult) ExitCode(maxErrorRate float64) int {
+	if result == nil {
+		return EXIT_INTERNAL
+	}
+	if result.LatsTotal == 0 && len(result.ErrorDist) == 0 {
+		fmt.Fprintf(os.Stderr, "Internal err: no requests completed %s\n", result.ErrMsg)
+		return EXIT_INTERNAL
+	}
+	if result.ErrCode != 0 {
+		return EXIT_ERRORS // Stopped by a request error
+	}
+	if rate := result.ErrorRate(); rate > maxErrorRate {
+		fmt.Fprintf(os.Stderr, "Error rate %4.3f%% above -max-error-rate %g%%\n", rate, maxErrorRate)
+		return EXIT_ERRORS
+	}
+	return EXIT_OK
+}
+
+func formatBytes(size float64) string {
+	switch {
+	case size > 1073741824:
+		return fmt.Sprintf("%4.3f GB", size/1073741824)
+	case size > 1048576:
+		return fmt.Sprintf("%4.3f MB", size/1048576)
+	case size > 1024:
+		return fmt.Sprintf("%4.3f KB", size/1024)
+	default:
+		return fmt.Sprintf("%4.3f bytes", size)
+	}
+}
+
+// sizeBucket returns the log2 bucket of a response size, bucket b holds the
+// sizes in [2^(b-1), 2^b) and bucket 0 the empty responses.
+func sizeBucket(size int64) int {
+	var b int
+	for ; size > 0; size >>= 1 {
+		b++
+	}
+	return b
+}
+
+func shortSize(size int64) string {
+	switch {
+	case size >= 1073741824 && size%1073741824 == 0:
+		return fmt.Sprintf("%dGB", size/1073741824)
+	case size >= 1048576 && size%1048576 == 0:
+		return fmt.Sprintf("%dMB", size/1048576)
+	case size >= 1024 && size%1024 == 0:
+		return fmt.Sprintf("%dKB", size/1024)
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
+
+// Print response size distribution.
+func (result *StressResult) printSizes(w io.Writer) {
+	var count int64
+	buckets := make([]int, 0, len(result.SizeDist))
+	for bucket, num := range result.SizeDist {
+		buckets = append(buckets, bucket)
+		count += num
+	}
+	sort.Ints(buckets)
+	fmt.Fprintf(w, "\nResponse size distribution:\n")
+	fmt.Fprintf(w, "  Min:\t%d bytes\n", result.SizeMin)
+	fmt.Fprintf(w, "  Avg:\t%d bytes\n", (result.SizeTotal-result.SentTotal)/count)
+	fmt.Fprintf(w, "  Max:\t%d bytes\n", result.SizeMax)
+	for _, bucket := range buckets {
+		if bucket == 0 {
+			fmt.Fprintf(w, "  [0B]\t%d responses\n", result.SizeDist[bucket])
+			continue
+		}
+		fmt.Fprintf(w, "  [%s, %s)\t%d responses\n", shortSize(1<<uint(bucket-1)), shortSize(1<<uint(bucket)), result.SizeDist[bucket])
+	}
+}
+
+// printTimeline prints the responses and average latency of every second,
+// marking the seconds with responses to requests sent during a burst.
+func (result *StressResult) printTimeline(w io.Writer) {
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	for second := range result.Timeline {
+		if second < first {
+			first = second
+		}
+		if second > last {
+			last = second
+		}
+	}
+	fmt.Fprintf(w, "\nTimeline (burst %s):\n", result.Burst)
+	for second := first; second <= last; second++ {
+		c := result.Timeline[second]
+		var avg float32
+		if c > 0 {
+			avg = float32(result.TimelineLats[second]/c) / SCALE_NUM
+		}
+		mark := ""
+		if result.BurstTimeline[second] > 0 {
+			mark = "\tburst"
+		}
+		fmt.Fprintf(w, "  [+%ds]\t%d responses\t%4.3f secs%s\n", second-first, c, avg, mark)
+	}
+}
+
+// printWorkers prints the share of every worker goroutine and -W worker, an
+// uneven one points at a worker stuck e.g. on a bad DNS answer.
+func (result *StressResult) printWorkers(w io.Writer) {
+	if len(result.Workers) > 0 {
+		fmt.Fprintf(w, "\nWorkers:\n")
+		for _, v := range result.Workers {
+			fmt.Fprintf(w, "  [%d]\t%d requests\t%d errors\t%4.3f secs\n", v.Index, v.Requests, v.Errors, float32(v.Average)/SCALE_NUM)
+		}
+	}
+	if len(result.Nodes) > 0 {
+		fmt.Fprintf(w, "\nNodes:\n")
+		for _, node := range result.Nodes {
+			failed, _ := node.Failures()
+			fmt.Fprintf(w, "  [%s]\t%d requests\t%d errors\t%4.3f secs\t%4.3f rps\n",
+				node.Node, node.LatsTotal, failed, float32(node.Average)/SCALE_NUM, float64(node.Rps)/SCALE_NUM)
+		}
+	}
+}
+
+// workerStats returns the WorkerStats of the shard of the goroutine index.
+func (result *StressResult) workerStats(index int) WorkerStats {
+	result.rdLock.RLock()
+	defer result.rdLock.RUnlock()
+
+	stats := WorkerStats{Index: index, Requests: result.LatsTotal}
+	stats.Errors, _ = result.Failures()
+	if result.LatsTotal > 0 {
+		stats.Average = result.AvgTotal / result.LatsTotal
+	}
+	return stats
+}
+
+// printUtilization prints the average and peak share of the connections busy
+// with a request, and a hint when all of them were busy below the -q target.
+func (result *StressResult) printUtilization(w io.Writer) {
+	var sum, peak int64
+	for _, busy := range result.BusyTimeline {
+		sum += busy
+		if busy > peak {
+			peak = busy
+		}
+	}
+	avg := float64(sum) / float64(len(result.BusyTimeline)) / float64(result.Connections)
+	max := float64(peak) / float64(result.Connections)
+	fmt.Fprintf(w, "  Utilization:\t%4.1f%% average, %4.1f%% peak of %d connections\n", avg*100, max*100, result.Connections)
+	if result.TargetQps > 0 && max >= 1 && float64(result.Rps)/SCALE_NUM < float64(result.TargetQps)*0.95 {
+		fmt.Fprintf(w, "  WARNING:\tall connections were busy below the target QPS, -c is the bottleneck\n")
+	}
+}
+
+// Print latency distribution.
+func (result *StressResult) printLatencies(w io.Writer) {
+	if result.CorrectedTotal > 0 {
+		printLatencyDist(w, "Latency distribution (raw, from actual send time)", result.Lats, result.LatsTotal)
+		printLatencyDist(w, "Latency distribution (corrected for coordinated omission, from intended send time)", result.CorrectedLats, result.CorrectedTotal)
+	} else if result.RequestTotal > 0 {
+		printLatencyDist(w, "Latency distribution (including connect)", result.Lats, result.LatsTotal)
+	} else {
+		printLatencyDist(w, "Latency distribution", result.Lats, result.LatsTotal)
+	}
+	if result.RequestTotal > 0 {
+		printLatencyDist(w, "Latency distribution (excluding connect, from the connection ready)", result.RequestLats, result.RequestTotal)
+	}
+}
+
+func printLatencyDist(w io.Writer, title string, lats map[string]int64, total int64) {
+	pctls := []int{10, 25, 50, 75, 90, 95, 99}
+	data := LatencyPercentiles(lats, total, pctls)
+	fmt.Fprintf(w, "\n%s:\n", title)
+	for i := 0; i < len(pctls); i++ {
+		fmt.Fprintf(w, "  %v%% in %s secs\n", pctls[i], data[i])
+	}
+}
+
+// LatencyPercentiles returns the latency buckets of lats, keyed as in
+// StressResult.Lats, reaching each of the pctls percentages of total.
+func LatencyPercentiles(lats map[string]int64, total int64, pctls []int) []string {
+	durationLats := make([]string, 0, len(lats))
+	for duration := range lats {
+		durationLats = append(durationLats, duration)
+	}
+	// Sort numerically, "10.000" comes after "9.000".
+	sort.Slice(durationLats, func(i, j int) bool {
+		a, _ := strconv.ParseFloat(strings.TrimSpace(durationLats[i]), 64)
+		b, _ := strconv.ParseFloat(strings.TrimSpace(durationLats[j]), 64)
+		return a < b
+	})
+	data := make([]string, len(pctls))
+	var j int = 0
+	var current int64 = 0
+	for i := 0; i < len(durationLats) && j < len(pctls); i++ {
+		current = current + lats[durationLats[i]]
+		// One bucket may reach several percentiles.
+		for ; j < len(pctls) && int(current*100/total) >= pctls[j]; j++ {
+			data[j] = durationLats[i]
+		}
+	}
+	return data
+}
+
+// printStream prints the chunk cadence of the -stream-metrics responses.
+func (result *StressResult) printStream(w io.Writer) {
+	fmt.Fprintf(w, "\nStream metrics:\n")
+	fmt.Fprintf(w, "  Responses:\t%d, %4.1f chunks on average\n", result.StreamTotal,
+		float64(result.StreamChunks)/float64(result.StreamTotal))
+	pctls := []int{50, 90, 99}
+	for _, row := range []struct {
+		name  string
+		lats  map[string]int64
+		total int64
+	}{
+		{"Time to first chunk:", result.StreamTtfcLats, result.StreamTotal},
+		{"Inter-chunk gap:", result.StreamGapLats, result.StreamGaps},
+		{"Stream duration:", result.StreamLats, result.StreamTotal},
+	} {
+		if row.total == 0 {
+			continue
+		}
+		_, mean, _, _, max := latsStats(row.lats)
+		data := LatencyPercentiles(row.lats, row.total, pctls)
+		fmt.Fprintf(w, "  %s\tavg %4.1f ms", row.name, mean)
+		for i, pctl := range pctls {
+			secs, _ := strconv.ParseFloat(strings.TrimSpace(data[i]), 64)
+			fmt.Fprintf(w, ", p%d %4.1f", pctl, secs*1000)
+		}
+		fmt.Fprintf(w, ", max %4.1f ms\n", max)
+	}
+}
+
+// Print upload throughput.
+func (result *StressResult) printUpload(w io.Writer) {
+	fmt.Fprintf(w, "\nUpload throughput:\n")
+	if result.SentTotal > 0 {
+		fmt.Fprintf(w, "  Total sent:\t%4.3f MB\n", float64(result.SentTotal)/1048576)
+		if result.Duration > 0 {
+			fmt.Fprintf(w, "  MB/sec:\t%4.3f\n", result.SentPerSec/1048576)
+		}
+	}
+	if result.BodyZipTotal > 0 {
+		fmt.Fprintf(w, "  Body raw:\t%d bytes\n", result.BodyRawTotal)
+		fmt.Fprintf(w, "  Body gzip:\t%d bytes\n", result.BodyZipTotal)
+		fmt.Fprintf(w, "  Compression:\t%4.3f\n", float64(result.BodyRawTotal)/float64(result.BodyZipTotal))
+	}
+}
+
+// Print status code distribution.
+func (result *StressResult) printStatusCodes(w io.Writer) {
+	codes := make([]int, 0, len(result.StatusCodeDist))
+	for code := range result.StatusCodeDist {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprintf(w, "\nStatus code distribution:\n")
+	for _, code := range codes {
+		fmt.Fprintf(w, "  [%d]\t%d responses\n", code, result.StatusCodeDist[code])
+	}
+}
+
+// Print the responses and latencies per value of every -capture-header.
+func (result *StressResult) printHeaderDist(w io.Writer) {
+	names := make([]string, 0, len(result.HeaderDist))
+	for name := range result.HeaderDist {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		printValueDist(w, name+" distribution", result.HeaderDist[name], result.HeaderLats[name])
+	}
+}
+
+// printValueDist prints the responses and the latencies of every value of
+// dist by descending count.
+func printValueDist(w io.Writer, title string, dist map[string]int64, lats map[string]map[string]int64) {
+	values := make([]string, 0, len(dist))
+	for value := range dist {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if dist[values[i]] != dist[values[j]] {
+			return dist[values[i]] > dist[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	fmt.Fprintf(w, "\n%s:\n", title)
+	for _, value := range values {
+		data := LatencyPercentiles(lats[value], dist[value], []int{50, 99})
+		fmt.Fprintf(w, "  [%s]\t%d responses\tp50 %s secs\tp99 %s secs\n", value, dist[value],
+			strings.TrimSpace(data[0]), strings.TrimSpace(data[1]))
+	}
+}
+
+// printProtocols prints the negotiated protocols by descending count, and a
+// warning if most responses did not use the requested -http type.
+func (result *StressResult) printProtocols(w io.Writer) {
+	protos := make([]string, 0, len(result.ProtoDist))
+	var total int64
+	for proto, c := range result.ProtoDist {
+		protos = append(protos, proto)
+		total += c
+	}
+	sort.Slice(protos, func(i, j int) bool {
+		if result.ProtoDist[protos[i]] != result.ProtoDist[protos[j]] {
+			return result.ProtoDist[protos[i]] > result.ProtoDist[protos[j]]
+		}
+		return protos[i] < protos[j]
+	})
+	dist := make([]string, len(protos))
+	for i, proto := range protos {
+		dist[i] = fmt.Sprintf("%s %4.1f%%", proto, float64(result.ProtoDist[proto])*100/float64(total))
+	}
+	fmt.Fprintf(w, "  Protocols:\t%s\n", strings.Join(dist, ", "))
+	if want := protoPrefix[result.HttpType]; want != "" && !strings.HasPrefix(protos[0], want) {
+		fmt.Fprintf(w, "  WARNING:\trequested -http %s but most responses used %s\n", result.HttpType, protos[0])
+	}
+}
+
+// Print the slowest requests above -slow-threshold.
+func (result *StressResult) printSlowRequests(w io.Writer) {
+	fmt.Fprintf(w, "\nSlowest requests:\n")
+	for _, slow := range result.SlowRequests {
+		fmt.Fprintf(w, "  %4.3f secs\t[%d]\t%s\n", float32(slow.Duration)/SCALE_NUM, slow.StatusCode, slow.Url)
+	}
+}
+
+// Print error distribution by descending count, errors longer than width
+// (if width > 0) are truncated.
+func (result *StressResult) printErrors(w io.Writer, width int) {
+	errs := make([]string, 0, len(result.ErrorDist))
+	for err := range result.ErrorDist {
+		errs = append(errs, err)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		if result.ErrorDist[errs[i]] != result.ErrorDist[errs[j]] {
+			return result.ErrorDist[errs[i]] > result.ErrorDist[errs[j]]
+		}
+		return errs[i] < errs[j]
+	})
+	fmt.Fprintf(w, "\nError distribution:\n")
+	for _, err := range errs {
+		msg := err
+		if width > 0 && len(msg) > width {
+			msg = fmt.Sprintf("%s(+%d more chars)", msg[:width], len(msg)-width)
+		}
+		fmt.Fprintf(w, "  [%d]\t%s\n", result.ErrorDist[err], msg)
+	}
+	if result.TimedOutTotal > 0 {
+		failed, _ := result.Failures()
+		fmt.Fprintf(w, "  Timed out:\t%d of %d failed requests hit a client-side timeout (-t %dms)\n",
+			result.TimedOutTotal, failed, result.Timeout)
+	}
+	if count := result.ErrorDist[ErrPortExhaustion.Error()]; count > 0 {
+		fmt.Fprintf(w, "  WARNING:\t%d requests found no free local port, keep connections alive, "+
+			"widen -local-port-range or add source IPs with -local-addr\n", count)
+	}
+}
+
+func (result *StressResult) Marshal() ([]byte, error) {
+	result.rdLock.RLock()
+	defer result.rdLock.RUnlock()
+
+	return json.Marshal(result)
+}
+
+// NewStressResult returns an empty result ready for record and Combine.
+func NewStressResult() *StressResult {
+	return &StressResult{
+		ErrorDist:      make(map[string]int, 0),
+		StatusCodeDist: make(map[int]int, 0),
+		Lats:           make(map[string]int64, 0),
+		SizeDist:       make(map[int]int64, 0),
+		Slowest:        int64(INT_MIN),
+		Fastest:        int64(INT_MAX),
+		SizeMin:        int64(INT_MAX),
+	}
+}
+
+// result adds res from any goroutine. The workers don't take the lock: each
+// one records into its own shard, merged by Combine once the run is done,
+// and Snapshot reads the atomic counters of the worker meanwhile.
+func (result *StressResult) result(res *result) {
+	result.rdLock.Lock()
+	defer result.rdLock.Unlock()
+
+	result.record(res)
+}
+
+// record adds res without locking, for a result owned by a single worker.
+// latencyKey is the key of d in the latency distributions, whole
+// milliseconds below LAT_EXACT_MAX and 4 significant digits above, so a
+// distribution keeps a bounded number of keys however spread the latencies.
+func latencyKey(d time.Duration) string {
+	step := time.Millisecond
+	for limit := LAT_EXACT_MAX; d >= limit; limit *= 10 {
+		step *= 10
+		if limit > math.MaxInt64/10 {
+			break
+		}
+	}
+	d = d / step * step
+	return fmt.Sprintf("%4.3f", d.Seconds())
+}
+
+// addBackoff adds the time a worker paused after a throttled response, which
+// a stop may cut short of the backoff asked for.
+func (result *StressResult) addBackoff(d time.Duration) {
+	result.rdLock.Lock()
+	defer result.rdLock.Unlock()
+
+	result.BackoffTotal += int64(d.Seconds() * SCALE_NUM)
+}
+
+func (result *StressResult) record(res *result) {
+	if result.live != nil {
+		result.live.add(res)
+	}
+	if res.err != nil {
+		if isTimeout(res.err) {
+			result.TimedOutTotal++
+		}
+		result.ErrorDist[res.err.Error()]++
+		result.foldErrors()
+		return
+	}
+	result.LatsTotal++
+	result.AvgTotal += int64(res.duration.Seconds() * SCALE_NUM)
+	result.StatusCodeDist[res.statusCode]++
+	if res.contentLength > 0 {
+		result.SizeTotal += res.contentLength
+	}
+	if res.sentLength > 0 {
+		result.SizeTotal += res.sentLength
+	}
+	result.Lats[latencyKey(res.duration)]++
+	duration := int64(res.duration.Seconds() * SCALE_NUM)
+	if result.Slowest < duration {
+		result.Slowest = duration
+	}
+	if result.Fastest > duration {
+		result.Fastest = duration
+	}
+	result.LatsSquare += float64(duration) * float64(duration)
+	if !res.scheduled.IsZero() {
+		corrected := res.end.Sub(res.scheduled)
+		if corrected < res.duration {
+			corrected = res.duration
+		}
+		if result.CorrectedLats == nil {
+			result.CorrectedLats = make(map[string]int64)
+		}
+		result.CorrectedLats[latencyKey(corrected)]++
+		result.CorrectedTotal++
+	}
+	if !res.end.IsZero() {
+		if result.Timeline == nil {
+			result.Timeline = make(map[int64]int64)
+		}
+		result.Timeline[res.end.Unix()]++
+		if result.TimelineLats == nil {
+			result.TimelineLats = make(map[int64]int64)
+		}
+		result.TimelineLats[res.end.Unix()] += duration
+		if res.burst {
+			if result.BurstTimeline == nil {
+				result.BurstTimeline = make(map[int64]int64)
+			}
+			result.BurstTimeline[res.end.Unix()]++
+		}
+	}
+	if res.requestTime > 0 {
+		if result.RequestLats == nil {
+			result.RequestLats = make(map[string]int64)
+		}
+		result.RequestLats[latencyKey(res.requestTime)]++
+		result.RequestTotal++
+	}
+	if res.reconnect {
+		result.Reconnects++
+		result.ReconnectTotal += int64(res.reconnectTime.Seconds() * SCALE_NUM)
+	}
+	if res.throttled {
+		result.ThrottledTotal++
+	}
+	if res.gotConn {
+		if res.connReused {
+			result.ReusedConns++
+		} else {
+			result.NewConns++
+		}
+	}
+	if res.contentLength >= 0 {
+		result.SizeDist[sizeBucket(res.contentLength)]++
+		if result.SizeMin > res.contentLength {
+			result.SizeMin = res.contentLength
+		}
+		if result.SizeMax < res.contentLength {
+			result.SizeMax = res.contentLength
+		}
+	}
+	if res.sentLength > 0 {
+		result.SentTotal += res.sentLength
+	}
+	result.BodyRawTotal += res.bodyRawLength
+	result.BodyZipTotal += res.bodyZipLength
+	result.WireTotal += res.wireLength
+	if res.phases {
+		if result.ConnectLats == nil {
+			result.ServerSoftware, result.DocumentLength = res.server, res.contentLength
+			result.ConnectLats = make(map[string]int64)
+			result.ProcessingLats = make(map[string]int64)
+			result.WaitingLats = make(map[string]int64)
+		}
+		result.ConnectLats[latencyKey(res.connWait)]++
+		result.ProcessingLats[latencyKey(res.duration-res.connWait)]++
+		result.WaitingLats[latencyKey(res.waiting)]++
+	}
+	if res.proto != "" {
+		if result.ProtoDist == nil {
+			result.ProtoDist = make(map[string]int64)
+		}
+		result.ProtoDist[res.proto]++
+	}
+	if res.corrupt {
+		result.Corrupt++
+		result.ErrorDist[ErrCorrupt.Error()]++
+	}
+	if res.echoMismatch {
+		result.EchoMismatch++
+		result.ErrorDist[ErrEchoMismatch.Error()]++
+	}
+	if res.lengthMismatch {
+		result.LengthMismatch++
+		result.LengthDeclared += res.declaredLength
+		result.LengthReceived += res.wireLength
+	}
+	if res.streamed {
+		if result.StreamTtfcLats == nil {
+			result.StreamTtfcLats = make(map[string]int64)
+			result.StreamGapLats = make(map[string]int64)
+			result.StreamLats = make(map[string]int64)
+		}
+		result.StreamTotal++
+		result.StreamChunks += res.chunks
+		result.StreamTtfcLats[latencyKey(res.streamTtfc)]++
+		result.StreamLats[latencyKey(res.streamDuration)]++
+		if res.chunks > 1 {
+			result.StreamGaps++
+			result.StreamGapLats[latencyKey(res.streamGap)]++
+		}
+	}
+	if res.conditional {
+		result.Conditional++
+		if res.contentLength > 0 {
+			result.CondSize += res.contentLength
+		}
+		if res.notModified {
+			result.NotModified++
+			result.SavedSize += res.savedLength
+		}
+	}
+	if res.target != nil && res.target.name != "" {
+		result.addTargetValue(res.target.name, latencyKey(res.duration), 1)
+	}
+	if res.slow {
+		result.addSlowRequest(SlowRequest{Url: res.url, Duration: duration, StatusCode: res.statusCode})
+	}
+	for name, value := range res.captured {
+		result.addHeaderValue(name, value, latencyKey(res.duration), 1)
+	}
+}
+
+// addTargetValue adds c responses of the duration bucket to the target pool.
+func (result *StressResult) addTargetValue(target, duration string, c int64) {
+	if result.TargetDist == nil {
+		result.TargetDist = make(map[string]int64)
+		result.TargetLats = make(map[string]map[string]int64)
+	}
+	if result.TargetLats[target] == nil {
+		result.TargetLats[target] = make(map[string]int64)
+	}
+	result.TargetDist[target] += c
+	result.TargetLats[target][duration] += c
+}
+
+// addSlowRequest keeps slow in SlowRequests if it is one of the SLOW_KEEP
+// slowest.
+func (result *StressResult) addSlowRequest(slow SlowRequest) {
+	i := sort.Search(len(result.SlowRequests), func(i int) bool {
+		return result.SlowRequests[i].Duration < slow.Duration
+	})
+	if i >= SLOW_KEEP {
+		return
+	}
+	result.SlowRequests = append(result.SlowRequests, SlowRequest{})
+	copy(result.SlowRequests[i+1:], result.SlowRequests[i:])
+	result.SlowRequests[i] = slow
+	if len(result.SlowRequests) > SLOW_KEEP {
+		result.SlowRequests = result.SlowRequests[:SLOW_KEEP]
+	}
+}
+
+// addHeaderValue adds c responses of the duration bucket with value in the
+// name header.
+func (result *StressResult) addHeaderValue(name, value, duration string, c int64) {
+	if result.HeaderDist == nil {
+		result.HeaderDist = make(map[string]map[string]int64)
+		result.HeaderLats = make(map[string]map[string]map[string]int64)
+	}
+	if result.HeaderDist[name] == nil {
+		result.HeaderDist[name] = make(map[string]int64)
+		result.HeaderLats[name] = make(map[string]map[string]int64)
+	}
+	if result.HeaderLats[name][value] == nil {
+		result.HeaderLats[name][value] = make(map[string]int64)
+	}
+	result.HeaderDist[name][value] += c
+	result.HeaderLats[name][value][duration] += c
+	result.foldHeaderValues(name)
+}
+
+// cardinality returns the max number of ErrorDist categories and of values
+// per HeaderDist name.
+func (result *StressResult) cardinality() int {
+	if result.MaxCardinality > 0 {
+		return result.MaxCardinality
+	}
+	return RESULT_CARDINALITY
+}
+
+// foldErrors merges the less frequent half of ErrorDist into RESULT_OTHER
+// once it exceeds the cardinality, e.g. errors embedding a changing port
+// would grow it for as long as a soak runs.
+func (result *StressResult) foldErrors() {
+	limit := result.cardinality()
+	if len(result.ErrorDist) <= limit {
+		return
+	}
+	keys := make([]string, 0, len(result.ErrorDist))
+	for key := range result.ErrorDist {
+		keys = append(keys, key)
+	}
+	for _, key := range leastFrequent(keys, func(key string) int64 { return int64(result.ErrorDist[key]) }, limit/2) {
+		result.ErrorDist[RESULT_OTHER] += result.ErrorDist[key]
+		delete(result.ErrorDist, key)
+	}
+}
+
+// foldHeaderValues merges the less frequent half of the values of a
+// -capture-header into RESULT_OTHER once they exceed the cardinality.
+func (result *StressResult) foldHeaderValues(name string) {
+	dist, lats := result.HeaderDist[name], result.HeaderLats[name]
+	limit := result.cardinality()
+	if len(dist) <= limit {
+		return
+	}
+	keys := make([]string, 0, len(dist))
+	for key := range dist {
+		keys = append(keys, key)
+	}
+	if lats[RESULT_OTHER] == nil {
+		lats[RESULT_OTHER] = make(map[string]int64)
+	}
+	for _, key := range leastFrequent(keys, func(key string) int64 { return dist[key] }, limit/2) {
+		dist[RESULT_OTHER] += dist[key]
+		for duration, c := range lats[key] {
+			lats[RESULT_OTHER][duration] += c
+		}
+		delete(dist, key)
+		delete(lats, key)
+	}
+}
+
+// leastFrequent returns the keys but the keep most frequent ones and
+// RESULT_OTHER.
+func leastFrequent(keys []string, count func(string) int64, keep int) []string {
+	sort.Slice(keys, func(i, j int) bool {
+		if count(keys[i]) != count(keys[j]) {
+			return count(keys[i]) > count(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	rest := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if i >= keep && key != RESULT_OTHER {
+			rest = append(rest, key)
+		}
+	}
+	return rest
+}
+
+// Combine merges resultList into result, the shards of a worker or the
+// results of the -W workers, and derives the rates from the merged counts.
+func (result *StressResult) Combine(resultList ...*StressResult) {
+	result.rdLock.Lock()
+	defer result.rdLock.Unlock()
+
+	for _, v := range resultList {
+		if result.Slowest < v.Slowest {
+			result.Slowest = v.Slowest
+		}
+		if result.Fastest > v.Fastest {
+			result.Fastest = v.Fastest
+		}
+		result.LatsTotal += v.LatsTotal
+		result.Attempted += v.Attempted
+		result.InFlight += v.InFlight
+		result.Drained += v.Drained
+		result.DrainFailed += v.DrainFailed
+		// The -W workers run in parallel, the run lasts as long as the
+		// slowest of them.
+		if result.Duration < v.Duration {
+			result.Duration = v.Duration
+		}
+		result.AvgTotal += v.AvgTotal
+		result.LatsSquare += v.LatsSquare
+		for lats, c := range v.CorrectedLats {
+			if result.CorrectedLats == nil {
+				result.CorrectedLats = make(map[string]int64, len(v.CorrectedLats))
+			}
+			result.CorrectedLats[lats] += c
+		}
+		result.CorrectedTotal += v.CorrectedTotal
+		for second, c := range v.Timeline {
+			if result.Timeline == nil {
+				result.Timeline = make(map[int64]int64, len(v.Timeline))
+			}
+			result.Timeline[second] += c
+		}
+		for second, c := range v.TimelineLats {
+			if result.TimelineLats == nil {
+				result.TimelineLats = make(map[int64]int64, len(v.TimelineLats))
+			}
+			result.TimelineLats[second] += c
+		}
+		for second, c := range v.BusyTimeline {
+			if result.BusyTimeline == nil {
+				result.BusyTimeline = make(map[int64]int64, len(v.BusyTimeline))
+			}
+			result.BusyTimeline[second] += c
+		}
+		result.Connections += v.Connections
+		for second, c := range v.BurstTimeline {
+			if result.BurstTimeline == nil {
+				result.BurstTimeline = make(map[int64]int64, len(v.BurstTimeline))
+			}
+			result.BurstTimeline[second] += c
+		}
+		for code, c := range v.StatusCodeDist {
+			result.StatusCodeDist[code] += c
+		}
+		result.SizeTotal += v.SizeTotal
+		result.SentTotal += v.SentTotal
+		result.BodyRawTotal += v.BodyRawTotal
+		result.BodyZipTotal += v.BodyZipTotal
+		result.WireTotal += v.WireTotal
+		result.RecvConns += v.RecvConns
+		result.ThinkWorkers += v.ThinkWorkers
+		result.TargetQps += v.TargetQps
+		result.QuicConns += v.QuicConns
+		result.Quic0RTTConns += v.Quic0RTTConns
+		result.H2Conns += v.H2Conns
+		result.H2PeakStreams += v.H2PeakStreams
+		result.NewConns += v.NewConns
+		result.Reconnects += v.Reconnects
+		result.ReconnectTotal += v.ReconnectTotal
+		result.ThrottledTotal += v.ThrottledTotal
+		result.BackoffTotal += v.BackoffTotal
+		result.TimedOutTotal += v.TimedOutTotal
+		result.Bottlenecks = append(result.Bottlenecks, v.Bottlenecks...)
+		if result.Timeout < v.Timeout {
+			result.Timeout = v.Timeout
+		}
+		result.Corrupt += v.Corrupt
+		result.EchoMismatch += v.EchoMismatch
+		result.LengthMismatch += v.LengthMismatch
+		result.LengthDeclared += v.LengthDeclared
+		result.LengthReceived += v.LengthReceived
+		result.OAuth2Failures += v.OAuth2Failures
+		result.Conditional += v.Conditional
+		result.NotModified += v.NotModified
+		result.CondSize += v.CondSize
+		result.SavedSize += v.SavedSize
+		result.ReusedConns += v.ReusedConns
+		for code, c := range v.ErrorDist {
+			result.ErrorDist[code] += c
+		}
+		if result.MaxCardinality < v.MaxCardinality {
+			result.MaxCardinality = v.MaxCardinality
+		}
+		result.foldErrors()
+		if result.HttpType == "" {
+			result.HttpType = v.HttpType
+		}
+		if result.Encoding == "" {
+			result.Encoding = v.Encoding
+		}
+		if result.Url == "" {
+			result.Url = v.Url
+		}
+		result.Concurrency += v.Concurrency
+		if result.ConnectLats == nil && v.ConnectLats != nil {
+			result.ServerSoftware, result.DocumentLength = v.ServerSoftware, v.DocumentLength
+			result.ConnectLats = make(map[string]int64, len(v.ConnectLats))
+			result.ProcessingLats = make(map[string]int64, len(v.ProcessingLats))
+			result.WaitingLats = make(map[string]int64, len(v.WaitingLats))
+		}
+		for lats, c := range v.ConnectLats {
+			result.ConnectLats[lats] += c
+		}
+		for lats, c := range v.ProcessingLats {
+			result.ProcessingLats[lats] += c
+		}
+		for lats, c := range v.WaitingLats {
+			result.WaitingLats[lats] += c
+		}
+		result.StreamTotal += v.StreamTotal
+		result.StreamChunks += v.StreamChunks
+		result.StreamGaps += v.StreamGaps
+		if result.StreamTtfcLats == nil && v.StreamTtfcLats != nil {
+			result.StreamTtfcLats = make(map[string]int64, len(v.StreamTtfcLats))
+			result.StreamGapLats = make(map[string]int64, len(v.StreamGapLats))
+			result.StreamLats = make(map[string]int64, len(v.StreamLats))
+		}
+		for lats, c := range v.StreamTtfcLats {
+			result.StreamTtfcLats[lats] += c
+		}
+		for lats, c := range v.StreamGapLats {
+			result.StreamGapLats[lats] += c
+		}
+		for lats, c := range v.StreamLats {
+			result.StreamLats[lats] += c
+		}
+		for lats, c := range v.RequestLats {
+			if result.RequestLats == nil {
+				result.RequestLats = make(map[string]int64, len(v.RequestLats))
+			}
+			result.RequestLats[lats] += c
+		}
+		result.RequestTotal += v.RequestTotal
+		for proto, c := range v.ProtoDist {
+			if result.ProtoDist == nil {
+				result.ProtoDist = make(map[string]int64, len(v.ProtoDist))
+			}
+			result.ProtoDist[proto] += c
+		}
+		for lats, c := range v.Lats {
+			result.Lats[lats] += c
+		}
+		for target, lats := range v.TargetLats {
+			for duration, c := range lats {
+				result.addTargetValue(target, duration, c)
+			}
+		}
+		for _, slow := range v.SlowRequests {
+			result.addSlowRequest(slow)
+		}
+		for name, values := range v.HeaderLats {
+			for value, lats := range values {
+				for duration, c := range lats {
+					result.addHeaderValue(name, value, duration, c)
+				}
+			}
+		}
+		if len(v.SizeDist) > 0 {
+			if len(result.SizeDist) == 0 || result.SizeMin > v.SizeMin {
+				result.SizeMin = v.SizeMin
+			}
+			if result.SizeMax < v.SizeMax {
+				result.SizeMax = v.SizeMax
+			}
+			if result.SizeDist == nil {
+				result.SizeDist = make(map[int]int64, len(v.SizeDist))
+			}
+			for bucket, c := range v.SizeDist {
+				result.SizeDist[bucket] += c
+			}
+		}
+	}
+
+	if result.Duration > 0 {
+		result.Rps = int64((result.LatsTotal * SCALE_NUM * SCALE_NUM) / result.Duration)
+		result.SentPerSec = float64(result.SentTotal) * SCALE_NUM / float64(result.Duration)
+	}
+
+	result.computePeakRps()
+
+	if result.LatsTotal > 0 {
+		result.Average = result.AvgTotal / result.LatsTotal
+		mean := float64(result.AvgTotal) / float64(result.LatsTotal)
+		if variance := result.LatsSquare/float64(result.LatsTotal) - mean*mean; variance > 0 {
+			result.StdDev = int64(math.Sqrt(variance))
+			if mean > 0 {
+				result.CV = math.Sqrt(variance) / mean
+			}
+		}
+	}
+}
+
+// computePeakRps derives the peak metrics from the merged Timeline, so
+// distributed workers are combined per wall clock second. A Timeline shorter
+// than 10 seconds has no PeakRps10s.
+func (result *StressResult) computePeakRps() {
+	if len(result.Timeline) == 0 {
+		return
+	}
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	for second := range result.Timeline {
+		if second < first {
+			first = second
+		}
+		if second > last {
+			last = second
+		}
+	}
+
+	const window = 10
+	result.PeakRps, result.PeakSecond, result.PeakRps10s = 0, 0, 0
+	var sum int64
+	for second := first; second <= last; second++ {
+		c := result.Timeline[second]
+		if c > result.PeakRps {
+			result.PeakRps, result.PeakSecond = c, second-first
+		}
+		sum += c
+		if second-first >= window {
+			sum -= result.Timeline[second-window]
+		}
+		if second-first+1 >= window {
+			if rps := float64(sum) / float64(window); rps > result.PeakRps10s {
+				result.PeakRps10s = rps
+			}
+		}
+	}
+}
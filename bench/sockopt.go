@@ -0,0 +1,25 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package bench
+
+import "syscall"
+
+// setSocketBuffers sets the SO_RCVBUF and SO_SNDBUF of a socket before it
+// connects, a size of 0 keeps the system default.
+func setSocketBuffers(c syscall.RawConn, rcvbuf, sndbuf int) error {
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		if rcvbuf > 0 {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf); err != nil {
+				return
+			}
+		}
+		if sndbuf > 0 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndbuf)
+		}
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
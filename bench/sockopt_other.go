@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package bench
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setSocketBuffers is not available on this platform, see sockopt.go.
+func setSocketBuffers(c syscall.RawConn, rcvbuf, sndbuf int) error {
+	return errors.New("-so-rcvbuf and -so-sndbuf are not supported on this platform")
+}
@@ -0,0 +1,3806 @@
+// Package bench is the load generator of http_bench, usable without the
+// command line:
+//
+//	worker := bench.New(bench.StressParameters{
+//		Urls:            []string{"http://127.0.0.1:8080/"},
+//		RequestMethod:   http.MethodGet,
+//		RequestHttpType: bench.TYPE_HTTP1,
+//		N:               1000,
+//		C:               10,
+//		Duration:        10,
+//		Timeout:         3000,
+//		Cmd:             bench.CMD_START,
+//	})
+//	result := worker.Run(ctx)
+//	result.Print(os.Stdout, 0)
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	gourl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+const (
+	CMD_START int = iota
+	CMD_STOP
+	CMD_METRICS
+	CMD_KEEPALIVE
+
+	SCALE_NUM = 10000
+
+	HTTPTR_NUM = 20
+
+	TYPE_HTTP1 = "http1"
+	TYPE_HTTP2 = "http2"
+	TYPE_HTTP3 = "http3"
+	TYPE_WS    = "ws"
+	TYPE_TCP   = "tcp"
+
+	BODY_ORDER_RANDOM     = "random"
+	BODY_ORDER_SEQUENTIAL = "sequential"
+
+	COMPRESS_GZIP = "gzip"
+
+	ACCEPT_GZIP     = "gzip"
+	ACCEPT_BR       = "br" // Asked for but never decoded, there is no brotli decoder
+	ACCEPT_IDENTITY = "identity"
+	ACCEPT_NONE     = "none" // No Accept-Encoding header
+
+	TRACE_W3C = "w3c"
+	TRACE_B3  = "b3"
+
+	HEADER_ABSENT = "(absent)" // -capture-header value of the responses without the header
+
+	VALIDATORS_KEEP = 1000 // Urls with an ETag or Last-Modified kept per worker for -conditional-requests
+
+	OUTPUT_CSV  = "csv"
+	OUTPUT_JSON = "json"
+	OUTPUT_AB   = "ab" // The report of Apache Bench
+
+	RATE_CONSTANT = "constant"
+	RATE_POISSON  = "poisson"
+
+	STOP_REQUESTS = "requests completed"
+	STOP_DURATION = "duration reached"
+	STOP_STOPPED  = "stopped"
+	STOP_ERROR    = "error"
+	STOP_DEADLINE = "coordinator deadline reached"
+	STOP_LOST     = "coordinator keepalives missed"
+
+	SLOW_KEEP = 20 // Slowest requests kept in SlowRequests
+
+	RESULT_CARDINALITY = 1000      // Default cap of the ErrorDist categories and of the values of each -capture-header
+	RESULT_OTHER       = "(other)" // Of the less frequent categories and values past the cap
+
+	LAT_EXACT_MAX = 10 * time.Second // Latencies are kept to the millisecond below, to 4 significant digits above
+
+	BEARER_RELOAD = time.Second      // How often -bearer-file is checked for a new token
+	OAUTH2_MARGIN = 30 * time.Second // OAuth2 tokens are refreshed that long before they expire
+	OAUTH2_RETRY  = time.Second      // Between the attempts of a failed OAuth2 token refresh
+	REDACTED      = "(redacted)"     // Printed instead of the secrets of StressParameters
+
+	READY_INTERVAL = 250 * time.Millisecond // Between the -wait-ready probes
+
+	TARGET_DEFAULT = "(default)" // -target-concurrency pool of the unmatched urls
+
+	EXIT_OK        = 0 // Run completed within -max-error-rate
+	EXIT_USAGE     = 1 // Invalid flags
+	EXIT_ERRORS    = 2 // Error rate above -max-error-rate or stopped by an error
+	EXIT_INTERNAL  = 3 // No results, e.g. every -W worker failed
+	EXIT_SLA       = 4 // A -regression check against -baseline failed
+	EXIT_NOT_READY = 5 // The target did not become ready within -wait-ready
+
+	WS_MODE_PERSISTENT = "persistent"
+	WS_MODE_RECONNECT  = "reconnect"
+
+	VALIDATE_STRICT = "strict" // Every rendered url, see ValidateUrls
+	VALIDATE_ONCE   = "once"
+	VALIDATE_OFF    = "off"
+
+	PORT_BACKOFF_MIN    = 10 * time.Millisecond // First pause of a worker after a port_exhaustion error
+	PORT_BACKOFF_MAX    = time.Second           // The pause doubles up to it while the errors go on
+	LOCAL_PORT_ATTEMPTS = 16                    // Ports of -local-port-range tried per dial while they are in use
+	RETRY_AFTER_MAX     = time.Minute           // Longest Retry-After pause when RetryAfterMax is 0
+	BODY_DRAIN_MAX      = 256 << 10             // Unread bytes of an http1 response drained past MaxBodyRead to reuse its connection
+
+	VERBOSE_TRACE = 0
+	VERBOSE_DEBUG = 1
+	VERBOSE_INFO  = 2
+	VERBOSE_ERROR = 3
+
+	INT_MAX = int(^uint(0) >> 1)
+	INT_MIN = ^INT_MAX
+)
+
+var (
+	ErrInitWsClient   = errors.New("init ws client error")
+	ErrInitTcpClient  = errors.New("init tcp client error")
+	ErrInitHttpClient = errors.New("init http client error")
+	ErrUrl            = errors.New("check url error")
+	ErrInvalidUrl     = errors.New("invalid_url")
+	ErrBadRequest     = errors.New("bad_request_construction")
+	ErrTemplate       = errors.New("template_error")
+	ErrStreamStall    = errors.New("stream_stall")
+	ErrReconnect      = errors.New("recreate client error")
+	ErrFormFile       = errors.New("form file must be name=@path[;type=content-type]")
+	ErrCorrupt        = errors.New("response body sha256 mismatch")
+	ErrEchoMismatch   = errors.New("request id echo mismatch")
+	ErrBearerEmpty    = errors.New("bearer token file is empty")
+	ErrNotReady       = errors.New("target not ready")
+	ErrOAuth2Token    = errors.New("oauth2 token response without access_token")
+
+	ErrConnectTimeout  = errors.New("connect timeout")
+	ErrTlsTimeout      = errors.New("tls handshake timeout")
+	ErrResponseTimeout = errors.New("response header timeout")
+	ErrRequestTimeout  = errors.New("request timeout") // The whole exchange outlasted Timeout
+	ErrPortExhaustion  = errors.New("port_exhaustion")
+	ErrDns             = errors.New("dns lookup failed")
+	ErrDnsTimeout      = errors.New("dns timeout")
+	ErrLocalAddr       = errors.New("local address must be an IP")
+
+	ErrQuicHandshakeTimeout   = errors.New("quic handshake timeout")
+	ErrQuicIdleTimeout        = errors.New("quic idle timeout")
+	ErrQuicVersionNegotiation = errors.New("quic version negotiation failed")
+	ErrQuicStatelessReset     = errors.New("quic stateless reset")
+
+	gzipWriterPool sync.Pool
+	gzipReaderPool sync.Pool
+	bufferPool     sync.Pool
+
+	quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+)
+
+// TargetGroup is one path prefix of -target-concurrency and the number of
+// workers dedicated to its urls.
+type TargetGroup struct {
+	Prefix string `json:"prefix"`
+	C      int    `json:"c"`
+}
+
+// QueryParam is one -query parameter, set with a random value on every url:
+// an integer in [Min, Max], or one of Choices if there are any.
+type QueryParam struct {
+	Name    string   `json:"name"`
+	Min     int64    `json:"min"`
+	Max     int64    `json:"max"`
+	Choices []string `json:"choices"`
+}
+
+// pair returns the escaped name=value of a new random value.
+func (q *QueryParam) pair() string {
+	var value string
+	if len(q.Choices) > 0 {
+		value = q.Choices[fnSrc.Int63()%int64(len(q.Choices))]
+	} else {
+		value = strconv.FormatInt(q.Min+fnSrc.Int63()%(q.Max-q.Min+1), 10)
+	}
+	return gourl.QueryEscape(q.Name) + "=" + gourl.QueryEscape(value)
+}
+
+// ReplayEntry is one request of an access log, see Replay.
+type ReplayEntry struct {
+	Method string `json:"method"`
+	Url    int    `json:"url"`    // Index into Urls
+	Offset int64  `json:"offset"` // Ms from the first logged request
+}
+
+type StressParameters struct {
+	SequenceId         int64               `json:"sequence_id"`         // Sequence
+	Cmd                int                 `json:"cmd"`                 // Commands
+	RequestMethod      string              `json:"request_method"`      // Request Method.
+	RequestBody        string              `json:"request_body"`        // Request Body.
+	RequestBodies      []string            `json:"request_bodies"`      // Request Bodies, one of them is selected per request instead of RequestBody.
+	BodyOrder          string              `json:"body_order"`          // BodyOrder selects RequestBodies at random or sequentially.
+	RequestScriptBody  string              `json:"request_script_body"` // Request Script Body.
+	RequestHttpType    string              `json:"request_httptype"`    // Request HTTP Type
+	N                  int                 `json:"n"`                   // N is the total number of requests to make.
+	C                  int                 `json:"c"`                   // C is the concurrency level, the number of concurrent workers to run.
+	Duration           int64               `json:"duration"`            // D is the duration for stress test, 0 means no time limit
+	Drain              int64               `json:"drain"`               // Drain in ms waits for the requests in flight when Duration expires, 0 aborts them.
+	Timeout            int                 `json:"timeout"`             // Timeout in ms.
+	ConnectTimeout     int64               `json:"connect_timeout"`     // ConnectTimeout in ms, 0 means Timeout.
+	TlsTimeout         int64               `json:"tls_timeout"`         // TlsTimeout in ms, 0 means Timeout.
+	ResponseTimeout    int64               `json:"response_timeout"`    // ResponseTimeout in ms to wait for the headers, 0 means only Timeout applies.
+	ValidateUrls       string              `json:"validate_urls"`       // VALIDATE_STRICT, VALIDATE_ONCE or VALIDATE_OFF, empty means once.
+	TcpDelay           bool                `json:"tcp_delay"`           // TcpDelay turns TCP_NODELAY off, so Nagle's algorithm batches small writes.
+	SoRcvbuf           int                 `json:"so_rcvbuf"`           // SoRcvbuf is the SO_RCVBUF size of every socket, 0 keeps the system default.
+	SoSndbuf           int                 `json:"so_sndbuf"`           // SoSndbuf is the SO_SNDBUF size of every socket, 0 keeps the system default.
+	LocalAddrs         []string            `json:"local_addrs"`         // LocalAddrs are the source IPs the connections rotate through, empty lets the system pick.
+	LocalPortMin       int                 `json:"local_port_min"`      // LocalPortMin and LocalPortMax bound the source ports, 0 lets the system pick.
+	LocalPortMax       int                 `json:"local_port_max"`
+	DnsServer          string              `json:"dns_server"`          // DnsServer is the host:port of the resolver of every dial, empty for the system one.
+	DnsTimeout         int64               `json:"dns_timeout"`         // DnsTimeout in ms of every lookup, 0 means the resolver default.
+	Qps                int                 `json:"qps"`                 // Qps is the rate limit.
+	DisableCompression bool                `json:"disable_compression"` // DisableCompression is an option to disable compression in response
+	AcceptEncoding     string              `json:"accept_encoding"`     // AcceptEncoding is one of the ACCEPT_* modes, empty means gzip unless DisableCompression.
+	NoDecompress       bool                `json:"no_decompress"`       // NoDecompress keeps gzip responses compressed, the body size is the bytes on the wire.
+	DisableKeepAlives  bool                `json:"disable_keepalives"`  // DisableKeepAlives is an option to prevents re-use of TCP connections between different HTTP requests
+	AuthUsername       string              `json:"auth_username"`       // Basic authentication, username:password.
+	AuthPassword       string              `json:"auth_password"`
+	Headers            map[string][]string `json:"headers"`      // Custom HTTP header.
+	HeaderPools        map[string][]string `json:"header_pools"` // HeaderPools holds the lines of -user-agent-file and -H-random, one picked per request.
+	Urls               []string            `json:"urls"`
+	UrlMethods         []string            `json:"url_methods"`          // UrlMethods is the method per Urls entry from -url-file, empty uses RequestMethod.
+	UrlHosts           []string            `json:"url_hosts"`            // UrlHosts is the Host header per Urls entry from -url-file, empty uses the url host.
+	UrlServerNames     []string            `json:"url_server_names"`     // UrlServerNames is the TLS server name per Urls entry from -url-file, empty uses the url host.
+	Output             string              `json:"output"`               // Output represents the output type. If "csv" is provided, the output will be dumped as a csv stream.
+	WsMode             string              `json:"ws_mode"`              // WsMode is persistent (one connection per worker) or reconnect (one connection per request).
+	WsRecvOnly         bool                `json:"ws_recv_only"`         // WsRecvOnly sends the body once as a subscribe message and then only reads.
+	TcpReadBytes       int                 `json:"tcp_read_bytes"`       // TcpReadBytes is the fixed number of bytes read back per tcp request.
+	TcpReadUntil       string              `json:"tcp_read_until"`       // TcpReadUntil reads back until the delimiter per tcp request.
+	TcpReconnect       bool                `json:"tcp_reconnect"`        // TcpReconnect dials a new tcp connection on every request.
+	Quic0RTT           bool                `json:"quic_0rtt"`            // Quic0RTT resumes QUIC sessions and sends GET requests as 0-RTT.
+	QuicIdleTimeout    int64               `json:"quic_idle_timeout"`    // QuicIdleTimeout in ms, 0 means the quic-go default.
+	QuicKeepAlive      int64               `json:"quic_keepalive"`       // QuicKeepAlive period in ms, 0 disables keep-alive.
+	QuicMaxStreams     int64               `json:"quic_max_streams"`     // QuicMaxStreams is the max number of concurrent incoming streams.
+	QuicDatagrams      bool                `json:"quic_datagrams"`       // QuicDatagrams enables the QUIC datagram extension.
+	H2Conns            int                 `json:"h2_conns"`             // H2Conns is the number of http2 connections shared by all workers, 0 means one per worker.
+	MaxConns           int                 `json:"max_conns"`            // MaxConns is the http1 MaxConnsPerHost, 0 means C.
+	MaxIdleConns       int                 `json:"max_idle_conns"`       // MaxIdleConns is the http1 MaxIdleConns and MaxIdleConnsPerHost, 0 means C.
+	IdleConnTimeout    int64               `json:"idle_conn_timeout"`    // IdleConnTimeout in ms, 0 means 90s.
+	FormFields         []string            `json:"form_fields"`          // FormFields are multipart name=value text fields, the value is a template.
+	FormFiles          []string            `json:"form_files"`           // FormFiles are multipart name=@path[;type=content-type] file fields.
+	BodyStream         string              `json:"body_stream"`          // BodyStream is a file streamed as the request body without templating.
+	CompressBody       string              `json:"compress_body"`        // CompressBody is the request body Content-Encoding, only gzip is supported.
+	MaxBodyRead        int64               `json:"max_body_read"`        // MaxBodyRead caps the response bytes read per request, 0 reads all.
+	SkipBody           bool                `json:"skip_body"`            // SkipBody does not read the response body at all.
+	LengthTolerance    int64               `json:"length_tolerance"`     // LengthTolerance in bytes a fully read body may differ from its Content-Length.
+	StreamMetrics      bool                `json:"stream_metrics"`       // StreamMetrics reads the response body chunk by chunk and records its cadence.
+	RespectRetryAfter  bool                `json:"respect_retry_after"`  // RespectRetryAfter pauses a worker for the Retry-After of its 429 and 503 responses.
+	RetryAfterMax      int64               `json:"retry_after_max"`      // RetryAfterMax in ms caps the RespectRetryAfter pauses, 0 means RETRY_AFTER_MAX.
+	StreamIdleTimeout  int64               `json:"stream_idle_timeout"`  // StreamIdleTimeout in ms fails a StreamMetrics response without a chunk for that long, 0 means none.
+	SaveResponses      string              `json:"save_responses"`       // SaveResponses is the directory non-2xx responses are written to.
+	SaveResponsesCount int                 `json:"save_responses_count"` // SaveResponsesCount caps the number of saved responses.
+	VerifySha256       string              `json:"verify_sha256"`        // VerifySha256 is the expected hex sha256 of every response body.
+	VerifySha256Header string              `json:"verify_sha256_header"` // VerifySha256Header names the response header holding the expected hex sha256.
+	Think              int64               `json:"think"`                // Think is the fixed pause in ms after every request.
+	ThinkMin           int64               `json:"think_min"`            // ThinkMin and ThinkMax in ms bound a random pause added to Think.
+	ThinkMax           int64               `json:"think_max"`
+	RequestsPerConn    int                 `json:"requests_per_conn"`  // RequestsPerConn recreates the client of a worker after that many requests, 0 never.
+	DnsRefresh         int64               `json:"dns_refresh"`        // DnsRefresh in ms re-resolves hosts and closes idle connections periodically, 0 never.
+	SlowThreshold      int64               `json:"slow_threshold"`     // SlowThreshold in ms logs every slower request, 0 never.
+	SlowLogRate        int                 `json:"slow_log_rate"`      // SlowLogRate is the max slow request lines logged per second.
+	TargetConcurrency  []TargetGroup       `json:"target_concurrency"` // TargetConcurrency dedicates workers to the urls of each path prefix.
+	Replay             []ReplayEntry       `json:"replay"`             // Replay are the requests of an access log, sent instead of random Urls.
+	ReplaySpeed        float64             `json:"replay_speed"`       // ReplaySpeed sends Replay in order at the logged gaps divided by it, 0 picks random entries.
+	TracePropagation   string              `json:"trace_propagation"`  // TracePropagation adds a w3c traceparent or b3 header with a new trace ID to every request.
+	RequestIdHeader    string              `json:"request_id_header"`  // RequestIdHeader is sent with a new UUID on every request and checked when echoed.
+	CacheBust          string              `json:"cache_bust"`         // CacheBust is a query parameter added with a random value to every url, empty for none.
+	Query              []QueryParam        `json:"query"`              // Query are the -query parameters set with random values on every url, after the url functions.
+	NoCacheHeaders     bool                `json:"no_cache_headers"`   // NoCacheHeaders sends Cache-Control: no-cache and Pragma: no-cache.
+	Conditional        bool                `json:"conditional"`        // Conditional sends the ETag and Last-Modified of the previous response of each url back as If-None-Match and If-Modified-Since.
+	CaptureHeaders     []string            `json:"capture_headers"`    // CaptureHeaders are the response headers counted by value in HeaderDist.
+	RateDistribution   string              `json:"rate_distribution"`  // RateDistribution of the gaps between -q requests, constant or poisson.
+	QpsGlobal          string              `json:"qps_global"`         // QpsGlobal is the coordinator token endpoint address enforcing Qps*C across all workers.
+	BurstRate          int                 `json:"burst_rate"`         // BurstRate replaces Qps for the last BurstDuration ms of every BurstInterval ms.
+	BurstDuration      int64               `json:"burst_duration"`
+	BurstInterval      int64               `json:"burst_interval"`
+	Bearer             string              `json:"bearer"`           // Bearer is the token sent as Authorization: Bearer on every request.
+	BearerFile         string              `json:"bearer_file"`      // BearerFile holds the token instead of Bearer, it is read again when it changes.
+	OAuth2TokenUrl     string              `json:"oauth2_token_url"` // OAuth2TokenUrl issues the Bearer tokens with the client credentials grant.
+	OAuth2ClientId     string              `json:"oauth2_client_id"` // OAuth2ClientId and OAuth2ClientSecret authenticate to OAuth2TokenUrl.
+	OAuth2ClientSecret string              `json:"oauth2_client_secret"`
+	OAuth2Scopes       []string            `json:"oauth2_scopes"`        // OAuth2Scopes are requested with every token.
+	MaxCardinality     int                 `json:"max_cardinality"`      // MaxCardinality caps ErrorDist and every HeaderDist, 0 means RESULT_CARDINALITY.
+	WorkerIndex        int                 `json:"worker_index"`         // WorkerIndex is the index of this -W worker, see the workerIndex function.
+	WorkerCount        int                 `json:"worker_count"`         // WorkerCount is the number of -W workers, 0 means a single node run.
+	Workers            []string            `json:"workers"`              // Workers are the -W addrs the run fans out to, empty in the params sent to them.
+	Labels             map[string]string   `json:"labels"`               // Labels are the -label pairs identifying the run, copied into the result.
+	PerWorkerBreakdown bool                `json:"per_worker_breakdown"` // PerWorkerBreakdown keeps the share of every goroutine and -W worker in the result.
+	Deadline           int64               `json:"deadline"`             // Deadline in unix ms set by the coordinator, -W workers abort the run past it.
+	Keepalive          int64               `json:"keepalive"`            // Keepalive is the ms between the coordinator keepalives, -W workers abort the run after missing two.
+}
+
+// transportLimits returns the effective http1 connection pool limits, missing
+// values are derived from the concurrency level.
+func (p *StressParameters) transportLimits() (maxConns, maxIdleConns int, idleConnTimeout time.Duration) {
+	maxConns, maxIdleConns = p.MaxConns, p.MaxIdleConns
+	idleConnTimeout = time.Duration(p.IdleConnTimeout) * time.Millisecond
+	if maxConns <= 0 {
+		maxConns = p.C
+	}
+	if maxIdleConns <= 0 {
+		maxIdleConns = p.C
+	}
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = time.Duration(90) * time.Second
+	}
+	return
+}
+
+// timeouts returns the connect and TLS handshake timeouts, Timeout if not set,
+// and the response header timeout, 0 if not set.
+func (p *StressParameters) timeouts() (connect, handshake, response time.Duration) {
+	timeout := time.Duration(p.Timeout) * time.Millisecond
+	connect, handshake = timeout, timeout
+	if p.ConnectTimeout > 0 {
+		connect = time.Duration(p.ConnectTimeout) * time.Millisecond
+	}
+	if p.TlsTimeout > 0 {
+		handshake = time.Duration(p.TlsTimeout) * time.Millisecond
+	}
+	response = time.Duration(p.ResponseTimeout) * time.Millisecond
+	return
+}
+
+// requestDeadline is the deadline of a ws or tcp request started now, none
+// when Timeout is 0.
+func (p *StressParameters) requestDeadline() time.Time {
+	if p.Timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(p.Timeout) * time.Millisecond)
+}
+
+// CheckTargetConcurrency reports whether the TargetConcurrency groups match
+// the Urls and add up to C.
+func (p *StressParameters) CheckTargetConcurrency() error {
+	_, err := targetPools(p)
+	return err
+}
+
+// CheckBurst reports whether the schedule of BurstRate is valid, a
+// BurstDuration shorter than BurstInterval and longer than 0.
+func (p *StressParameters) CheckBurst() error {
+	if p.BurstRate > 0 && (p.BurstDuration <= 0 || p.BurstInterval <= p.BurstDuration) {
+		return fmt.Errorf("invalid burst: duration %dms must be positive and shorter than interval %dms",
+			p.BurstDuration, p.BurstInterval)
+	}
+	return nil
+}
+
+// CheckTemplates reports the first syntax error in the functions of the Urls,
+// the bodies, the FormFields and the Headers, with its position.
+func (p *StressParameters) CheckTemplates() error {
+	for _, v := range p.Urls {
+		if _, err := template.New("url").Funcs(fnMap).Parse(v); err != nil {
+			return err
+		}
+	}
+	for _, v := range append([]string{p.RequestBody}, p.RequestBodies...) {
+		if _, err := template.New("body").Funcs(fnMap).Parse(v); err != nil {
+			return err
+		}
+	}
+	for _, v := range p.FormFields {
+		if idx := strings.Index(v, "="); idx >= 0 {
+			if _, err := template.New("form " + v[:idx]).Funcs(fnMap).Parse(v[idx+1:]); err != nil {
+				return err
+			}
+		}
+	}
+	for name, values := range p.Headers {
+		for _, v := range values {
+			if !strings.Contains(v, "{{") {
+				continue
+			}
+			if _, err := template.New("header " + name).Funcs(fnMap).Parse(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// thinkTime returns the pause before the next iteration, 0 if none is set.
+func (p *StressParameters) thinkTime() time.Duration {
+	think := p.Think
+	if p.ThinkMax > 0 {
+		think += p.ThinkMin + rand.Int63n(p.ThinkMax-p.ThinkMin+1)
+	}
+	return time.Duration(think) * time.Millisecond
+}
+
+// thinkString describes the configured think time for the summary.
+func (p *StressParameters) thinkString() string {
+	var parts []string
+	if p.Think > 0 {
+		parts = append(parts, (time.Duration(p.Think) * time.Millisecond).String())
+	}
+	if p.ThinkMax > 0 {
+		parts = append(parts, fmt.Sprintf("random %v-%v",
+			time.Duration(p.ThinkMin)*time.Millisecond, time.Duration(p.ThinkMax)*time.Millisecond))
+	}
+	return strings.Join(parts, " + ")
+}
+
+// acceptEncoding returns the ACCEPT_* mode of the requests.
+func (p *StressParameters) acceptEncoding() string {
+	switch {
+	case p.AcceptEncoding != "":
+		return p.AcceptEncoding
+	case p.DisableCompression:
+		return ACCEPT_NONE
+	}
+	return ACCEPT_GZIP
+}
+
+// encodingMode describes the acceptEncoding mode for the summary, and
+// whether the bodies counted are decoded.
+func (p *StressParameters) encodingMode() string {
+	switch mode := p.acceptEncoding(); mode {
+	case ACCEPT_GZIP:
+		if p.NoDecompress {
+			return mode + ", not decompressed"
+		}
+		return mode + ", decompressed"
+	case ACCEPT_BR:
+		return mode + ", not decompressed"
+	default:
+		return mode
+	}
+}
+
+// String returns the parameters as indented json, with the secrets redacted.
+func (p *StressParameters) String() string {
+	redacted := *p
+	if redacted.Bearer != "" {
+		redacted.Bearer = REDACTED
+	}
+	if redacted.OAuth2ClientSecret != "" {
+		redacted.OAuth2ClientSecret = REDACTED
+	}
+	if redacted.AuthPassword != "" {
+		redacted.AuthPassword = REDACTED
+	}
+	if body, err := json.MarshalIndent(&redacted, "", "\t"); err != nil {
+		return err.Error()
+	} else {
+		return string(body)
+	}
+}
+
+type (
+	result struct {
+		err            error
+		statusCode     int
+		duration       time.Duration
+		contentLength  int64
+		end            time.Time // Completion time for the timeline
+		scheduled      time.Time // Intended send time under -q, see CorrectedLats
+		burst          bool      // Sent during a -burst window
+		gotConn        bool      // Connection info traced, see connReused
+		connReused     bool
+		connWait       time.Duration     // Time to get a new http connection, 0 if reused
+		gotConnAt      time.Time         // When the connection was ready to write the request
+		requestTime    time.Duration     // From gotConnAt to the response complete, the latency without connecting
+		reconnect      bool              // First request on a client recreated by -requests-per-conn
+		reconnectTime  time.Duration     // Time to recreate the client and connect
+		traceId        string            // Trace ID sent with -trace-propagation
+		requestId      string            // Value of the -request-id-header sent
+		echoMismatch   bool              // The response echoed another request id
+		captured       map[string]string // Values of the -capture-header response headers
+		url            string            // Rendered url, kept for -slow-threshold
+		slow           bool              // Slower than -slow-threshold
+		target         *targetPool       // Urls the worker sends to
+		replay         *ReplayEntry      // Access log request to send instead
+		sentLength     int64             // Uploaded body bytes, rendered or streamed, counted in SizeTotal
+		bodyRawLength  int64             // Request body bytes before and after -compress-body
+		bodyZipLength  int64
+		corrupt        bool          // Response body failed the sha256 verification
+		conditional    bool          // Sent with If-None-Match or If-Modified-Since
+		notModified    bool          // Answered 304 to a conditional request
+		savedLength    int64         // Body bytes of the cached response not downloaded again
+		wireLength     int64         // Response body bytes received, before decompression
+		lengthMismatch bool          // Body bytes received differ from the Content-Length, see LengthTolerance
+		declaredLength int64         // The Content-Length of a lengthMismatch response
+		throttled      bool          // A 429 or 503 with a Retry-After under RespectRetryAfter
+		backoff        time.Duration // The pause of the worker after the throttled response
+		streamed       bool          // Body read chunk by chunk under StreamMetrics
+		chunks         int64         // Reads returning body bytes
+		streamTtfc     time.Duration // From the request sent to the first chunk
+		streamGap      time.Duration // Mean gap between the chunks
+		streamDuration time.Duration // From the first to the last chunk
+		proto          string        // Negotiated protocol of an http response
+		phases         bool          // Traced for -o ab, see waiting and server
+		waiting        time.Duration // From the request written to the first response byte
+		server         string        // Server header of the response
+	}
+
+	// validator is the ETag and Last-Modified of a url for -conditional-requests.
+	validator struct {
+		etag, lastModified string
+		size               int64 // Body bytes of the response carrying them
+	}
+
+	formField struct {
+		name  string
+		value *template.Template
+	}
+
+	formFile struct {
+		name, path, contentType string
+	}
+
+	savedResponse struct {
+		method, url string
+		reqHeader   http.Header
+		reqBody     []byte
+		resp        *http.Response
+		respBody    []byte
+	}
+
+	// Options are the settings of a StressWorker which stay in this
+	// process, unlike the StressParameters also sent to -W workers.
+	Options struct {
+		Verbose int            // Lowest VERBOSE_* level logged
+		Quiet   bool           // No progress output and only VERBOSE_ERROR logs
+		Live    bool           // Snapshot also has the status codes, errors and recent latencies, see -ui
+		Log     *log.Logger    // Where the logs go
+		Proxy   *gourl.URL     // Proxy of the http1 requests, nil for none
+		RootCAs *x509.CertPool // Trusted roots of the http3 servers, nil for the system ones
+	}
+
+	StressWorker struct {
+		RequestParams            *StressParameters
+		Options                  Options
+		shards                   []*StressResult // Recorded by one worker each, combined when done
+		done                     chan struct{}   // Closed once all workers finished
+		resultList               []*StressResult
+		currentResult            *StressResult
+		totalTime                time.Duration
+		quicConns, quic0RTTConns int64
+		remaining, attempted     int64 // Requests left under -n and requests sent so far
+		completed                int64 // Responses recorded so far, for the interim metrics
+		stopped                  int32 // Set by Stop, read by every worker
+		stopReason               string
+		stopOnce                 sync.Once
+		lives                    atomic.Value    // []*liveStats of the shards with Options.Live
+		h2Clients                []*StressClient // Shared by all workers when H2Conns > 0
+		h2Next                   uint64
+		replayNext               int64          // Next Replay entry under ReplaySpeed
+		sockoptOnce              sync.Once      // Warns once if the socket options are not supported
+		templateOnce             sync.Once      // Logs the first function error only
+		portOnce                 sync.Once      // Logs the first port_exhaustion error only
+		badRequestOnce           sync.Once      // Logs the first bad_request_construction error only
+		requestErrOnce           sync.Once      // Logs the first timeout or connection error at VERBOSE_ERROR
+		localIPs                 []net.IP       // Parsed LocalAddrs
+		localNext                uint64         // Next source address of dial
+		replayStart              time.Time      // When the first Replay entry is sent
+		wg                       sync.WaitGroup // Wait some task finish
+		err                      error
+		bodyTemplate             *template.Template
+		urlTemplates             []*template.Template // One per Urls entry
+		bodyTemplates            []*template.Template // One per RequestBodies entry
+		bodyNext                 uint64
+		tokens                   chan struct{} // Request tokens granted by the -qps-global coordinator
+		schedule                 *rateSchedule // Shared -q and -burst rate of every connection
+		dnsCache                 *dnsCache     // Resolver of every dial under -dns-refresh
+		resolver                 *net.Resolver // Of -dns-server and -dns-timeout, nil for the system one
+		dnsLogged                sync.Map      // Hosts whose addresses were logged
+		dnsGeneration            uint64        // Incremented on every -dns-refresh tick
+		formFields               []formField
+		headerTemplates          []headerTemplate     // -H names with a function in any value
+		indexTemplates           []*template.Template // Templates calling goroutineIndex, iteration or globalRequest, cloned per worker goroutine
+		saveCh                   chan *savedResponse
+		saveCount                int64
+		formFiles                []formFile
+		ctx                      context.Context // Canceled by Abort, see requestContext
+		cancel                   context.CancelFunc
+		ctxOnce                  sync.Once
+		conns                    sync.Map   // Open ws and tcp connections, see trackConn
+		slowLock                 sync.Mutex // Guards the -slow-log-rate window
+		slowSecond               int64
+		slowLines, slowDropped   int
+		bearer                   atomic.Value // Authorization value of -bearer, -bearer-file or the OAuth2 token
+		bearerModTime            time.Time    // Of the -bearer-file last read
+		oauth2Paused             int32        // Set while the OAuth2 token expired and cannot be refreshed
+		oauth2Failures           int64
+		inFlight                 int64           // Requests in doClient
+		busyTimeline             map[int64]int64 // inFlight sampled every second by collectReport
+		bottlenecks              []string        // Of hostStats, set by collectReport when done
+		draining                 int32           // Set when Duration expired, see collectReport
+		cutoff                   int64           // Unix ns Duration expired at, 0 before
+		inFlightAtCutoff         int64
+		drained, drainFailed     int64 // The inFlightAtCutoff requests ended within Drain
+	}
+)
+
+// DefaultOptions logs the errors to stderr.
+func DefaultOptions() Options {
+	return Options{
+		Verbose: VERBOSE_ERROR,
+		Log:     log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds),
+	}
+}
+
+// New returns a worker for params with DefaultOptions, change its Options
+// before starting it.
+func New(params StressParameters) *StressWorker {
+	return &StressWorker{RequestParams: &params, Options: DefaultOptions()}
+}
+
+// Run runs the stress test and returns its result, canceling ctx stops it
+// and aborts the requests in flight.
+func (b *StressWorker) Run(ctx context.Context) *StressResult {
+	b.ctxOnce.Do(func() {
+		b.ctx, b.cancel = context.WithCancel(ctx)
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.SetStopReason(STOP_STOPPED)
+			b.Abort()
+		case <-done:
+		}
+	}()
+	b.Start()
+	return b.Wait()
+}
+
+func (b *StressWorker) Start() {
+	b.done = make(chan struct{})
+	b.resultList = make([]*StressResult, 0)
+	b.collectReport()
+	b.runWorkers()
+	b.logf(VERBOSE_INFO, "Worker finished and wait result\n")
+}
+
+// Stop stop stress worker and wait coroutine finish
+func (b *StressWorker) Stop(wait bool, err error) {
+	atomic.StoreInt32(&b.stopped, 1)
+	if err != nil {
+		b.err = err
+		b.SetStopReason(STOP_ERROR)
+	}
+	if wait {
+		b.wg.Wait()
+	}
+}
+
+// Err returns the error which stopped the worker, nil if none.
+func (b *StressWorker) Err() error {
+	return b.err
+}
+
+// logEnabled reports whether logf logs at level, check it before building
+// costly arguments.
+func (b *StressWorker) logEnabled(level int) bool {
+	return b.Options.Verbose <= level && (!b.Options.Quiet || level >= VERBOSE_ERROR)
+}
+
+// logf logs to Options.Log with the level, the format is only applied when
+// the level is enabled.
+func (b *StressWorker) logf(level int, format string, args ...interface{}) {
+	if !b.logEnabled(level) {
+		return
+	}
+
+	switch level {
+	case VERBOSE_TRACE:
+		b.Options.Log.Printf("[TRACE] "+format, args...)
+	case VERBOSE_DEBUG:
+		b.Options.Log.Printf("[DEBUG] "+format, args...)
+	case VERBOSE_INFO:
+		b.Options.Log.Printf("[INFO] "+format, args...)
+	default:
+		b.Options.Log.Printf("[ERROR] "+format, args...)
+	}
+}
+
+// requestContext returns the context of every request, canceled by Abort.
+func (b *StressWorker) requestContext() context.Context {
+	b.ctxOnce.Do(func() {
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+	})
+	return b.ctx
+}
+
+// Abort stops like Stop and also cancels the requests in flight, without
+// waiting for them to time out.
+func (b *StressWorker) Abort() {
+	b.requestContext()
+	b.cancel()
+	b.conns.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).SetDeadline(time.Now())
+		return true
+	})
+	b.Stop(false, nil)
+}
+
+// trackedConn is a ws or tcp connection, their reads take no context so
+// Abort expires the deadline of every open one instead.
+type trackedConn struct {
+	net.Conn
+	b *StressWorker
+}
+
+func (c *trackedConn) Close() error {
+	c.b.conns.Delete(c)
+	return c.Conn.Close()
+}
+
+// newDialer returns a dialer with the connect timeout and the -dns-server
+// resolver, which sets -so-rcvbuf and -so-sndbuf before the socket connects.
+func (b *StressWorker) newDialer(timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout, Resolver: b.resolver}
+	if b.RequestParams.SoRcvbuf > 0 || b.RequestParams.SoSndbuf > 0 {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if err := setSocketBuffers(c, b.RequestParams.SoRcvbuf, b.RequestParams.SoSndbuf); err != nil {
+				b.sockoptOnce.Do(func() {
+					b.logf(VERBOSE_ERROR, "Socket options err: %v, continuing without them\n", err)
+				})
+			}
+			return nil
+		}
+	}
+	return dialer
+}
+
+// dial connects through the -dns-refresh cache if any, from the next source
+// address of -local-addr and -local-port-range, and enables Nagle's algorithm
+// again under TcpDelay since Go disables it on every connection.
+func (b *StressWorker) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	attempts := 1
+	if b.RequestParams.LocalPortMax > 0 {
+		attempts = LOCAL_PORT_ATTEMPTS // Skip the ports still held by other sockets
+	}
+	for i := 0; i < attempts; i++ {
+		d := dialer
+		if local := b.localAddr(); local != nil {
+			withLocal := *dialer
+			withLocal.LocalAddr = local
+			d = &withLocal
+		}
+		if b.dnsCache != nil {
+			conn, err = b.dnsCache.dial(ctx, d, network, addr)
+		} else if b.resolver != nil {
+			conn, err = dialHost(ctx, d, network, addr, b.lookupHost)
+		} else {
+			conn, err = d.DialContext(ctx, network, addr)
+		}
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			break
+		}
+	}
+	if err == nil && b.RequestParams.TcpDelay {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetNoDelay(false)
+		}
+	}
+	return conn, err
+}
+
+// localAddr returns the next source address, every -local-addr IP in turn
+// with the ports of -local-port-range in turn, nil if neither is set.
+func (b *StressWorker) localAddr() *net.TCPAddr {
+	if len(b.localIPs) == 0 && b.RequestParams.LocalPortMax == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&b.localNext, 1) - 1
+	addr := &net.TCPAddr{}
+	if len(b.localIPs) > 0 {
+		addr.IP = b.localIPs[n%uint64(len(b.localIPs))]
+		n /= uint64(len(b.localIPs))
+	}
+	if b.RequestParams.LocalPortMax > 0 {
+		ports := uint64(b.RequestParams.LocalPortMax - b.RequestParams.LocalPortMin + 1)
+		addr.Port = b.RequestParams.LocalPortMin + int(n%ports)
+	}
+	return addr
+}
+
+// trackConn wraps the result of a dial so Abort unblocks its reads.
+func (b *StressWorker) trackConn(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	c := &trackedConn{Conn: conn, b: b}
+	b.conns.Store(c, struct{}{})
+	if b.requestContext().Err() != nil {
+		c.SetDeadline(time.Now()) // Aborted while dialing
+	}
+	return c, nil
+}
+
+// SetStopReason records why the run ended, only the first reason is kept.
+func (b *StressWorker) SetStopReason(reason string) {
+	b.stopOnce.Do(func() {
+		b.stopReason = reason
+	})
+}
+
+func (b *StressWorker) IsStop() bool {
+	return atomic.LoadInt32(&b.stopped) == 1
+}
+
+func (b *StressWorker) Append(result ...*StressResult) {
+	b.resultList = append(b.resultList, result...)
+}
+
+func (b *StressWorker) Wait() *StressResult {
+	b.wg.Wait()
+
+	if len(b.resultList) <= 0 {
+		b.logf(VERBOSE_ERROR, "Internal err: stress test result empty\n")
+		return nil
+	}
+
+	b.logf(VERBOSE_DEBUG, "resultList len: %d\n", len(b.resultList))
+	return CombineNodes(b.resultList, b.RequestParams.PerWorkerBreakdown && b.resultList[0].Node != "")
+}
+
+// CombineNodes combines the results of the -W workers or of the -url hosts
+// into the first one. With keep, Nodes holds a copy of each sorted by Node.
+func CombineNodes(resultList []*StressResult, keep bool) *StressResult {
+	var nodes []*StressResult
+	if keep {
+		// Copied before Combine merges the maps of the others into the first.
+		nodes = make([]*StressResult, len(resultList))
+		for i := range resultList {
+			nodes[i] = &StressResult{}
+			if data, err := resultList[i].Marshal(); err == nil {
+				json.Unmarshal(data, nodes[i])
+			}
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	}
+	resultList[0].Combine(resultList[1:]...)
+	if nodes != nil {
+		resultList[0].Node, resultList[0].Workers, resultList[0].Nodes = "", nil, nodes
+	}
+	return resultList[0]
+}
+
+// runWorker returns the client in use when it stops, -requests-per-conn
+// replaces the one it was given.
+func (b *StressWorker) runWorker(client *StressClient, shard *StressResult, target *targetPool) *StressClient {
+	var next time.Time
+	if b.schedule != nil {
+		next = b.schedule.start
+	}
+	var connRequests int
+	var reconnectTime time.Duration
+	var reconnected bool
+	var broken bool // The ws or tcp connection failed, redialed by the next request
+	var dnsGeneration uint64
+	var portBackoff time.Duration
+	var iteration int64
+
+	// random set seed
+	rand.Seed(time.Now().UnixNano())
+	rnd := rand.New(rand.NewSource(rand.Int63()))
+
+	for !b.IsStop() {
+		if atomic.LoadInt32(&b.oauth2Paused) == 1 {
+			time.Sleep(10 * time.Millisecond) // Until refreshOAuth2 got a token
+			continue
+		}
+		// Every worker takes from the shared quota so the total is exactly N.
+		if b.RequestParams.N > 0 && atomic.AddInt64(&b.remaining, -1) < 0 {
+			break
+		}
+		if b.tokens != nil && !b.takeToken() {
+			break
+		}
+		var replay *ReplayEntry
+		if len(b.RequestParams.Replay) > 0 {
+			if replay = b.nextReplay(rnd); replay == nil {
+				break // End of the access log
+			}
+		}
+		request := atomic.AddInt64(&b.attempted, 1) - 1
+
+		recycle := broken || b.RequestParams.RequestsPerConn > 0 && connRequests == b.RequestParams.RequestsPerConn
+		broken = false
+		if generation := atomic.LoadUint64(&b.dnsGeneration); generation != dnsGeneration {
+			// Idle http connections are redialed on the next request, the
+			// persistent ws and tcp connections are recreated.
+			dnsGeneration = generation
+			if client.httpClient != nil {
+				client.httpClient.CloseIdleConnections()
+				for _, named := range client.serverNames {
+					named.CloseIdleConnections()
+				}
+			} else if client.wsClient != nil || client.tcpClient != nil {
+				recycle = true
+			}
+		}
+		if recycle {
+			b.closeClient(client)
+			t := time.Now()
+			if client = b.getClient(client); client == nil {
+				b.Stop(false, ErrReconnect)
+				break
+			}
+			connRequests, reconnectTime, reconnected = 0, time.Since(t), true
+		}
+		connRequests++
+		if client.data != nil {
+			client.data.Iteration, client.data.GlobalRequest = iteration, request
+		}
+		iteration++
+
+		var res = &result{reconnect: reconnected, target: target, replay: replay}
+		if b.tokens != nil {
+			res.burst = b.schedule.inBurst(time.Now())
+		} else if b.schedule != nil {
+			// Requests are scheduled at a fixed rate, after a slow response
+			// the worker sends back to back until it catches up and the
+			// corrected latency counts the delay from the intended send time.
+			next = b.schedule.next(next, rnd)
+			res.scheduled, res.burst = next, b.schedule.inBurst(next)
+			if wait := time.Until(res.scheduled); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		var t = time.Now()
+
+		atomic.AddInt64(&b.inFlight, 1)
+		code, size, err := b.doClient(client, res)
+		atomic.AddInt64(&b.inFlight, -1)
+		if b.requestContext().Err() != nil {
+			break // Canceled by Abort, not a request error
+		}
+		if atomic.LoadInt32(&b.draining) == 1 {
+			// Sent before Duration expired, kept out of the stats of the run.
+			if err != nil {
+				atomic.AddInt64(&b.drainFailed, 1)
+			} else {
+				atomic.AddInt64(&b.drained, 1)
+			}
+			break
+		}
+		if err != nil {
+			if err == ErrInvalidUrl || errors.Is(err, ErrTemplate) || err == ErrStreamStall {
+				// Counted without a log line, a bad template would flood it.
+				shard.record(&result{err: classifyError(err)})
+				continue
+			}
+			if errors.Is(err, ErrBadRequest) {
+				shard.record(&result{err: ErrBadRequest})
+				b.badRequestOnce.Do(func() {
+					b.logf(VERBOSE_ERROR, "err: %v\n", err)
+				})
+				continue
+			}
+			if category := classifyError(err); category == ErrPortExhaustion {
+				// The local ports are held by TIME_WAIT sockets, the worker
+				// backs off instead of failing the run and flooding the log.
+				shard.record(&result{err: category})
+				b.portOnce.Do(func() {
+					b.logf(VERBOSE_ERROR, "err: %v, backing off while the local ports are exhausted\n", err)
+				})
+				if portBackoff *= 2; portBackoff < PORT_BACKOFF_MIN {
+					portBackoff = PORT_BACKOFF_MIN
+				} else if portBackoff > PORT_BACKOFF_MAX {
+					portBackoff = PORT_BACKOFF_MAX
+				}
+				b.pause(portBackoff)
+				continue
+			}
+			if isRequestFailure(err) {
+				// A timeout or a lost connection fails this request only,
+				// the worker goes on with the next one.
+				shard.record(&result{err: classifyError(err)})
+				level := VERBOSE_INFO
+				b.requestErrOnce.Do(func() { level = VERBOSE_ERROR })
+				b.logf(level, "err: %v%s\n", err, res.ids())
+				broken = client.wsClient != nil || client.tcpClient != nil
+				continue
+			}
+			b.logf(VERBOSE_ERROR, "err: %v%s\n", err, res.ids())
+			shard.record(&result{err: classifyError(err)})
+			b.Stop(false, err)
+			break
+		} else {
+			portBackoff = 0
+			res.statusCode = code
+			if res.echoMismatch {
+				b.logf(VERBOSE_INFO, "status code: %d, echo mismatch%s\n", code, res.ids())
+			} else if (res.traceId != "" || res.requestId != "") && (code < 200 || code > 299) {
+				b.logf(VERBOSE_INFO, "status code: %d%s\n", code, res.ids())
+			}
+			res.end = time.Now()
+			res.duration = res.end.Sub(t)
+			if !res.gotConnAt.IsZero() {
+				res.requestTime = res.end.Sub(res.gotConnAt)
+			}
+			res.contentLength = size
+			if b.RequestParams.SlowThreshold > 0 && res.duration >= time.Duration(b.RequestParams.SlowThreshold)*time.Millisecond {
+				res.slow = true
+				b.logSlow(res)
+			}
+			if reconnected {
+				// The dial of http clients happens in the first request.
+				res.reconnectTime = reconnectTime + res.connWait
+				reconnected = false
+			}
+			shard.record(res)
+			atomic.AddInt64(&b.completed, 1)
+		}
+
+		// Think time is not part of the latency, and shifts the -q schedule
+		// so the pause is not reported as coordinated omission.
+		if think := b.RequestParams.thinkTime(); think > 0 && !b.IsStop() {
+			time.Sleep(think)
+			next = next.Add(think)
+		}
+		// The throttled worker waits as asked, the pause is not latency either.
+		if res.backoff > 0 && !b.IsStop() {
+			shard.addBackoff(b.pause(res.backoff))
+			next = next.Add(res.backoff)
+		}
+	}
+	return client
+}
+
+// pause sleeps for d, returning early once the worker stops, and returns
+// how long it slept.
+func (b *StressWorker) pause(d time.Duration) time.Duration {
+	start := time.Now()
+	for wait := d; wait > 0 && !b.IsStop(); wait -= 100 * time.Millisecond {
+		if wait > 100*time.Millisecond {
+			time.Sleep(100 * time.Millisecond) // Check Stop during long pauses
+		} else {
+			time.Sleep(wait)
+		}
+	}
+	return time.Since(start)
+}
+
+// retryAfter parses a Retry-After header, delay seconds or an http date.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// reloadBearer reads -bearer-file again whenever it changes, so a token
+// rotated by an agent is used by the next requests.
+func (b *StressWorker) reloadBearer() {
+	ticker := time.NewTicker(BEARER_RELOAD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			if err := b.loadBearer(); err != nil {
+				b.logf(VERBOSE_ERROR, "Read bearer file err: %v\n", err)
+			}
+		}
+	}
+}
+
+// loadBearer reads the token of -bearer-file if the file changed since the
+// last read, an empty file keeps the previous token.
+func (b *StressWorker) loadBearer() error {
+	info, err := os.Stat(b.RequestParams.BearerFile)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(b.bearerModTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.RequestParams.BearerFile)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return ErrBearerEmpty
+	}
+	b.bearer.Store("Bearer " + token)
+	b.bearerModTime = info.ModTime()
+	return nil
+}
+
+// oauth2Token is the response of OAuth2TokenUrl.
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// WaitReady probes the first url with a GET every READY_INTERVAL until it
+// answers with status, or returns ErrNotReady with the last probe outcome
+// once window expires. Called before Start, the probes are part of no
+// result and do not count toward Duration. They go through the client of
+// the run with its headers and bearer token, so a target which requires
+// them is ready as soon as the run would succeed.
+func (b *StressWorker) WaitReady(ctx context.Context, window time.Duration, status int) error {
+	url := b.readyTemplate("READY", b.RequestParams.Urls[0])
+	b.resolver = b.newResolver()
+	client := b.getClient(nil)
+	if client == nil || client.httpClient == nil {
+		return fmt.Errorf("%w: %v", ErrNotReady, ErrInitHttpClient)
+	}
+	defer func() {
+		if client.http3Client != nil {
+			// Closed apart from closeClient, which counts the QUIC
+			// connections of the run.
+			client.http3Client.Close()
+			client.udpConn.Close()
+		} else {
+			b.closeClient(client)
+		}
+	}()
+
+	deadline := time.Now().Add(window)
+	for {
+		err := b.readyAuth()
+		if err == nil {
+			err = b.probeReady(ctx, client, url, status)
+		}
+		if err == nil {
+			return nil
+		}
+		if b.IsStop() {
+			return fmt.Errorf("%w, stopped: %v", ErrNotReady, err)
+		}
+		if time.Now().Add(READY_INTERVAL).After(deadline) {
+			return fmt.Errorf("%w after %v: %v", ErrNotReady, window, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w, stopped: %v", ErrNotReady, err)
+		case <-time.After(READY_INTERVAL):
+		}
+	}
+}
+
+// readyTemplate renders a url or header of a -wait-ready probe, text
+// which is no template of fnMap is sent as is.
+func (b *StressWorker) readyTemplate(name, text string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	if t, err := template.New(name).Funcs(fnMap).Parse(text); err == nil {
+		var buf bytes.Buffer
+		if t.Execute(&buf, b.templateData(nil)) == nil {
+			return buf.String()
+		}
+	}
+	return text
+}
+
+// readyHeader is the header of a -wait-ready probe, the -H headers with
+// their templates rendered, a line of every header pool and the bearer
+// token as on the requests of the run.
+func (b *StressWorker) readyHeader(client *StressClient) http.Header {
+	header := client.header(b.RequestParams.Headers)
+	for name, values := range b.RequestParams.Headers {
+		rendered := make([]string, len(values))
+		for i, v := range values {
+			rendered[i] = b.readyTemplate("READY-HEADER", v)
+		}
+		client.setHeaderValues(name, rendered)
+	}
+	for name, lines := range b.RequestParams.HeaderPools {
+		client.setHeader(name, randomLine(lines))
+	}
+	if bearer, ok := b.bearer.Load().(string); ok {
+		client.setHeader("Authorization", bearer)
+	}
+	return header
+}
+
+// readyAuth gets the bearer token of the probes until it has one, an
+// OAuth2 token server not yet up fails the probe like the target.
+func (b *StressWorker) readyAuth() error {
+	if _, ok := b.bearer.Load().(string); ok {
+		return nil
+	}
+	switch {
+	case b.RequestParams.Bearer != "":
+		b.bearer.Store("Bearer " + b.RequestParams.Bearer)
+	case b.RequestParams.BearerFile != "":
+		return b.loadBearer()
+	case b.RequestParams.OAuth2TokenUrl != "":
+		_, err := b.fetchOAuth2Token()
+		return err
+	}
+	return nil
+}
+
+// probeReady sends one -wait-ready probe, it fails unless the answer has
+// status.
+func (b *StressWorker) probeReady(ctx context.Context, client *StressClient, url string, status int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = b.readyHeader(client)
+	if len(b.RequestParams.UrlHosts) > 0 && b.RequestParams.UrlHosts[0] != "" {
+		req.Host = b.RequestParams.UrlHosts[0]
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10)) // Lets the connection be reused
+	if resp.StatusCode != status {
+		return fmt.Errorf("status %d, want %d", resp.StatusCode, status)
+	}
+	return nil
+}
+
+// fetchOAuth2Token gets a token with the client credentials grant and swaps
+// it in for the next requests, it returns when the token expires, the zero
+// time if never.
+func (b *StressWorker) fetchOAuth2Token() (time.Time, error) {
+	form := gourl.Values{"grant_type": {"client_credentials"}}
+	if len(b.RequestParams.OAuth2Scopes) > 0 {
+		form.Set("scope", strings.Join(b.RequestParams.OAuth2Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(b.requestContext(), http.MethodPost, b.RequestParams.OAuth2TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(gourl.QueryEscape(b.RequestParams.OAuth2ClientId), gourl.QueryEscape(b.RequestParams.OAuth2ClientSecret))
+	client := &http.Client{Timeout: time.Duration(b.RequestParams.Timeout) * time.Millisecond}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var token oauth2Token
+	if err = json.Unmarshal(data, &token); err != nil {
+		return time.Time{}, err
+	}
+	if token.AccessToken == "" {
+		return time.Time{}, ErrOAuth2Token
+	}
+	b.bearer.Store("Bearer " + token.AccessToken)
+	if token.ExpiresIn <= 0 {
+		return time.Time{}, nil
+	}
+	return start.Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// refreshOAuth2 refreshes the OAuth2 token OAUTH2_MARGIN before it expires,
+// or halfway for short lived ones. Failed refreshes are retried every
+// OAUTH2_RETRY, and once the token expired the workers wait for a new one
+// instead of sending requests bound to fail with 401.
+func (b *StressWorker) refreshOAuth2(expiry time.Time) {
+	refreshAt := oauth2RefreshTime(expiry)
+	for {
+		timer := time.NewTimer(time.Until(refreshAt))
+		select {
+		case <-b.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		next, err := b.fetchOAuth2Token()
+		if err != nil {
+			atomic.AddInt64(&b.oauth2Failures, 1)
+			b.logf(VERBOSE_ERROR, "OAuth2 token refresh err: %v\n", err)
+			now := time.Now()
+			if !now.Before(expiry) {
+				atomic.StoreInt32(&b.oauth2Paused, 1)
+			}
+			// Retry at the latest when the token expires.
+			if refreshAt = now.Add(OAUTH2_RETRY); now.Before(expiry) && refreshAt.After(expiry) {
+				refreshAt = expiry
+			}
+			continue
+		}
+		atomic.StoreInt32(&b.oauth2Paused, 0)
+		if next.IsZero() {
+			return
+		}
+		expiry, refreshAt = next, oauth2RefreshTime(next)
+	}
+}
+
+func oauth2RefreshTime(expiry time.Time) time.Time {
+	margin := OAUTH2_MARGIN
+	if lifetime := time.Until(expiry); lifetime < 2*margin {
+		margin = lifetime / 2
+	}
+	return expiry.Add(-margin)
+}
+
+// refreshDns starts a new -dns-refresh generation periodically, the workers
+// then close their idle connections and the next dials resolve again.
+func (b *StressWorker) refreshDns() {
+	ticker := time.NewTicker(b.dnsCache.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.dnsCache.expire() // Or the redials would get the addresses cached before the tick
+			atomic.AddUint64(&b.dnsGeneration, 1)
+			for _, client := range b.h2Clients {
+				client.httpClient.CloseIdleConnections()
+			}
+		}
+	}
+}
+
+// dnsCache resolves every host at most once per ttl for -dns-refresh, and
+// logs when the addresses of a host change.
+type dnsCache struct {
+	ttl        time.Duration
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	logf       func(level int, format string, args ...interface{})
+	lock       sync.Mutex
+	entries    map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDnsCache(ttl time.Duration, lookupHost func(context.Context, string) ([]string, error),
+	logf func(int, string, ...interface{})) *dnsCache {
+	return &dnsCache{ttl: ttl, lookupHost: lookupHost, logf: logf, entries: make(map[string]*dnsEntry)}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.lock.Lock()
+	entry := c.entries[host]
+	fresh := entry != nil && time.Now().Before(entry.expires)
+	c.lock.Unlock()
+	if fresh {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(addrs)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if old := c.entries[host]; old != nil && strings.Join(old.addrs, ",") != strings.Join(addrs, ",") {
+		c.logf(VERBOSE_INFO, "DNS %s changed from %v to %v\n", host, old.addrs, addrs)
+	}
+	c.entries[host] = &dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	return addrs, nil
+}
+
+// expire makes the next lookup of every host resolve again, the old addresses
+// are kept to log a change.
+func (c *dnsCache) expire() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, entry := range c.entries {
+		entry.expires = time.Time{}
+	}
+}
+
+// dial connects to one of the cached addresses of the host.
+func (c *dnsCache) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	return dialHost(ctx, dialer, network, addr, c.lookup)
+}
+
+// newResolver returns the resolver of -dns-server and -dns-timeout, nil if
+// neither is set.
+func (b *StressWorker) newResolver() *net.Resolver {
+	if b.RequestParams.DnsServer == "" && b.RequestParams.DnsTimeout <= 0 {
+		return nil
+	}
+	resolver := &net.Resolver{}
+	if server := b.RequestParams.DnsServer; server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		// The cgo resolver would ignore Dial.
+		resolver.PreferGo = true
+		resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		}
+	}
+	return resolver
+}
+
+// lookupHost resolves host with the -dns-server resolver within -dns-timeout,
+// the addresses of every host are logged once.
+func (b *StressWorker) lookupHost(ctx context.Context, host string) ([]string, error) {
+	resolver := net.DefaultResolver
+	if b.resolver != nil {
+		resolver = b.resolver
+	}
+	if b.RequestParams.DnsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(b.RequestParams.DnsTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err == nil {
+		if _, logged := b.dnsLogged.LoadOrStore(host, struct{}{}); !logged {
+			b.logf(VERBOSE_DEBUG, "DNS %s resolved to %v\n", host, addrs)
+		}
+	}
+	return addrs, err
+}
+
+// dialHost connects to one of the addresses of the host, starting at a
+// random one so the workers spread over all of them.
+func dialHost(ctx context.Context, dialer *net.Dialer, network, addr string,
+	lookup func(context.Context, string) ([]string, error)) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	offset := rand.Intn(len(addrs))
+	for i := range addrs {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addrs[(offset+i)%len(addrs)], port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// takeToken waits for a -qps-global request token, false once the test stops.
+func (b *StressWorker) takeToken() bool {
+	select {
+	case <-b.tokens:
+		return true
+	default:
+	}
+	for !b.IsStop() {
+		select {
+		case <-b.tokens:
+			return true
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return false
+}
+
+// fetchTokens polls the -qps-global coordinator for batches of about 100ms of
+// the fleet-wide rate and hands them to the workers through b.tokens.
+func (b *StressWorker) fetchTokens() {
+	batch := b.tokenBatch()
+	uri := fmt.Sprintf("http://%s/tokens?n=%d", b.RequestParams.QpsGlobal, batch)
+	client := &http.Client{Timeout: time.Second}
+	for !b.IsStop() {
+		// b.tokens holds 2*batch, so a full grant never blocks.
+		if len(b.tokens) > batch {
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		granted, err := requestTokens(client, uri)
+		if err != nil {
+			b.logf(VERBOSE_ERROR, "Request tokens err: %v\n", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if granted == 0 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		for i := 0; i < granted; i++ {
+			b.tokens <- struct{}{}
+		}
+	}
+}
+
+// tokenBatch is the number of -qps-global tokens requested per poll.
+func (b *StressWorker) tokenBatch() int {
+	qps := b.RequestParams.Qps
+	if b.RequestParams.BurstRate > qps {
+		qps = b.RequestParams.BurstRate
+	}
+	if batch := qps * b.RequestParams.C / 10; batch > 1 {
+		return batch
+	}
+	return 1
+}
+
+func requestTokens(client *http.Client, uri string) (int, error) {
+	resp, err := client.Get(uri)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return strconv.Atoi(strings.TrimSpace(string(body)))
+}
+
+// tokenServer grants -qps-global request tokens to the distributed workers
+// at a fixed fleet-wide rate.
+type tokenServer struct {
+	schedule *rateSchedule
+	granted  int64
+	lock     sync.Mutex
+	listener net.Listener
+}
+
+func newTokenServer(addr string, schedule *rateSchedule) (*tokenServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &tokenServer{schedule: schedule, listener: listener}
+	mux := http.NewServeMux()
+	mux.Handle("/tokens", s)
+	go http.Serve(listener, mux)
+	return s, nil
+}
+
+// ServeTokens listens on addr for the -qps-global token requests of the -W
+// workers, granting params.Qps per connection of params.C until closed.
+func ServeTokens(addr string, params *StressParameters) (io.Closer, error) {
+	if err := params.CheckBurst(); err != nil {
+		return nil, err
+	}
+	return newTokenServer(addr, newRateSchedule(params, params.C))
+}
+
+// grant returns up to n tokens out of those accrued since the schedule start.
+func (s *tokenServer) grant(now time.Time, n int64) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	available := int64(s.schedule.accrued(now)) - s.granted
+	// Idle time does not build up more than one second of the current rate.
+	if burst := int64(s.schedule.rate(now)); available > burst {
+		s.granted += available - burst
+		available = burst
+	}
+	if n > available {
+		n = available
+	}
+	if n < 0 {
+		n = 0
+	}
+	s.granted += n
+	return n
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseInt(r.URL.Query().Get("n"), 10, 64)
+	if err != nil || n <= 0 {
+		http.Error(w, "invalid token count", http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "%d", s.grant(time.Now(), n))
+}
+
+func (s *tokenServer) Close() error {
+	return s.listener.Close()
+}
+
+// rateSchedule is the -q rate limiter shared by the workers, with -burst every
+// connection switches to the burst rate for the last BurstDuration of every
+// BurstInterval at the same time.
+type rateSchedule struct {
+	start         time.Time
+	base, burst   float64 // Requests per second
+	burstDuration time.Duration
+	burstInterval time.Duration
+	poisson       bool // Exponential gaps around the mean rate instead of a constant one
+}
+
+// newRateSchedule starts the schedule of one connection, or with conns of
+// the whole fleet for -qps-global.
+func newRateSchedule(p *StressParameters, conns int) *rateSchedule {
+	s := &rateSchedule{
+		start:   time.Now(),
+		base:    float64(p.Qps * conns),
+		poisson: p.RateDistribution == RATE_POISSON,
+	}
+	if p.BurstRate > 0 {
+		s.burst = float64(p.BurstRate * conns)
+		s.burstDuration = time.Duration(p.BurstDuration) * time.Millisecond
+		s.burstInterval = time.Duration(p.BurstInterval) * time.Millisecond
+	}
+	return s
+}
+
+func (s *rateSchedule) inBurst(at time.Time) bool {
+	if s.burst <= 0 || at.Before(s.start) {
+		return false
+	}
+	return at.Sub(s.start)%s.burstInterval >= s.burstInterval-s.burstDuration
+}
+
+func (s *rateSchedule) rate(at time.Time) float64 {
+	if s.inBurst(at) {
+		return s.burst
+	}
+	return s.base
+}
+
+// next returns the send time following prev, rnd is the private source of
+// the worker for poisson gaps.
+func (s *rateSchedule) next(prev time.Time, rnd *rand.Rand) time.Time {
+	gap := float64(time.Second) / s.rate(prev)
+	if s.poisson && rnd != nil {
+		gap *= rnd.ExpFloat64()
+	}
+	return prev.Add(time.Duration(gap))
+}
+
+// accrued returns the number of requests allowed from start up to at.
+func (s *rateSchedule) accrued(at time.Time) float64 {
+	elapsed := at.Sub(s.start)
+	if elapsed <= 0 {
+		return 0
+	}
+	if s.burst <= 0 {
+		return elapsed.Seconds() * s.base
+	}
+	baseDuration := s.burstInterval - s.burstDuration
+	periods := elapsed / s.burstInterval
+	total := float64(periods) * (baseDuration.Seconds()*s.base + s.burstDuration.Seconds()*s.burst)
+	if rest := elapsed % s.burstInterval; rest > baseDuration {
+		total += baseDuration.Seconds()*s.base + (rest-baseDuration).Seconds()*s.burst
+	} else {
+		total += rest.Seconds() * s.base
+	}
+	return total
+}
+
+// runRecvWorker sends the request body once as a subscribe message, then only
+// reads inbound messages and records the gap between them as the latency. A
+// lost connection is counted as an error and subscribed again on a new one,
+// which is returned like by runWorker.
+func (b *StressWorker) runRecvWorker(client *StressClient, shard *StressResult) *StressClient {
+	// ReadMessage blocks until the next message, so close the connection
+	// being read once the test stops to unblock it.
+	var conn atomic.Value
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if c, ok := conn.Load().(*websocket.Conn); ok && b.IsStop() {
+					c.Close() // Until done, a new connection may be stored meanwhile
+				}
+			}
+		}
+	}()
+
+	for !b.IsStop() {
+		if client.wsClient == nil {
+			b.Stop(false, ErrInitWsClient)
+			break
+		}
+		conn.Store(client.wsClient)
+		err := b.subscribe(client, shard)
+		if err == nil || b.IsStop() || b.requestContext().Err() != nil {
+			break
+		}
+		if !isRequestFailure(err) {
+			b.logf(VERBOSE_ERROR, "err: %v\n", err)
+			b.Stop(false, err)
+			break
+		}
+		shard.record(&result{err: classifyError(err)})
+		level := VERBOSE_INFO
+		b.requestErrOnce.Do(func() { level = VERBOSE_ERROR })
+		b.logf(level, "err: %v, subscribing again\n", err)
+
+		b.closeClient(client)
+		if client = b.getClient(client); client == nil {
+			if !b.IsStop() {
+				b.Stop(false, ErrReconnect)
+			}
+			break
+		}
+	}
+	return client
+}
+
+// subscribe sends the subscribe message on the ws connection of client and
+// records its inbound messages, until the test stops or the read fails.
+func (b *StressWorker) subscribe(client *StressClient, shard *StressResult) error {
+	var bodyBytes bytes.Buffer
+	if _, err := b.executeBody(&bodyBytes, client); err != nil {
+		return err
+	}
+	if bodyBytes.Len() > 0 {
+		if err := client.wsClient.WriteMessage(websocket.TextMessage, bodyBytes.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	var t = time.Now()
+	for !b.IsStop() {
+		_, message, err := client.wsClient.ReadMessage()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		shard.record(&result{
+			statusCode:    http.StatusOK,
+			duration:      now.Sub(t),
+			end:           now,
+			contentLength: int64(len(message)),
+		})
+		atomic.AddInt64(&b.completed, 1)
+		t = now
+	}
+	return nil
+}
+
+func (b *StressWorker) runWorkers() {
+	if b.Options.Quiet {
+		// pass
+	} else if len(b.RequestParams.Urls) > 1 {
+		fmt.Printf("Running %d connections, @ random urls.txt\n", b.RequestParams.C)
+	} else {
+		fmt.Printf("Running %d connections, @ %s\n", b.RequestParams.C, b.RequestParams.Urls[0])
+	}
+
+	// Every connection is a socket, a soft limit below -c fails the last ones.
+	want := uint64(b.RequestParams.C) + FILE_LIMIT_MARGIN
+	if from, to, err := raiseFileLimit(want); err == nil && to > from && !b.Options.Quiet {
+		fmt.Printf("Open files limit raised from %d to %d for %d connections\n", from, to, b.RequestParams.C)
+	} else if from > 0 && to < want {
+		b.logf(VERBOSE_ERROR, "Open files limit %d is too low for %d connections, raise it with ulimit -n\n", to, b.RequestParams.C)
+	}
+	if b.RequestParams.RequestHttpType == TYPE_HTTP1 && !b.Options.Quiet {
+		maxConns, maxIdleConns, idleConnTimeout := b.RequestParams.transportLimits()
+		fmt.Printf("Transport max conns: %d, max idle conns: %d, idle conn timeout: %v\n", maxConns, maxIdleConns, idleConnTimeout)
+	}
+	if (b.RequestParams.TcpDelay || b.RequestParams.SoRcvbuf > 0 || b.RequestParams.SoSndbuf > 0) && !b.Options.Quiet {
+		fmt.Printf("Socket tcp nodelay: %v, rcvbuf: %d, sndbuf: %d (0 is the system default)\n",
+			!b.RequestParams.TcpDelay, b.RequestParams.SoRcvbuf, b.RequestParams.SoSndbuf)
+	}
+	for _, addr := range b.RequestParams.LocalAddrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			b.logf(VERBOSE_ERROR, "Local addr %q err: %v\n", addr, ErrLocalAddr)
+			b.Stop(false, ErrLocalAddr)
+			break
+		}
+		b.localIPs = append(b.localIPs, ip)
+	}
+	if (len(b.localIPs) > 0 || b.RequestParams.LocalPortMax > 0) && !b.Options.Quiet {
+		fmt.Printf("Local addrs: %v, ports: %d-%d (0 is the system default)\n",
+			b.RequestParams.LocalAddrs, b.RequestParams.LocalPortMin, b.RequestParams.LocalPortMax)
+	}
+
+	var (
+		start            = time.Now()
+		wg               sync.WaitGroup
+		err              error
+		bodyTemplateName = fmt.Sprintf("BODY-%d", b.RequestParams.SequenceId)
+		urlTemplateName  = fmt.Sprintf("URL-%d", b.RequestParams.SequenceId)
+	)
+
+	// A single node run is worker 0 of 1, so the templates work unchanged.
+	workerIndex, workerCount := int64(b.RequestParams.WorkerIndex), int64(b.RequestParams.WorkerCount)
+	if workerCount <= 0 {
+		workerIndex, workerCount = 0, 1
+	}
+	funcs := template.FuncMap{}
+	for name, fn := range fnMap {
+		funcs[name] = fn
+	}
+	funcs["workerIndex"] = func() int64 { return workerIndex }
+	funcs["workerCount"] = func() int64 { return workerCount }
+	totalRequests := int64(b.RequestParams.N)
+	funcs["totalRequests"] = func() int64 { return totalRequests }
+	parse := func(name, text string) (*template.Template, error) {
+		t, err := template.New(name).Funcs(funcs).Parse(text)
+		if err == nil && (strings.Contains(text, "goroutineIndex") ||
+			strings.Contains(text, "iteration") || strings.Contains(text, "globalRequest")) {
+			b.indexTemplates = append(b.indexTemplates, t)
+		}
+		return t, err
+	}
+
+	b.urlTemplates = make([]*template.Template, len(b.RequestParams.Urls))
+	for i, v := range b.RequestParams.Urls {
+		if b.urlTemplates[i], err = parse(fmt.Sprintf("%s-%d", urlTemplateName, i), v); err != nil {
+			b.logf(VERBOSE_ERROR, "Parse urls function err: %v\n", err)
+			b.Stop(false, err)
+		}
+	}
+
+	if b.RequestParams.ValidateUrls != VALIDATE_OFF && b.RequestParams.RequestHttpType != TYPE_TCP {
+		if err = b.validateUrls(); err != nil {
+			b.logf(VERBOSE_ERROR, "Parse URL err: %v\n", err)
+			b.Stop(false, ErrUrl)
+		}
+	}
+
+	pools, err := targetPools(b.RequestParams)
+	if err != nil {
+		b.logf(VERBOSE_ERROR, "Target concurrency err: %v\n", err)
+		pools, _ = targetPools(&StressParameters{Urls: b.RequestParams.Urls, C: b.RequestParams.C})
+	}
+	if len(pools) > 1 && !b.Options.Quiet {
+		for _, pool := range pools {
+			fmt.Printf("  %s: %d connections, %d urls\n", pool.name, pool.workers, len(pool.urls))
+		}
+	}
+
+	if b.bodyTemplate, err = parse(bodyTemplateName, b.RequestParams.RequestBody); err != nil {
+		b.logf(VERBOSE_ERROR, "Parse request body function err: %v\n", err)
+		b.Stop(false, err)
+	}
+
+	b.bodyTemplates = make([]*template.Template, len(b.RequestParams.RequestBodies))
+	for i, v := range b.RequestParams.RequestBodies {
+		bodyTemplateName := fmt.Sprintf("BODY-%d-%d", b.RequestParams.SequenceId, i)
+		if b.bodyTemplates[i], err = parse(bodyTemplateName, v); err != nil {
+			b.logf(VERBOSE_ERROR, "Parse request body function err: %v\n", err)
+			b.Stop(false, err)
+		}
+	}
+
+	for i, v := range b.RequestParams.FormFields {
+		name, value := v, ""
+		if idx := strings.Index(v, "="); idx >= 0 {
+			name, value = v[:idx], v[idx+1:]
+		}
+		field := formField{name: name}
+		formTemplateName := fmt.Sprintf("FORM-%d-%d", b.RequestParams.SequenceId, i)
+		if field.value, err = parse(formTemplateName, value); err != nil {
+			b.logf(VERBOSE_ERROR, "Parse form field function err: %v\n", err)
+			b.Stop(false, err)
+		}
+		b.formFields = append(b.formFields, field)
+	}
+
+	for name, values := range b.RequestParams.Headers {
+		h := headerTemplate{name: name, values: make([]*template.Template, len(values))}
+		templated := false
+		for i, v := range values {
+			if !strings.Contains(v, "{{") {
+				continue
+			}
+			headerTemplateName := fmt.Sprintf("HEADER-%d-%s-%d", b.RequestParams.SequenceId, name, i)
+			if h.values[i], err = parse(headerTemplateName, v); err != nil {
+				b.logf(VERBOSE_ERROR, "Parse header function err: %v\n", err)
+				b.Stop(false, err)
+			} else {
+				templated = true
+			}
+		}
+		if templated {
+			b.headerTemplates = append(b.headerTemplates, h)
+		}
+	}
+
+	for _, v := range b.RequestParams.FormFiles {
+		if file, err := parseFormFile(v); err != nil {
+			b.logf(VERBOSE_ERROR, "Parse form file err: %v\n", err)
+		} else {
+			b.formFiles = append(b.formFiles, file)
+		}
+	}
+
+	if b.RequestParams.Bearer != "" {
+		b.bearer.Store("Bearer " + b.RequestParams.Bearer)
+	} else if b.RequestParams.BearerFile != "" {
+		if err = b.loadBearer(); err != nil {
+			b.logf(VERBOSE_ERROR, "Read bearer file err: %v\n", err)
+		}
+	}
+	var oauth2Expiry time.Time
+	if b.RequestParams.OAuth2TokenUrl != "" {
+		if oauth2Expiry, err = b.fetchOAuth2Token(); err != nil {
+			b.logf(VERBOSE_ERROR, "OAuth2 token err: %v\n", err)
+			b.Stop(false, err)
+		}
+	}
+
+	b.resolver = b.newResolver()
+	if b.RequestParams.DnsRefresh > 0 {
+		b.dnsCache = newDnsCache(time.Duration(b.RequestParams.DnsRefresh)*time.Millisecond, b.lookupHost, b.logf)
+	}
+	if b.RequestParams.RequestHttpType == TYPE_HTTP2 && b.RequestParams.H2Conns > 0 {
+		b.h2Clients = make([]*StressClient, b.RequestParams.H2Conns)
+		for i := range b.h2Clients {
+			b.h2Clients[i] = &StressClient{httpClient: b.newHttp2Client()}
+		}
+	}
+
+	workers := b.RequestParams.C
+	if b.RequestParams.N > 0 && !b.RequestParams.WsRecvOnly {
+		b.remaining = int64(b.RequestParams.N)
+		if b.RequestParams.N < workers {
+			workers = b.RequestParams.N
+		}
+	}
+	if err := b.RequestParams.CheckBurst(); err != nil {
+		b.logf(VERBOSE_ERROR, "Burst err: %v\n", err)
+		b.Stop(false, err)
+	}
+	if b.RequestParams.Qps > 0 && !b.RequestParams.WsRecvOnly {
+		b.schedule = newRateSchedule(b.RequestParams, 1)
+		if b.RequestParams.QpsGlobal != "" {
+			b.tokens = make(chan struct{}, 2*b.tokenBatch())
+			go b.fetchTokens()
+		}
+	}
+	if b.RequestParams.DnsRefresh > 0 {
+		go b.refreshDns()
+	}
+	if b.RequestParams.BearerFile != "" && b.RequestParams.Bearer == "" {
+		go b.reloadBearer()
+	}
+	if !oauth2Expiry.IsZero() {
+		go b.refreshOAuth2(oauth2Expiry)
+	}
+	var saveDone chan struct{}
+	if b.RequestParams.SaveResponses != "" && b.RequestParams.SaveResponsesCount > 0 {
+		if err = os.MkdirAll(b.RequestParams.SaveResponses, 0755); err != nil {
+			b.logf(VERBOSE_ERROR, "Save responses err: %v\n", err)
+		} else {
+			b.saveCh = make(chan *savedResponse, 16)
+			saveDone = make(chan struct{})
+			go b.saveResponses(saveDone)
+		}
+	}
+
+	b.replayStart = time.Now()
+	b.shards = make([]*StressResult, workers)
+	var lives []*liveStats
+	for i := range b.shards {
+		b.shards[i] = NewStressResult()
+		b.shards[i].MaxCardinality = b.RequestParams.MaxCardinality
+		if b.Options.Live {
+			b.shards[i].live = newLiveStats()
+			lives = append(lives, b.shards[i].live)
+		}
+	}
+	b.lives.Store(lives)
+	workerPools := assignWorkers(pools, workers)
+	for i := 0; i < workers && !(b.IsStop()); i++ {
+		wg.Add(1)
+		go func(index int, shard *StressResult, target *targetPool) {
+			// The templates are set before the client dials, a ws handshake
+			// renders the headers with them.
+			data := &templateData{TotalRequests: int64(b.RequestParams.N)}
+			client := b.getClient(&StressClient{data: data, templates: b.workerTemplates(index, data)})
+
+			defer func() {
+				if client != nil {
+					b.closeClient(client)
+				}
+				wg.Done()
+				if r := recover(); r != nil {
+					b.logf(VERBOSE_ERROR, "Internal err: %v\n", r)
+				}
+			}()
+
+			if client != nil {
+				if b.RequestParams.WsRecvOnly {
+					client = b.runRecvWorker(client, shard)
+				} else {
+					client = b.runWorker(client, shard, target)
+				}
+			}
+		}(i, b.shards[i], workerPools[i])
+	}
+
+	wg.Wait()
+	b.SetStopReason(STOP_REQUESTS)
+	b.Stop(false, nil)
+	b.totalTime = time.Now().Sub(start)
+	if cutoff := atomic.LoadInt64(&b.cutoff); cutoff > 0 {
+		b.totalTime = time.Unix(0, cutoff).Sub(start) // Without the drain window
+	}
+	for _, client := range b.h2Clients {
+		b.closeClient(client)
+	}
+	if saveDone != nil {
+		close(b.saveCh)
+		<-saveDone
+	}
+	if b.slowDropped > 0 {
+		b.Options.Log.Printf("[SLOW] %d slow requests not logged, over -slow-log-rate\n", b.slowDropped)
+	}
+	close(b.done)
+}
+
+// nextReplay picks the Replay entry of the next request, a random one, or
+// under ReplaySpeed the next one in order once its logged time has come. It
+// returns nil at the end of the log or when the worker stops while waiting.
+func (b *StressWorker) nextReplay(rnd *rand.Rand) *ReplayEntry {
+	entries := b.RequestParams.Replay
+	if b.RequestParams.ReplaySpeed <= 0 {
+		return &entries[rnd.Intn(len(entries))]
+	}
+	i := atomic.AddInt64(&b.replayNext, 1) - 1
+	if i >= int64(len(entries)) {
+		return nil
+	}
+	offset := time.Duration(float64(entries[i].Offset) * float64(time.Millisecond) / b.RequestParams.ReplaySpeed)
+	for wait := time.Until(b.replayStart.Add(offset)); wait > 0; wait = time.Until(b.replayStart.Add(offset)) {
+		if b.IsStop() {
+			return nil
+		}
+		if wait > 100*time.Millisecond {
+			wait = 100 * time.Millisecond // Check Stop during long gaps
+		}
+		time.Sleep(wait)
+	}
+	return &entries[i]
+}
+
+// logSlow logs a request slower than -slow-threshold, at most SlowLogRate
+// lines per second, the dropped ones are counted in the next line.
+func (b *StressWorker) logSlow(res *result) {
+	now := res.end.Unix()
+	b.slowLock.Lock()
+	if now != b.slowSecond {
+		if b.slowDropped > 0 {
+			b.Options.Log.Printf("[SLOW] %d slow requests not logged, over -slow-log-rate\n", b.slowDropped)
+		}
+		b.slowSecond, b.slowLines, b.slowDropped = now, 0, 0
+	}
+	if b.RequestParams.SlowLogRate > 0 && b.slowLines >= b.RequestParams.SlowLogRate {
+		b.slowDropped++
+		b.slowLock.Unlock()
+		return
+	}
+	b.slowLines++
+	b.slowLock.Unlock()
+	b.Options.Log.Printf("[SLOW] %4.3f secs, status code: %d, size: %d, url: %s%s\n",
+		res.duration.Seconds(), res.statusCode, res.contentLength, res.url, res.ids())
+}
+
+// saveResponses writes the responses received from saveCh to numbered files,
+// it runs in its own goroutine to keep disk writes off the request path.
+func (b *StressWorker) saveResponses(done chan struct{}) {
+	defer close(done)
+	var i int
+	for saved := range b.saveCh {
+		i++
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%s %s\n", saved.method, saved.url)
+		if _, ok := b.bearer.Load().(string); ok {
+			saved.reqHeader.Set("Authorization", "Bearer "+REDACTED)
+		}
+		saved.reqHeader.Write(&buf)
+		if len(saved.reqBody) > 0 {
+			fmt.Fprintf(&buf, "\n%s\n", saved.reqBody)
+		}
+		fmt.Fprintf(&buf, "\n%s %s\n", saved.resp.Proto, saved.resp.Status)
+		saved.resp.Header.Write(&buf)
+		fmt.Fprintf(&buf, "\n%s", saved.respBody)
+		name := filepath.Join(b.RequestParams.SaveResponses, fmt.Sprintf("response-%04d.txt", i))
+		if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+			b.logf(VERBOSE_ERROR, "Save responses err: %v\n", err)
+		}
+	}
+}
+
+func (b *StressWorker) newHttp2Client() *http.Client {
+	tr := &http2.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		DisableCompression: true, // See acceptEncoding in doClient
+		// Keep exactly one connection per shared client.
+		StrictMaxConcurrentStreams: b.RequestParams.H2Conns > 0,
+	}
+	connectTimeout, handshakeTimeout, _ := b.RequestParams.timeouts()
+	dialer := b.newDialer(connectTimeout)
+	tr.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		// The transport passes no request context, the one of the run lets
+		// Abort cancel the dial and the handshake.
+		ctx := b.requestContext()
+		conn, err := b.dial(ctx, dialer, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if handshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		}
+		handshaked := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-handshaked:
+			}
+		}()
+		tlsConn := tls.Client(conn, cfg)
+		err = tlsConn.Handshake()
+		close(handshaked)
+		if err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				err = ErrTlsTimeout
+			}
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+	return &http.Client{
+		Timeout:   time.Duration(b.RequestParams.Timeout) * time.Millisecond,
+		Transport: tr,
+	}
+}
+
+// borrowH2Client picks a shared http2 client in round robin order and counts
+// the request as an in-flight stream, call the returned func when it is done.
+func (b *StressWorker) borrowH2Client() (*StressClient, func()) {
+	client := b.h2Clients[atomic.AddUint64(&b.h2Next, 1)%uint64(len(b.h2Clients))]
+	streams := atomic.AddInt64(&client.streams, 1)
+	for {
+		peak := atomic.LoadInt64(&client.peakStreams)
+		if streams <= peak || atomic.CompareAndSwapInt64(&client.peakStreams, peak, streams) {
+			break
+		}
+	}
+	return client, func() { atomic.AddInt64(&client.streams, -1) }
+}
+
+// getClient returns a new client of the worker, which keeps the per worker
+// validators and templates of prev, the client it replaces, nil for the first.
+func (b *StressWorker) getClient(prev *StressClient) *StressClient {
+	client := &StressClient{}
+	if prev != nil {
+		client.validators, client.templates, client.data = prev.validators, prev.templates, prev.data
+	}
+	switch b.RequestParams.RequestHttpType {
+	case TYPE_HTTP3:
+		// All QUIC connections of a worker share a single UDP socket.
+		var local *net.UDPAddr
+		if addr := b.localAddr(); addr != nil {
+			local = &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+		}
+		udpConn, err := net.ListenUDP("udp", local)
+		if err != nil {
+			b.logf(VERBOSE_ERROR, "Listen udp err: %s\n", err.Error())
+			return nil
+		}
+		client.udpConn = udpConn
+		if b.RequestParams.SoRcvbuf > 0 {
+			udpConn.SetReadBuffer(b.RequestParams.SoRcvbuf)
+		}
+		if b.RequestParams.SoSndbuf > 0 {
+			udpConn.SetWriteBuffer(b.RequestParams.SoSndbuf)
+		}
+		_, handshakeTimeout, _ := b.RequestParams.timeouts()
+		tlsConfig := &tls.Config{
+			RootCAs:            b.Options.RootCAs,
+			InsecureSkipVerify: true,
+		}
+		if b.RequestParams.Quic0RTT {
+			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+		client.http3Client = &http3.RoundTripper{
+			TLSClientConfig: tlsConfig,
+			QuicConfig: &quic.Config{
+				HandshakeIdleTimeout: handshakeTimeout,
+				MaxIdleTimeout:       time.Duration(b.RequestParams.QuicIdleTimeout) * time.Millisecond,
+				KeepAlivePeriod:      time.Duration(b.RequestParams.QuicKeepAlive) * time.Millisecond,
+				MaxIncomingStreams:   b.RequestParams.QuicMaxStreams,
+				EnableDatagrams:      b.RequestParams.QuicDatagrams,
+			},
+			EnableDatagrams:    b.RequestParams.QuicDatagrams,
+			DisableCompression: true,
+			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				if b.resolver != nil && net.ParseIP(host) == nil {
+					addrs, err := b.lookupHost(ctx, host)
+					if err != nil {
+						return nil, err
+					}
+					addr = net.JoinHostPort(addrs[0], port)
+				}
+				udpAddr, err := net.ResolveUDPAddr("udp", addr)
+				if err != nil {
+					return nil, err
+				}
+				conn, err := quic.DialEarlyContext(ctx, udpConn, udpAddr, host, tlsCfg, cfg)
+				if err == nil {
+					client.quicConns = append(client.quicConns, conn)
+				}
+				return conn, err
+			},
+		}
+		client.httpClient = &http.Client{
+			Timeout:   time.Duration(b.RequestParams.Timeout) * time.Millisecond,
+			Transport: client.http3Client,
+		}
+	case TYPE_HTTP2:
+		if len(b.h2Clients) > 0 {
+			break // borrow a shared client on every request in doClient
+		}
+		client.httpClient = b.newHttp2Client()
+	case TYPE_HTTP1:
+		maxConns, maxIdleConns, idleConnTimeout := b.RequestParams.transportLimits()
+		connectTimeout, handshakeTimeout, responseTimeout := b.RequestParams.timeouts()
+		dialer := b.newDialer(connectTimeout)
+		dialer.KeepAlive = time.Duration(60) * time.Second
+		tr := &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			DisableCompression:    true,
+			DisableKeepAlives:     b.RequestParams.DisableKeepAlives,
+			TLSHandshakeTimeout:   handshakeTimeout,
+			ResponseHeaderTimeout: responseTimeout,
+			TLSNextProto:          make(map[string]func(string, *tls.Conn) http.RoundTripper),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return b.dial(ctx, dialer, network, addr)
+			},
+			MaxIdleConns:        maxIdleConns,
+			MaxIdleConnsPerHost: maxIdleConns,
+			MaxConnsPerHost:     maxConns,
+			IdleConnTimeout:     idleConnTimeout,
+		}
+		if b.Options.Proxy != nil {
+			tr.Proxy = http.ProxyURL(b.Options.Proxy)
+		}
+		client.httpClient = &http.Client{
+			Timeout:   time.Duration(b.RequestParams.Timeout) * time.Millisecond,
+			Transport: tr,
+		}
+	case TYPE_WS:
+		if b.RequestParams.WsMode == WS_MODE_RECONNECT {
+			break // dial on every request in doClient
+		}
+		randv := rand.Intn(len(b.RequestParams.Urls)) % len(b.RequestParams.Urls)
+		url := b.RequestParams.Urls[randv]
+		if c, err := b.dialWs(url, client); err != nil {
+			b.logf(VERBOSE_ERROR, "Websocket err: %s\n", err.Error())
+			return nil
+		} else {
+			client.wsClient = c
+		}
+	case TYPE_TCP:
+		if b.RequestParams.TcpReconnect {
+			break // dial on every request in doClient
+		}
+		randv := rand.Intn(len(b.RequestParams.Urls)) % len(b.RequestParams.Urls)
+		addr := b.RequestParams.Urls[randv]
+		if c, err := b.dialTcp(addr); err != nil {
+			b.logf(VERBOSE_ERROR, "Tcp err: %s\n", err.Error())
+			return nil
+		} else {
+			client.tcpClient = c
+			client.tcpReader = bufio.NewReader(c)
+		}
+	}
+
+	return client
+}
+
+func (b *StressWorker) dialTcp(addr string) (net.Conn, error) {
+	connectTimeout, _, _ := b.RequestParams.timeouts()
+	return b.trackConn(b.dial(b.requestContext(), b.newDialer(connectTimeout), "tcp", addr))
+}
+
+// readTcp reads one response from r, either a fixed number of bytes, up to and
+// including the delimiter, or whatever a single read returns.
+func (b *StressWorker) readTcp(r *bufio.Reader) (int64, error) {
+	if b.RequestParams.TcpReadBytes > 0 {
+		n, err := io.CopyN(ioutil.Discard, r, int64(b.RequestParams.TcpReadBytes))
+		return n, err
+	}
+
+	if delim := b.RequestParams.TcpReadUntil; len(delim) > 0 {
+		var n int64
+		var tail []byte
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return n, err
+			}
+			n++
+			tail = append(tail, c)
+			if len(tail) > len(delim) {
+				tail = tail[1:]
+			}
+			if string(tail) == delim {
+				return n, nil
+			}
+		}
+	}
+
+	buf := make([]byte, 4096)
+	n, err := r.Read(buf)
+	return int64(n), err
+}
+
+// targetPool is the urls of a -target-concurrency group and its workers.
+type targetPool struct {
+	name    string // Path prefix, TARGET_DEFAULT, or empty without -target-concurrency
+	workers int
+	urls    []int // Indexes into Urls
+}
+
+// targetPools splits Urls by the longest matching -target-concurrency path
+// prefix, the unmatched urls share the workers left in a default pool.
+func targetPools(params *StressParameters) ([]*targetPool, error) {
+	all := &targetPool{workers: params.C}
+	if len(params.TargetConcurrency) == 0 {
+		for i := range params.Urls {
+			all.urls = append(all.urls, i)
+		}
+		return []*targetPool{all}, nil
+	}
+	var pools []*targetPool
+	all.name = TARGET_DEFAULT
+	for _, group := range params.TargetConcurrency {
+		if group.C <= 0 {
+			return nil, fmt.Errorf("%s needs at least one connection", group.Prefix)
+		}
+		pools = append(pools, &targetPool{name: group.Prefix, workers: group.C})
+		all.workers -= group.C
+	}
+	if all.workers < 0 {
+		return nil, fmt.Errorf("more connections than -c %d", params.C)
+	}
+	for i, v := range params.Urls {
+		pool := all
+		var path string
+		if u, err := gourl.Parse(v); err == nil {
+			path = u.Path
+		}
+		for j, group := range params.TargetConcurrency {
+			if strings.HasPrefix(path, group.Prefix) && (pool == all || len(group.Prefix) > len(pool.name)) {
+				pool = pools[j]
+			}
+		}
+		pool.urls = append(pool.urls, i)
+	}
+	for _, pool := range pools {
+		if len(pool.urls) == 0 {
+			return nil, fmt.Errorf("%s matches no url", pool.name)
+		}
+	}
+	if len(all.urls) > 0 {
+		if all.workers == 0 {
+			return nil, fmt.Errorf("no connections left for the %d unmatched urls", len(all.urls))
+		}
+		pools = append(pools, all)
+	} else if all.workers > 0 {
+		return nil, fmt.Errorf("connections add up to %d, not -c %d", params.C-all.workers, params.C)
+	}
+	return pools, nil
+}
+
+// assignWorkers returns the pool of each of n workers, taking one worker of
+// every pool in turn so all pools run when n is below C.
+func assignWorkers(pools []*targetPool, n int) []*targetPool {
+	assigned := make([]*targetPool, 0, n)
+	left := make([]int, len(pools))
+	for i, pool := range pools {
+		left[i] = pool.workers
+	}
+	for len(assigned) < n {
+		for i, pool := range pools {
+			if left[i] > 0 && len(assigned) < n {
+				assigned = append(assigned, pool)
+				left[i]--
+			}
+		}
+	}
+	return assigned
+}
+
+// headerTemplate holds the parsed functions of the values of one -H name, nil
+// for the values without any.
+type headerTemplate struct {
+	name   string
+	values []*template.Template
+}
+
+// templateData is the data the templates are executed with, {{.Iteration}}
+// and the like, the current request of a worker goroutine as set by runWorker.
+type templateData struct {
+	Iteration     int64 // Requests of the worker goroutine before this one
+	GlobalRequest int64 // Requests of the run on this node before this one
+	TotalRequests int64 // N, 0 when the run is not bound by a request count
+}
+
+// templateData returns the data of the current request of client, or a zero
+// request outside the workers.
+func (b *StressWorker) templateData(client *StressClient) *templateData {
+	if client != nil && client.data != nil {
+		return client.data
+	}
+	return &templateData{TotalRequests: int64(b.RequestParams.N)}
+}
+
+// workerTemplates returns the clones of indexTemplates for the worker
+// goroutine index, whose goroutineIndex returns it and whose iteration and
+// globalRequest read data.
+func (b *StressWorker) workerTemplates(index int, data *templateData) map[*template.Template]*template.Template {
+	if len(b.indexTemplates) == 0 {
+		return nil
+	}
+	funcs := template.FuncMap{
+		"goroutineIndex": func() int64 { return int64(index) },
+		"iteration":      func() int64 { return data.Iteration },
+		"globalRequest":  func() int64 { return data.GlobalRequest },
+	}
+	templates := make(map[*template.Template]*template.Template, len(b.indexTemplates))
+	for _, t := range b.indexTemplates {
+		if clone, err := t.Clone(); err == nil {
+			templates[t] = clone.Funcs(funcs)
+		}
+	}
+	return templates
+}
+
+// renderHeader returns the values of a -H name with the functions executed,
+// client selects the worker templates and is nil outside the workers.
+func (b *StressWorker) renderHeader(h headerTemplate, client *StressClient) ([]string, error) {
+	values := make([]string, len(h.values))
+	for i, t := range h.values {
+		if t == nil {
+			values[i] = b.RequestParams.Headers[h.name][i]
+			continue
+		}
+		var buf strings.Builder
+		if err := client.template(t).Execute(&buf, b.templateData(client)); err != nil {
+			return nil, b.templateError(err)
+		}
+		values[i] = buf.String()
+	}
+	return values, nil
+}
+
+// templateError logs the first error of a template function and returns
+// ErrTemplate, the request is not sent with a partial rendering.
+func (b *StressWorker) templateError(err error) error {
+	b.templateOnce.Do(func() {
+		b.logf(VERBOSE_ERROR, "Execute function err: %v, counted as %v from now on\n", err, ErrTemplate)
+	})
+	return ErrTemplate
+}
+
+// dialWs dials url with the headers of the run, rendered with the
+// templates of client.
+func (b *StressWorker) dialWs(url string, client *StressClient) (*websocket.Conn, error) {
+	connectTimeout, handshakeTimeout, _ := b.RequestParams.timeouts()
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = handshakeTimeout
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return b.trackConn(b.dial(ctx, b.newDialer(connectTimeout), network, addr))
+	}
+	header := http.Header(b.RequestParams.Headers)
+	if len(b.headerTemplates) > 0 {
+		header = header.Clone()
+		for _, h := range b.headerTemplates {
+			values, err := b.renderHeader(h, client)
+			if err != nil {
+				return nil, err
+			}
+			header[h.name] = values
+		}
+	}
+	if len(b.RequestParams.HeaderPools) > 0 {
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		for name, lines := range b.RequestParams.HeaderPools {
+			header.Set(name, randomLine(lines))
+		}
+	}
+	if bearer, ok := b.bearer.Load().(string); ok {
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Set("Authorization", bearer)
+	}
+	if b.RequestParams.NoCacheHeaders {
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Pragma", "no-cache")
+	}
+	c, _, err := dialer.DialContext(b.requestContext(), url, header)
+	return c, err
+}
+
+func closeWs(c *websocket.Conn) {
+	c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.Close()
+}
+
+// executeBody renders the request body into w and returns the index of the
+// selected RequestBodies entry, or -1 when the single RequestBody is used.
+func (b *StressWorker) executeBody(w *bytes.Buffer, client *StressClient) (int, error) {
+	if len(b.bodyTemplates) > 0 {
+		var idx int
+		if b.RequestParams.BodyOrder == BODY_ORDER_SEQUENTIAL {
+			idx = int((atomic.AddUint64(&b.bodyNext, 1) - 1) % uint64(len(b.bodyTemplates)))
+		} else {
+			idx = rand.Intn(len(b.bodyTemplates))
+		}
+		if tmpl := b.bodyTemplates[idx]; tmpl != nil {
+			if err := client.template(tmpl).Execute(w, b.templateData(client)); err != nil {
+				return idx, b.templateError(err)
+			}
+		} else {
+			w.WriteString(b.RequestParams.RequestBodies[idx])
+		}
+		return idx, nil
+	}
+
+	if len(b.RequestParams.RequestBody) > 0 && b.bodyTemplate != nil {
+		if err := client.template(b.bodyTemplate).Execute(w, b.templateData(client)); err != nil {
+			return -1, b.templateError(err)
+		}
+	} else {
+		w.WriteString(b.RequestParams.RequestBody)
+	}
+	return -1, nil
+}
+
+// doClient sends one request, per request details other than the status code
+// and size are recorded in res.
+func (b *StressWorker) doClient(client *StressClient, res *result) (code int, size int64, err error) {
+	urlBytes, bodyBytes := getBuffer(), getBuffer()
+	defer putBuffer(urlBytes)
+	defer putBuffer(bodyBytes)
+
+	randv := rand.Intn(len(b.RequestParams.Urls))
+	method := b.RequestParams.RequestMethod
+	if res.replay != nil {
+		randv = res.replay.Url
+		if res.replay.Method != "" {
+			method = res.replay.Method
+		}
+	} else if res.target != nil {
+		randv = res.target.urls[rand.Intn(len(res.target.urls))]
+	}
+	if res.replay == nil && randv < len(b.RequestParams.UrlMethods) && b.RequestParams.UrlMethods[randv] != "" {
+		method = b.RequestParams.UrlMethods[randv]
+	}
+	url := b.RequestParams.Urls[randv]
+
+	if b.urlTemplates[randv] != nil && len(url) > 0 {
+		if err = client.template(b.urlTemplates[randv]).Execute(urlBytes, b.templateData(client)); err != nil {
+			err = b.templateError(err)
+			return
+		}
+	} else {
+		urlBytes.WriteString(url)
+	}
+	urlStr := urlBytes.String()
+	if len(b.RequestParams.Query) > 0 && b.RequestParams.RequestHttpType != TYPE_TCP {
+		pairs := make([]string, len(b.RequestParams.Query))
+		for i := range b.RequestParams.Query {
+			pairs[i] = b.RequestParams.Query[i].pair()
+		}
+		urlStr = addQuery(urlStr, pairs...)
+	}
+	if b.RequestParams.CacheBust != "" && b.RequestParams.RequestHttpType != TYPE_TCP {
+		urlStr = cacheBust(urlStr, b.RequestParams.CacheBust)
+	}
+	if b.RequestParams.SlowThreshold > 0 {
+		res.url = urlStr
+	}
+
+	bodyIndex, err := b.executeBody(bodyBytes, client)
+	if err != nil {
+		return
+	}
+
+	if b.RequestParams.RequestHttpType == TYPE_TCP {
+		if _, _, addrErr := net.SplitHostPort(urlStr); addrErr != nil {
+			b.logf(VERBOSE_ERROR, "Parse addr err: %v\n", addrErr)
+			err = ErrUrl
+			return
+		}
+	} else if b.RequestParams.ValidateUrls == VALIDATE_STRICT && !checkURL(urlStr) {
+		err = ErrInvalidUrl
+		return
+	}
+
+	if b.logEnabled(VERBOSE_TRACE) {
+		b.logf(VERBOSE_TRACE, "Request url: %s\n", urlStr)
+		if len(b.bodyTemplates) > 0 {
+			b.logf(VERBOSE_TRACE, "Request body[%d]: %s\n", bodyIndex, bodyBytes.String())
+		} else {
+			b.logf(VERBOSE_TRACE, "Request body: %s\n", bodyBytes.String())
+		}
+	}
+
+	switch b.RequestParams.RequestHttpType {
+	case TYPE_HTTP1, TYPE_HTTP2, TYPE_HTTP3:
+		httpClient, owner := client.httpClient, client
+		if len(b.h2Clients) > 0 {
+			shared, done := b.borrowH2Client()
+			defer done()
+			httpClient, owner = shared.httpClient, shared
+		}
+		if httpClient == nil {
+			err = ErrInitHttpClient
+			return
+		}
+		if randv < len(b.RequestParams.UrlServerNames) && b.RequestParams.UrlServerNames[randv] != "" {
+			httpClient = b.serverNameClient(owner, httpClient, b.RequestParams.UrlServerNames[randv])
+		}
+		// The body is copied out of the pooled buffer, the transport may
+		// still read it after Do returns.
+		var reqBody io.Reader
+		if bodyBytes.Len() > 0 {
+			reqBody = strings.NewReader(bodyBytes.String())
+		}
+		var sent *countReader
+		reqHeader := client.header(b.RequestParams.Headers)
+		for _, h := range b.headerTemplates {
+			values, renderErr := b.renderHeader(h, client)
+			if renderErr != nil {
+				err = renderErr
+				return
+			}
+			client.setHeaderValues(h.name, values)
+		}
+		for name, lines := range b.RequestParams.HeaderPools {
+			client.setHeader(name, randomLine(lines))
+		}
+		if bearer, ok := b.bearer.Load().(string); ok {
+			client.setHeader("Authorization", bearer)
+		}
+		if b.RequestParams.NoCacheHeaders {
+			client.setHeader("Cache-Control", "no-cache")
+			client.setHeader("Pragma", "no-cache")
+		}
+		// The transports never ask for gzip themselves, their transparent
+		// decoding would hide the compressed size, the body is decoded below.
+		encoding := b.RequestParams.acceptEncoding()
+		acceptEncoding := encoding != ACCEPT_NONE && method != http.MethodHead &&
+			reqHeader.Get("Accept-Encoding") == "" && reqHeader.Get("Range") == ""
+		if acceptEncoding {
+			client.setHeader("Accept-Encoding", encoding)
+		}
+		decodeGzip := acceptEncoding && encoding == ACCEPT_GZIP && !b.RequestParams.NoDecompress
+		cached, hasValidator := client.validators[urlStr]
+		if hasValidator {
+			if cached.etag != "" {
+				client.setHeader("If-None-Match", cached.etag)
+			}
+			if cached.lastModified != "" {
+				client.setHeader("If-Modified-Since", cached.lastModified)
+			}
+			res.conditional = true
+		}
+		if b.RequestParams.TracePropagation != "" {
+			var name, value string
+			res.traceId, name, value = newTraceHeader(b.RequestParams.TracePropagation)
+			client.setHeader(name, value)
+		}
+		if b.RequestParams.RequestIdHeader != "" {
+			res.requestId = newUUID()
+			client.setHeader(b.RequestParams.RequestIdHeader, res.requestId)
+		}
+		if len(b.formFields) > 0 || len(b.formFiles) > 0 {
+			pr, pw := io.Pipe()
+			defer pr.Close() // unblock the writer when the request fails early
+			mw := multipart.NewWriter(pw)
+			client.setHeader("Content-Type", mw.FormDataContentType())
+			go func() {
+				pw.CloseWithError(b.writeForm(mw, client))
+			}()
+			sent = &countReader{r: pr}
+			reqBody = sent
+		}
+		var streamSize int64
+		if streamPath := b.RequestParams.BodyStream; streamPath != "" {
+			f, openErr := os.Open(streamPath)
+			if openErr != nil {
+				err = openErr
+				return
+			}
+			defer f.Close()
+			if info, statErr := f.Stat(); statErr == nil {
+				streamSize = info.Size()
+			}
+			sent = &countReader{r: f}
+			reqBody = sent
+		}
+		var raw *countReader
+		var zipped int64 = -1 // Compressed size of an in-memory body
+		if b.RequestParams.CompressBody == COMPRESS_GZIP && (sent != nil || bodyBytes.Len() > 0) {
+			client.setHeader("Content-Encoding", COMPRESS_GZIP)
+			raw = &countReader{r: reqBody}
+			if sent == nil {
+				var buf bytes.Buffer
+				zw := getGzipWriter(&buf)
+				io.Copy(zw, raw)
+				zw.Close()
+				gzipWriterPool.Put(zw)
+				zipped = int64(buf.Len())
+				reqBody = &buf
+			} else {
+				// Compress streamed bodies on the fly.
+				pr, pw := io.Pipe()
+				defer pr.Close()
+				go func() {
+					zw := getGzipWriter(pw)
+					_, err := io.Copy(zw, raw)
+					if closeErr := zw.Close(); err == nil {
+						err = closeErr
+					}
+					gzipWriterPool.Put(zw)
+					pw.CloseWithError(err)
+				}()
+				sent = &countReader{r: pr}
+				reqBody = sent
+			}
+		}
+		req, reqErr := http.NewRequestWithContext(b.requestContext(), method, urlStr, reqBody)
+		if reqErr != nil {
+			var urlErr *gourl.Error
+			if errors.As(reqErr, &urlErr) {
+				err = ErrInvalidUrl
+			} else {
+				err = fmt.Errorf("%w, %s %s: %v", ErrBadRequest, method, urlStr, reqErr)
+			}
+			return
+		}
+		if streamPath := b.RequestParams.BodyStream; streamPath != "" && raw == nil {
+			req.ContentLength = streamSize
+			req.GetBody = func() (io.ReadCloser, error) {
+				return os.Open(streamPath)
+			}
+		}
+		req.Header = reqHeader
+		if randv < len(b.RequestParams.UrlHosts) && b.RequestParams.UrlHosts[randv] != "" {
+			req.Host = b.RequestParams.UrlHosts[randv]
+		}
+		var getConn time.Time
+		trace := &httptrace.ClientTrace{
+			GetConn: func(hostPort string) {
+				getConn = time.Now()
+			},
+			GotConn: func(info httptrace.GotConnInfo) {
+				res.gotConn, res.gotConnAt = true, time.Now()
+				res.connReused = info.Reused
+				if !info.Reused && !getConn.IsZero() {
+					res.connWait = time.Since(getConn)
+				}
+			},
+		}
+		if b.RequestParams.Output == OUTPUT_AB {
+			// The http1 transport writes and reads on separate goroutines.
+			var wrote int64
+			trace.WroteRequest = func(httptrace.WroteRequestInfo) {
+				atomic.StoreInt64(&wrote, time.Now().UnixNano())
+			}
+			trace.GotFirstResponseByte = func() {
+				if t := atomic.LoadInt64(&wrote); t > 0 {
+					res.waiting = time.Duration(time.Now().UnixNano() - t)
+				}
+			}
+			res.phases = true
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		if b.RequestParams.Quic0RTT && req.Method == http.MethodGet && client.http3Client != nil {
+			req.Method = http3.MethodGet0RTT
+		}
+		var stall context.CancelFunc
+		if b.RequestParams.StreamMetrics && b.RequestParams.StreamIdleTimeout > 0 {
+			ctx, cancel := context.WithCancel(req.Context())
+			defer cancel()
+			req, stall = req.WithContext(ctx), cancel
+		}
+		start := time.Now()
+		var resp *http.Response
+		var respErr error
+		if _, _, responseTimeout := b.RequestParams.timeouts(); responseTimeout > 0 && b.RequestParams.RequestHttpType != TYPE_HTTP1 {
+			// The http2 and http3 transports have no ResponseHeaderTimeout,
+			// the request is canceled if the headers are late.
+			ctx, cancel := context.WithCancel(req.Context())
+			defer cancel()
+			var late int32
+			timer := time.AfterFunc(responseTimeout, func() {
+				atomic.StoreInt32(&late, 1)
+				cancel()
+			})
+			resp, respErr = httpClient.Do(req.WithContext(ctx))
+			timer.Stop()
+			if respErr != nil && atomic.LoadInt32(&late) == 1 {
+				respErr = ErrResponseTimeout
+			}
+		} else {
+			resp, respErr = httpClient.Do(req)
+		}
+		err = respErr
+		if respErr == nil {
+			declared := resp.ContentLength // Of the body on the wire
+			wire := &countReader{r: resp.Body}
+			if decodeGzip && strings.EqualFold(resp.Header.Get("Content-Encoding"), COMPRESS_GZIP) {
+				// Like the transport, drop the headers of the compressed body.
+				resp.Header.Del("Content-Encoding")
+				resp.Header.Del("Content-Length")
+				resp.ContentLength = -1
+				resp.Uncompressed = true
+				resp.Body = &gzipBody{r: wire, body: resp.Body}
+			} else {
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{wire, resp.Body}
+			}
+			defer func() {
+				res.wireLength = atomic.LoadInt64(&wire.n)
+			}()
+			if res.phases {
+				res.server = resp.Header.Get("Server")
+			}
+			if res.proto = resp.Proto; res.proto == "" && resp.TLS != nil {
+				res.proto = resp.TLS.NegotiatedProtocol
+			}
+			size = resp.ContentLength
+			code = resp.StatusCode
+			if b.RequestParams.RespectRetryAfter && (code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable) {
+				if wait, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+					max := time.Duration(b.RequestParams.RetryAfterMax) * time.Millisecond
+					if max <= 0 {
+						max = RETRY_AFTER_MAX
+					}
+					if wait > max {
+						wait = max
+					}
+					res.throttled, res.backoff = true, wait
+				}
+			}
+			defer resp.Body.Close()
+			if res.requestId != "" {
+				echo := resp.Header.Get(b.RequestParams.RequestIdHeader)
+				res.echoMismatch = echo != "" && echo != res.requestId
+			}
+			if len(b.RequestParams.CaptureHeaders) > 0 {
+				res.captured = make(map[string]string, len(b.RequestParams.CaptureHeaders))
+				for _, name := range b.RequestParams.CaptureHeaders {
+					if res.captured[name] = resp.Header.Get(name); res.captured[name] == "" {
+						res.captured[name] = HEADER_ABSENT
+					}
+				}
+			}
+			var saved *savedResponse
+			if b.saveCh != nil && (code < 200 || code > 299 || res.echoMismatch) &&
+				atomic.AddInt64(&b.saveCount, 1) <= int64(b.RequestParams.SaveResponsesCount) {
+				saved = &savedResponse{
+					method:    method,
+					url:       urlStr,
+					reqHeader: reqHeader.Clone(),
+					reqBody:   append([]byte(nil), bodyBytes.Bytes()...),
+					resp:      resp,
+				}
+				var respBody bytes.Buffer
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(resp.Body, &limitWriter{w: &respBody, n: 1 << 20}), resp.Body}
+				defer func() {
+					saved.respBody = respBody.Bytes()
+					select {
+					case b.saveCh <- saved:
+					default: // drop rather than block the request path
+					}
+				}()
+			}
+			// Closing a partially read http1 body closes its connection
+			// instead of returning it to the pool, so -max-body-read and
+			// -discard-body=false trade keep-alive for not downloading.
+			expectedSum := b.RequestParams.VerifySha256
+			if b.RequestParams.VerifySha256Header != "" {
+				expectedSum = resp.Header.Get(b.RequestParams.VerifySha256Header)
+			}
+			var body io.Reader = resp.Body
+			var bodyHash hash.Hash
+			if b.RequestParams.VerifySha256 != "" || b.RequestParams.VerifySha256Header != "" {
+				bodyHash = sha256.New()
+				body = io.TeeReader(resp.Body, bodyHash)
+			}
+			switch {
+			case method == http.MethodHead:
+				size = 0 // No body whatever the Content-Length, the connection is reused as is
+			case b.RequestParams.SkipBody:
+				size = 0
+			case b.RequestParams.StreamMetrics:
+				var readErr error
+				if size, readErr = b.readStream(body, client.scratch(), start, stall, res); readErr == ErrStreamStall {
+					err = ErrStreamStall
+				} else if readErr != nil && classifyError(readErr) == ErrRequestTimeout {
+					err = ErrRequestTimeout
+				}
+			case b.RequestParams.MaxBodyRead > 0:
+				var readErr error
+				size, readErr = fastRead(io.LimitReader(body, b.RequestParams.MaxBodyRead), client.scratch())
+				if readErr != nil && classifyError(readErr) == ErrRequestTimeout {
+					err = ErrRequestTimeout // Timeout expired during the body download
+				} else if readErr == nil && resp.ProtoMajor == 1 && (resp.ContentLength < 0 || resp.ContentLength-size <= BODY_DRAIN_MAX) {
+					// Closed with unread bytes the http1 connection may not be
+					// reused, a short rest is drained without being counted.
+					fastRead(io.LimitReader(resp.Body, BODY_DRAIN_MAX), client.scratch())
+				}
+			default:
+				// Content-Length is checked, not trusted, it is the compressed
+				// size under gzip, compared with the bytes on the wire whether
+				// or not they are decoded.
+				var readErr error
+				size, readErr = fastRead(body, client.scratch())
+				if declared >= 0 && code != http.StatusNoContent && code != http.StatusNotModified &&
+					(readErr == nil || errors.Is(readErr, io.ErrUnexpectedEOF)) {
+					diff := atomic.LoadInt64(&wire.n) - declared
+					res.lengthMismatch = diff > b.RequestParams.LengthTolerance || -diff > b.RequestParams.LengthTolerance
+					res.declaredLength = declared
+				}
+				if readErr != nil && classifyError(readErr) == ErrRequestTimeout {
+					err = ErrRequestTimeout
+				}
+			}
+			if bodyHash != nil {
+				res.corrupt = !strings.EqualFold(hex.EncodeToString(bodyHash.Sum(nil)), strings.TrimSpace(expectedSum))
+			}
+			if b.RequestParams.Conditional {
+				client.updateValidator(urlStr, resp, size, cached, res)
+			}
+		}
+		if sent != nil {
+			res.sentLength = atomic.LoadInt64(&sent.n)
+		} else if respErr == nil {
+			// An in-memory body was sent whole once there is a response.
+			if res.sentLength = int64(bodyBytes.Len()); zipped >= 0 {
+				res.sentLength = zipped
+			}
+		}
+		if raw != nil {
+			res.bodyRawLength = atomic.LoadInt64(&raw.n)
+			if zipped >= 0 {
+				res.bodyZipLength = zipped
+			} else {
+				res.bodyZipLength = res.sentLength
+			}
+		}
+	case TYPE_WS:
+		wsClient := client.wsClient
+		if b.RequestParams.WsMode == WS_MODE_RECONNECT {
+			if wsClient, err = b.dialWs(urlStr, client); err != nil {
+				return
+			}
+			defer closeWs(wsClient)
+		}
+		if wsClient == nil {
+			err = ErrInitWsClient
+			return
+		}
+		wsClient.SetReadDeadline(b.RequestParams.requestDeadline())
+		if err = b.requestContext().Err(); err != nil {
+			return // Aborted before the deadline above was set
+		}
+		if err = wsClient.WriteMessage(websocket.TextMessage, bodyBytes.Bytes()); err != nil {
+			return
+		}
+		res.sentLength = int64(bodyBytes.Len())
+		if _, message, readErr := wsClient.ReadMessage(); readErr != nil {
+			err = readErr
+			return
+		} else {
+			size = int64(len(message))
+			res.wireLength = size
+			code = http.StatusOK
+		}
+	case TYPE_TCP:
+		tcpClient, tcpReader := client.tcpClient, client.tcpReader
+		if b.RequestParams.TcpReconnect {
+			if tcpClient, err = b.dialTcp(urlStr); err != nil {
+				return
+			}
+			defer tcpClient.Close()
+			tcpReader = bufio.NewReader(tcpClient)
+		}
+		if tcpClient == nil {
+			err = ErrInitTcpClient
+			return
+		}
+		tcpClient.SetDeadline(b.RequestParams.requestDeadline())
+		if err = b.requestContext().Err(); err != nil {
+			return // Aborted before the deadline above was set
+		}
+		if _, err = tcpClient.Write(bodyBytes.Bytes()); err != nil {
+			return
+		}
+		res.sentLength = int64(bodyBytes.Len())
+		if size, err = b.readTcp(tcpReader); err != nil {
+			return
+		}
+		res.wireLength = size
+		code = http.StatusOK
+	default:
+		// pass
+	}
+
+	return
+}
+
+// writeForm renders the multipart form fields and streams the form files into
+// mw, files are copied as they are read and never buffered in full.
+func (b *StressWorker) writeForm(mw *multipart.Writer, client *StressClient) error {
+	for _, field := range b.formFields {
+		w, err := mw.CreateFormField(field.name)
+		if err != nil {
+			return err
+		}
+		if field.value != nil {
+			if err = client.template(field.value).Execute(w, b.templateData(client)); err != nil {
+				return b.templateError(err)
+			}
+		}
+	}
+
+	for _, file := range b.formFiles {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			quoteEscaper.Replace(file.name), quoteEscaper.Replace(filepath.Base(file.path))))
+		h.Set("Content-Type", file.contentType)
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(file.path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// parseFormFile parses name=@path[;type=content-type].
+func parseFormFile(spec string) (formFile, error) {
+	var file formFile
+	idx := strings.Index(spec, "=@")
+	if idx <= 0 {
+		return file, ErrFormFile
+	}
+	file.name = spec[:idx]
+	parts := strings.Split(spec[idx+2:], ";")
+	file.path = parts[0]
+	if file.path == "" {
+		return file, ErrFormFile
+	}
+	for _, part := range parts[1:] {
+		if strings.HasPrefix(part, "type=") {
+			file.contentType = strings.TrimPrefix(part, "type=")
+		}
+	}
+	if file.contentType == "" {
+		file.contentType = "application/octet-stream"
+	}
+	return file, nil
+}
+
+// FormFilePath returns the path of a FormFiles entry, name=@path[;type=content-type].
+func FormFilePath(spec string) (string, error) {
+	file, err := parseFormFile(spec)
+	return file.path, err
+}
+
+// getBuffer returns an empty pooled buffer, put it back with putBuffer.
+func getBuffer() *bytes.Buffer {
+	if buf, ok := bufferPool.Get().(*bytes.Buffer); ok {
+		buf.Reset()
+		return buf
+	}
+	return new(bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	// Do not keep the occasional huge body around.
+	if buf.Cap() <= 64<<10 {
+		bufferPool.Put(buf)
+	}
+}
+
+// getGzipWriter returns a pooled gzip.Writer writing to w, put it back into
+// gzipWriterPool after Close.
+func getGzipWriter(w io.Writer) *gzip.Writer {
+	if zw, ok := gzipWriterPool.Get().(*gzip.Writer); ok {
+		zw.Reset(w)
+		return zw
+	}
+	return gzip.NewWriter(w)
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if zr, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		return zr, zr.Reset(r)
+	}
+	return gzip.NewReader(r)
+}
+
+// gzipBody decodes a gzip response body. The gzip header is read on the first
+// Read, so an empty body, such as the one of a 304, is not an error.
+type gzipBody struct {
+	r    io.Reader
+	zr   *gzip.Reader
+	err  error
+	body io.ReadCloser
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	if g.zr == nil && g.err == nil {
+		g.zr, g.err = getGzipReader(g.r)
+	}
+	if g.err != nil {
+		return 0, g.err
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gzipBody) Close() error {
+	if g.zr != nil {
+		gzipReaderPool.Put(g.zr)
+		g.zr, g.err = nil, io.ErrClosedPipe
+	}
+	return g.body.Close()
+}
+
+// limitWriter writes at most n bytes to w and silently drops the rest.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.n > 0 {
+		q := p
+		if int64(len(q)) > l.n {
+			q = q[:l.n]
+		}
+		n, err := l.w.Write(q)
+		l.n -= int64(n)
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+// countReader counts the bytes read through it.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// serverNameClient returns the client of c sending name as the TLS server
+// name, a copy of the http1 or http2 transport of httpClient created on first
+// use. The transports pool their connections by address only, so the targets
+// of one address with different names cannot share one. http3 keeps the url
+// host.
+func (b *StressWorker) serverNameClient(c *StressClient, httpClient *http.Client, name string) *http.Client {
+	c.serverNameLock.Lock()
+	defer c.serverNameLock.Unlock()
+	if named, ok := c.serverNames[name]; ok {
+		return named
+	}
+	named := httpClient
+	switch tr := httpClient.Transport.(type) {
+	case *http.Transport:
+		clone := tr.Clone()
+		clone.TLSClientConfig.ServerName = name
+		named = &http.Client{Timeout: httpClient.Timeout, Transport: clone}
+	case *http2.Transport:
+		named = b.newHttp2Client()
+		named.Transport.(*http2.Transport).TLSClientConfig.ServerName = name
+	}
+	if c.serverNames == nil {
+		c.serverNames = make(map[string]*http.Client)
+	}
+	c.serverNames[name] = named
+	return named
+}
+
+func (b *StressWorker) closeClient(client *StressClient) {
+	switch b.RequestParams.RequestHttpType {
+	case TYPE_HTTP1, TYPE_HTTP2:
+		if client.httpClient != nil {
+			client.httpClient.CloseIdleConnections()
+		}
+		for _, named := range client.serverNames {
+			named.CloseIdleConnections()
+		}
+	case TYPE_HTTP3:
+		for _, conn := range client.quicConns {
+			atomic.AddInt64(&b.quicConns, 1)
+			if conn.ConnectionState().TLS.Used0RTT {
+				atomic.AddInt64(&b.quic0RTTConns, 1)
+			}
+		}
+		if client.http3Client != nil {
+			client.http3Client.Close()
+		}
+		if client.udpConn != nil {
+			client.udpConn.Close()
+		}
+	case TYPE_WS:
+		if client.wsClient != nil {
+			closeWs(client.wsClient)
+		}
+	case TYPE_TCP:
+		if client.tcpClient != nil {
+			client.tcpClient.Close()
+		}
+	default:
+		// pass
+	}
+}
+
+// classifyError maps QUIC level errors, DNS failures, the connect, TLS,
+// response header and whole request timeouts and the exhaustion of the local
+// ports to distinct categories so they are not lumped together with generic
+// transport errors in ErrorDist.
+func classifyError(err error) error {
+	var (
+		handshakeErr *quic.HandshakeTimeoutError
+		idleErr      *quic.IdleTimeoutError
+		versionErr   *quic.VersionNegotiationError
+		resetErr     *quic.StatelessResetError
+		opErr        *net.OpError
+		dnsErr       *net.DNSError
+	)
+	switch {
+	case errors.As(err, &handshakeErr):
+		return ErrQuicHandshakeTimeout
+	case errors.As(err, &idleErr):
+		return ErrQuicIdleTimeout
+	case errors.As(err, &versionErr):
+		return ErrQuicVersionNegotiation
+	case errors.As(err, &resetErr):
+		return ErrQuicStatelessReset
+	case errors.Is(err, ErrTlsTimeout), strings.Contains(err.Error(), "TLS handshake timeout"):
+		return ErrTlsTimeout
+	case errors.Is(err, ErrResponseTimeout), strings.Contains(err.Error(), "timeout awaiting response headers"):
+		return ErrResponseTimeout
+	case errors.Is(err, ErrTemplate):
+		return ErrTemplate
+	case errors.Is(err, ErrBadRequest):
+		return ErrBadRequest
+	case errors.Is(err, ErrStreamStall):
+		return ErrStreamStall
+	case errors.Is(err, ErrRequestTimeout), strings.Contains(err.Error(), "Client.Timeout"):
+		return ErrRequestTimeout
+	case errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		return ErrDnsTimeout
+	case errors.As(err, &dnsErr):
+		return ErrDns
+	case errors.As(err, &opErr) && opErr.Op == "dial" &&
+		(errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EADDRINUSE)):
+		return ErrPortExhaustion
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return ErrConnectTimeout
+	}
+	return err
+}
+
+// isTimeout reports whether err aborted a request on a client-side timeout,
+// one of the timeout categories of classifyError, a deadline or a net.Error
+// timing out, rather than an error of the server or the network.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrConnectTimeout), errors.Is(err, ErrTlsTimeout),
+		errors.Is(err, ErrResponseTimeout), errors.Is(err, ErrRequestTimeout),
+		errors.Is(err, ErrDnsTimeout), errors.Is(err, ErrQuicHandshakeTimeout),
+		errors.Is(err, ErrQuicIdleTimeout), errors.Is(err, ErrStreamStall):
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	}
+	return false
+}
+
+// isRequestFailure reports whether err failed a single request, a timeout or
+// a refused, reset, closed or dropped ws connection, rather than the run
+// itself.
+func isRequestFailure(err error) bool {
+	var (
+		opErr      *net.OpError
+		dnsErr     *net.DNSError
+		versionErr *quic.VersionNegotiationError
+		resetErr   *quic.StatelessResetError
+	)
+	switch {
+	case isTimeout(err):
+		return true
+	case errors.As(err, &opErr), errors.As(err, &dnsErr), errors.As(err, &versionErr), errors.As(err, &resetErr):
+		return true
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case websocket.IsCloseError(err, websocket.CloseAbnormalClosure, websocket.CloseGoingAway):
+		return true
+	}
+	return false
+}
+
+type StressClient struct {
+	httpClient  *http.Client
+	http3Client *http3.RoundTripper
+	udpConn     net.PacketConn
+	quicConns   []quic.EarlyConnection
+
+	streams, peakStreams int64 // In-flight and peak http2 streams of a shared client
+	wsClient             *websocket.Conn
+	tcpClient            net.Conn
+	tcpReader            *bufio.Reader
+
+	readBuf    []byte                                    // Scratch buffer for discarding response bodies
+	reqHeader  http.Header                               // Per-worker clone of the -H headers
+	setKeys    []string                                  // Keys of reqHeader set for the current request only
+	validators map[string]validator                      // Of the urls, see -conditional-requests
+	templates  map[*template.Template]*template.Template // Per worker clones, see workerTemplates
+	data       *templateData                             // Of the current request, per worker
+
+	serverNameLock sync.Mutex
+	serverNames    map[string]*http.Client // By TLS server name, see serverNameClient
+}
+
+// template returns the clone of t for the worker of c, or t itself when it
+// does not call goroutineIndex. The clones are only read once created.
+func (c *StressClient) template(t *template.Template) *template.Template {
+	if c != nil {
+		if clone, ok := c.templates[t]; ok {
+			return clone
+		}
+	}
+	return t
+}
+
+// updateValidator records the validators of a full response of url, and the
+// bytes saved by a 304 to a conditional request.
+func (c *StressClient) updateValidator(url string, resp *http.Response, size int64, cached validator, res *result) {
+	if resp.StatusCode == http.StatusNotModified {
+		if res.conditional {
+			res.notModified, res.savedLength = true, cached.size
+		}
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		delete(c.validators, url)
+		return
+	}
+	if c.validators == nil {
+		c.validators = make(map[string]validator)
+	}
+	if _, ok := c.validators[url]; !ok && len(c.validators) >= VALIDATORS_KEEP {
+		for k := range c.validators {
+			delete(c.validators, k) // Any one, to bound templated urls
+			break
+		}
+	}
+	c.validators[url] = validator{etag: etag, lastModified: lastModified, size: size}
+}
+
+func (c *StressClient) scratch() []byte {
+	if c.readBuf == nil {
+		c.readBuf = make([]byte, 4096)
+	}
+	return c.readBuf
+}
+
+// header returns the request header of the worker, cloned from base once,
+// with the values set by setHeader for the previous request restored.
+func (c *StressClient) header(base http.Header) http.Header {
+	if c.reqHeader == nil {
+		if c.reqHeader = base.Clone(); c.reqHeader == nil {
+			c.reqHeader = make(http.Header)
+		}
+	}
+	for _, k := range c.setKeys {
+		if v, ok := base[k]; ok {
+			c.reqHeader[k] = v // Set replaces the slice, base is never modified
+		} else {
+			delete(c.reqHeader, k)
+		}
+	}
+	c.setKeys = c.setKeys[:0]
+	return c.reqHeader
+}
+
+// setHeader sets a header of the current request on top of the -H ones.
+func (c *StressClient) setHeader(key, value string) {
+	c.setHeaderValues(key, []string{value})
+}
+
+// setHeaderValues replaces every value of a header of the current request.
+func (c *StressClient) setHeaderValues(key string, values []string) {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	c.reqHeader[key] = values
+	c.setKeys = append(c.setKeys, key)
+}
+
+// mergeShards combines the results of all workers once they are done.
+func (b *StressWorker) mergeShards() *StressResult {
+	merged := NewStressResult()
+	merged.MaxCardinality = b.RequestParams.MaxCardinality
+	if protoPrefix[b.RequestParams.RequestHttpType] != "" {
+		merged.HttpType = b.RequestParams.RequestHttpType
+	}
+	if b.RequestParams.Output == OUTPUT_AB {
+		merged.Url = b.RequestParams.Urls[0]
+		merged.Concurrency = b.RequestParams.C
+	}
+	if protoPrefix[b.RequestParams.RequestHttpType] != "" {
+		merged.Encoding = b.RequestParams.encodingMode()
+	}
+	merged.Timeout = int64(b.RequestParams.Timeout)
+	merged.Bottlenecks = b.bottlenecks
+	if b.RequestParams.RequestHttpType == TYPE_WS {
+		merged.WsMode = b.RequestParams.WsMode
+		if b.RequestParams.WsRecvOnly {
+			merged.RecvConns = b.RequestParams.C
+		}
+	}
+	if b.RequestParams.Qps > 0 && b.RequestParams.QpsGlobal == "" && !b.RequestParams.WsRecvOnly {
+		merged.TargetQps = int64(b.RequestParams.Qps * b.RequestParams.C)
+	}
+	if len(b.busyTimeline) > 0 {
+		merged.BusyTimeline, merged.Connections = b.busyTimeline, b.RequestParams.C
+	}
+	if b.schedule != nil && b.tokens == nil {
+		merged.RateDist = RATE_CONSTANT
+		if b.schedule.poisson {
+			merged.RateDist = RATE_POISSON
+		}
+	}
+	if b.RequestParams.BurstRate > 0 && !b.RequestParams.WsRecvOnly {
+		merged.Burst = fmt.Sprintf("rate=%d,duration=%v,interval=%v", b.RequestParams.BurstRate,
+			time.Duration(b.RequestParams.BurstDuration)*time.Millisecond, time.Duration(b.RequestParams.BurstInterval)*time.Millisecond)
+	}
+	if think := b.RequestParams.thinkString(); think != "" && !b.RequestParams.WsRecvOnly {
+		merged.Think = think
+		merged.ThinkWorkers = len(b.shards)
+	}
+	merged.Duration = int64(b.totalTime.Seconds() * SCALE_NUM)
+	merged.StopReason = b.stopReason
+	merged.Attempted = atomic.LoadInt64(&b.attempted)
+	merged.InFlight = atomic.LoadInt64(&b.inFlightAtCutoff)
+	merged.Drained = atomic.LoadInt64(&b.drained)
+	merged.DrainFailed = atomic.LoadInt64(&b.drainFailed)
+	merged.OAuth2Failures = atomic.LoadInt64(&b.oauth2Failures)
+	merged.QuicConns = atomic.LoadInt64(&b.quicConns)
+	merged.Quic0RTTConns = atomic.LoadInt64(&b.quic0RTTConns)
+	for _, client := range b.h2Clients {
+		merged.H2Conns++
+		merged.H2PeakStreams += atomic.LoadInt64(&client.peakStreams)
+	}
+
+	if b.RequestParams.PerWorkerBreakdown && !b.RequestParams.WsRecvOnly {
+		merged.Workers = make([]WorkerStats, len(b.shards))
+		for i, shard := range b.shards {
+			merged.Workers[i] = shard.workerStats(i)
+		}
+	}
+	merged.Combine(b.shards...)
+	return merged
+}
+
+// Snapshot returns the interim metrics from the atomic counters while the
+// workers are running. With Options.Live it also has the status codes and
+// errors so far, and in Lats the latencies of the last LIVE_WINDOW seconds.
+func (b *StressWorker) Snapshot() *StressResult {
+	snapshot := &StressResult{
+		LatsTotal: atomic.LoadInt64(&b.completed),
+		Attempted: atomic.LoadInt64(&b.attempted),
+	}
+	if b.Options.Live {
+		snapshot.StatusCodeDist = make(map[int]int)
+		snapshot.ErrorDist = make(map[string]int)
+		snapshot.Lats = make(map[string]int64)
+		lives, _ := b.lives.Load().([]*liveStats)
+		for _, live := range lives {
+			live.fill(snapshot)
+		}
+	}
+	return snapshot
+}
+
+func (b *StressWorker) collectReport() {
+	b.wg.Add(1)
+
+	go func() {
+		// No time limit when Duration is 0, a nil channel never fires.
+		var timeTickerC <-chan time.Time
+		if b.RequestParams.Duration > 0 {
+			timeTicker := time.NewTicker(time.Duration(b.RequestParams.Duration) * time.Second)
+			defer timeTicker.Stop()
+			timeTickerC = timeTicker.C
+		}
+		var drainC <-chan time.Time
+		// The busy workers, the ones waiting for the rate limit or thinking
+		// are idle.
+		busyTicker := time.NewTicker(time.Second)
+		defer busyTicker.Stop()
+		b.busyTimeline = make(map[int64]int64)
+		host := newHostStats()
+		defer b.wg.Done()
+		for {
+			select {
+			case now := <-busyTicker.C:
+				if atomic.LoadInt32(&b.draining) == 0 && !b.RequestParams.WsRecvOnly {
+					b.busyTimeline[now.Unix()] = atomic.LoadInt64(&b.inFlight)
+				}
+				host.sample(now)
+			case <-b.done:
+				b.bottlenecks = host.bottlenecks(time.Now())
+				b.currentResult = b.mergeShards()
+				b.resultList = append(b.resultList, b.currentResult)
+				return
+			case <-timeTickerC:
+				b.logf(VERBOSE_INFO, "Time ticker upcoming, duration: %ds\n", b.RequestParams.Duration)
+				timeTickerC = nil
+				b.SetStopReason(STOP_DURATION)
+				// No new requests from now on, the ones in flight end within
+				// Drain and are counted apart, the stragglers are aborted.
+				atomic.StoreInt64(&b.cutoff, time.Now().UnixNano())
+				atomic.StoreInt32(&b.draining, 1)
+				b.Stop(false, nil)
+				atomic.StoreInt64(&b.inFlightAtCutoff, atomic.LoadInt64(&b.inFlight))
+				if b.RequestParams.Drain > 0 {
+					drainC = time.After(time.Duration(b.RequestParams.Drain) * time.Millisecond)
+				} else {
+					b.Abort()
+				}
+			case <-drainC:
+				b.Abort()
+			}
+		}
+	}()
+}
+
+// readStream reads a -stream-metrics response body as it arrives into res,
+// every read returning bytes is a chunk. stall cancels the request when no
+// chunk comes for StreamIdleTimeout, the read then fails with ErrStreamStall.
+func (b *StressWorker) readStream(body io.Reader, buf []byte, start time.Time, stall context.CancelFunc, res *result) (int64, error) {
+	var stalled int32
+	var timer *time.Timer
+	idle := time.Duration(b.RequestParams.StreamIdleTimeout) * time.Millisecond
+	if stall != nil {
+		timer = time.AfterFunc(idle, func() {
+			atomic.StoreInt32(&stalled, 1)
+			stall()
+		})
+		defer timer.Stop()
+	}
+	var n int64
+	var first, last time.Time
+	for {
+		n1, err := body.Read(buf[0:cap(buf)])
+		if n1 > 0 {
+			if last = time.Now(); first.IsZero() {
+				first = last
+			}
+			if timer != nil {
+				timer.Reset(idle)
+			}
+			n += int64(n1)
+			res.chunks++
+		}
+		if err != nil {
+			if atomic.LoadInt32(&stalled) == 1 {
+				return n, ErrStreamStall
+			}
+			if err != io.EOF {
+				return n, err
+			}
+			break
+		}
+	}
+	if res.chunks > 0 {
+		res.streamed = true
+		res.streamTtfc, res.streamDuration = first.Sub(start), last.Sub(first)
+		if res.chunks > 1 {
+			res.streamGap = res.streamDuration / time.Duration(res.chunks-1)
+		}
+	}
+	return n, nil
+}
+
+func fastRead(r io.Reader, b []byte) (int64, error) {
+	n := int64(0)
+	for {
+		n1, err := r.Read(b[0:cap(b)])
+		n += int64(n1) // A reader may return the last bytes with io.EOF
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+	}
+}
+
+// randomLine picks one of lines, it is safe for concurrent use.
+func randomLine(lines []string) string {
+	return lines[fnSrc.Int63()%int64(len(lines))]
+}
+
+func checkURL(url string) bool {
+	_, err := gourl.ParseRequestURI(url)
+	return err == nil
+}
+
+// validateUrls checks the static urls and the first rendering of the
+// templated ones before the run, later malformed urls are only counted as
+// ErrInvalidUrl.
+func (b *StressWorker) validateUrls() error {
+	var buf bytes.Buffer
+	for i, url := range b.RequestParams.Urls {
+		buf.Reset()
+		if b.urlTemplates[i] == nil || b.urlTemplates[i].Execute(&buf, b.templateData(nil)) != nil {
+			buf.Reset()
+			buf.WriteString(url)
+		}
+		if _, err := gourl.ParseRequestURI(buf.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ids returns the trace and request ids of the request for the failure logs.
+func (res *result) ids() string {
+	var s string
+	if res.traceId != "" {
+		s += ", trace id: " + res.traceId
+	}
+	if res.requestId != "" {
+		s += ", request id: " + res.requestId
+	}
+	return s
+}
+
+// newUUID returns a random UUID v4 for the -request-id-header.
+func newUUID() string {
+	var u [16]byte
+	crand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// cacheBust adds name with a random value to the query of url, before its
+// fragment if any.
+func cacheBust(url, name string) string {
+	return addQuery(url, gourl.QueryEscape(name)+"="+strconv.FormatUint(uint64(fnSrc.Int63()), 36))
+}
+
+// addQuery adds the escaped name=value pairs to the query of url, before its
+// fragment, in place of the parameters of url with the same names.
+func addQuery(url string, pairs ...string) string {
+	var fragment, query string
+	if idx := strings.IndexByte(url, '#'); idx >= 0 {
+		url, fragment = url[:idx], url[idx:]
+	}
+	if idx := strings.IndexByte(url, '?'); idx >= 0 {
+		url, query = url[:idx], url[idx+1:]
+	}
+	kept := make([]string, 0, strings.Count(query, "&")+1+len(pairs))
+	for _, param := range strings.Split(query, "&") {
+		name := param
+		if idx := strings.IndexByte(param, '='); idx >= 0 {
+			name = param[:idx]
+		}
+		replaced := false
+		for _, pair := range pairs {
+			if strings.HasPrefix(pair, name+"=") {
+				replaced = true
+				break
+			}
+		}
+		if param != "" && !replaced {
+			kept = append(kept, param)
+		}
+	}
+	return url + "?" + strings.Join(append(kept, pairs...), "&") + fragment
+}
+
+// newTraceHeader returns a fresh trace ID and the w3c traceparent or b3 single
+// header carrying it with a new span ID, sampled.
+func newTraceHeader(propagation string) (traceId, name, value string) {
+	var id [24]byte
+	crand.Read(id[:])
+	traceId, spanId := hex.EncodeToString(id[:16]), hex.EncodeToString(id[16:])
+	if propagation == TRACE_B3 {
+		return traceId, "b3", traceId + "-" + spanId + "-1"
+	}
+	return traceId, "traceparent", "00-" + traceId + "-" + spanId + "-01"
+}
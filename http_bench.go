@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
@@ -11,168 +10,29 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
+	"log"
+	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/textproto"
 	gourl "net/url"
 	"os"
-	"os/exec"
 	"os/signal"
+	"path"
 	"regexp"
 	"runtime"
 	"runtime/debug"
+	"runtime/pprof"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
-	"text/template"
 	"time"
 
-	"github.com/gorilla/websocket"
-	"github.com/lucas-clemente/quic-go/http3"
-	"golang.org/x/net/http2"
-)
-
-// ========================= function begin =========================
-// template functions
-func intSum(v ...int64) int64 {
-	var r int64
-	for _, r1 := range v {
-		r += int64(r1)
-	}
-	return r
-}
-
-func random(min, max int64) int64 {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Int63n(max-min) + min
-}
-
-func formatTime(now time.Time, fmt string) string {
-	switch fmt {
-	case "YMD":
-		return now.Format("20060201")
-	case "HMS":
-		return now.Format("150405")
-	default:
-		return now.Format("20060201-150405")
-	}
-}
-
-func uuidStr() string {
-	if out, err := exec.Command("uuidgen").Output(); err != nil {
-		return randomString(10)
-	} else {
-		return string(out)
-	}
-}
-
-// YMD = yyyyMMdd, HMS = HHmmss, YMDHMS = yyyyMMdd-HHmmss
-func date(fmt string) string {
-	return formatTime(time.Now(), fmt)
-}
-
-func randomDate(fmt string) string {
-	return formatTime(time.Unix(rand.Int63n(time.Now().Unix()-94608000)+94608000, 0), fmt)
-}
-
-func escape(u string) string {
-	return gourl.QueryEscape(u)
-}
-
-const (
-	letterIdxBits  = 6                    // 6 bits to represent a letter index
-	letterIdxMask  = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax   = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
-	letterBytes    = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	letterNumBytes = "0123456789"
-)
-
-var (
-	fnSrc = rand.NewSource(time.Now().UnixNano()) // for functions
-	fnMap = template.FuncMap{
-		"intSum":       intSum,
-		"random":       random,
-		"randomDate":   randomDate,
-		"randomString": randomString,
-		"randomNum":    randomNum,
-		"date":         date,
-		"UUID":         UUID,
-		"escape":       escape,
-		"getEnv":       getEnv,
-	}
-	fnUUID = uuidStr()
-
-	ErrInitWsClient   = errors.New("init ws client error")
-	ErrInitHttpClient = errors.New("init http client error")
-	ErrUrl            = errors.New("check url error")
-)
-
-func randomString(n int) string {
-	b := make([]byte, n)
-	for i, cache, remain := n-1, fnSrc.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = fnSrc.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
-	}
-	return string(b)
-}
-
-func randomNum(n int) string {
-	b := make([]byte, n)
-	for i, cache, remain := n-1, fnSrc.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = fnSrc.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterNumBytes) {
-			b[i] = letterNumBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
-	}
-	return string(b)
-}
-
-func UUID() string {
-	return fnUUID
-}
-
-func getEnv(key string) string {
-	return os.Getenv(key)
-}
-
-// ========================= function end =========================
-
-const (
-	CMD_START int = iota
-	CMD_STOP
-	CMD_METRICS
-
-	SCALE_NUM = 10000
-
-	HTTPTR_NUM = 20
-
-	TYPE_HTTP1 = "http1"
-	TYPE_HTTP2 = "http2"
-	TYPE_HTTP3 = "http3"
-	TYPE_WS    = "ws"
-
-	VERBOSE_TRACE = 0
-	VERBOSE_DEBUG = 1
-	VERBOSE_INFO  = 2
-	VERBOSE_ERROR = 3
-
-	INT_MAX = int(^uint(0) >> 1)
-	INT_MIN = ^INT_MAX
+	"github.com/linkxzhou/http_bench/bench"
 )
 
 type flagSlice []string
@@ -186,572 +46,294 @@ func (h *flagSlice) Set(value string) error {
 	return nil
 }
 
-type StressResult struct {
-	ErrCode  int    `json:"err_code"`
-	ErrMsg   string `json:"err_msg"`
-	AvgTotal int64  `json:"avg_total"`
-	Fastest  int64  `json:"fastest"`
-	Slowest  int64  `json:"slowest"`
-	Average  int64  `json:"average"`
-	Rps      int64  `json:"rps"`
-
-	ErrorDist      map[string]int   `json:"error_dist"`
-	StatusCodeDist map[int]int      `json:"status_code_dist"`
-	Lats           map[string]int64 `json:"lats"`
-	LatsTotal      int64            `json:"lats_total"`
-	SizeTotal      int64            `json:"size_total"`
-	Duration       int64            `json:"duration"`
-	Output         string           `json:"output"`
-	rdLock         sync.RWMutex     `json:"-"`
-}
-
-func (result *StressResult) print() {
-	result.rdLock.RLock()
-	defer result.rdLock.RUnlock()
-
-	switch result.Output {
-	case "csv":
-		fmt.Printf("Duration,Count\n")
-		for duration, val := range result.Lats {
-			fmt.Printf("%s,%d\n", duration, val/SCALE_NUM)
-		}
-		return
-	default:
-		// pass
-	}
-
-	if len(result.Lats) > 0 {
-		fmt.Printf("\nSummary:\n")
-		fmt.Printf("  Total:\t%4.3f secs\n", float32(result.Duration)/SCALE_NUM)
-		fmt.Printf("  Slowest:\t%4.3f secs\n", float32(result.Slowest)/SCALE_NUM)
-		fmt.Printf("  Fastest:\t%4.3f secs\n", float32(result.Fastest)/SCALE_NUM)
-		fmt.Printf("  Average:\t%4.3f secs\n", float32(result.Average)/SCALE_NUM)
-		fmt.Printf("  Requests/sec:\t%4.3f\n", float32(result.Rps)/SCALE_NUM)
-		if result.SizeTotal > 1073741824 {
-			fmt.Printf("  Total data:\t%4.3f GB\n", float64(result.SizeTotal)/1073741824)
-		} else if result.SizeTotal > 1048576 {
-			fmt.Printf("  Total data:\t%4.3f MB\n", float64(result.SizeTotal)/1048576)
-		} else if result.SizeTotal > 1024 {
-			fmt.Printf("  Total data:\t%4.3f KB\n", float64(result.SizeTotal)/1024)
-		} else if result.SizeTotal > 0 {
-			fmt.Printf("  Total data:\t%4.3f bytes\n", float64(result.SizeTotal))
-		} else {
-			// pass
-		}
-		fmt.Printf("  Size/request:\t%d bytes\n", result.SizeTotal/result.LatsTotal)
-		result.printStatusCodes()
-		result.printLatencies()
-	}
-
-	if len(result.ErrorDist) > 0 {
-		result.printErrors()
+func usageAndExit(msg string) {
+	if msg != "" {
+		fmt.Fprintf(os.Stderr, msg+"\n\n")
 	}
+	flag.Usage()
+	fmt.Fprintf(os.Stderr, "\n")
+	os.Exit(bench.EXIT_USAGE)
 }
 
-// Print latency distribution.
-func (result *StressResult) printLatencies() {
-	pctls := []int{10, 25, 50, 75, 90, 95, 99}
-	data := make([]string, len(pctls))
-	durationLats := make([]string, 0)
-	for duration, _ := range result.Lats {
-		durationLats = append(durationLats, duration)
-	}
-	sort.Strings(durationLats)
-	var j int = 0
-	var current int64 = 0
-	for i := 0; i < len(durationLats) && j < len(pctls); i++ {
-		current = current + result.Lats[durationLats[i]]
-		if int(current*100/result.LatsTotal) >= pctls[j] {
-			data[j] = durationLats[i]
-			j++
-		}
-	}
-	fmt.Printf("\nLatency distribution:\n")
-	for i := 0; i < len(pctls); i++ {
-		fmt.Printf("  %v%% in %s secs\n", pctls[i], data[i])
+func parseInputWithRegexp(input, regx string) ([]string, error) {
+	re := regexp.MustCompile(regx)
+	matches := re.FindStringSubmatch(input)
+	if len(matches) < 1 {
+		return nil, fmt.Errorf("could not parse the provided input; input = %v", input)
 	}
+	return matches, nil
 }
 
-// Print status code distribution.
-func (result *StressResult) printStatusCodes() {
-	fmt.Printf("\nStatus code distribution:\n")
-	for code, num := range result.StatusCodeDist {
-		fmt.Printf("  [%d]\t%d responses\n", code, num)
+// parseHeaders parses the -H headers, repeated names add values in order and
+// the names are canonicalized as in http.Header, so "cookie" and "Cookie" are
+// the same header.
+func parseHeaders(headers []string) (map[string][]string, error) {
+	parsed := make(map[string][]string, len(headers))
+	for _, h := range headers {
+		match, err := parseInputWithRegexp(h, headerRegexp)
+		if err != nil {
+			return nil, err
+		}
+		name := textproto.CanonicalMIMEHeaderKey(match[1])
+		parsed[name] = append(parsed[name], match[2])
 	}
+	return parsed, nil
 }
 
-func (result *StressResult) printErrors() {
-	fmt.Printf("\nError distribution:\n")
-	for err, num := range result.ErrorDist {
-		fmt.Printf("  [%d]\t%s\n", num, err)
+// parseHeaderFile parses a -header-file, one Name: value per line, blank
+// lines and lines starting with # are skipped.
+func parseHeaderFile(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-}
-
-func (result *StressResult) marshal() ([]byte, error) {
-	result.rdLock.RLock()
-	defer result.rdLock.RUnlock()
-
-	return json.Marshal(result)
-}
-
-func (result *StressResult) result(res *result) {
-	result.rdLock.Lock()
-	defer result.rdLock.Unlock()
-
-	if res.err != nil {
-		result.ErrorDist[res.err.Error()]++
-	} else {
-		result.Lats[fmt.Sprintf("%4.3f", res.duration.Seconds())]++
-		duration := int64(res.duration.Seconds() * SCALE_NUM)
-		result.LatsTotal++
-		if result.Slowest < duration {
-			result.Slowest = duration
-		}
-		if result.Fastest > duration {
-			result.Fastest = duration
+	var lines []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		result.AvgTotal += duration
-		result.StatusCodeDist[res.statusCode]++
-		if res.contentLength > 0 {
-			result.SizeTotal += res.contentLength
+		if _, err := parseInputWithRegexp(line, headerRegexp); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid header %q", path, i+1, line)
 		}
+		lines = append(lines, line)
 	}
+	return parseHeaders(lines)
 }
 
-func (result *StressResult) combine(resultList ...StressResult) {
-	result.rdLock.RLock()
-	defer result.rdLock.RUnlock()
-
-	for _, v := range resultList {
-		if result.Slowest < v.Slowest {
-			result.Slowest = v.Slowest
-		}
-		if result.Fastest > v.Fastest {
-			result.Fastest = v.Fastest
-		}
-		result.LatsTotal += v.LatsTotal
-		result.AvgTotal += v.AvgTotal
-		for code, c := range v.StatusCodeDist {
-			result.StatusCodeDist[code] += c
-		}
-		result.SizeTotal += v.SizeTotal
-		for code, c := range v.ErrorDist {
-			result.ErrorDist[code] += c
-		}
-		for lats, c := range v.Lats {
-			result.Lats[lats] += c
-		}
-	}
-
-	if result.Duration > 0 {
-		result.Rps = int64((result.LatsTotal * SCALE_NUM * SCALE_NUM) / result.Duration)
-	}
-
-	if result.LatsTotal > 0 {
-		result.Average = result.AvgTotal / result.LatsTotal
+// checkMethod checks a request method against the token grammar of RFC 7230,
+// known is false for a method other than the common ones, e.g. a typo of GET,
+// which is still sent as is.
+func checkMethod(method string) (known bool, err error) {
+	if !regexp.MustCompile(methodRegexp).MatchString(method) {
+		return false, fmt.Errorf("invalid method %q, it must be an http token", method)
 	}
-}
-
-type StressParameters struct {
-	SequenceId         int64               `json:"sequence_id"`         // Sequence
-	Cmd                int                 `json:"cmd"`                 // Commands
-	RequestMethod      string              `json:"request_method"`      // Request Method.
-	RequestBody        string              `json:"request_body"`        // Request Body.
-	RequestScriptBody  string              `json:"request_script_body"` // Request Script Body.
-	RequestHttpType    string              `json:"request_httptype"`    // Request HTTP Type
-	N                  int                 `json:"n"`                   // N is the total number of requests to make.
-	C                  int                 `json:"c"`                   // C is the concurrency level, the number of concurrent workers to run.
-	Duration           int64               `json:"duration"`            // D is the duration for stress test
-	Timeout            int                 `json:"timeout"`             // Timeout in ms.
-	Qps                int                 `json:"qps"`                 // Qps is the rate limit.
-	DisableCompression bool                `json:"disable_compression"` // DisableCompression is an option to disable compression in response
-	DisableKeepAlives  bool                `json:"disable_keepalives"`  // DisableKeepAlives is an option to prevents re-use of TCP connections between different HTTP requests
-	AuthUsername       string              `json:"auth_username"`       // Basic authentication, username:password.
-	AuthPassword       string              `json:"auth_password"`
-	Headers            map[string][]string `json:"headers"` // Custom HTTP header.
-	Urls               []string            `json:"urls"`
-	Output             string              `json:"output"` // Output represents the output type. If "csv" is provided, the output will be dumped as a csv stream.
-}
-
-func (p *StressParameters) String() string {
-	if body, err := json.MarshalIndent(p, "", "\t"); err != nil {
-		return err.Error()
-	} else {
-		return string(body)
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodTrace, http.MethodConnect:
+		return true, nil
 	}
+	return false, nil
 }
 
-type (
-	result struct {
-		err           error
-		statusCode    int
-		duration      time.Duration
-		contentLength int64
-	}
-
-	StressWorker struct {
-		RequestParams             *StressParameters
-		results                   chan *result
-		resultList                []StressResult
-		currentResult             StressResult
-		totalTime                 time.Duration
-		wg                        sync.WaitGroup // Wait some task finish
-		err                       error
-		bodyTemplate, urlTemplate *template.Template
-	}
-)
-
-func (b *StressWorker) Start() {
-	b.results = make(chan *result, 2*b.RequestParams.C+1)
-	b.resultList = make([]StressResult, 0)
-	b.collectReport()
-	b.runWorkers()
-	verbosePrint(VERBOSE_INFO, "Worker finished and wait result\n")
+// urlFileEntries are the urls of a -url-file and the overrides of their
+// lines, methods, hosts and serverNames have one entry per url, empty when
+// the line does not set it, or are nil when no line does.
+type urlFileEntries struct {
+	urls, methods      []string
+	hosts, serverNames []string
+	unknown            []string // Unrecognized option keys, each once
 }
 
-// Stop stop stress worker and wait coroutine finish
-func (b *StressWorker) Stop(wait bool, err error) {
-	b.RequestParams.Cmd = CMD_STOP
+// parseUrlFile reads a -url-file, urls separated by spaces or lines, a line
+// of "METHOD url" sends the url with that method instead of -m. The key=value
+// options of a line apply to all of its urls, host= sets the Host header and
+// sni= the TLS server name.
+func parseUrlFile(path string) (entries urlFileEntries, err error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		b.err = err
-	}
-	if wait {
-		b.wg.Wait()
-	}
-}
-
-func (b *StressWorker) IsStop() bool {
-	return b.RequestParams.Cmd == CMD_STOP
-}
-
-func (b *StressWorker) Append(result ...StressResult) {
-	b.resultList = append(b.resultList, result...)
-}
-
-func (b *StressWorker) Wait() *StressResult {
-	b.wg.Wait()
-
-	if len(b.resultList) <= 0 {
-		fmt.Fprintf(os.Stderr, "Internal err: stress test result empty")
-		return nil
-	}
-
-	b.resultList[0].combine(b.resultList[1:]...)
-	verbosePrint(VERBOSE_DEBUG, "resultList len: %d\n", len(b.resultList))
-	return &(b.resultList[0])
-}
-
-func (b *StressWorker) runWorker(n int, client *StressClient) {
-	var throttle <-chan time.Time
-	var runCounts int = 0
-
-	if b.RequestParams.Qps > 0 {
-		throttle = time.Tick(time.Duration(1e6/(b.RequestParams.Qps)) * time.Microsecond)
-	}
-
-	// random set seed
-	rand.Seed(time.Now().UnixNano())
-
-	for !b.IsStop() {
-		if n > 0 && runCounts > n {
-			break
-		}
-		runCounts++
-
-		if b.RequestParams.Qps > 0 {
-			<-throttle
-		}
-
-		var t = time.Now()
-
-		if code, size, err := b.doClient(client); err != nil {
-			verbosePrint(VERBOSE_ERROR, "err: %v\n", err)
-			b.Stop(false, err)
-			break
-		} else {
-			b.results <- &result{
-				statusCode:    code,
-				duration:      time.Now().Sub(t),
-				err:           err,
-				contentLength: size,
+		return entries, err
+	}
+	re, optionRe := regexp.MustCompile(methodRegexp), regexp.MustCompile(urlOptionRegexp)
+	var hasMethod, hasHost, hasServerName bool
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(string(data), "\n") {
+		var fields []string
+		var host, serverName string
+		for _, field := range strings.Fields(line) {
+			match := optionRe.FindStringSubmatch(field)
+			if match == nil {
+				fields = append(fields, field)
+				continue
 			}
-		}
-	}
-}
-
-func (b *StressWorker) runWorkers() {
-	if len(b.RequestParams.Urls) > 1 {
-		fmt.Printf("Running %d connections, @ random urls.txt\n", b.RequestParams.C)
-	} else {
-		fmt.Printf("Running %d connections, @ %s\n", b.RequestParams.C, b.RequestParams.Urls[0])
-	}
-
-	var (
-		start            = time.Now()
-		wg               sync.WaitGroup
-		err              error
-		bodyTemplateName = fmt.Sprintf("BODY-%d", b.RequestParams.SequenceId)
-		urlTemplateName  = fmt.Sprintf("URL-%d", b.RequestParams.SequenceId)
-	)
-
-	if b.urlTemplate, err = template.New(urlTemplateName).Funcs(fnMap).Parse(b.RequestParams.Urls[0]); err != nil {
-		verbosePrint(VERBOSE_ERROR, "Parse urls function err: "+err.Error()+"\n")
-	}
-
-	if b.bodyTemplate, err = template.New(bodyTemplateName).Funcs(fnMap).Parse(b.RequestParams.RequestBody); err != nil {
-		verbosePrint(VERBOSE_ERROR, "Parse request body function err: "+err.Error()+"\n")
-	}
-
-	// Ignore the case where b.RequestParams.N % b.RequestParams.C != 0.
-	for i := 0; i < b.RequestParams.C && !(b.IsStop()); i++ {
-		wg.Add(1)
-		go func() {
-			client := b.getClient()
-
-			defer func() {
-				b.closeClient(client)
-				wg.Done()
-				if r := recover(); r != nil {
-					fmt.Fprintf(os.Stderr, "Internal err: %v\n", r)
+			key, value := strings.ToLower(match[1]), match[2]
+			switch key {
+			case "host", "sni":
+				if value == "" {
+					return entries, fmt.Errorf("%s:%d: empty %s option", path, i+1, key)
+				}
+				if key == "host" {
+					host, hasHost = value, true
+				} else if net.ParseIP(value) != nil {
+					return entries, fmt.Errorf("%s:%d: sni %s must be a host name", path, i+1, value)
+				} else {
+					serverName, hasServerName = value, true
+				}
+			default:
+				if !seen[key] {
+					seen[key] = true
+					entries.unknown = append(entries.unknown, key)
 				}
-			}()
-
-			if client != nil {
-				b.runWorker(b.RequestParams.N/b.RequestParams.C, client)
 			}
-		}()
-	}
-
-	wg.Wait()
-	b.Stop(false, nil)
-	b.totalTime = time.Now().Sub(start)
-	close(b.results)
-}
-
-func (b *StressWorker) getClient() *StressClient {
-	client := &StressClient{}
-	switch b.RequestParams.RequestHttpType {
-	case TYPE_HTTP3:
-		client.httpClient = &http.Client{
-			Timeout: time.Duration(b.RequestParams.Timeout) * time.Millisecond,
-			Transport: &http3.RoundTripper{
-				TLSClientConfig: &tls.Config{
-					RootCAs:            http3Pool,
-					InsecureSkipVerify: true,
-				},
-			},
-		}
-	case TYPE_HTTP2:
-		client.httpClient = &http.Client{
-			Timeout: time.Duration(b.RequestParams.Timeout) * time.Millisecond,
-			Transport: &http2.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
-				DisableCompression: b.RequestParams.DisableCompression,
-			},
-		}
-	case TYPE_HTTP1:
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-			DisableCompression:  b.RequestParams.DisableCompression,
-			DisableKeepAlives:   b.RequestParams.DisableKeepAlives,
-			TLSHandshakeTimeout: time.Duration(b.RequestParams.Timeout) * time.Millisecond,
-			TLSNextProto:        make(map[string]func(string, *tls.Conn) http.RoundTripper),
-			DialContext: (&net.Dialer{
-				Timeout:   time.Duration(b.RequestParams.Timeout) * time.Second,
-				KeepAlive: time.Duration(60) * time.Second,
-			}).DialContext,
-			MaxIdleConns:        10,
-			MaxIdleConnsPerHost: 10,
-			MaxConnsPerHost:     10,
-			IdleConnTimeout:     time.Duration(90) * time.Second,
-		}
-		if proxyUrl != nil {
-			tr.Proxy = http.ProxyURL(proxyUrl)
-		}
-		client.httpClient = &http.Client{
-			Timeout:   time.Duration(b.RequestParams.Timeout) * time.Millisecond,
-			Transport: tr,
-		}
-	case TYPE_WS:
-		randv := rand.Intn(len(b.RequestParams.Urls)) % len(b.RequestParams.Urls)
-		url := b.RequestParams.Urls[randv]
-		if c, _, err := websocket.DefaultDialer.Dial(url, b.RequestParams.Headers); err != nil {
-			verbosePrint(VERBOSE_ERROR, "Websocket err: %s\n", err.Error())
-			return nil
-		} else {
-			client.wsClient = c
+		}
+		method := ""
+		if len(fields) == 2 && re.MatchString(fields[0]) {
+			method, fields = strings.ToUpper(fields[0]), fields[1:]
+			hasMethod = true
+		}
+		if len(fields) == 0 && (host != "" || serverName != "") {
+			return entries, fmt.Errorf("%s:%d: options without a url", path, i+1)
+		}
+		for _, url := range fields {
+			entries.urls = append(entries.urls, url)
+			entries.methods = append(entries.methods, method)
+			entries.hosts = append(entries.hosts, host)
+			entries.serverNames = append(entries.serverNames, serverName)
 		}
 	}
-
-	return client
-}
-
-func (b *StressWorker) doClient(client *StressClient) (code int, size int64, err error) {
-	var urlBytes, bodyBytes bytes.Buffer
-
-	randv := rand.Intn(len(b.RequestParams.Urls)) % len(b.RequestParams.Urls)
-	url := b.RequestParams.Urls[randv]
-
-	if b.urlTemplate != nil && len(url) > 0 {
-		b.urlTemplate.Execute(&urlBytes, nil)
-	} else {
-		urlBytes.WriteString(url)
+	if !hasMethod {
+		entries.methods = nil
 	}
-
-	if len(b.RequestParams.RequestBody) > 0 && b.bodyTemplate != nil {
-		b.bodyTemplate.Execute(&bodyBytes, nil)
-	} else {
-		bodyBytes.WriteString(b.RequestParams.RequestBody)
+	if !hasHost {
+		entries.hosts = nil
 	}
-
-	if !checkURL(urlBytes.String()) {
-		err = ErrUrl
-		return
+	if !hasServerName {
+		entries.serverNames = nil
 	}
+	return entries, nil
+}
 
-	verbosePrint(VERBOSE_TRACE, "Request url: %s\n", urlBytes.String())
-	verbosePrint(VERBOSE_TRACE, "Request body: %s\n", bodyBytes.String())
-
-	switch b.RequestParams.RequestHttpType {
-	case TYPE_HTTP1, TYPE_HTTP2, TYPE_HTTP3:
-		if client.httpClient == nil {
-			err = ErrInitHttpClient
-			return
+// parseAccessLog reads the requests of an access log in format, common or
+// combined, the urls are baseUrl followed by the logged paths. Lines which do
+// not match the format, or without a timestamp when timing, are only counted.
+func parseAccessLog(path, format, baseUrl string, timing bool) (urls []string, entries []bench.ReplayEntry, malformed int, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	re := regexp.MustCompile(accessLogRegexps[format])
+	index := make(map[string]int)
+	var first time.Time
+	baseUrl = strings.TrimRight(baseUrl, "/")
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
 		}
-		req, reqErr := http.NewRequest(b.RequestParams.RequestMethod, urlBytes.String(), strings.NewReader(bodyBytes.String()))
-		if reqErr != nil || req == nil {
-			err = errors.New("Request err: " + err.Error())
-			return
+		match := re.FindStringSubmatch(line)
+		if match == nil || !strings.HasPrefix(match[3], "/") {
+			malformed++
+			continue
 		}
-		req.Header = b.RequestParams.Headers
-		resp, respErr := client.httpClient.Do(req)
-		err = respErr
-		if respErr == nil {
-			size = resp.ContentLength
-			code = resp.StatusCode
-			defer resp.Body.Close()
-			if n, _ := fastRead(resp.Body); size <= 0 {
-				size = n
+		entry := bench.ReplayEntry{Method: match[2]}
+		if timing {
+			logged, err := time.Parse(ACCESS_LOG_TIME, match[1])
+			if err != nil {
+				malformed++
+				continue
 			}
+			if first.IsZero() {
+				first = logged
+			}
+			entry.Offset = int64(logged.Sub(first) / time.Millisecond)
 		}
-	case TYPE_WS:
-		if client.wsClient == nil {
-			err = ErrInitWsClient
-			return
-		}
-		if err = client.wsClient.WriteMessage(websocket.TextMessage, bodyBytes.Bytes()); err != nil {
-			return
-		}
-		if _, message, readErr := client.wsClient.ReadMessage(); readErr != nil {
-			err = readErr
-			return
-		} else {
-			size = int64(len(message))
-			code = http.StatusOK
+		url := baseUrl + match[3]
+		i, ok := index[url]
+		if !ok {
+			i = len(urls)
+			index[url] = i
+			urls = append(urls, url)
 		}
-	default:
-		// pass
+		entry.Url = i
+		entries = append(entries, entry)
 	}
-
-	return
+	if len(entries) == 0 {
+		return nil, nil, malformed, fmt.Errorf("%s: no requests", path)
+	}
+	return urls, entries, malformed, nil
 }
 
-func (b *StressWorker) closeClient(client *StressClient) {
-	switch b.RequestParams.RequestHttpType {
-	case TYPE_HTTP1, TYPE_HTTP2, TYPE_HTTP3:
-		if client.httpClient != nil {
-			client.httpClient.CloseIdleConnections()
+// parseTargetConcurrency parses a -target-concurrency list of prefix=workers.
+func parseTargetConcurrency(s string) ([]bench.TargetGroup, error) {
+	var groups []bench.TargetGroup
+	for _, v := range strings.Split(s, ",") {
+		idx := strings.LastIndex(v, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("%q must be prefix=connections", v)
 		}
-	case TYPE_WS:
-		if client.wsClient != nil {
-			client.wsClient.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		c, err := strconv.Atoi(strings.TrimSpace(v[idx+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%q must be prefix=connections", v)
 		}
-	default:
-		// TODO: add http3
+		groups = append(groups, bench.TargetGroup{Prefix: strings.TrimSpace(v[:idx]), C: c})
 	}
+	return groups, nil
 }
 
-type StressClient struct {
-	httpClient *http.Client
-	wsClient   *websocket.Conn
-}
-
-func (b *StressWorker) collectReport() {
-	b.wg.Add(1)
-
-	go func() {
-		timeTicker := time.NewTicker(time.Duration(b.RequestParams.Duration) * time.Second)
-		defer func() {
-			timeTicker.Stop()
-			b.wg.Done()
-		}()
-		b.currentResult = StressResult{
-			ErrorDist:      make(map[string]int, 0),
-			StatusCodeDist: make(map[int]int, 0),
-			Lats:           make(map[string]int64, 0),
-			Slowest:        int64(INT_MIN),
-			Fastest:        int64(INT_MAX),
-		}
-		for {
-			select {
-			case res, ok := <-b.results:
-				if !ok {
-					b.currentResult.Duration = int64(b.totalTime.Seconds() * SCALE_NUM)
-					b.resultList = append(b.resultList, b.currentResult)
-					return
-				}
-				b.currentResult.result(res)
-			case <-timeTicker.C:
-				verbosePrint(VERBOSE_INFO, "Time ticker upcoming, duration: %ds\n", b.RequestParams.Duration)
-				b.Stop(false, nil) // Time ticker exec Stop commands
-			}
+// parseLabels parses a -label, comma separated key=value pairs.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, v := range strings.Split(s, ",") {
+		idx := strings.Index(v, "=")
+		if idx <= 0 || strings.TrimSpace(v[:idx]) == "" {
+			return nil, fmt.Errorf("%q must be key=value", v)
 		}
-	}()
-}
-
-func usageAndExit(msg string) {
-	if msg != "" {
-		fmt.Fprintf(os.Stderr, msg+"\n\n")
+		labels[strings.TrimSpace(v[:idx])] = strings.TrimSpace(v[idx+1:])
 	}
-	flag.Usage()
-	fmt.Fprintf(os.Stderr, "\n")
-	os.Exit(1)
+	return labels, nil
 }
 
-func fastRead(r io.Reader) (int64, error) {
-	n := int64(0)
-	b := make([]byte, 0, 512)
-	for {
-		n1, err := r.Read(b[0:cap(b)])
-		if err != nil {
-			if err == io.EOF {
-				err = nil
-			}
-			return n, err
+// parseQuery parses a -query, name=randint:min:max or name=choice:a,b,c.
+func parseQuery(spec string) (bench.QueryParam, error) {
+	idx := strings.Index(spec, "=")
+	if idx <= 0 {
+		return bench.QueryParam{}, fmt.Errorf("%q must be name=randint:min:max or name=choice:a,b", spec)
+	}
+	q := bench.QueryParam{Name: spec[:idx]}
+	generator := strings.SplitN(spec[idx+1:], ":", 2)
+	switch {
+	case generator[0] == "randint" && len(generator) == 2:
+		bounds := strings.Split(generator[1], ":")
+		if len(bounds) != 2 {
+			break
+		}
+		min, minErr := strconv.ParseInt(bounds[0], 10, 64)
+		max, maxErr := strconv.ParseInt(bounds[1], 10, 64)
+		if minErr == nil && maxErr == nil && min <= max && uint64(max-min) < math.MaxInt64 {
+			q.Min, q.Max = min, max
+			return q, nil
 		}
-		n += int64(n1)
+	case generator[0] == "choice" && len(generator) == 2 && generator[1] != "":
+		q.Choices = strings.Split(generator[1], ",")
+		return q, nil
 	}
+	return bench.QueryParam{}, fmt.Errorf("%q must be name=randint:min:max or name=choice:a,b", spec)
 }
 
-func parseInputWithRegexp(input, regx string) ([]string, error) {
-	re := regexp.MustCompile(regx)
-	matches := re.FindStringSubmatch(input)
-	if len(matches) < 1 {
-		return nil, fmt.Errorf("could not parse the provided input; input = %v", input)
+// parseHeaderPool parses a -H-random, "Name: @path" with one value per line
+// of the file, blank lines and lines starting with # are skipped.
+func parseHeaderPool(v string) (string, []string, error) {
+	match, err := parseInputWithRegexp(v, headerRegexp)
+	if err != nil {
+		return "", nil, err
 	}
-	return matches, nil
+	if !strings.HasPrefix(match[2], "@") {
+		return "", nil, fmt.Errorf("%q must be Name: @path", v)
+	}
+	lines, err := readLines(match[2][1:])
+	if err != nil {
+		return "", nil, err
+	}
+	return textproto.CanonicalMIMEHeaderKey(match[1]), lines, nil
 }
 
-func checkURL(url string) bool {
-	if _, err := gourl.ParseRequestURI(url); err != nil {
-		fmt.Fprintln(os.Stderr, "Parse URL err: ", err.Error())
-		return false
+// readLines returns the trimmed lines of a file without the blank ones and
+// the ones starting with #, an empty file is an error.
+func readLines(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
 	}
-	return true
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s: no lines", path)
+	}
+	return lines, nil
 }
 
 func parseFile(fileName string, delimiter []rune) ([]string, error) {
@@ -787,118 +369,689 @@ func parseFile(fileName string, delimiter []rune) ([]string, error) {
 	return contentList, nil
 }
 
+// splitBodies splits content on lines containing only the delimiter.
+func splitBodies(content, delimiter string) []string {
+	var bodies []string
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimRight(line, "\r") == delimiter {
+			bodies = append(bodies, strings.Join(lines, "\n"))
+			lines = lines[:0]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	bodies = append(bodies, strings.Join(lines, "\n"))
+
+	result := bodies[:0]
+	for _, body := range bodies {
+		if body = strings.Trim(body, "\r\n"); len(body) > 0 {
+			result = append(result, body)
+		}
+	}
+	return result
+}
+
+// verboseEnabled reports whether verbosePrint logs at level, check it before
+// building costly arguments.
+func verboseEnabled(level int) bool {
+	return *verbose <= level && (!*quiet || level >= bench.VERBOSE_ERROR)
+}
+
+// verbosePrint logs to stderr, or -log-file, with a timestamp and the level,
+// the format is only applied when the level is enabled.
 func verbosePrint(level int, vfmt string, args ...interface{}) {
-	if *verbose > level {
+	if !verboseEnabled(level) {
 		return
 	}
 
 	switch level {
-	case VERBOSE_TRACE:
-		fmt.Printf("[VERBOSE TRACE] "+vfmt, args...)
-	case VERBOSE_DEBUG:
-		fmt.Printf("[VERBOSE DEBUG] "+vfmt, args...)
-	case VERBOSE_INFO:
-		fmt.Printf("[VERBOSE INFO] "+vfmt, args...)
+	case bench.VERBOSE_TRACE:
+		benchLog.Printf("[TRACE] "+vfmt, args...)
+	case bench.VERBOSE_DEBUG:
+		benchLog.Printf("[DEBUG] "+vfmt, args...)
+	case bench.VERBOSE_INFO:
+		benchLog.Printf("[INFO] "+vfmt, args...)
 	default:
-		fmt.Printf("[VERBOSE ERROR] "+vfmt, args...)
+		benchLog.Printf("[ERROR] "+vfmt, args...)
 	}
 }
 
-func parseTime(timeStr string) int64 {
-	var timeStrLen = len(timeStr) - 1
+// parseSize parses a byte size such as 512, 64KB, 1MB or 2GB, the units are
+// binary so 2GiB is the same as 2GB.
+func parseSize(sizeStr string) (int64, error) {
 	var multi int64 = 1
-	if timeStrLen > 0 {
-		switch timeStr[timeStrLen] {
-		case 's':
-			timeStr = timeStr[:timeStrLen]
-		case 'm':
-			timeStr = timeStr[:timeStrLen]
-			multi = 60
-		case 'h':
-			timeStr = timeStr[:timeStrLen]
-			multi = 3600
+	s := strings.ToUpper(strings.TrimSpace(sizeStr))
+	for _, unit := range []struct {
+		suffix string
+		multi  int64
+	}{{"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multi = strings.TrimSuffix(s, unit.suffix), unit.multi
+			break
 		}
 	}
-
-	t, err := strconv.ParseInt(timeStr, 10, 64)
-	if err != nil || t <= 0 {
-		usageAndExit("Duration parse err: " + err.Error())
+	v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: %s", sizeStr)
 	}
-
-	return multi * t
+	return v * multi, nil
 }
 
-func execStress(params StressParameters, stressTestPtr **StressWorker) *StressResult {
-	var stressResult *StressResult
-	var stressTest *StressWorker
-	if v, ok := stressList.Load(params.SequenceId); ok && v != nil {
-		stressTest = v.(*StressWorker)
-	} else {
-		stressTest = &StressWorker{
-			RequestParams: &params,
-		}
-		stressList.Store(params.SequenceId, stressTest)
-	}
-	*stressTestPtr = stressTest
-	switch params.Cmd {
-	case CMD_START:
-		if len(workerList) > 0 {
-			jsonBody, _ := json.Marshal(params)
-			resultList := requestWorkerList(jsonBody, stressTest)
-			stressTest.Append(resultList...)
-		} else {
-			stressTest.Start()
+// applyConfig sets the flags of the -config file which were not given on the
+// command line, keys are flag names and repeated flags take arrays.
+func applyConfig(path string, cliFlags map[string]bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&config); err != nil {
+		return err
+	}
+	for name, value := range config {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" || name == "dump-config" {
+			return fmt.Errorf("unknown key %q", name)
 		}
-		stressResult = stressTest.Wait()
-		if stressResult != nil {
-			stressResult.print()
+		if cliFlags[name] {
+			continue
 		}
-		stressList.Delete(params.SequenceId)
-	case CMD_STOP:
-		if len(workerList) > 0 {
-			jsonBody, _ := json.Marshal(params)
-			requestWorkerList(jsonBody, stressTest)
+		values, isArray := value.([]interface{})
+		if _, repeated := f.Value.(*flagSlice); isArray && !repeated {
+			return fmt.Errorf("%q takes a single value", name)
+		} else if !isArray {
+			values = []interface{}{value}
 		}
-		stressTest.Stop(true, nil)
-		stressList.Delete(params.SequenceId)
-	case CMD_METRICS:
-		if len(workerList) > 0 {
-			jsonBody, _ := json.Marshal(params)
-			if resultList := requestWorkerList(jsonBody, stressTest); len(resultList) > 0 {
-				stressResult = &StressResult{}
-				for i := 0; i < len(resultList); i++ {
-					stressResult.LatsTotal += resultList[i].LatsTotal
-				} // TODO: assign other variable
+		for _, v := range values {
+			var s string
+			switch v := v.(type) {
+			case string:
+				s = v
+			case json.Number:
+				s = v.String()
+			case bool:
+				s = strconv.FormatBool(v)
+			default:
+				return fmt.Errorf("invalid value of %q", name)
+			}
+			if err = flag.Set(name, s); err != nil {
+				return fmt.Errorf("%q: %v", name, err)
 			}
-		} else {
-			stressResult = &stressTest.currentResult
 		}
 	}
-	if stressTest.err != nil {
-		stressResult.ErrCode = -1
-		stressResult.ErrMsg = stressTest.err.Error()
-	}
-	return stressResult
+	return nil
+}
+
+// secretFlags are left out of -dump-config, they are given again on the
+// command line next to -config.
+var secretFlags = map[string]bool{"a": true, "bearer": true, "oauth2-client-secret": true}
+
+// dumpConfig returns the value of every flag but secretFlags as a -config
+// file, loading it again gives the same run and the same dump.
+func dumpConfig() ([]byte, error) {
+	config := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "dump-config" || strings.HasPrefix(f.Name, "test.") || secretFlags[f.Name] {
+			return
+		}
+		switch v := f.Value.(type) {
+		case *flagSlice:
+			config[f.Name] = append([]string{}, *v...)
+		case flag.Getter:
+			if d, ok := v.Get().(time.Duration); ok {
+				config[f.Name] = d.String()
+			} else {
+				config[f.Name] = v.Get()
+			}
+		default:
+			config[f.Name] = f.Value.String()
+		}
+	})
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// gcPercentNow returns the current GC percent, there is no getter.
+func gcPercentNow() int {
+	gc := debug.SetGCPercent(100)
+	debug.SetGCPercent(gc)
+	return gc
+}
+
+// printRuntime prints the effective runtime settings at VERBOSE_INFO.
+func printRuntime() {
+	gc := gcPercentNow()
+	gcStr, limitStr := strconv.Itoa(gc), "unlimited"
+	if gc < 0 {
+		gcStr = "off"
+	}
+	if limit := memoryLimit(); limit >= 0 && limit != math.MaxInt64 {
+		limitStr = strconv.FormatInt(limit>>20, 10) + "MiB"
+	}
+	verbosePrint(bench.VERBOSE_INFO, "Runtime GOMAXPROCS: %d, GC percent: %s, memory limit: %s\n",
+		runtime.GOMAXPROCS(0), gcStr, limitStr)
+}
+
+// parseBurst parses a -burst schedule such as rate=1000,duration=2s,interval=30s.
+func parseBurst(burstStr string) (rate int, duration, interval time.Duration, err error) {
+	for _, kv := range strings.Split(burstStr, ",") {
+		idx := strings.Index(kv, "=")
+		if idx < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid burst: %s", burstStr)
+		}
+		key, value := strings.TrimSpace(kv[:idx]), strings.TrimSpace(kv[idx+1:])
+		switch key {
+		case "rate":
+			rate, err = strconv.Atoi(value)
+		case "duration":
+			duration, err = time.ParseDuration(value)
+		case "interval":
+			interval, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown burst key %q", key)
+		}
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid burst: %s, %v", burstStr, err)
+		}
+	}
+	if rate <= 0 || duration < time.Millisecond || interval <= duration {
+		return 0, 0, 0, fmt.Errorf("invalid burst: %s, rate must be positive and duration at least 1ms and shorter than interval", burstStr)
+	}
+	return rate, duration, interval, nil
+}
+
+// parseThinkRandom parses a random think time range such as 200ms-2s.
+func parseThinkRandom(rangeStr string) (min, max time.Duration, err error) {
+	parts := strings.SplitN(rangeStr, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid think time range: %s", rangeStr)
+	}
+	if min, err = time.ParseDuration(strings.TrimSpace(parts[0])); err != nil {
+		return 0, 0, fmt.Errorf("invalid think time range: %s", rangeStr)
+	}
+	if max, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil {
+		return 0, 0, fmt.Errorf("invalid think time range: %s", rangeStr)
+	}
+	if min < 0 || max < min {
+		return 0, 0, fmt.Errorf("invalid think time range: %s", rangeStr)
+	}
+	return min, max, nil
+}
+
+// parsePortRange parses a -local-port-range such as 20000-60000.
+func parsePortRange(rangeStr string) (min, max int, err error) {
+	parts := strings.SplitN(rangeStr, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range: %s", rangeStr)
+	}
+	if min, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range: %s", rangeStr)
+	}
+	if max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range: %s", rangeStr)
+	}
+	if min < 1 || max > 65535 || max < min {
+		return 0, 0, fmt.Errorf("invalid port range: %s, ports must be 1-65535", rangeStr)
+	}
+	return min, max, nil
+}
+
+// parseTime parses a Go duration such as 500ms or 1m30s into a whole number
+// of unit, a bare integer is already in unit as in the older -t and -d forms.
+func parseTime(timeStr string, unit time.Duration) (int64, error) {
+	timeStr = strings.TrimSpace(timeStr)
+	if n, err := strconv.ParseInt(timeStr, 10, 64); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("negative duration %s", timeStr)
+		}
+		return n, nil
+	}
+	d, err := time.ParseDuration(timeStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, e.g. 500ms, 30s or 1m30s", timeStr)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %s", timeStr)
+	}
+	if d%unit != 0 {
+		return 0, fmt.Errorf("duration %s is not a whole number of %v, the resolution of this flag", timeStr, unit)
+	}
+	return int64(d / unit), nil
+}
+
+// parseTimeout parses -t into milliseconds, 0 means no timeout.
+func parseTimeout(timeStr string) (int, error) {
+	timeout, err := parseTime(timeStr, time.Millisecond)
+	if err != nil {
+		return 0, err
+	}
+	if timeout > int64(bench.INT_MAX) || timeout > int64(math.MaxInt64/time.Millisecond) {
+		return 0, fmt.Errorf("timeout %s is too long", timeStr)
+	}
+	return int(timeout), nil
+}
+
+// runStress runs params on stressTest, here or on the -W workers, and returns
+// the result unprinted.
+func runStress(ctx context.Context, params bench.StressParameters, stressTest *bench.StressWorker) *bench.StressResult {
+	var stressResult *bench.StressResult
+	started := time.Now()
+	if len(params.Workers) > 0 {
+		// The workers abort on their own if this process dies, see
+		// watchCoordinator.
+		params.Keepalive = int64(KEEPALIVE_INTERVAL / time.Millisecond)
+		if params.Duration > 0 {
+			deadline := time.Now().Add(time.Duration(params.Duration)*time.Second +
+				time.Duration(params.Drain)*time.Millisecond + DEADLINE_GRACE)
+			params.Deadline = deadline.UnixNano() / int64(time.Millisecond)
+		}
+		stopKeepalive := sendKeepalives(params, stressTest)
+		var tokens io.Closer
+		if params.QpsGlobal != "" {
+			var err error
+			if tokens, err = bench.ServeTokens(params.QpsGlobal, &params); err != nil {
+				stopKeepalive()
+				fmt.Fprintf(os.Stderr, "Token server listen err: %s\n", err.Error())
+				return &bench.StressResult{ErrCode: -1, ErrMsg: err.Error()}
+			}
+		}
+		resultList := requestWorkerList(params, stressTest)
+		stopKeepalive()
+		if tokens != nil {
+			tokens.Close()
+		}
+		stressTest.Append(resultList...)
+		stressResult = stressTest.Wait()
+	} else {
+		stopWatch := watchCoordinator(params, stressTest)
+		stopUI := func() {}
+		if stressTest.Options.Live {
+			stopUI = startUI(params, stressTest)
+		}
+		stressResult = stressTest.Run(ctx)
+		stopUI()
+		stopWatch()
+	}
+	if stressResult != nil && params.QpsGlobal != "" {
+		stressResult.TargetQps = int64(params.Qps * params.C)
+	}
+	if stressResult != nil {
+		stressResult.Output = params.Output
+		stressResult.Labels = params.Labels
+		stressResult.Meta = runMeta(params, started)
+	}
+	return stressResult
+}
+
+// newSequenceId returns the id of a new run, the time in ns, and above the
+// previous one so the runs of one process never share an id.
+func newSequenceId() int64 {
+	for {
+		last := atomic.LoadInt64(&lastSequenceId)
+		id := time.Now().UnixNano()
+		if id <= last {
+			id = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastSequenceId, last, id) {
+			return id
+		}
+	}
+}
+
+// hostParams splits params into the runs of its -url hosts, each with its
+// share of -c, or cPerUrl connections, and of -n.
+func hostParams(params bench.StressParameters, cPerUrl int) ([]bench.StressParameters, error) {
+	n := len(params.Urls)
+	if cPerUrl == 0 && params.C < n {
+		return nil, fmt.Errorf("-c %d is less than the %d -url hosts, raise it or set -c-per-url", params.C, n)
+	}
+	if params.N > 0 && params.N < n {
+		return nil, fmt.Errorf("-n %d is less than the %d -url hosts", params.N, n)
+	}
+	hosts := make([]bench.StressParameters, n)
+	for i, url := range params.Urls {
+		host := params
+		host.Urls = []string{url}
+		if i > 0 {
+			host.SequenceId = newSequenceId() // Apart from any other run, params has the first one
+		}
+		if host.C = qpsShare(params.C, i, n); cPerUrl > 0 {
+			host.C = cPerUrl
+		}
+		if params.N > 0 {
+			host.N = qpsShare(params.N, i, n)
+		}
+		hosts[i] = host
+	}
+	return hosts, nil
+}
+
+// runHosts runs the -url hosts at once, the workers registered in stressList,
+// prints the summary of each and returns their combined result, which keeps
+// the result of every host in Nodes. The hosts share the process, so its
+// bottlenecks are only warned about in the combined summary.
+func runHosts(ctx context.Context, params bench.StressParameters, hosts []bench.StressParameters) *bench.StressResult {
+	started := time.Now()
+	results := make([]*bench.StressResult, len(hosts))
+	var wg sync.WaitGroup
+	for i := range hosts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if v, ok := stressList.Load(hosts[i].SequenceId); ok {
+				results[i] = runStress(ctx, hosts[i], v.(*bench.StressWorker))
+			}
+			stressList.Delete(hosts[i].SequenceId)
+		}(i)
+	}
+	wg.Wait()
+
+	var resultList []*bench.StressResult
+	var bottlenecks []string
+	for i, result := range results {
+		url := hosts[i].Urls[0]
+		if result == nil || result.ErrCode != 0 {
+			fmt.Fprintf(os.Stderr, "Host %s: no result\n", url)
+			continue
+		}
+		result.Node = url
+		// Every host sampled the same process, one set of warnings is enough.
+		if bottlenecks == nil {
+			bottlenecks = result.Bottlenecks
+		}
+		result.Bottlenecks = nil
+		if !*quiet && (params.Output == "" || *outputFile != "") {
+			fmt.Printf("\nHost %s:\n", url)
+			result.Print(os.Stdout, *errorWidth)
+		}
+		resultList = append(resultList, result)
+	}
+	if len(resultList) == 0 {
+		return nil
+	}
+	combined := bench.CombineNodes(resultList, true)
+	combined.Bottlenecks = bottlenecks
+	combined.Meta = runMeta(params, started)
+	if !*quiet && (params.Output == "" || *outputFile != "") {
+		fmt.Printf("\nCombined, %d hosts:\n", len(resultList))
+	}
+	printResult(combined)
+	return combined
+}
+
+// execStress runs params.Cmd, canceling ctx aborts a run started here.
+func execStress(ctx context.Context, params bench.StressParameters, stressTestPtr **bench.StressWorker) *bench.StressResult {
+	var stressResult *bench.StressResult
+	var stressTest *bench.StressWorker
+	if params.Cmd == bench.CMD_START {
+		// A retried or double clicked start would run the same worker twice.
+		if _, loaded := startedList.LoadOrStore(params.SequenceId, true); loaded {
+			return &bench.StressResult{ErrCode: -1, ErrMsg: ErrRunning.Error()}
+		}
+		defer startedList.Delete(params.SequenceId)
+	}
+	if v, ok := stressList.Load(params.SequenceId); ok && v != nil {
+		stressTest = v.(*bench.StressWorker)
+	} else if params.Cmd != bench.CMD_START {
+		// Stop or query a run which is over, or was never started here.
+		if v, ok := finishedList.Load(params.SequenceId); ok {
+			return v.(*bench.StressResult)
+		}
+		return &bench.StressResult{ErrCode: -1, ErrMsg: ErrUnknownRun.Error()}
+	} else {
+		stressTest = bench.New(params)
+		stressTest.Options = workerOptions()
+		// Before stressList, so a stop finding the run can wait for it.
+		finishing.Store(params.SequenceId, make(chan struct{}))
+		stressList.Store(params.SequenceId, stressTest)
+	}
+	*stressTestPtr = stressTest
+	switch params.Cmd {
+	case bench.CMD_START:
+		stressResult = runStress(ctx, params, stressTest)
+		if stressResult != nil && stressResult.ErrCode == 0 {
+			printResult(stressResult)
+			// Keep answering stop and status for a while, see http_bench status.
+			finishedList.Store(params.SequenceId, stressResult)
+			time.AfterFunc(FINISHED_KEEP, func() {
+				finishedList.Delete(params.SequenceId)
+			})
+		}
+		stressList.Delete(params.SequenceId)
+		if done, ok := finishing.Load(params.SequenceId); ok {
+			finishing.Delete(params.SequenceId)
+			close(done.(chan struct{}))
+		}
+	case bench.CMD_STOP:
+		// The -W workers answer with their partial results once stopped, the
+		// run here merges them as they also end its requests to them.
+		stressTest.SetStopReason(bench.STOP_STOPPED)
+		var progress *bench.StressResult
+		if workers := stressTest.RequestParams.Workers; len(workers) > 0 {
+			progress = sumProgress(workers, requestWorkerList(params, stressTest))
+		}
+		stressTest.Stop(true, nil)
+		if stressResult = stoppedResult(params.SequenceId); stressResult == nil {
+			if stressResult = progress; stressResult == nil {
+				stressResult = stressTest.Snapshot()
+			}
+			stressResult.StopReason = bench.STOP_STOPPED
+		}
+		stressList.Delete(params.SequenceId)
+	case bench.CMD_KEEPALIVE:
+		keepalives.Store(params.SequenceId, time.Now())
+		stressResult = &bench.StressResult{}
+	case bench.CMD_METRICS:
+		if workers := stressTest.RequestParams.Workers; len(workers) > 0 {
+			stressResult = sumProgress(workers, requestWorkerList(params, stressTest))
+		} else {
+			stressResult = stressTest.Snapshot()
+		}
+	}
+	if stressTest.Err() != nil {
+		if stressResult == nil {
+			stressResult = &bench.StressResult{}
+		}
+		stressResult.ErrCode = -1
+		stressResult.ErrMsg = stressTest.Err().Error()
+	}
+	return stressResult
+}
+
+// stoppedResult waits up to STOP_WAIT for the run of id started by /api to
+// end and returns its final result, nil if it failed or is still running.
+func stoppedResult(id int64) *bench.StressResult {
+	if done, ok := finishing.Load(id); ok {
+		select {
+		case <-done.(chan struct{}):
+		case <-time.After(STOP_WAIT):
+		}
+	}
+	if v, ok := finishedList.Load(id); ok {
+		return v.(*bench.StressResult)
+	}
+	return nil
+}
+
+// printResult prints the result as -o, -o-file and -quiet ask.
+func printResult(result *bench.StressResult) {
+	if result.Output != "" {
+		w := io.Writer(os.Stdout)
+		if *outputFile != "" {
+			f, err := os.Create(*outputFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Output file err: %s\n", err.Error())
+				return
+			}
+			defer f.Close()
+			w = f
+		}
+		result.WriteOutput(w)
+		if *outputFile == "" {
+			return
+		}
+	}
+
+	if *quiet {
+		result.PrintQuiet(os.Stdout)
+		return
+	}
+	result.Print(os.Stdout, *errorWidth)
+}
+
+// workerOptions returns the bench.Options set by the flags.
+func workerOptions() bench.Options {
+	return bench.Options{
+		Verbose: *verbose,
+		Quiet:   *quiet,
+		Log:     benchLog,
+		Proxy:   proxyUrl,
+		RootCAs: http3Pool,
+	}
+}
+
+// sumProgress adds up the progress of the -W workers for stop and metrics,
+// the attempted and completed requests, the full results are combined once
+// the run is over. Nodes holds the progress of each of workers, with an
+// ErrMsg for those which did not answer.
+func sumProgress(workers []string, resultList []*bench.StressResult) *bench.StressResult {
+	stressResult := &bench.StressResult{}
+	answered := make(map[string]*bench.StressResult, len(resultList))
+	for i := 0; i < len(resultList); i++ {
+		stressResult.LatsTotal += resultList[i].LatsTotal
+		stressResult.Attempted += resultList[i].Attempted
+		answered[resultList[i].Node] = resultList[i]
+	}
+	for _, addr := range workers {
+		node := &bench.StressResult{Node: addr, ErrCode: -1, ErrMsg: ErrNoAnswer.Error()}
+		if result, ok := answered[addr]; ok {
+			node.LatsTotal, node.Attempted, node.StopReason = result.LatsTotal, result.Attempted, result.StopReason
+			node.ErrCode, node.ErrMsg = result.ErrCode, result.ErrMsg
+		}
+		stressResult.Nodes = append(stressResult.Nodes, node)
+	}
+	return stressResult
+}
+
+// checkWorkerShares checks that the -q rate and the -burst rate of params can
+// be split among its workers, a worker with a share of 0 would send without
+// any limit.
+func checkWorkerShares(params bench.StressParameters) error {
+	if params.QpsGlobal != "" {
+		if len(params.Workers) == 0 || params.Qps <= 0 {
+			return errors.New("-qps-global requires -q and -W")
+		}
+		return nil
+	}
+	if len(params.Workers) == 0 {
+		return nil
+	}
+	if params.Qps > 0 && params.Qps < len(params.Workers) {
+		return errors.New("q cannot be less than the number of -W workers, or use -qps-global")
+	}
+	if params.BurstRate > 0 && params.BurstRate < len(params.Workers) {
+		return errors.New("-burst rate cannot be less than the number of -W workers, or use -qps-global")
+	}
+	return nil
+}
+
+// checkWorkers returns an error naming the first of the workers of params
+// which is not an idle -listen worker, it asks each for the run of params
+// which it must not know yet.
+func checkWorkers(params bench.StressParameters) error {
+	body, _ := json.Marshal(bench.StressParameters{SequenceId: params.SequenceId, Cmd: bench.CMD_METRICS})
+	client := &http.Client{Timeout: WORKER_TIMEOUT}
+	errs := make([]error, len(params.Workers))
+	var wg sync.WaitGroup
+	for i, addr := range params.Workers {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			resp, err := client.Post("http://"+addr+"/", "application/json", bytes.NewReader(body))
+			if err != nil {
+				errs[i] = fmt.Errorf("worker %s: %v", addr, err)
+				return
+			}
+			defer resp.Body.Close()
+			var result bench.StressResult
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				errs[i] = fmt.Errorf("worker %s: not an http_bench worker", addr)
+			} else if result.ErrMsg != ErrUnknownRun.Error() {
+				errs[i] = fmt.Errorf("worker %s: already running sequence id %d", addr, params.SequenceId)
+			}
+		}(i, addr)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// qpsShare returns the -q share of the i-th of total distributed workers, the
+// remainder goes to the first workers so the shares add up to qps.
+func qpsShare(qps, i, total int) int {
+	share := qps / total
+	if i < qps%total {
+		share++
+	}
+	return share
+}
+
+// replayShare returns the -access-log requests of the i-th of total
+// distributed workers, every total-th one from i, so the workers together
+// replay the log once at its logged gaps.
+func replayShare(entries []bench.ReplayEntry, i, total int) []bench.ReplayEntry {
+	if len(entries) == 0 {
+		return nil
+	}
+	share := make([]bench.ReplayEntry, 0, len(entries)/total+1)
+	for j := i; j < len(entries); j += total {
+		share = append(share, entries[j])
+	}
+	return share
 }
 
 func handleWorker(w http.ResponseWriter, r *http.Request) {
 	if reqStr, err := ioutil.ReadAll(r.Body); err == nil {
-		var params StressParameters
-		var result *StressResult
+		var params bench.StressParameters
+		var result *bench.StressResult
 		if err := json.Unmarshal(reqStr, &params); err != nil {
 			fmt.Fprintf(os.Stderr, "Unmarshal body err: %s\n", err.Error())
-			result = &StressResult{
+			result = &bench.StressResult{
 				ErrCode: -1,
 				ErrMsg:  err.Error(),
 			}
 		} else {
-			verbosePrint(VERBOSE_DEBUG, "Request params: %s\n", params.String())
-			var stressWorker *StressWorker
-			result = execStress(params, &stressWorker)
+			verbosePrint(bench.VERBOSE_DEBUG, "Request params: %s\n", params.String())
+			var stressWorker *bench.StressWorker
+			if params.Cmd == bench.CMD_START {
+				// From the dashboard, the checks main does, and a dead -W
+				// worker would silently shrink the run.
+				err := params.CheckBurst()
+				if err == nil && len(params.Workers) > 0 {
+					err = checkWorkerShares(params)
+				}
+				if err == nil && len(params.Workers) > 0 {
+					err = checkWorkers(params)
+				}
+				if err != nil {
+					result = &bench.StressResult{ErrCode: -1, ErrMsg: err.Error()}
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			}
+			if result == nil {
+				result = execStress(context.Background(), params, &stressWorker)
+			}
 		}
 		if result != nil {
-			if wbody, err := result.marshal(); err != nil {
-				verbosePrint(VERBOSE_ERROR, "Marshal result: %v\n", err)
+			if wbody, err := result.Marshal(); err != nil {
+				verbosePrint(bench.VERBOSE_ERROR, "Marshal result: %v\n", err)
 			} else {
 				w.Write(wbody)
 			}
@@ -906,69 +1059,450 @@ func handleWorker(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func requestWorker(uri string, body []byte) (*StressResult, error) {
-	verbosePrint(VERBOSE_DEBUG, "Request body: %s\n", string(body))
+// handleResult serves GET /api/result/{sequence_id}?format=json|csv, the
+// result of a run in progress or finished within FINISHED_KEEP, as a download.
+func handleResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/result/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid sequence id", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	contentType := "application/json"
+	switch format {
+	case "":
+		format = bench.OUTPUT_JSON
+	case bench.OUTPUT_JSON:
+	case bench.OUTPUT_CSV:
+		contentType = "text/csv; charset=utf-8"
+	default:
+		http.Error(w, "invalid format, only json and csv are supported", http.StatusBadRequest)
+		return
+	}
+	var stressWorker *bench.StressWorker
+	result := execStress(r.Context(), bench.StressParameters{SequenceId: id, Cmd: bench.CMD_METRICS}, &stressWorker)
+	if result == nil || result.ErrMsg == ErrUnknownRun.Error() {
+		http.Error(w, ErrUnknownRun.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"http_bench-%d.%s\"", id, format))
+	result.WriteFormat(w, format)
+}
+
+// dashboardHandler serves the -dashboard page from the assets directory, a
+// directory path serving its index.html, and falls back to the default page
+// in the working directory when assets is empty or is missing the file.
+func dashboardHandler(assets string) http.Handler {
+	fallback := http.FileServer(http.Dir("./"))
+	if assets == "" {
+		return fallback
+	}
+	dir := http.Dir(assets)
+	custom := http.FileServer(dir)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// http.Dir cleans the path and rejects .. so it stays in assets
+		name := path.Clean("/" + r.URL.Path)
+		f, err := dir.Open(name)
+		if err == nil {
+			info, statErr := f.Stat()
+			f.Close()
+			if statErr == nil && info.IsDir() {
+				f, err = dir.Open(path.Join(name, "index.html"))
+				if err == nil {
+					f.Close()
+				}
+			} else {
+				err = statErr
+			}
+		}
+		if err != nil {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		custom.ServeHTTP(w, r)
+	})
+}
+
+// parseCorsOrigins parses -cors-origins, each one a scheme://host[:port]
+// origin or * for any.
+func parseCorsOrigins(originsStr string, credentials bool) ([]string, error) {
+	var origins []string
+	for _, origin := range strings.Split(originsStr, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "*" {
+			if credentials {
+				return nil, errors.New("-cors-origins * cannot be used with -cors-credentials, browsers reject a wildcard origin with credentials")
+			}
+		} else if u, err := gourl.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid cors origin %q, e.g. https://ui.internal", origin)
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// withCors sets the CORS headers of the allowed origins on the responses of
+// h, and answers the preflight requests itself.
+func withCors(h http.Handler, origins []string, credentials bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := ""
+		for _, o := range origins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				allowed = o
+				break
+			}
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || allowed == "" {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		if allowed == "*" {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Add("Vary", "Origin")
+		}
+		if credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			h.ServeHTTP(w, r)
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			header.Set("Access-Control-Allow-Headers", requested)
+		} else {
+			header.Set("Access-Control-Allow-Headers", "Content-Type")
+		}
+		header.Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// sendKeepalives tells the -W workers every KEEPALIVE_INTERVAL that the
+// coordinator of params is alive, until the returned func is called.
+func sendKeepalives(params bench.StressParameters, stressTest *bench.StressWorker) func() {
+	params.Cmd = bench.CMD_KEEPALIVE
+	ticker := time.NewTicker(KEEPALIVE_INTERVAL)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				go requestWorkerList(params, stressTest)
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// watchCoordinator aborts a run of a -W worker past params.Deadline, or once
+// KEEPALIVE_MISSES keepalives of the coordinator are missed, so the load
+// stops when the coordinator died. It is a no-op for a local run.
+func watchCoordinator(params bench.StressParameters, stressTest *bench.StressWorker) func() {
+	interval := time.Duration(params.Keepalive) * time.Millisecond
+	if params.Deadline <= 0 && interval <= 0 {
+		return func() {}
+	}
+	keepalives.Store(params.SequenceId, time.Now())
+	done := make(chan struct{})
+	go func() {
+		// A nil channel never fires, for a missing deadline or keepalive.
+		var deadlineC, keepaliveC <-chan time.Time
+		if params.Deadline > 0 {
+			timer := time.NewTimer(time.Until(time.Unix(0, params.Deadline*int64(time.Millisecond))))
+			defer timer.Stop()
+			deadlineC = timer.C
+		}
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			keepaliveC = ticker.C
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-deadlineC:
+				verbosePrint(bench.VERBOSE_ERROR, "Coordinator deadline reached, aborting run %d\n", params.SequenceId)
+				stressTest.SetStopReason(bench.STOP_DEADLINE)
+				stressTest.Abort()
+				return
+			case <-keepaliveC:
+				v, _ := keepalives.Load(params.SequenceId)
+				// Half an interval of slack for the latency of the keepalives.
+				if time.Since(v.(time.Time)) > KEEPALIVE_MISSES*interval+interval/2 {
+					verbosePrint(bench.VERBOSE_ERROR, "Coordinator keepalives missed, aborting run %d\n", params.SequenceId)
+					stressTest.SetStopReason(bench.STOP_LOST)
+					stressTest.Abort()
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		keepalives.Delete(params.SequenceId)
+	}
+}
+
+// requestWorker sends params to the -W worker at uri, the logged copy is
+// without the secrets.
+func requestWorker(uri string, params bench.StressParameters) (*bench.StressResult, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	if verboseEnabled(bench.VERBOSE_DEBUG) {
+		logged, _ := json.Marshal(redactParams(params))
+		verbosePrint(bench.VERBOSE_DEBUG, "Request body: %s\n", string(logged))
+	}
 	resp, err := http.Post(uri, "application/json", bytes.NewBuffer(body))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "RequestWorker addr(%s), err: %s\n", uri, err.Error())
 		return nil, err
 	}
 	defer resp.Body.Close()
-	var result StressResult
+	var result bench.StressResult
 	respStr, _ := ioutil.ReadAll(resp.Body)
 	err = json.Unmarshal(respStr, &result)
 	return &result, err
 }
 
+const (
+	FINISHED_KEEP = 5 * time.Minute // How long a worker answers for a finished run
+
+	KEEPALIVE_INTERVAL = 5 * time.Second  // Between the keepalives of the coordinator to the -W workers
+	KEEPALIVE_MISSES   = 2                // Keepalives missed before a worker aborts the run
+	DEADLINE_GRACE     = 30 * time.Second // Added to -d for the deadline of the -W workers
+	WORKER_TIMEOUT     = 3 * time.Second  // Of the check of the dashboard workers before a run
+	STOP_WAIT          = 30 * time.Second // How long a stop waits for the final result of the run
+
+	ACCESS_LOG_COMBINED = "combined"
+	ACCESS_LOG_COMMON   = "common"
+	ACCESS_LOG_TIME     = "02/Jan/2006:15:04:05 -0700" // Timestamp layout of both formats
+)
+
 var (
-	stressList sync.Map
-	workerList flagSlice // Worker mechine addr list.
+	ErrUnknownRun = errors.New("unknown sequence id")
+	ErrNoAnswer   = errors.New("no answer")
+	ErrRunning    = errors.New("already running")
+)
+
+var (
+	stressList   sync.Map
+	finishedList sync.Map  // Results of finished runs by SequenceId, kept for FINISHED_KEEP
+	finishing    sync.Map  // Closed once a run started by /api is over, by SequenceId
+	startedList  sync.Map  // SequenceIds of the runs started and not over yet
+	keepalives   sync.Map  // Time of the last coordinator keepalive by SequenceId
+	workerList   flagSlice // Worker mechine addr list.
+	urlList      flagSlice // -url hosts, each run by its own StressWorker when several.
+
+	lastSequenceId int64 // Of newSequenceId
 
 	headerRegexp = `^([\w-]+):\s*(.+)`
 	authRegexp   = `^(.+):([^\s].+)`
+	// The combined format adds the referer and user agent to the common one,
+	// fields after them such as the request time of nginx are ignored.
+	accessLogRegexps = map[string]string{
+		ACCESS_LOG_COMMON:   `^\S+ \S+ \S+ \[([^\]]+)\] "([A-Z]+) (\S+)[^"]*" \d{3} (?:\d+|-)$`,
+		ACCESS_LOG_COMBINED: `^\S+ \S+ \S+ \[([^\]]+)\] "([A-Z]+) (\S+)[^"]*" \d{3} (?:\d+|-) "[^"]*" "[^"]*"`,
+	}
+	methodRegexp    = "^[-!#$%&'*+.^_`|~0-9A-Za-z]+$" // tchar of RFC 7230
+	urlOptionRegexp = `^([A-Za-z][\w-]*)=(.*)$`       // key=value after the urls of a -url-file line
 
 	proxyUrl   *gourl.URL
 	stopSignal chan os.Signal
+	// benchLog serializes the verbosePrint lines of every goroutine.
+	benchLog = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
 
 	m          = flag.String("m", "GET", "")
 	body       = flag.String("body", "", "")
 	authHeader = flag.String("a", "", "")
-
-	output = flag.String("o", "", "") // Output type
-
-	c            = flag.Int("c", 50, "")               // Number of requests to run concurrently
-	n            = flag.Int("n", 0, "")                // Number of requests to run
-	q            = flag.Int("q", 0, "")                // Rate limit, in seconds (QPS)
-	d            = flag.String("d", "10s", "")         // Duration for stress test
-	t            = flag.Int("t", 3000, "")             // Timeout in ms
-	httpType     = flag.String("http", TYPE_HTTP1, "") // HTTP Version
-	printExample = flag.Bool("example", false, "")
-
-	cpus = flag.Int("cpus", runtime.GOMAXPROCS(-1), "")
+	bearer     = flag.String("bearer", "", "")
+	bearerFile = flag.String("bearer-file", "", "")
+
+	oauth2TokenUrl     = flag.String("oauth2-token-url", "", "")
+	oauth2ClientId     = flag.String("oauth2-client-id", "", "")
+	oauth2ClientSecret = flag.String("oauth2-client-secret", "", "")
+	oauth2Scopes       = flag.String("oauth2-scopes", "", "")
+
+	output       = flag.String("o", "", "") // Output type
+	outputFile   = flag.String("o-file", "", "")
+	quiet        = flag.Bool("quiet", false, "")
+	liveUI       = flag.Bool("ui", false, "")
+	errorWidth   = flag.Int("error-width", 200, "")
+	maxErrorRate = flag.Float64("max-error-rate", 1, "")
+	maxCard      = flag.Int("max-result-cardinality", bench.RESULT_CARDINALITY, "")
+
+	c         = flag.Int("c", 50, "") // Number of requests to run concurrently
+	n         = flag.Int("n", 0, "")  // Number of requests to run
+	q         = flag.Int("q", 0, "")  // Rate limit, in seconds (QPS)
+	qpsGlobal = flag.String("qps-global", "", "")
+	burst     = flag.String("burst", "", "")
+
+	rateDistribution = flag.String("rate-distribution", bench.RATE_CONSTANT, "")
+	d                = flag.String("d", "10s", "")  // Duration for stress test
+	t                = flag.String("t", "3000", "") // Timeout, bare integers in ms
+	connectTimeout   = flag.Duration("connect-timeout", 0, "")
+	tlsTimeout       = flag.Duration("tls-timeout", 0, "")
+	responseTimeout  = flag.Duration("response-timeout", 0, "")
+	drain            = flag.Duration("drain", 0, "")
+	waitReady        = flag.Duration("wait-ready", 0, "")
+	readyStatus      = flag.Int("expect-ready-status", http.StatusOK, "")
+	httpType         = flag.String("http", bench.TYPE_HTTP1, "") // HTTP Version
+	wsMode           = flag.String("ws-mode", bench.WS_MODE_PERSISTENT, "")
+	wsRecvOnly       = flag.Bool("ws-recv-only", false, "")
+	tcpReadBytes     = flag.Int("tcp-read-bytes", 0, "")
+	tcpReadUntil     = flag.String("tcp-read-until", "", "")
+	tcpReconnect     = flag.Bool("tcp-reconnect", false, "")
+
+	quic0RTT        = flag.Bool("quic-0rtt", false, "")
+	quicIdleTimeout = flag.Duration("quic-idle-timeout", 0, "")
+	quicKeepAlive   = flag.Duration("quic-keepalive", 0, "")
+	quicMaxStreams  = flag.Int64("quic-max-streams", 0, "")
+	quicDatagrams   = flag.Bool("quic-datagrams", false, "")
+
+	h2Conns = flag.Int("h2-conns", 0, "")
+
+	requestsPerConn = flag.Int("requests-per-conn", 0, "")
+	dnsRefresh      = flag.Duration("dns-refresh", 0, "")
+	dnsServer       = flag.String("dns-server", "", "")
+	dnsTimeout      = flag.Duration("dns-timeout", 0, "")
+	slowThreshold   = flag.Duration("slow-threshold", 0, "")
+	perWorker       = flag.Bool("per-worker-breakdown", false, "")
+	slowLogRate     = flag.Int("slow-log-rate", 10, "")
+	targetConc      = flag.String("target-concurrency", "", "")
+
+	traceProp       = flag.String("trace-propagation", "", "")
+	requestIdHeader = flag.String("request-id-header", "", "")
+	cacheBust       = flag.Bool("cache-bust", false, "")
+	cacheBustParam  = flag.String("cache-bust-param", "_cb", "")
+	noCacheHeaders  = flag.Bool("no-cache-headers", false, "")
+	conditional     = flag.Bool("conditional-requests", false, "")
+
+	think       = flag.Duration("think", 0, "")
+	thinkRandom = flag.String("think-random", "", "")
+
+	maxConns        = flag.Int("max-conns", 0, "")
+	maxIdleConns    = flag.Int("max-idle-conns", 0, "")
+	idleConnTimeout = flag.Duration("idle-conn-timeout", 90*time.Second, "")
+	printExample    = flag.Bool("example", false, "")
+	printVersion    = flag.Bool("version", false, "")
+	configFile      = flag.String("config", "", "")
+	dumpConfigFlag  = flag.Bool("dump-config", false, "")
+	saveResult      = flag.String("save-result", "", "")
+	labelFlag       = flag.String("label", "", "")
+	baselineFile    = flag.String("baseline", "", "")
+	regression      = flag.String("regression", "", "")
+	updateBaseline  = flag.Bool("update-baseline", false, "")
+
+	cpus      = flag.Int("cpus", runtime.GOMAXPROCS(-1), "")
+	gcPercent = flag.Int("gc-percent", 100, "")
+	memLimit  = flag.String("memlimit", "", "")
 
 	disableCompression = flag.Bool("disable-compression", false, "")
+	acceptEncoding     = flag.String("accept-encoding", "", "")
+	noDecompress       = flag.Bool("no-decompress", false, "")
 	disableKeepAlives  = flag.Bool("disable-keepalive", false, "")
+	tcpNoDelay         = flag.Bool("tcp-nodelay", true, "")
+	soRcvbuf           = flag.Int("so-rcvbuf", 0, "")
+	soSndbuf           = flag.Int("so-sndbuf", 0, "")
+	localAddr          = flag.String("local-addr", "", "")
+	localPortRange     = flag.String("local-port-range", "", "")
 	proxyAddr          = flag.String("x", "", "")
 
-	urlstr    = flag.String("url", "", "")
+	cPerUrl   = flag.Int("c-per-url", 0, "")
+	validate  = flag.String("validate-urls", bench.VALIDATE_ONCE, "")
 	verbose   = flag.Int("verbose", 3, "")
+	logFile   = flag.String("log-file", "", "")
 	listen    = flag.String("listen", "", "")
-	dashboard = flag.String("dashboard", "", "")
-
-	urlFile           = flag.String("url-file", "", "")
-	bodyFile          = flag.String("body-file", "", "")
-	scriptFile        = flag.String("script", "", "")
-	requestWorkerList = func(paramsJson []byte, stressTest *StressWorker) []StressResult {
+	pprofAddr = flag.String("pprof", "", "")
+
+	cpuProfile = flag.String("cpuprofile", "", "")
+	memProfile = flag.String("memprofile", "", "")
+	dashboard  = flag.String("dashboard", "", "")
+
+	dashboardAssets = flag.String("dashboard-assets", "", "")
+
+	corsOrigins     = flag.String("cors-origins", "", "")
+	corsCredentials = flag.Bool("cors-credentials", false, "")
+
+	urlFile            = flag.String("url-file", "", "")
+	accessLog          = flag.String("access-log", "", "")
+	accessLogFormat    = flag.String("access-log-format", ACCESS_LOG_COMBINED, "")
+	baseUrl            = flag.String("base-url", "", "")
+	replayTiming       = flag.Float64("replay-timing", 0, "")
+	bodyFile           = flag.String("body-file", "", "")
+	bodyStream         = flag.String("body-stream", "", "")
+	bodyDelimiter      = flag.String("body-delimiter", "---", "")
+	bodyOrder          = flag.String("body-order", bench.BODY_ORDER_RANDOM, "")
+	compressBody       = flag.String("compress-body", "", "")
+	maxBodyRead        = flag.String("max-body-read", "", "")
+	lengthTolerance    = flag.Int64("content-length-tolerance", 0, "")
+	streamMetrics      = flag.Bool("stream-metrics", false, "")
+	respectRetryAfter  = flag.Bool("respect-retry-after", false, "")
+	retryAfterMax      = flag.Duration("retry-after-max", bench.RETRY_AFTER_MAX, "")
+	streamIdleTimeout  = flag.Duration("stream-idle-timeout", 0, "")
+	discardBody        = flag.Bool("discard-body", true, "")
+	saveResponses      = flag.String("save-responses", "", "")
+	saveResponsesCount = flag.Int("save-responses-count", 100, "")
+	verifySha256       = flag.String("verify-sha256", "", "")
+	verifySha256Header = flag.String("verify-sha256-header", "", "")
+	scriptFile         = flag.String("script", "", "")
+	headerFile         = flag.String("header-file", "", "")
+	userAgentFile      = flag.String("user-agent-file", "", "")
+	requestWorkerList  = func(params bench.StressParameters, stressTest *bench.StressWorker) []*bench.StressResult {
 		var wg sync.WaitGroup
-		var stressResult []StressResult
-		for _, v := range workerList {
+		var lock sync.Mutex
+		var stressResult []*bench.StressResult
+		// The workers of the run, params of a stop or metrics only has its id.
+		workers := stressTest.RequestParams.Workers
+		for i, v := range workers {
+			// Without -qps-global every worker runs its share of -q so the
+			// offered rate does not grow with the number of workers.
+			workerParams := params
+			workerParams.WorkerIndex, workerParams.WorkerCount = i, len(workers)
+			workerParams.Workers = nil
+			workerParams.Replay = replayShare(params.Replay, i, len(workers))
+			if workerParams.Qps > 0 && workerParams.QpsGlobal == "" {
+				workerParams.Qps = qpsShare(params.Qps, i, len(workers))
+				if workerParams.BurstRate > 0 {
+					workerParams.BurstRate = qpsShare(params.BurstRate, i, len(workers))
+				}
+			}
 			wg.Add(1)
-			go func(addr string) {
+			go func(addr string, workerParams bench.StressParameters) {
 				defer wg.Done()
-				if result, err := requestWorker("http://"+addr+"/", paramsJson); err == nil {
-					stressResult = append(stressResult, *result)
+				if result, err := requestWorker("http://"+addr+"/", workerParams); err == nil {
+					result.Node = addr
+					for i, warning := range result.Bottlenecks {
+						result.Bottlenecks[i] = addr + " " + warning
+					}
+					lock.Lock()
+					stressResult = append(stressResult, result)
+					lock.Unlock()
 				}
-			}(v)
+			}(v, workerParams)
 		}
 		wg.Wait()
 		return stressResult
@@ -980,34 +1514,263 @@ var (
 var usage = `Usage: http_bench [options...] <url>
 Options:
 	-n  Number of requests to run.
-	-c  Number of requests to run concurrently. Total number of requests cannot
-		be smaller than the concurency level.
+	-c  Number of requests to run concurrently, capped to -n with a warning when
+			there are fewer requests than that.
 	-q  Rate limit, in seconds (QPS).
-	-d  Duration of the stress test, e.g. 2s, 2m, 2h
-	-t  Timeout in ms.
+	-qps-global  Coordinator IP:PORT serving request tokens to the -W workers, which
+			then hold the total -q x -c rate exactly across all of them. Without it
+			-q is divided between the -W workers.
+	-burst  Burst schedule, e.g. "rate=1000,duration=2s,interval=30s" sends at the burst
+			rate instead of -q for the last 2s of every 30s, and prints a timeline.
+	-rate-distribution  Gaps between -q requests, constant or poisson (default constant).
+			Poisson gaps are exponentially distributed around the same mean rate, which
+			queues like real traffic, so percentiles differ from constant pacing.
+	-d  Duration of the stress test in whole seconds, e.g. 30s, 2m, 1m30s, or bare seconds (default 10s,
+			or no limit when only -n is set). 0 means no limit, with -n the run stops at whichever
+			comes first.
+			Requests still in flight at the end are aborted unless -drain is set, and not recorded.
+	-drain  Wait for the requests in flight when -d expires, e.g. 5s, and count them apart from
+			the run, the ones still in flight after it are aborted (default 0, abort at once).
+	-wait-ready  Before the run probe the first url with a GET until it answers, e.g. 30s, so a
+			target still starting up neither fails the run nor skews it. The probes carry the
+			-H headers and the bearer token of the run, count in no result and not toward -d,
+			a target not ready in time exits with code 5.
+	-expect-ready-status  Status of a -wait-ready answer which means ready (default 200).
+	-t  Timeout of the whole request including the body download, e.g. 500ms, 5s,
+			or bare milliseconds (default 3000). 0 means no timeout.
+	-connect-timeout  Time to establish a connection, e.g. 500ms (default -t).
+	-tls-timeout  Time of the TLS handshake, for http3 the QUIC one (default -t).
+	-response-timeout  Time to wait for the response headers once the request is sent,
+			for http2 and http3 it also counts a new connection (default none, -t still applies).
+	-header-timeout  Alias of -response-timeout, the last one given wins, e.g.
+			-header-timeout 200ms -t 10s for headers within 200ms and the whole response
+			within 10s.
+			Each timeout is a distinct error in the error distribution.
 	-o  Output type. If none provided, a summary is printed.
-		"csv" is the only supported alternative. Dumps the response
-		metrics in comma-seperated values format.
-	-m  HTTP method, one of GET, POST, PUT, DELETE, HEAD, OPTIONS.
+		"csv" dumps the response metrics in comma-seperated values format,
+		"json" dumps the full result as one json object,
+		"ab" prints the report of Apache Bench for the parsers of its output.
+	-o-file  Write the -o output to the file, the summary is still printed.
+	-quiet  Print only a single line summary, rps=... p50=... p99=... errors=... bytes=...
+			(latencies in secs), and no logs below the error level.
+	-ui  Show a live dashboard of the run, the rps, the p50, p95 and p99 of the last
+			seconds, the status codes, errors and progress, redrawn every 250ms. When
+			stdout is not a terminal a line per second goes to stderr instead. The dashboard
+			shows the last log lines of the run and writes them to stderr once it is gone.
+	-error-width  Max error message width in the summary, longer messages are
+			truncated (default 200, 0 means unlimited).
+	-max-result-cardinality  Max distinct errors and values of each -capture-header kept, past it
+			the less frequent ones are merged into (other), which bounds the memory of long soaks
+			(default 1000).
+	-max-error-rate  Max percentage of failed requests, transport errors, 5xx responses
+			and corrupt responses, before exiting with code 2 (default 1).
+	-m  HTTP method, e.g. GET, POST, PUT, PATCH, DELETE, HEAD, OPTIONS (default GET). Other
+			methods are sent after a warning, HEAD responses are never read for a body.
 	-H  Custom HTTP header. You can specify as many as needed by repeating the flag.
-		for example, -H "Accept: text/html" -H "Content-Type: application/xml", 
-		but "Host: ***", replace that with -host.
-	-http  Support http1, http2, ws, wss (default http1).
+		for example, -H "Accept: text/html" -H "Content-Type: application/xml",
+		a repeated name sends the header once per value, in order,
+		but "Host: ***", replace that with -host. Values support functions.
+	-header-file  Headers read from a file, one "Name: value" per line, blank lines and
+			lines starting with # are skipped. -H wins over the file for the same name.
+	-user-agent-file  User-Agent values, one per line, a random one is sent per request.
+	-H-random  Header drawn per request from a file, "Name: @path" with one value per line,
+			for example -H-random "X-Device-Id: @devices.txt". Repeat for several names.
+	-http  Support http1, http2, ws, wss, tcp (default http1).
+			for tcp the url is host:port and -body is written on every request.
+			The summary warns if most responses used another protocol.
+	-ws-mode  Websocket connection mode, persistent or reconnect (default persistent).
+			"reconnect" dials, upgrades, exchanges one message and closes on every request.
+	-ws-recv-only  Websocket receive only, send -body once as the subscribe message and
+			then count inbound messages until -d expires, subscribing again on a new
+			connection when it is lost (default false).
+	-tcp-read-bytes  Tcp response size in bytes read back on every request.
+	-tcp-read-until  Tcp response delimiter read back on every request, e.g. "\n".
+	-tcp-reconnect   Tcp dial a new connection on every request (default false).
+	-quic-0rtt          Http3 resume sessions and send GET requests as 0-RTT (default false).
+	-quic-idle-timeout  Http3 QUIC max idle timeout, e.g. 30s.
+	-quic-keepalive     Http3 QUIC keep-alive period, e.g. 10s.
+	-quic-max-streams   Http3 QUIC max concurrent incoming streams, e.g. 100.
+	-quic-datagrams     Http3 enable QUIC datagrams (default false).
+	-h2-conns  Http2 connections shared by all workers, every request is multiplexed
+			as a stream on one of them (default 0, one connection per worker).
+	-max-conns          Http1 max connections per host (default the -c value).
+	-max-idle-conns     Http1 max idle connections (default the -c value).
+	-idle-conn-timeout  Http1 idle connection timeout (default 90s).
+	-think         Pause after every request, e.g. 500ms, not counted in latency.
+	-think-random  Random pause range added after every request, e.g. 200ms-2s.
+	-form       Multipart form text field, name=value, the value supports functions.
+			You can specify as many as needed by repeating the flag.
+	-form-file  Multipart form file field, name=@path[;type=content-type], the file
+			is streamed from disk. You can specify as many as needed by repeating the flag.
+	-body-stream  Request body streamed from file on every request, without functions,
+			for large upload tests.
 	-body  Request body, default empty.
 	-a  Basic authentication, username:password.
+	-bearer  Token sent as Authorization: Bearer on every request, never printed.
+	-bearer-file  File holding the -bearer token, read again whenever it changes for
+			tokens rotated by an agent. With -W the file is read on every worker.
+	-oauth2-token-url  OAuth2 token endpoint, the bearer token is fetched with the client
+			credentials grant before the run and refreshed 30s before it expires. Requests
+			pause while an expired token cannot be refreshed.
+	-oauth2-client-id  OAuth2 client id.
+	-oauth2-client-secret  OAuth2 client secret, never printed.
+	-oauth2-scopes  OAuth2 scopes, comma separated.
 	-x  HTTP Proxy address as host:port.
-	-disable-compression  Disable compression.
+	-disable-compression  Do not ask for gzip responses. Received/sec counts the bytes on the wire,
+			Total data the decoded ones.
+	-accept-encoding  Accept-Encoding of the requests, gzip, br, identity or none (no header),
+			default gzip unless -disable-compression. gzip responses are decoded, br ones
+			are not, -H "Accept-Encoding: ..." sends the header as is without decoding.
+	-no-decompress  Keep the gzip responses compressed, Total data and -verify-sha256 then
+			see the bytes on the wire, to measure the raw transfer e.g. of a CDN.
 	-disable-keepalive    Disable keep-alive, prevents re-use of TCP connections between different HTTP requests.
+	-tcp-nodelay          Set TCP_NODELAY, -tcp-nodelay=false lets Nagle's algorithm batch small writes (default true).
+	-so-rcvbuf            SO_RCVBUF size in bytes of every socket (default 0, the system default).
+	-so-sndbuf            SO_SNDBUF size in bytes of every socket (default 0, the system default).
+			Unsupported platforms warn once and use the system default.
+	-local-addr           Comma separated source IPs the connections rotate through, e.g. 10.0.0.2,10.0.0.3.
+	-local-port-range     Source ports the connections rotate through, e.g. 20000-60000 (default the system ephemeral range).
+			Without keep-alive the local ports run out at high rates, the workers back off
+			and the requests are counted as port_exhaustion.
+	-requests-per-conn    Close and recreate the connection of every worker after that many requests,
+			for http1, http2, http3, ws and tcp (default 0, never).
+	-dns-refresh          Re-resolve hosts and close idle connections periodically, e.g. 30s,
+			for http1, http2, ws and tcp (default 0, resolve on every new connection).
+	-dns-server           Resolver IP[:PORT] queried instead of the system one, e.g. 10.0.0.2:53,
+			for split-horizon DNS. The addresses of every host are logged once at -verbose 1.
+	-dns-timeout          Max time of every DNS lookup, e.g. 500ms (default the resolver's own).
+			Failed and timed out lookups are distinct errors in the error distribution.
+	-trace-propagation    Send a fresh trace ID with every http request, w3c for the traceparent
+			header or b3 for the b3 single header. The trace IDs of failed requests are logged.
+	-request-id-header    Send a new UUID in this header with every request, e.g. X-Request-Id,
+			it is logged for failed requests and written to -save-responses. A response
+			echoing a different value counts as an echo mismatch failure.
+	-cache-bust           Add a random _cb query parameter to every http and ws url, after the url
+			functions, to force cache misses on CDNs.
+	-cache-bust-param     Name of the -cache-bust query parameter (default _cb).
+	-query  Query parameter set with a random value on every http and ws url, after the url
+			functions, e.g. -query "page=randint:1:500" -query "sort=choice:asc,desc".
+			It replaces a parameter of the same name in the url. Repeatable.
+	-no-cache-headers     Send Cache-Control: no-cache and Pragma: no-cache with every request.
+	-conditional-requests  Send the ETag and Last-Modified of the previous response of each url
+			back as If-None-Match and If-Modified-Since, per worker. The summary counts the
+			304 and full responses and the bytes the 304s saved.
+	-capture-header       Count the responses and their latencies per value of this response
+			header, e.g. X-Cache. Repeat for several headers, a missing header counts as (absent).
+	-slow-threshold       Log every request slower than this, e.g. 800ms, with its url, status and
+			size, and list the 20 slowest at the end of the summary (default 0, never).
+	-slow-log-rate        Max slow requests logged per second, 0 means unlimited (default 10).
+	-target-concurrency   Dedicate connections to the urls of each path prefix, e.g. with -c 100
+			"/slow=10,/fast=90". The connections left go to the unmatched urls.
 	-cpus		Number of used cpu cores. (default for current machine is %d cores).
-	-url 		Request single url.
+	-gc-percent  Garbage collection target percentage of http_bench, -1 disables the gc,
+			takes precedence over BENCH_GC=1 (default 100, or GOGC).
+	-memlimit    Soft memory limit of http_bench, e.g. 2GiB (default unlimited, or GOMEMLIMIT).
+	-url 		Request single url. Repeat it, or pass several urls, to run the hosts at once with
+			their own workers, each with its share of -c and -n, and print a summary per host
+			and a combined one. With -W every host is run on all the workers.
+	-c-per-url  Connections of each of several -url hosts instead of a share of -c.
 	-verbose 	Print detail logs, default 3(0:TRACE, 1:DEBUG, 2:INFO, 3:ERROR).
-	-url-file 	Read url list from file and random stress test.
+	-log-file  Append the logs to the file instead of stderr.
+	-url-file 	Read url list from file and random stress test. A line of "PATCH url"
+			sends the url with that method instead of -m. The host=name and sni=name
+			options after the urls of a line set their Host header and TLS server
+			name, e.g. "https://10.0.0.5/ host=shop.example.com sni=shop.example.com".
+	-access-log  Replay the requests of an nginx or Apache access log, the method and path of
+			each line, malformed lines are counted and skipped. Without -replay-timing the
+			requests are a random mix weighted by how often each one was logged.
+	-access-log-format  Format of -access-log, combined or common (default combined), the
+			lines of the other format are counted as malformed.
+	-base-url  Scheme and host prefixed to the -access-log paths, e.g. http://127.0.0.1:8080
+			(default the url argument).
+	-replay-timing  Replay -access-log in order at the logged gaps, sped up by the factor,
+			e.g. 2 replays an hour in 30 minutes. The run ends with the log unless -d is set.
+	-validate-urls  Url validation, strict checks every rendered url, once the urls and the first
+			rendering of templated ones before the run, off none (default once). Malformed urls
+			during the run are counted as invalid_url errors without a log line each.
 	-body-file  Request body from file.
+	-body-delimiter  Line separating multiple request bodies in -body-file (default "---"),
+			one of them is selected per request.
+	-body-order  Select -body-file bodies in random or sequential order (default random).
+	-compress-body  Compress the request body and set Content-Encoding, only gzip is supported.
+	-max-body-read  Max response body bytes read per request, e.g. 1MB (default unlimited).
+			The unread rest of an http1 response is drained uncounted to reuse its connection
+			when it is at most 256KB, a longer one closes the connection.
+	-discard-body   Read and discard the response body (default true), -discard-body=false
+			skips reading it, which also closes http1 connections.
+	-content-length-tolerance  Bytes a fully read response body may differ from its
+			Content-Length before it counts as a Content-Length mismatch (default 0). The
+			summary shows the bytes the mismatched responses declared and those received.
+	-respect-retry-after  Pause a connection for the Retry-After of its 429 and 503 responses
+			instead of sending on, and report the throttled responses and the time backing off.
+	-retry-after-max  Longest -respect-retry-after pause (default 1m).
+	-stream-metrics  Read chunked or streamed responses as they arrive and print the time to
+			the first chunk, the gap between chunks and the stream duration.
+	-stream-idle-timeout  Fail a -stream-metrics response as stream_stall when no chunk comes
+			for this long, e.g. 5s (default none). -t still limits the whole request.
+	-save-responses        Directory the first non-2xx responses are written to, with
+			the status line, headers and the rendered request url and body.
+	-save-responses-count  Max number of saved responses (default 100).
+	-verify-sha256         Expected hex sha256 of every response body, mismatches are
+			counted as corrupt responses.
+	-verify-sha256-header  Response header holding the expected hex sha256 of the body,
+			e.g. X-Content-Sha256.
 	-listen 	Listen IP:PORT for distributed stress test and worker mechine (default empty). e.g. "127.0.0.1:12710".
-	-dashboard 	Listen dashboard IP:PORT and operate stress params on browser.
+	-dashboard 	Listen dashboard IP:PORT and operate stress params on browser, the page takes
+			the -listen workers of a distributed run too.
+	-dashboard-assets  Serve the -dashboard page and its files from the directory instead,
+			e.g. ./ui, falling back to the default page for the files it is missing.
+	-cors-origins  Origins allowed to call the -dashboard /api from a browser, comma separated,
+			e.g. "https://ui.internal,http://127.0.0.1:3000", or * for any (default none).
+	-cors-credentials  Allow the -cors-origins requests with cookies or HTTP auth, not with *.
+	-pprof  Listen IP:PORT for the net/http/pprof handlers in every mode, e.g. "127.0.0.1:6061".
+	-cpuprofile  Write a cpu profile of http_bench to the file on exit.
+	-memprofile  Write a heap profile of http_bench to the file on exit.
 	-W  Running distributed stress test worker mechine list.
 				for example, -W "127.0.0.1:12710" -W "127.0.0.1:12711".
+	-per-worker-breakdown  Print the requests, errors and average latency of every connection
+			goroutine, and with -W of every worker, whose results -o json keeps in "nodes".
 	-example 	Print some stress test examples (default false).
+	-version 	Print the version, git commit and build date of http_bench.
+	-config  Read the flags from a json file, keys are flag names without the dash and
+			repeated flags take arrays, e.g. {"c": 10, "d": "30s", "H": ["Accept: */*"]}.
+			Flags on the command line override the file, unknown keys are an error.
+	-dump-config  Print the effective flags as a -config file and exit, without the
+			secrets of -a, -bearer and -oauth2-client-secret.
+	-save-result  Write the result, the params and the time of the run to a json file,
+			for http_bench compare.
+	-label  Labels identifying the run, e.g. "release=v2.3,env=staging", printed in the
+			summary and kept in the result next to the version, host and params of the run.
+			The params leave out the secrets and the credential headers, and only count the
+			-access-log requests, -body-file bodies and header file lines.
+	-baseline  A -save-result file the run is checked against with -regression.
+	-regression  Allowed changes against -baseline, e.g. "p99<+10%%,rps>-5%%", metrics
+			are rps, p50, p75, p90, p95, p99, errors (error rate),
+			timeout_rate (rate of the client-side timeouts) and bytes.
+			A failed check exits with code 4.
+	-update-baseline  Write the run to the -baseline file when every check passed,
+			creates the file if it does not exist.
+
+Stop or query a distributed run on -listen workers:
+	http_bench stop -W host:port [-W host:port...] -id sequence_id
+	http_bench status -W host:port [-W host:port...] -id sequence_id
+	The sequence id is printed when a run with -W starts, workers answer
+	for a finished run for 5 minutes. Stop prints the summary of what was
+	measured until the runs stopped.
+
+Compare two -save-result files:
+	http_bench compare [-threshold 5%%] [-force] run1.json run2.json
+	-threshold  Change of rps, p50, p99 or error rate reported as a regression (default 5%%).
+	-force      Compare runs with a different url, method or duration.
+	Exits with code 2 if there is a regression.
+
+Exit codes:
+	0  The run completed with an error rate within -max-error-rate.
+	1  Usage error.
+	2  The run completed with an error rate above -max-error-rate, or was stopped by an error.
+	3  Internal failure, no results were collected, e.g. every -W worker failed.
+	4  A -regression check against the -baseline run failed.
+	5  The target did not answer -expect-ready-status within -wait-ready.
 `
 var examples = `
 1.Example stress test:
@@ -1016,52 +1779,629 @@ var examples = `
 	./http_bench -n 1000 -c 10 -t 3000 -m GET "http://127.0.0.1/test1" -url-file urls.txt
 	./http_bench -d 10s -c 10 -m POST -body "{}" -url-file urls.txt
 
-2.Example http2 test:
-	./http_bench -d 10s -c 10 -http http2 -m POST "http://127.0.0.1/test1" -body "{}"
+2.Example http2 test:
+	./http_bench -d 10s -c 10 -http http2 -m POST "http://127.0.0.1/test1" -body "{}"
+
+3.Example http3 test:
+	./http_bench -d 10s -c 10 -http http3 -m POST "http://127.0.0.1/test1" -body "{}"
+
+4.Example dashboard test:
+	./http_bench -dashboard "127.0.0.1:12345" -verbose 1
+
+5.Example Support Function and Variable test:
+	./http_bench -c 1 -n 1 "https://127.0.0.1:18090?data={{ randomString 10}}" -verbose 0
+
+5.Example distributed stress test:
+	(1) ./http_bench -listen "127.0.0.1:12710" -verbose 1
+	(2) ./http_bench -c 1 -d 10s "http://127.0.0.1:18090/test1" -body "{}" -verbose 1 -W "127.0.0.1:12710"
+`
+
+// startProfiles starts the -cpuprofile, the returned func stops it and
+// writes the -memprofile.
+func startProfiles() func() {
+	var cpuFile *os.File
+	if len(*cpuProfile) > 0 {
+		var err error
+		if cpuFile, err = os.Create(*cpuProfile); err != nil {
+			usageAndExit("Create cpu profile err: " + err.Error())
+		}
+		if err = pprof.StartCPUProfile(cpuFile); err != nil {
+			usageAndExit("Start cpu profile err: " + err.Error())
+		}
+	}
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+		if len(*memProfile) > 0 {
+			f, err := os.Create(*memProfile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Create memory profile err: %s\n", err.Error())
+				return
+			}
+			defer f.Close()
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				fmt.Fprintf(os.Stderr, "Write memory profile err: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// savedRun is the -save-result file read by http_bench compare.
+type savedRun struct {
+	Time   time.Time              `json:"time"`
+	Params bench.StressParameters `json:"params"`
+	Result *bench.StressResult    `json:"result"`
+}
+
+func saveRun(path string, params bench.StressParameters, result *bench.StressResult) error {
+	params = recordedParams(params)
+	data, err := result.Marshal()
+	if err != nil {
+		return err
+	}
+	run := struct {
+		Time   time.Time              `json:"time"`
+		Params bench.StressParameters `json:"params"`
+		Result json.RawMessage        `json:"result"`
+	}{time.Now(), params, data}
+	if data, err = json.MarshalIndent(run, "", "  "); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func loadRun(path string) (*savedRun, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var run savedRun
+	if err = json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if run.Result == nil {
+		return nil, fmt.Errorf("%s: no result", path)
+	}
+	return &run, nil
+}
+
+// redactParams returns params without the secrets and the values of the
+// sensitive headers, for the logs, files and results which keep them.
+func redactParams(params bench.StressParameters) bench.StressParameters {
+	params.AuthPassword, params.Bearer, params.OAuth2ClientSecret = "", "", ""
+	params.Headers = redactHeaders(params.Headers)
+	params.HeaderPools = redactHeaders(params.HeaderPools)
+	return params
+}
+
+// redactHeaders returns a copy of headers with the values of the sensitive
+// names replaced by bench.REDACTED.
+func redactHeaders(headers map[string][]string) map[string][]string {
+	if headers == nil {
+		return nil
+	}
+	redacted := make(map[string][]string, len(headers))
+	for name, values := range headers {
+		if sensitiveHeader(name) {
+			values = []string{bench.REDACTED}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+// sensitiveHeader reports whether the values of the header name are
+// credentials: Authorization, Proxy-Authorization, the cookies, and the
+// api keys and tokens.
+func sensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	return name == "authorization" || name == "proxy-authorization" || strings.Contains(name, "cookie") ||
+		strings.HasSuffix(name, "key") || strings.Contains(name, "token")
+}
+
+// recordedParams returns params as the results and the saved runs keep them:
+// redacted, and with the access log, the bodies and the header pools, which
+// can be large, left to their sizes in RunMeta.
+func recordedParams(params bench.StressParameters) bench.StressParameters {
+	params = redactParams(params)
+	params.Replay, params.RequestBodies, params.HeaderPools = nil, nil, nil
+	return params
+}
+
+// The build of http_bench, set with e.g. go build -ldflags "-X main.version=v1.2.0
+// -X main.gitCommit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%d)".
+var (
+	version   = "dev"
+	gitCommit = "dev"
+	buildDate = "dev"
+)
+
+// benchVersion returns the version http_bench was built as, without
+// -ldflags the module version of go install.
+func benchVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
+}
+
+// runMeta returns the metadata identifying a run started at start.
+func runMeta(params bench.StressParameters, start time.Time) *bench.RunMeta {
+	hostname, _ := os.Hostname()
+	meta := &bench.RunMeta{
+		Version:        benchVersion(),
+		Commit:         gitCommit,
+		BuildDate:      buildDate,
+		Hostname:       hostname,
+		GoMaxProcs:     runtime.GOMAXPROCS(0),
+		StartTime:      start,
+		ReplayRequests: len(params.Replay),
+		Bodies:         len(params.RequestBodies),
+	}
+	for name, lines := range params.HeaderPools {
+		if meta.HeaderPools == nil {
+			meta.HeaderPools = make(map[string]int)
+		}
+		meta.HeaderPools[name] = len(lines)
+	}
+	params = recordedParams(params)
+	meta.Params = &params
+	return meta
+}
+
+// buildDifference returns the builds of http_bench of two runs when they
+// differ, or "" when they match or a run does not record it.
+func buildDifference(a, b *bench.RunMeta) string {
+	if a == nil || b == nil || (a.Version == b.Version && a.Commit == b.Commit) {
+		return ""
+	}
+	return a.Build() + " != " + b.Build()
+}
+
+// labelDifferences returns the labels which differ between two runs.
+func labelDifferences(a, b map[string]string) []string {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	var diffs []string
+	for k := range keys {
+		va, oka := a[k]
+		vb, okb := b[k]
+		if oka && okb && va == vb {
+			continue
+		}
+		if !oka {
+			va = "(none)"
+		}
+		if !okb {
+			vb = "(none)"
+		}
+		diffs = append(diffs, fmt.Sprintf("%s %s != %s", k, va, vb))
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// runDifferences returns the parameters which make two runs incomparable.
+func runDifferences(a, b bench.StressParameters) []string {
+	var diffs []string
+	if strings.Join(a.Urls, " ") != strings.Join(b.Urls, " ") {
+		diffs = append(diffs, fmt.Sprintf("url %v != %v", a.Urls, b.Urls))
+	}
+	if a.RequestMethod != b.RequestMethod {
+		diffs = append(diffs, fmt.Sprintf("method %s != %s", a.RequestMethod, b.RequestMethod))
+	}
+	if a.Duration != b.Duration {
+		diffs = append(diffs, fmt.Sprintf("duration %ds != %ds", a.Duration, b.Duration))
+	}
+	return diffs
+}
+
+// runMetric returns a metric of result by its -regression name: rps, p50,
+// p75, p90, p95 and p99 in secs, errors as the error rate, timeout_rate as
+// the rate of the client-side timeouts and bytes.
+func runMetric(result *bench.StressResult, name string) (float64, bool) {
+	switch name {
+	case "rps":
+		return float64(result.Rps) / bench.SCALE_NUM, true
+	case "errors":
+		return result.ErrorRate(), true
+	case "timeout_rate":
+		return result.TimeoutRate(), true
+	case "bytes":
+		return float64(result.SizeTotal), true
+	case "p50", "p75", "p90", "p95", "p99":
+		if result.LatsTotal <= 0 {
+			return 0, true
+		}
+		pctl, _ := strconv.Atoi(name[1:])
+		v, _ := strconv.ParseFloat(strings.TrimSpace(bench.LatencyPercentiles(result.Lats, result.LatsTotal, []int{pctl})[0]), 64)
+		return v, true
+	}
+	return 0, false
+}
+
+// metricDelta returns the change from base to next in percent, a metric
+// growing from 0 changes by +Inf.
+func metricDelta(base, next float64) float64 {
+	switch {
+	case base != 0:
+		return (next - base) * 100 / base
+	case next > 0:
+		return math.Inf(1)
+	case next < 0:
+		return math.Inf(-1)
+	}
+	return 0
+}
+
+// regressionCheck is one -regression check, such as p99<+10%, the change of
+// metric against the baseline must be below, or above, limit percent.
+type regressionCheck struct {
+	metric string
+	below  bool
+	limit  float64
+}
+
+func (c regressionCheck) String() string {
+	op := ">"
+	if c.below {
+		op = "<"
+	}
+	return fmt.Sprintf("%s%s%+g%%", c.metric, op, c.limit)
+}
+
+// parseRegression parses -regression checks such as p99<+10%,rps>-5%.
+func parseRegression(spec string) ([]regressionCheck, error) {
+	var checks []regressionCheck
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		i := strings.IndexAny(s, "<>")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid regression check: %s", s)
+		}
+		c := regressionCheck{metric: s[:i], below: s[i] == '<'}
+		if _, ok := runMetric(&bench.StressResult{}, c.metric); !ok {
+			return nil, fmt.Errorf("unknown regression metric: %s", c.metric)
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSuffix(s[i+1:], "%"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regression check: %s", s)
+		}
+		c.limit = limit
+		checks = append(checks, c)
+	}
+	return checks, nil
+}
+
+// checkRegressions returns the failed checks of result against base, one
+// line each.
+func checkRegressions(checks []regressionCheck, base, result *bench.StressResult) []string {
+	var failed []string
+	for _, c := range checks {
+		baseValue, _ := runMetric(base, c.metric)
+		value, _ := runMetric(result, c.metric)
+		delta := metricDelta(baseValue, value)
+		if (c.below && delta < c.limit) || (!c.below && delta > c.limit) {
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s: %+.2f%% (%.3f -> %.3f)", c, delta, baseValue, value))
+	}
+	return failed
+}
+
+// checkBaseline prints the failed -regression checks of result and writes it
+// to the -baseline file with -update-baseline if the run passed, it returns
+// the exit code of the run.
+func checkBaseline(baseline *savedRun, checks []regressionCheck, params bench.StressParameters, result *bench.StressResult, exitCode int) int {
+	if baseline != nil {
+		failed := checkRegressions(checks, baseline.Result, result)
+		for _, line := range failed {
+			fmt.Fprintf(os.Stderr, "Regression %s\n", line)
+		}
+		if len(failed) > 0 && exitCode == bench.EXIT_OK {
+			exitCode = bench.EXIT_SLA
+		} else if len(failed) == 0 && !*quiet {
+			fmt.Printf("Baseline: %d checks passed\n", len(checks))
+		}
+	}
+	if *updateBaseline && exitCode == bench.EXIT_OK {
+		if err := saveRun(*baselineFile, params, result); err != nil {
+			fmt.Fprintf(os.Stderr, "Update baseline err: %s\n", err.Error())
+			return bench.EXIT_INTERNAL
+		}
+	}
+	return exitCode
+}
+
+// compareRuns prints the delta table of next against base and returns the
+// number of metrics which got worse by more than threshold percent.
+func compareRuns(w io.Writer, base, next *savedRun, threshold float64) int {
+	metrics := []struct {
+		name, title  string
+		format       string
+		higherBetter bool
+		checked      bool
+	}{
+		{"rps", "RPS", "%.3f", true, true},
+		{"p50", "p50 (secs)", "%.3f", false, true},
+		{"p99", "p99 (secs)", "%.3f", false, true},
+		{"errors", "Error rate %", "%.3f", false, true},
+		{"timeout_rate", "Timeout rate %", "%.3f", false, false},
+		{"bytes", "Bytes", "%.0f", true, false},
+	}
+
+	regressions := 0
+	fmt.Fprintf(w, "%-14s %16s %16s %10s\n", "Metric", "Run 1", "Run 2", "Change")
+	for _, m := range metrics {
+		baseValue, _ := runMetric(base.Result, m.name)
+		nextValue, _ := runMetric(next.Result, m.name)
+		change := "0.00%"
+		worse := 0.0 // Percentage the metric got worse by
+		if delta := metricDelta(baseValue, nextValue); baseValue != 0 {
+			change = fmt.Sprintf("%+.2f%%", delta)
+			if worse = delta; m.higherBetter {
+				worse = -delta
+			}
+		} else if nextValue != 0 {
+			change = "new"
+			if !m.higherBetter {
+				worse = delta
+			}
+		}
+		line := fmt.Sprintf("%-14s %16s %16s %10s", m.title,
+			fmt.Sprintf(m.format, baseValue), fmt.Sprintf(m.format, nextValue), change)
+		if m.checked && worse > threshold {
+			line += "  REGRESSION"
+			regressions++
+		}
+		fmt.Fprintln(w, line)
+	}
+	return regressions
+}
 
-3.Example http3 test:
-	./http_bench -d 10s -c 10 -http http3 -m POST "http://127.0.0.1/test1" -body "{}"
+// compareMain runs http_bench compare and returns the exit code.
+func compareMain(args []string) int {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	thresholdStr := fs.String("threshold", "5%", "")
+	force := fs.Bool("force", false, "")
+	fs.Usage = flag.Usage
+	if err := fs.Parse(args); err != nil {
+		return bench.EXIT_USAGE
+	}
+	threshold, err := strconv.ParseFloat(strings.TrimSuffix(*thresholdStr, "%"), 64)
+	if err != nil || threshold < 0 || fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: http_bench compare [-threshold 5%%] [-force] run1.json run2.json\n")
+		return bench.EXIT_USAGE
+	}
+
+	var runs [2]*savedRun
+	for i := range runs {
+		if runs[i], err = loadRun(fs.Arg(i)); err != nil {
+			fmt.Fprintf(os.Stderr, "Load result err: %s\n", err.Error())
+			return bench.EXIT_USAGE
+		}
+	}
+	if diffs := runDifferences(runs[0].Params, runs[1].Params); len(diffs) > 0 && !*force {
+		fmt.Fprintf(os.Stderr, "Runs are not comparable, use -force to compare anyway: %s\n", strings.Join(diffs, ", "))
+		return bench.EXIT_USAGE
+	}
 
-4.Example dashboard test:
-	./http_bench -dashboard "127.0.0.1:12345" -verbose 1
+	fmt.Printf("Run 1: %s %s\n", fs.Arg(0), runs[0].Time.Format(time.RFC3339))
+	fmt.Printf("Run 2: %s %s\n", fs.Arg(1), runs[1].Time.Format(time.RFC3339))
+	if builds := buildDifference(runs[0].Result.Meta, runs[1].Result.Meta); builds != "" {
+		fmt.Fprintf(os.Stderr, "Runs made by different builds of http_bench, %s, part of the differences may come from it.\n", builds)
+	}
+	for _, diff := range labelDifferences(runs[0].Result.Labels, runs[1].Result.Labels) {
+		fmt.Printf("Label: %s\n", diff)
+	}
+	fmt.Println()
+	if n := compareRuns(os.Stdout, runs[0], runs[1], threshold); n > 0 {
+		fmt.Printf("\n%d regressions beyond %g%%\n", n, threshold)
+		return bench.EXIT_ERRORS
+	}
+	return bench.EXIT_OK
+}
 
-5.Example Support Function and Variable test:
-	./http_bench -c 1 -n 1 "https://127.0.0.1:18090?data={{ randomString 10}}" -verbose 0
+// remoteMain runs http_bench stop and status against -listen workers and
+// returns the exit code.
+func remoteMain(command string, args []string) int {
+	var addrs flagSlice
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.Var(&addrs, "W", "")
+	id := fs.Int64("id", 0, "")
+	fs.Usage = flag.Usage
+	if err := fs.Parse(args); err != nil {
+		return bench.EXIT_USAGE
+	}
+	if len(addrs) == 0 || *id == 0 || fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: http_bench %s -W host:port [-W host:port...] -id sequence_id\n", command)
+		return bench.EXIT_USAGE
+	}
+
+	params := bench.StressParameters{SequenceId: *id, Cmd: bench.CMD_METRICS}
+	if command == "stop" {
+		params.Cmd = bench.CMD_STOP
+	}
+	results := make([]*bench.StressResult, len(addrs))
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			results[i], errs[i] = requestWorker("http://"+addr+"/", params)
+		}(i, addr)
+	}
+	wg.Wait()
 
-5.Example distributed stress test:
-	(1) ./http_bench -listen "127.0.0.1:12710" -verbose 1
-	(2) ./http_bench -c 1 -d 10s "http://127.0.0.1:18090/test1" -body "{}" -verbose 1 -W "127.0.0.1:12710"
-`
+	exitCode := bench.EXIT_OK
+	var total bench.StressResult
+	for i, addr := range addrs {
+		state := "running"
+		switch result := results[i]; {
+		case errs[i] != nil:
+			state, exitCode = "error: "+errs[i].Error(), bench.EXIT_INTERNAL
+		case result.ErrCode != 0:
+			state, exitCode = "error: "+result.ErrMsg, bench.EXIT_INTERNAL
+		default:
+			if result.StopReason != "" {
+				state = "finished (" + result.StopReason + ")"
+			}
+			state += fmt.Sprintf(", %d attempted, %d completed", result.Attempted, result.LatsTotal)
+			total.Attempted += result.Attempted
+			total.LatsTotal += result.LatsTotal
+		}
+		fmt.Printf("%-21s %s\n", addr, state)
+	}
+	fmt.Printf("%-21s %d attempted, %d completed\n", "Total", total.Attempted, total.LatsTotal)
+	if command == "stop" {
+		// The partial results of the stopped runs, status only has progress.
+		var stopped []*bench.StressResult
+		for i, result := range results {
+			if errs[i] == nil && result.ErrCode == 0 && len(result.Lats) > 0 {
+				stopped = append(stopped, result)
+			}
+		}
+		if len(stopped) > 0 {
+			bench.CombineNodes(stopped, false).Print(os.Stdout, *errorWidth)
+		}
+	}
+	return exitCode
+}
 
 func main() {
 	flag.Usage = func() {
 		fmt.Println(fmt.Sprintf(usage, runtime.NumCPU()))
 	}
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		os.Exit(compareMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "stop" || os.Args[1] == "status") {
+		os.Exit(remoteMain(os.Args[1], os.Args[2:]))
+	}
 
-	var params StressParameters
+	var params bench.StressParameters
 	var headerslice flagSlice
-	flag.Var(&headerslice, "H", "") // Custom HTTP header
-	flag.Var(&workerList, "W", "")  // Worker mechine
+	var formslice, formFileSlice flagSlice
+	var randomHeaderSlice, captureHeaderSlice flagSlice
+	var querySlice flagSlice
+	flag.Var(&formslice, "form", "")                    // Multipart form text field
+	flag.Var(&formFileSlice, "form-file", "")           // Multipart form file field
+	flag.Var(&headerslice, "H", "")                     // Custom HTTP header
+	flag.Var(&randomHeaderSlice, "H-random", "")        // Header drawn from a file per request
+	flag.Var(&captureHeaderSlice, "capture-header", "") // Response header counted by value
+	flag.Var(&querySlice, "query", "")                  // Random query parameter
+	flag.Var(&workerList, "W", "")                      // Worker mechine
+	flag.Var(&urlList, "url", "")                       // Url, or one of the hosts run at once
+
+	flag.DurationVar(responseTimeout, "header-timeout", 0, "") // Alias of -response-timeout
 	flag.Parse()
 
 	for flag.NArg() > 0 {
-		if len(*urlstr) == 0 {
-			*urlstr = flag.Args()[0]
-		}
+		flag.Set("url", flag.Args()[0])
 		os.Args = flag.Args()[0:]
 		flag.Parse()
 	}
 
+	if *configFile != "" {
+		cliFlags := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			cliFlags[f.Name] = true
+		})
+		if err := applyConfig(*configFile, cliFlags); err != nil {
+			usageAndExit("-config " + err.Error())
+		}
+	}
+
 	if *printExample {
 		fmt.Println(examples)
 		return
 	}
+	if *printVersion {
+		meta := bench.RunMeta{Version: benchVersion(), Commit: gitCommit, BuildDate: buildDate}
+		fmt.Println("http_bench " + meta.Build())
+		return
+	}
 
 	runtime.GOMAXPROCS(*cpus)
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	// decrease gc profile, the flags take precedence over BENCH_GC
+	if setFlags["gc-percent"] {
+		debug.SetGCPercent(*gcPercent)
+	} else if os.Getenv("BENCH_GC") == "1" {
+		debug.SetGCPercent(200)
+	}
+	if *memLimit != "" {
+		limit, err := parseSize(*memLimit)
+		if err != nil {
+			usageAndExit("-memlimit " + err.Error())
+		}
+		if err = setMemoryLimit(limit); err != nil {
+			usageAndExit(err.Error())
+		}
+	}
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			usageAndExit("-log-file " + err.Error())
+		}
+		benchLog.SetOutput(f)
+	}
+	printRuntime()
+
 	params.N = *n
 	params.C = *c
 	params.Qps = *q
-	params.Duration = parseTime(*d)
+	params.QpsGlobal = *qpsGlobal
+	switch params.RateDistribution = strings.ToLower(*rateDistribution); params.RateDistribution {
+	case bench.RATE_CONSTANT, bench.RATE_POISSON:
+	default:
+		usageAndExit("-rate-distribution must be constant or poisson.")
+	}
+	if *burst != "" {
+		if params.Qps <= 0 {
+			usageAndExit("-burst requires -q.")
+		}
+		rate, duration, interval, err := parseBurst(*burst)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		params.BurstRate = rate
+		params.BurstDuration = int64(duration / time.Millisecond)
+		params.BurstInterval = int64(interval / time.Millisecond)
+		if err := params.CheckBurst(); err != nil {
+			usageAndExit(err.Error()) // Equal once truncated to ms
+		}
+	}
+	// -n alone runs to completion, -d 0 means no time limit, with both the
+	// run stops at whichever comes first.
+	if params.N > 0 && !setFlags["d"] {
+		params.Duration = 0
+	} else {
+		duration, err := parseTime(*d, time.Second)
+		if err != nil {
+			usageAndExit("-d: " + err.Error())
+		}
+		params.Duration = duration
+	}
+	if *drain < 0 {
+		usageAndExit("-drain cannot be negative.")
+	}
+	params.Drain = int64(*drain / time.Millisecond)
 
 	if params.C <= 0 {
 		usageAndExit("n and c cannot be smaller than 1.")
@@ -1070,19 +2410,225 @@ func main() {
 	if (params.N < params.C) && (params.Duration < 0) {
 		usageAndExit("n cannot be less than c.")
 	}
+	if params.N > 0 && params.N < params.C && !params.WsRecvOnly {
+		fmt.Fprintf(os.Stderr, "-c %d capped to -n %d, the other workers would have no request to send.\n", params.C, params.N)
+		params.C = params.N
+	}
 
-	if *urlFile == "" {
-		params.Urls = append(params.Urls, *urlstr)
+	if *accessLog != "" {
+		if _, ok := accessLogRegexps[*accessLogFormat]; !ok {
+			usageAndExit("-access-log-format must be combined or common.")
+		}
+		if *urlFile != "" || *targetConc != "" || len(urlList) > 1 {
+			usageAndExit("-access-log cannot be used with -url-file, -target-concurrency or several -url.")
+		}
+		if *replayTiming < 0 {
+			usageAndExit("-replay-timing cannot be negative.")
+		}
+		base := *baseUrl
+		if base == "" && len(urlList) > 0 {
+			base = urlList[0]
+		}
+		if base == "" {
+			usageAndExit("-access-log requires -base-url.")
+		}
+		urls, entries, malformed, err := parseAccessLog(*accessLog, *accessLogFormat, base, *replayTiming > 0)
+		if err != nil {
+			usageAndExit("-access-log " + err.Error())
+		}
+		if len(entries) < len(workerList) {
+			usageAndExit("-access-log has fewer requests than -W workers, each replays its share of the log.")
+		}
+		params.Urls, params.Replay, params.ReplaySpeed = urls, entries, *replayTiming
+		if params.ReplaySpeed > 0 && !setFlags["d"] {
+			params.Duration = 0
+		}
+		if !*quiet {
+			fmt.Printf("Access log: %d requests, %d urls, %d malformed lines skipped\n", len(entries), len(urls), malformed)
+		}
+	} else if *urlFile == "" {
+		params.Urls = append(params.Urls, urlList...)
+		if len(params.Urls) == 0 {
+			params.Urls = append(params.Urls, "")
+		}
 	} else {
-		var err error
-		if params.Urls, err = parseFile(*urlFile, []rune{'\r', '\n', ' '}); err != nil {
+		entries, err := parseUrlFile(*urlFile)
+		if err != nil {
 			usageAndExit(*urlFile + " file read error(" + err.Error() + ").")
 		}
+		params.Urls, params.UrlMethods = entries.urls, entries.methods
+		params.UrlHosts, params.UrlServerNames = entries.hosts, entries.serverNames
+		for _, key := range entries.unknown {
+			fmt.Fprintf(os.Stderr, "Unknown option %s= in %s is ignored.\n", key, *urlFile)
+		}
+	}
+	if len(urlList) > 1 && (*urlFile != "" || *targetConc != "" || *qpsGlobal != "") {
+		usageAndExit("Several -url cannot be used with -url-file, -target-concurrency or -qps-global.")
+	}
+	if *cPerUrl < 0 || (*cPerUrl > 0 && len(urlList) < 2) {
+		usageAndExit("-c-per-url must be positive and requires several -url.")
 	}
 
 	params.RequestMethod = strings.ToUpper(*m)
+	warned := make(map[string]bool)
+	for _, method := range append([]string{params.RequestMethod}, params.UrlMethods...) {
+		if method == "" || warned[method] {
+			continue
+		}
+		warned[method] = true
+		if known, err := checkMethod(method); err != nil {
+			usageAndExit(err.Error() + ".")
+		} else if !known {
+			fmt.Fprintf(os.Stderr, "Unusual method %s is sent as is, check it for a typo.\n", method)
+		}
+	}
 	params.DisableCompression = *disableCompression
+	switch strings.ToLower(*acceptEncoding) {
+	case "":
+	case bench.ACCEPT_GZIP, bench.ACCEPT_BR, bench.ACCEPT_IDENTITY, bench.ACCEPT_NONE:
+		if params.DisableCompression && strings.ToLower(*acceptEncoding) != bench.ACCEPT_NONE {
+			usageAndExit("-disable-compression cannot be used with -accept-encoding " + *acceptEncoding + ".")
+		}
+		params.AcceptEncoding = strings.ToLower(*acceptEncoding)
+	default:
+		usageAndExit("Not support -accept-encoding: " + *acceptEncoding)
+	}
+	if *noDecompress && (params.DisableCompression || params.AcceptEncoding == bench.ACCEPT_IDENTITY || params.AcceptEncoding == bench.ACCEPT_NONE) {
+		usageAndExit("-no-decompress requires -accept-encoding gzip or br.")
+	}
+	params.NoDecompress = *noDecompress
 	params.DisableKeepAlives = *disableKeepAlives
+	if *maxCard < 1 {
+		usageAndExit("-max-result-cardinality must be at least 1.")
+	}
+	params.MaxCardinality = *maxCard
+	if *soRcvbuf < 0 || *soSndbuf < 0 {
+		usageAndExit("-so-rcvbuf and -so-sndbuf cannot be negative.")
+	}
+	params.TcpDelay, params.SoRcvbuf, params.SoSndbuf = !*tcpNoDelay, *soRcvbuf, *soSndbuf
+	if *localAddr != "" {
+		for _, addr := range strings.Split(*localAddr, ",") {
+			if net.ParseIP(strings.TrimSpace(addr)) == nil {
+				usageAndExit(fmt.Sprintf("-local-addr %q is not an IP.", addr))
+			}
+			params.LocalAddrs = append(params.LocalAddrs, strings.TrimSpace(addr))
+		}
+	}
+	if *localPortRange != "" {
+		min, max, err := parsePortRange(*localPortRange)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		params.LocalPortMin, params.LocalPortMax = min, max
+	}
+	if *requestsPerConn < 0 {
+		usageAndExit("-requests-per-conn cannot be negative.")
+	}
+	params.RequestsPerConn = *requestsPerConn
+	if *dnsRefresh < 0 {
+		usageAndExit("-dns-refresh cannot be negative.")
+	}
+	params.DnsRefresh = int64(*dnsRefresh / time.Millisecond)
+	if *dnsServer != "" {
+		host := *dnsServer
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			usageAndExit(fmt.Sprintf("-dns-server %q is not an IP[:PORT].", *dnsServer))
+		}
+	}
+	if *dnsTimeout < 0 {
+		usageAndExit("-dns-timeout cannot be negative.")
+	}
+	params.DnsServer, params.DnsTimeout = *dnsServer, int64(*dnsTimeout/time.Millisecond)
+	if *slowThreshold < 0 {
+		usageAndExit("-slow-threshold cannot be negative.")
+	}
+	params.SlowThreshold = int64(*slowThreshold / time.Millisecond)
+	params.PerWorkerBreakdown = *perWorker
+	params.Workers = workerList
+	if err := checkWorkerShares(params); err != nil {
+		usageAndExit(err.Error() + ".")
+	}
+	params.SlowLogRate = *slowLogRate
+	if *targetConc != "" {
+		var err error
+		if params.TargetConcurrency, err = parseTargetConcurrency(*targetConc); err != nil {
+			usageAndExit("-target-concurrency " + err.Error())
+		}
+		if err = params.CheckTargetConcurrency(); err != nil {
+			usageAndExit("-target-concurrency " + err.Error())
+		}
+	}
+	switch params.TracePropagation = strings.ToLower(*traceProp); params.TracePropagation {
+	case "", bench.TRACE_W3C, bench.TRACE_B3:
+	default:
+		usageAndExit("-trace-propagation must be w3c or b3.")
+	}
+	if *requestIdHeader != "" {
+		if _, err := parseInputWithRegexp(*requestIdHeader+": x", headerRegexp); err != nil {
+			usageAndExit("-request-id-header must be a header name.")
+		}
+		params.RequestIdHeader = textproto.CanonicalMIMEHeaderKey(*requestIdHeader)
+	}
+	for _, spec := range querySlice {
+		q, err := parseQuery(spec)
+		if err != nil {
+			usageAndExit("-query " + err.Error() + ".")
+		}
+		params.Query = append(params.Query, q)
+	}
+	if *cacheBust {
+		if *cacheBustParam == "" {
+			usageAndExit("-cache-bust-param is empty.")
+		}
+		params.CacheBust = *cacheBustParam
+	}
+	params.NoCacheHeaders = *noCacheHeaders
+	params.Conditional = *conditional
+	for _, name := range captureHeaderSlice {
+		if _, err := parseInputWithRegexp(name+": x", headerRegexp); err != nil {
+			usageAndExit("-capture-header must be a header name.")
+		}
+		params.CaptureHeaders = append(params.CaptureHeaders, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	params.MaxConns = *maxConns
+	params.MaxIdleConns = *maxIdleConns
+	params.IdleConnTimeout = int64(*idleConnTimeout / time.Millisecond)
+	if *think < 0 {
+		usageAndExit("-think cannot be negative.")
+	}
+	params.Think = int64(*think / time.Millisecond)
+	if *thinkRandom != "" {
+		min, max, err := parseThinkRandom(*thinkRandom)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		params.ThinkMin = int64(min / time.Millisecond)
+		params.ThinkMax = int64(max / time.Millisecond)
+	}
+	params.FormFields = formslice
+	for _, v := range formFileSlice {
+		path, err := bench.FormFilePath(v)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		if _, err = os.Stat(path); err != nil {
+			usageAndExit(path + " file read error(" + err.Error() + ").")
+		}
+	}
+	params.FormFiles = formFileSlice
+
+	if *bodyStream != "" {
+		if len(params.FormFields) > 0 || len(params.FormFiles) > 0 {
+			usageAndExit("-body-stream cannot be used with -form or -form-file.")
+		}
+		if _, err := os.Stat(*bodyStream); err != nil {
+			usageAndExit(*bodyStream + " file read error(" + err.Error() + ").")
+		}
+		params.BodyStream = *bodyStream
+	}
 	params.RequestBody = *body
 
 	if *bodyFile != "" {
@@ -1090,11 +2636,67 @@ func main() {
 			usageAndExit(*bodyFile + " file read error(" + err.Error() + ").")
 		} else {
 			if len(readBody) > 0 {
-				params.RequestBody = readBody[0]
+				if bodies := splitBodies(readBody[0], *bodyDelimiter); len(bodies) > 1 {
+					params.RequestBodies = bodies
+				} else {
+					params.RequestBody = readBody[0]
+				}
 			}
 		}
 	}
 
+	if *maxBodyRead != "" {
+		size, err := parseSize(*maxBodyRead)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		params.MaxBodyRead = size
+	}
+	params.SkipBody = !*discardBody
+	if *lengthTolerance < 0 {
+		usageAndExit("-content-length-tolerance must not be negative.")
+	}
+	params.LengthTolerance = *lengthTolerance
+	if *streamMetrics && (params.SkipBody || params.MaxBodyRead > 0) {
+		usageAndExit("-stream-metrics reads the whole body, it cannot be used with -max-body-read or -discard-body=false.")
+	}
+	if *streamIdleTimeout < 0 || (*streamIdleTimeout > 0 && !*streamMetrics) {
+		usageAndExit("-stream-idle-timeout must be positive and requires -stream-metrics.")
+	}
+	if *retryAfterMax <= 0 {
+		usageAndExit("-retry-after-max must be positive.")
+	}
+	params.RespectRetryAfter, params.RetryAfterMax = *respectRetryAfter, int64(*retryAfterMax/time.Millisecond)
+	if *labelFlag != "" {
+		labels, err := parseLabels(*labelFlag)
+		if err != nil {
+			usageAndExit("-label " + err.Error() + ".")
+		}
+		params.Labels = labels
+	}
+	params.StreamMetrics, params.StreamIdleTimeout = *streamMetrics, int64(*streamIdleTimeout/time.Millisecond)
+	params.SaveResponses = *saveResponses
+	params.SaveResponsesCount = *saveResponsesCount
+	params.VerifySha256 = *verifySha256
+	params.VerifySha256Header = *verifySha256Header
+	if (params.VerifySha256 != "" || params.VerifySha256Header != "") && (params.SkipBody || params.MaxBodyRead > 0) {
+		usageAndExit("-verify-sha256 needs the full body, it cannot be used with -max-body-read or -discard-body=false.")
+	}
+
+	switch strings.ToLower(*compressBody) {
+	case "", bench.COMPRESS_GZIP:
+		params.CompressBody = strings.ToLower(*compressBody)
+	default:
+		usageAndExit("Not support -compress-body: " + *compressBody)
+	}
+
+	switch strings.ToLower(*bodyOrder) {
+	case bench.BODY_ORDER_RANDOM, bench.BODY_ORDER_SEQUENTIAL:
+		params.BodyOrder = strings.ToLower(*bodyOrder)
+	default:
+		usageAndExit("Not support -body-order: " + *bodyOrder)
+	}
+
 	if *scriptFile != "" {
 		if scriptBody, err := parseFile(*scriptFile, nil); err != nil {
 			usageAndExit(*scriptFile + " file read error(" + err.Error() + ").")
@@ -1106,29 +2708,109 @@ func main() {
 	}
 
 	switch strings.ToLower(*httpType) {
-	case TYPE_HTTP1, TYPE_HTTP2, TYPE_WS:
+	case bench.TYPE_HTTP1, bench.TYPE_WS:
 		params.RequestHttpType = strings.ToLower(*httpType)
-	case TYPE_HTTP3:
+	case bench.TYPE_HTTP2:
+		params.RequestHttpType = strings.ToLower(*httpType)
+		params.H2Conns = *h2Conns
+	case bench.TYPE_TCP:
+		params.RequestHttpType = strings.ToLower(*httpType)
+		params.TcpReadBytes = *tcpReadBytes
+		params.TcpReconnect = *tcpReconnect
+		if *tcpReadUntil != "" {
+			delim, err := strconv.Unquote(`"` + *tcpReadUntil + `"`)
+			if err != nil {
+				usageAndExit("Invalid -tcp-read-until: " + err.Error())
+			}
+			params.TcpReadUntil = delim
+		}
+	case bench.TYPE_HTTP3:
 		params.RequestHttpType = strings.ToLower(*httpType)
 		var err error
 		http3Pool, err = x509.SystemCertPool()
 		if err != nil {
-			panic(TYPE_HTTP3 + " err: " + err.Error())
+			panic(bench.TYPE_HTTP3 + " err: " + err.Error())
 		}
+		params.Quic0RTT = *quic0RTT
+		params.QuicIdleTimeout = int64(*quicIdleTimeout / time.Millisecond)
+		params.QuicKeepAlive = int64(*quicKeepAlive / time.Millisecond)
+		params.QuicMaxStreams = *quicMaxStreams
+		params.QuicDatagrams = *quicDatagrams
 	default:
 		usageAndExit("Not support -http: " + *httpType)
 	}
+	if params.UrlServerNames != nil && params.RequestHttpType != bench.TYPE_HTTP1 && params.RequestHttpType != bench.TYPE_HTTP2 {
+		usageAndExit("The sni option of -url-file requires -http http1 or http2.")
+	}
+	if *waitReady < 0 || (*waitReady > 0 && (params.RequestHttpType == bench.TYPE_WS || params.RequestHttpType == bench.TYPE_TCP)) {
+		usageAndExit("-wait-ready must be positive and requires an http -http type.")
+	}
+	if *readyStatus < 100 || *readyStatus > 599 {
+		usageAndExit("-expect-ready-status must be an http status code.")
+	}
+
+	switch strings.ToLower(*validate) {
+	case bench.VALIDATE_STRICT, bench.VALIDATE_ONCE, bench.VALIDATE_OFF:
+		params.ValidateUrls = strings.ToLower(*validate)
+	default:
+		usageAndExit("Not support -validate-urls: " + *validate)
+	}
+
+	switch strings.ToLower(*wsMode) {
+	case bench.WS_MODE_PERSISTENT, bench.WS_MODE_RECONNECT:
+		params.WsMode = strings.ToLower(*wsMode)
+	default:
+		usageAndExit("Not support -ws-mode: " + *wsMode)
+	}
+
+	if *wsRecvOnly {
+		if params.RequestHttpType != bench.TYPE_WS || params.WsMode != bench.WS_MODE_PERSISTENT {
+			usageAndExit("-ws-recv-only requires -http ws with persistent -ws-mode.")
+		}
+		params.WsRecvOnly = true
+	}
 
 	// set any other additional repeatable headers
-	for _, h := range headerslice {
-		match, err := parseInputWithRegexp(h, headerRegexp)
-		if err != nil {
+	if len(headerslice) > 0 {
+		var err error
+		if params.Headers, err = parseHeaders(headerslice); err != nil {
 			usageAndExit(err.Error())
 		}
+	}
+	if *headerFile != "" {
+		fileHeaders, err := parseHeaderFile(*headerFile)
+		if err != nil {
+			usageAndExit("-header-file " + err.Error())
+		}
 		if params.Headers == nil {
-			params.Headers = make(map[string][]string, 0)
+			params.Headers = make(map[string][]string, len(fileHeaders))
+		}
+		for name, values := range fileHeaders {
+			if _, ok := params.Headers[name]; !ok { // -H wins
+				params.Headers[name] = values
+			}
+		}
+	}
+
+	for _, v := range randomHeaderSlice {
+		name, lines, err := parseHeaderPool(v)
+		if err != nil {
+			usageAndExit("-H-random " + err.Error())
 		}
-		params.Headers[match[1]] = []string{match[2]}
+		if params.HeaderPools == nil {
+			params.HeaderPools = make(map[string][]string)
+		}
+		params.HeaderPools[name] = lines
+	}
+	if *userAgentFile != "" {
+		lines, err := readLines(*userAgentFile)
+		if err != nil {
+			usageAndExit("-user-agent-file " + err.Error())
+		}
+		if params.HeaderPools == nil {
+			params.HeaderPools = make(map[string][]string)
+		}
+		params.HeaderPools["User-Agent"] = lines
 	}
 
 	// set basic auth if set
@@ -1140,12 +2822,54 @@ func main() {
 		}
 	}
 
-	if *output != "csv" && *output != "" {
-		usageAndExit("Invalid output type; only csv is supported.")
+	if *bearer != "" && *bearerFile != "" {
+		usageAndExit("-bearer and -bearer-file are exclusive.")
+	}
+	params.Bearer = *bearer
+	if *bearerFile != "" && len(workerList) == 0 {
+		if _, err := ioutil.ReadFile(*bearerFile); err != nil {
+			usageAndExit("-bearer-file " + err.Error())
+		}
+	}
+	params.BearerFile = *bearerFile
+
+	if *oauth2TokenUrl != "" {
+		if *bearer != "" || *bearerFile != "" {
+			usageAndExit("-oauth2-token-url and -bearer are exclusive.")
+		}
+		if *oauth2ClientId == "" {
+			usageAndExit("-oauth2-token-url needs -oauth2-client-id.")
+		}
+		if _, err := gourl.ParseRequestURI(*oauth2TokenUrl); err != nil {
+			usageAndExit("-oauth2-token-url " + err.Error())
+		}
+		params.OAuth2TokenUrl, params.OAuth2ClientId, params.OAuth2ClientSecret = *oauth2TokenUrl, *oauth2ClientId, *oauth2ClientSecret
+		for _, scope := range strings.Split(*oauth2Scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				params.OAuth2Scopes = append(params.OAuth2Scopes, scope)
+			}
+		}
+	}
+
+	switch *output {
+	case "", bench.OUTPUT_CSV, bench.OUTPUT_JSON, bench.OUTPUT_AB:
+		params.Output = *output
+	default:
+		usageAndExit("Invalid output type; only csv, json and ab are supported.")
+	}
+	if *outputFile != "" && *output == "" {
+		usageAndExit("-o-file requires -o csv, -o json or -o ab.")
 	}
 
 	// set request timeout
-	params.Timeout = *t
+	if timeout, err := parseTimeout(*t); err != nil {
+		usageAndExit("-t: " + err.Error())
+	} else {
+		params.Timeout = timeout
+	}
+	params.ConnectTimeout = int64(*connectTimeout / time.Millisecond)
+	params.TlsTimeout = int64(*tlsTimeout / time.Millisecond)
+	params.ResponseTimeout = int64(*responseTimeout / time.Millisecond)
 
 	if *proxyAddr != "" {
 		var err error
@@ -1154,12 +2878,71 @@ func main() {
 		}
 	}
 
+	var baseline *savedRun
+	var regressionChecks []regressionCheck
+	if *baselineFile != "" {
+		var err error
+		if *regression == "" && !*updateBaseline {
+			usageAndExit("-baseline requires -regression or -update-baseline.")
+		}
+		if *regression != "" {
+			if regressionChecks, err = parseRegression(*regression); err != nil {
+				usageAndExit(err.Error())
+			}
+		}
+		if baseline, err = loadRun(*baselineFile); err != nil && !(os.IsNotExist(err) && *updateBaseline) {
+			usageAndExit("-baseline " + err.Error())
+		}
+		if baseline != nil {
+			if diffs := runDifferences(baseline.Params, params); len(diffs) > 0 {
+				usageAndExit("-baseline is not comparable: " + strings.Join(diffs, ", "))
+			}
+		}
+	} else if *regression != "" || *updateBaseline {
+		usageAndExit("-regression and -update-baseline require -baseline.")
+	}
+
+	if *dumpConfigFlag {
+		// Pin the values which depend on a flag being unset.
+		if params.Duration == 0 {
+			flag.Set("d", "0")
+		}
+		flag.Set("gc-percent", strconv.Itoa(gcPercentNow()))
+		data, err := dumpConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Dump config err: %s\n", err.Error())
+			os.Exit(bench.EXIT_INTERNAL)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
 	var mainServer *http.Server
-	_, mainCancel := context.WithCancel(context.Background())
+	mainCtx, mainCancel := context.WithCancel(context.Background())
+	defer mainCancel()
 
-	// decrease gc profile
-	if getEnv("BENCH_GC") == "1" {
-		debug.SetGCPercent(200)
+	if len(*pprofAddr) > 0 {
+		// net/http/pprof registers its handlers on the default mux.
+		fmt.Fprintf(os.Stdout, "Pprof listen %s\n", *pprofAddr)
+		go func() {
+			if err := http.ListenAndServe(*pprofAddr, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "Pprof ListenAndServe err: %s\n", err.Error())
+			}
+		}()
+	}
+	stopProfiles := startProfiles()
+	exitCode := bench.EXIT_OK
+
+	if len(*listen) > 0 || len(*dashboard) > 0 {
+		// Stop the server on a signal so the profiles are written on exit.
+		serverSignal := make(chan os.Signal, 1)
+		signal.Notify(serverSignal, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-serverSignal
+			if mainServer != nil {
+				mainServer.Close()
+			}
+		}()
 	}
 
 	if len(*listen) > 0 {
@@ -1170,48 +2953,140 @@ func main() {
 			Addr:    *listen,
 			Handler: mux,
 		}
-		if err := mainServer.ListenAndServe(); err != nil {
+		if err := mainServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			fmt.Fprintf(os.Stderr, "ListenAndServe err: %s\n", err.Error())
 		}
 	} else if len(*dashboard) > 0 {
 		mux := http.NewServeMux()
-		mux.Handle("/", http.FileServer(http.Dir("./")))
-		mux.HandleFunc("/api", handleWorker)
+		if *dashboardAssets != "" {
+			if info, err := os.Stat(*dashboardAssets); err != nil || !info.IsDir() {
+				usageAndExit(fmt.Sprintf("-dashboard-assets %s is not a directory.", *dashboardAssets))
+			}
+		}
+		mux.Handle("/", dashboardHandler(*dashboardAssets))
+		api := map[string]http.Handler{
+			"/api":         http.HandlerFunc(handleWorker),
+			"/api/result/": http.HandlerFunc(handleResult),
+		}
+		for pattern, h := range api {
+			if *corsOrigins != "" {
+				origins, err := parseCorsOrigins(*corsOrigins, *corsCredentials)
+				if err != nil {
+					usageAndExit(err.Error())
+				}
+				h = withCors(h, origins, *corsCredentials)
+			}
+			mux.Handle(pattern, h)
+		}
 		fmt.Fprintf(os.Stdout, "Dashboard listen %s\n", *dashboard)
 		mainServer = &http.Server{
 			Addr:    *dashboard,
 			Handler: mux,
 		}
-		if err := mainServer.ListenAndServe(); err != nil {
+		if err := mainServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			fmt.Fprintf(os.Stderr, "ListenAndServe err: %s\n", err.Error())
 		}
 	} else {
 		if len(params.Urls) <= 0 || len(params.Urls[0]) <= 0 {
 			usageAndExit("url or url-file empty.")
 		}
+		// A syntax error would send the functions unrendered.
+		if err := params.CheckTemplates(); err != nil {
+			usageAndExit(err.Error())
+		}
 
-		params.SequenceId = time.Now().Unix()
-		params.Cmd = CMD_START
-		verbosePrint(VERBOSE_DEBUG, "Request params: %s\n", params.String())
-		stopSignal = make(chan os.Signal)
+		params.SequenceId = newSequenceId()
+		params.Cmd = bench.CMD_START
+		hosts := []bench.StressParameters{params}
+		if len(urlList) > 1 {
+			var err error
+			if hosts, err = hostParams(params, *cPerUrl); err != nil {
+				usageAndExit(err.Error())
+			}
+		}
+		if *liveUI && (len(workerList) > 0 || len(hosts) > 1 || *quiet) {
+			usageAndExit("-ui cannot be used with -W, several -url or -quiet.")
+		}
+		if len(workerList) > 0 && !*quiet {
+			fmt.Printf("Sequence id: %d\n", params.SequenceId)
+		}
+		verbosePrint(bench.VERBOSE_DEBUG, "Request params: %s\n", params.String())
+		for _, host := range hosts {
+			if *waitReady <= 0 {
+				break
+			}
+			if !*quiet {
+				fmt.Printf("Waiting up to %v for %s to answer %d\n", *waitReady, host.Urls[0], *readyStatus)
+			}
+			probe := bench.New(host)
+			probe.Options = workerOptions()
+			if err := probe.WaitReady(mainCtx, *waitReady, *readyStatus); err != nil {
+				fmt.Fprintf(os.Stderr, "Wait ready err: %s\n", err.Error())
+				stopProfiles()
+				os.Exit(bench.EXIT_NOT_READY)
+			}
+		}
+		stopSignal = make(chan os.Signal, 2)
 		signal.Notify(stopSignal, syscall.SIGINT, syscall.SIGTERM)
 
-		var stressTest *StressWorker
-		var stressResult *StressResult
+		// Registered before the run so the signal goroutine never sees nil,
+		// execStress and runHosts pick them up by the SequenceId.
+		stressTests := make([]*bench.StressWorker, len(hosts))
+		for i, host := range hosts {
+			stressTests[i] = bench.New(host)
+			stressTests[i].Options = workerOptions()
+			stressTests[i].Options.Live = *liveUI
+			stressList.Store(host.SequenceId, stressTests[i])
+		}
+		var stressResult *bench.StressResult
 
 		go func() {
-			<-stopSignal
-			verbosePrint(VERBOSE_INFO, "Recv stop signal\n")
-			params.Cmd = CMD_STOP
-			jsonBody, _ := json.Marshal(params)
-			requestWorkerList(jsonBody, stressTest)
-			stressTest.Stop(true, nil) // Recv stop signal and Stop commands
-			mainCancel()
+			if _, ok := <-stopSignal; !ok {
+				return // Closed once the run is over
+			}
+			verbosePrint(bench.VERBOSE_INFO, "Recv stop signal\n")
+			fmt.Fprintf(runStderr(), "Stopping, press Ctrl-C again to force\n")
+			for i, stressTest := range stressTests {
+				stopParams := hosts[i]
+				stopParams.Cmd = bench.CMD_STOP
+				go requestWorkerList(stopParams, stressTest)
+				stressTest.SetStopReason(bench.STOP_STOPPED)
+				stressTest.Stop(false, nil) // Recv stop signal and Stop commands
+			}
+
+			if _, ok := <-stopSignal; !ok {
+				return
+			}
+			fmt.Fprintf(runStderr(), "Forced stop\n")
+			if len(workerList) > 0 {
+				// The -W workers hold the results and finish on their own.
+				os.Exit(bench.EXIT_INTERNAL)
+			}
+			mainCancel() // Aborts the requests in flight
 		}()
 
-		if stressResult = execStress(params, &stressTest); stressResult != nil {
-			close(stopSignal)
-			stressResult.print()
+		if len(hosts) > 1 {
+			stressResult = runHosts(mainCtx, params, hosts)
+		} else {
+			var running *bench.StressWorker // stressTests[0] again, kept apart from the signal goroutine
+			stressResult = execStress(mainCtx, params, &running)
+		}
+		signal.Stop(stopSignal)
+		close(stopSignal) // execStress printed the result
+		exitCode = stressResult.ExitCode(*maxErrorRate)
+		if *baselineFile != "" && stressResult != nil {
+			exitCode = checkBaseline(baseline, regressionChecks, params, stressResult, exitCode)
 		}
+		if *saveResult != "" && stressResult != nil {
+			if err := saveRun(*saveResult, params, stressResult); err != nil {
+				fmt.Fprintf(os.Stderr, "Save result err: %s\n", err.Error())
+				exitCode = bench.EXIT_INTERNAL
+			}
+		}
+	}
+
+	stopProfiles()
+	if exitCode != bench.EXIT_OK {
+		os.Exit(exitCode)
 	}
 }
@@ -0,0 +1,1448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/linkxzhou/http_bench/bench"
+)
+
+// TestMain runs http_bench itself when re-executed by runMain.
+func TestMain(m *testing.M) {
+	if os.Getenv("HTTP_BENCH_TEST_MAIN") == "1" {
+		os.Args = append([]string{os.Args[0]}, strings.Fields(os.Getenv("HTTP_BENCH_TEST_ARGS"))...)
+		main()
+		os.Exit(bench.EXIT_OK)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs http_bench with args in a child process and returns its exit
+// code and stdout.
+func runMain(t *testing.T, args ...string) (int, string) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "HTTP_BENCH_TEST_MAIN=1", "HTTP_BENCH_TEST_ARGS="+strings.Join(args, " "))
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), string(out)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return bench.EXIT_OK, string(out)
+}
+
+func newTestWorker(params bench.StressParameters) *bench.StressWorker {
+	if params.RequestMethod == "" {
+		params.RequestMethod = http.MethodGet
+	}
+	if params.RequestHttpType == "" {
+		params.RequestHttpType = bench.TYPE_HTTP1
+	}
+	if params.Timeout == 0 {
+		params.Timeout = 3000
+	}
+	if params.Duration == 0 {
+		params.Duration = 60
+	}
+	params.Cmd = bench.CMD_START
+	return bench.New(params)
+}
+
+func TestSplitBodies(t *testing.T) {
+	content := "{\"a\":1}\r\n---\r\n{\"b\":\n2}\n---\n\n---\n{{ randomNum 3 }}\n"
+	bodies := splitBodies(content, "---")
+	expected := []string{"{\"a\":1}", "{\"b\":\n2}", "{{ randomNum 3 }}"}
+	if len(bodies) != len(expected) {
+		t.Fatalf("expected %d bodies, got %q", len(expected), bodies)
+	}
+	for i := range expected {
+		if bodies[i] != expected[i] {
+			t.Fatalf("body %d: expected %q, got %q", i, expected[i], bodies[i])
+		}
+	}
+}
+
+func TestQpsShare(t *testing.T) {
+	for _, tc := range []struct{ qps, total int }{{100, 3}, {7, 7}, {10, 4}, {1000, 1}} {
+		sum := 0
+		for i := 0; i < tc.total; i++ {
+			share := qpsShare(tc.qps, i, tc.total)
+			if share < tc.qps/tc.total || share > tc.qps/tc.total+1 {
+				t.Fatalf("qps %d over %d: uneven share %d", tc.qps, tc.total, share)
+			}
+			sum += share
+		}
+		if sum != tc.qps {
+			t.Fatalf("qps %d over %d: shares add up to %d", tc.qps, tc.total, sum)
+		}
+	}
+}
+
+func TestParseBurst(t *testing.T) {
+	rate, duration, interval, err := parseBurst("rate=1000,duration=2s,interval=30s")
+	if err != nil || rate != 1000 || duration != 2*time.Second || interval != 30*time.Second {
+		t.Fatalf("parseBurst: %d %v %v %v", rate, duration, interval, err)
+	}
+	for _, bad := range []string{"rate=10", "rate=10,duration=5s,interval=5s", "rate=0,duration=1s,interval=5s", "speed=1",
+		"rate=10,duration=500us,interval=5s"} {
+		if _, _, _, err := parseBurst(bad); err == nil {
+			t.Fatalf("parseBurst(%q) accepted", bad)
+		}
+	}
+
+}
+
+func TestParseTime(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		unit time.Duration
+		want int64
+	}{
+		{"10", time.Second, 10},
+		{"0", time.Second, 0},
+		{"10s", time.Second, 10},
+		{"2m", time.Second, 120},
+		{"2h", time.Second, 7200},
+		{"1m30s", time.Second, 90},
+		{"3000", time.Millisecond, 3000},
+		{"500ms", time.Millisecond, 500},
+		{"1.5s", time.Millisecond, 1500},
+	} {
+		if got, err := parseTime(tc.in, tc.unit); err != nil || got != tc.want {
+			t.Fatalf("parseTime(%q, %v) = %d, %v, want %d", tc.in, tc.unit, got, err, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "-1", "-5s", "ten", "10x", "500ms", "1.5s"} {
+		if _, err := parseTime(bad, time.Second); err == nil {
+			t.Fatalf("parseTime(%q) accepted", bad)
+		}
+	}
+	// -d counts whole seconds, a fraction is rejected with the reason
+	if _, err := parseTime("1.5s", time.Second); err == nil || !strings.Contains(err.Error(), "whole number of 1s") {
+		t.Fatalf("parseTime(1.5s) error %v, want the resolution", err)
+	}
+	// -t 0 means no timeout as before
+	for in, want := range map[string]int{"0": 0, "0s": 0, "3000": 3000, "1.5s": 1500} {
+		if got, err := parseTimeout(in); err != nil || got != want {
+			t.Fatalf("parseTimeout(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"-1", "1us", "9999999999999"} {
+		if _, err := parseTimeout(bad); err == nil {
+			t.Fatalf("parseTimeout(%q) accepted", bad)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	// Nothing listens on a closed server, every -W request fails.
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	worker := strings.TrimPrefix(closed.URL, "http://")
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"success", []string{"-n", "20", "-c", "2", ok.URL}, bench.EXIT_OK},
+		{"usage", []string{"-c", "0", ok.URL}, bench.EXIT_USAGE},
+		{"errors", []string{"-n", "20", "-c", "2", failing.URL}, bench.EXIT_ERRORS},
+		{"errors allowed", []string{"-n", "20", "-c", "2", "-max-error-rate", "100", failing.URL}, bench.EXIT_OK},
+		{"unreachable", []string{"-n", "20", "-c", "2", closed.URL}, bench.EXIT_ERRORS},
+		{"workers failed", []string{"-n", "20", "-c", "2", "-W", worker, ok.URL}, bench.EXIT_INTERNAL},
+	} {
+		if code, _ := runMain(t, tc.args...); code != tc.code {
+			t.Errorf("%s: exit code %d, want %d", tc.name, code, tc.code)
+		}
+	}
+}
+
+func TestQuietSummary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jsonPath := filepath.Join(dir, "result.json")
+
+	code, out := runMain(t, "-n", "20", "-c", "2", "-verbose", "0", "-quiet", "-o", "json", "-o-file", jsonPath, server.URL)
+	if code != bench.EXIT_OK {
+		t.Fatalf("exit code %d", code)
+	}
+	if !regexp.MustCompile(`^rps=[0-9.]+ p50=[0-9.]+ p99=[0-9.]+ errors=0 bytes=100\n$`).MatchString(out) {
+		t.Fatalf("quiet output %q", out)
+	}
+	data, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full bench.StressResult
+	if err := json.Unmarshal(data, &full); err != nil {
+		t.Fatal(err)
+	}
+	if full.LatsTotal != 20 || full.StatusCodeDist[200] != 20 {
+		t.Fatalf("json result %d requests, status %v", full.LatsTotal, full.StatusCodeDist)
+	}
+}
+
+func TestVerbosePrintLevels(t *testing.T) {
+	var buf bytes.Buffer
+	benchLog.SetOutput(&buf)
+	defer benchLog.SetOutput(os.Stderr)
+	defer func(v int) { *verbose = v }(*verbose)
+	*verbose = bench.VERBOSE_INFO
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				verbosePrint(bench.VERBOSE_TRACE, "trace %d\n", i)
+				verbosePrint(bench.VERBOSE_INFO, "info %d\n", i)
+				verbosePrint(bench.VERBOSE_ERROR, "error %d\n", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 8*50*2 {
+		t.Fatalf("%d lines, want %d", len(lines), 8*50*2)
+	}
+	line := regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{6} \[(INFO|ERROR)\] (info|error) \d$`)
+	for _, l := range lines {
+		if !line.MatchString(l) {
+			t.Fatalf("unexpected log line %q", l)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	code, dump := runMain(t, "-n", "5", "-c", "2", "-H", "Accept:text/plain", "-dump-config", "http://127.0.0.1/")
+	if code != bench.EXIT_OK {
+		t.Fatalf("dump exit code %d", code)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(dump), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["n"] != 5.0 || config["d"] != "0" || !reflect.DeepEqual(config["url"], []interface{}{"http://127.0.0.1/"}) {
+		t.Fatalf("dumped n %v, d %v, url %v", config["n"], config["d"], config["url"])
+	}
+	path := filepath.Join(dir, "bench.json")
+	if err := ioutil.WriteFile(path, []byte(dump), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, again := runMain(t, "-config", path, "-dump-config"); again != dump {
+		t.Fatalf("config dumped differently:\n%s\nwant:\n%s", again, dump)
+	}
+	_, override := runMain(t, "-config", path, "-c", "7", "-dump-config")
+	if err := json.Unmarshal([]byte(override), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["c"] != 7.0 || config["n"] != 5.0 {
+		t.Fatalf("overridden c %v, n %v", config["c"], config["n"])
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"concurrency": 10}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := runMain(t, "-config", path, "-dump-config"); code != bench.EXIT_USAGE {
+		t.Fatalf("unknown key exit code %d, want %d", code, bench.EXIT_USAGE)
+	}
+}
+
+func TestSecretsNotPrinted(t *testing.T) {
+	secrets := []string{"t0ken", "s3cret", "cl1ent"}
+	code, dump := runMain(t, "-n", "5", "-bearer", "t0ken", "-a", "user:s3cret",
+		"-oauth2-client-secret", "cl1ent", "-dump-config", "http://127.0.0.1/")
+	if code != bench.EXIT_OK {
+		t.Fatalf("dump exit code %d", code)
+	}
+	for _, secret := range secrets {
+		if strings.Contains(dump, secret) {
+			t.Fatalf("%s in the dumped config:\n%s", secret, dump)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	var buf bytes.Buffer
+	benchLog.SetOutput(&buf)
+	defer benchLog.SetOutput(os.Stderr)
+	defer func(v int) { *verbose = v }(*verbose)
+	*verbose = bench.VERBOSE_DEBUG
+	params := bench.StressParameters{Bearer: "t0ken", AuthUsername: "user", AuthPassword: "s3cret", OAuth2ClientSecret: "cl1ent"}
+	if _, err := requestWorker(server.URL, params); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Request body: ") {
+		t.Fatalf("request body not logged: %s", buf.String())
+	}
+	for _, secret := range secrets {
+		if strings.Contains(buf.String(), secret) || strings.Contains(params.String(), secret) {
+			t.Fatalf("%s printed: %s", secret, buf.String())
+		}
+	}
+}
+
+func TestRecordedParams(t *testing.T) {
+	params := bench.StressParameters{
+		Headers: map[string][]string{"Authorization": {"Basic dXNlcjpwdw=="}, "X-Api-Key": {"k3y"},
+			"Cookie": {"session=c00kie"}, "Accept": {"application/json"}},
+		HeaderPools:   map[string][]string{"X-Auth-Token": {"tok1", "tok2"}, "User-Agent": {"a", "b", "c"}},
+		Replay:        make([]bench.ReplayEntry, 2),
+		RequestBodies: []string{"1", "2", "3"},
+	}
+	data, err := json.Marshal(runMeta(params, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"dXNlcjpwdw==", "k3y", "c00kie", "tok1"} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("%s in the run metadata: %s", secret, data)
+		}
+	}
+	var meta bench.RunMeta
+	json.Unmarshal(data, &meta)
+	if meta.Params.Headers["Accept"][0] != "application/json" || meta.Params.Headers["Authorization"][0] != bench.REDACTED {
+		t.Fatalf("headers %v", meta.Params.Headers)
+	}
+	if meta.Params.Replay != nil || meta.Params.RequestBodies != nil || meta.Params.HeaderPools != nil ||
+		meta.ReplayRequests != 2 || meta.Bodies != 3 || meta.HeaderPools["User-Agent"] != 3 {
+		t.Fatalf("inputs kept %+v", meta)
+	}
+	if params.Headers["X-Api-Key"][0] != "k3y" || len(params.HeaderPools) != 2 {
+		t.Fatalf("params of the run changed: %v %v", params.Headers, params.HeaderPools)
+	}
+}
+
+func TestCompareRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params := bench.StressParameters{Urls: []string{"http://127.0.0.1/"}, RequestMethod: http.MethodGet, Duration: 10, AuthPassword: "secret"}
+	newRun := func(rps int64, p99 string) *bench.StressResult {
+		res := bench.NewStressResult()
+		res.Rps = rps * bench.SCALE_NUM
+		res.LatsTotal = 100
+		res.Lats = map[string]int64{"0.010": 98, p99: 2}
+		res.StatusCodeDist[200] = 100
+		return res
+	}
+	base, next := filepath.Join(dir, "base.json"), filepath.Join(dir, "next.json")
+	if err := saveRun(base, params, newRun(1000, "0.020")); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveRun(next, params, newRun(980, "0.030")); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := make([]*savedRun, 2)
+	for i, path := range []string{base, next} {
+		if runs[i], err = loadRun(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs[0].Params.AuthPassword != "" || runs[0].Time.IsZero() {
+		t.Fatalf("saved password %q, time %v", runs[0].Params.AuthPassword, runs[0].Time)
+	}
+	var out bytes.Buffer
+	if n := compareRuns(&out, runs[0], runs[1], 5); n != 1 {
+		t.Fatalf("%d regressions, want only p99:\n%s", n, out.String())
+	}
+	if !regexp.MustCompile(`p99 \(secs\) +0\.020 +0\.030 +\+50\.00%  REGRESSION`).MatchString(out.String()) {
+		t.Fatalf("unexpected table:\n%s", out.String())
+	}
+	if n := compareRuns(ioutil.Discard, runs[0], runs[1], 60); n != 0 {
+		t.Fatalf("%d regressions beyond 60%%", n)
+	}
+
+	other := params
+	other.Urls = []string{"http://127.0.0.1/other"}
+	if diffs := runDifferences(params, other); len(diffs) != 1 {
+		t.Fatalf("differences %v", diffs)
+	}
+	if code, _ := runMain(t, "compare", base, next); code != bench.EXIT_ERRORS {
+		t.Fatalf("compare exit code %d, want %d", code, bench.EXIT_ERRORS)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	labels, err := parseLabels("release=v2.3, env=staging,empty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 3 || labels["release"] != "v2.3" || labels["env"] != "staging" || labels["empty"] != "" {
+		t.Fatalf("labels %v", labels)
+	}
+	for _, bad := range []string{"release", "=v2.3", " =v2.3", "env=staging,"} {
+		if _, err := parseLabels(bad); err == nil {
+			t.Fatalf("parseLabels(%q) accepted", bad)
+		}
+	}
+
+	diffs := labelDifferences(labels, map[string]string{"release": "v2.4", "env": "staging", "region": "eu"})
+	if strings.Join(diffs, ", ") != "empty  != (none), region (none) != eu, release v2.3 != v2.4" {
+		t.Fatalf("differences %q", diffs)
+	}
+
+	start := time.Now()
+	meta := runMeta(bench.StressParameters{Bearer: "secret", Labels: labels}, start)
+	if meta.Params.Bearer != "" || meta.Params.Labels["env"] != "staging" || !meta.StartTime.Equal(start) ||
+		meta.GoMaxProcs < 1 || meta.Version == "" {
+		t.Fatalf("meta %+v", meta)
+	}
+
+	res := bench.NewStressResult()
+	res.LatsTotal, res.Lats = 1, map[string]int64{"0.010": 1}
+	res.Labels = labels
+	var out bytes.Buffer
+	res.Print(&out, 0)
+	if !strings.Contains(out.String(), "Labels:\tempty=, env=staging, release=v2.3\n") {
+		t.Fatalf("unexpected summary:\n%s", out.String())
+	}
+}
+
+func TestBuildVersion(t *testing.T) {
+	code, out := runMain(t, "-version")
+	if code != bench.EXIT_OK || out != "http_bench dev (commit dev, built dev)\n" {
+		t.Fatalf("exit code %d, output %q", code, out)
+	}
+
+	meta := runMeta(bench.StressParameters{}, time.Now())
+	if meta.Version != "dev" || meta.Commit != "dev" || meta.BuildDate != "dev" {
+		t.Fatalf("meta %+v", meta)
+	}
+	res := bench.NewStressResult()
+	res.LatsTotal, res.Lats = 1, map[string]int64{"0.010": 1}
+	res.Meta = meta
+	var summary bytes.Buffer
+	res.Print(&summary, 0)
+	if !strings.Contains(summary.String(), "Version:\tdev (commit dev, built dev)\n") {
+		t.Fatalf("unexpected summary:\n%s", summary.String())
+	}
+
+	release := &bench.RunMeta{Version: "v1.2.0", Commit: "3f2a1bc", BuildDate: "2026-10-01"}
+	if diff := buildDifference(meta, release); diff != "dev (commit dev, built dev) != v1.2.0 (commit 3f2a1bc, built 2026-10-01)" {
+		t.Fatalf("difference %q", diff)
+	}
+	if buildDifference(release, release) != "" || buildDifference(nil, release) != "" {
+		t.Fatal("difference of matching or unrecorded builds")
+	}
+}
+
+func TestLiveView(t *testing.T) {
+	start := time.Now()
+	view := &liveView{params: bench.StressParameters{N: 1000}, start: start}
+	snapshot := &bench.StressResult{
+		LatsTotal:      100,
+		Attempted:      104,
+		StatusCodeDist: map[int]int{200: 98, 503: 2},
+		ErrorDist:      map[string]int{"connection refused": 3},
+		Lats:           map[string]int64{"0.001": 50, "0.002": 45, "0.040": 5},
+	}
+	view.update(snapshot, start.Add(time.Second))
+	var out bytes.Buffer
+	view.line(&out, start.Add(time.Second))
+	if out.String() != "[104 of 1000 requests (10%)] 100 completed, 100 rps, p50 0.001s p95 0.002s p99 0.040s, "+
+		"status 200: 98, 503: 2, errors connection refused: 3\n" {
+		t.Fatalf("line %q", out.String())
+	}
+
+	next := &bench.StressResult{LatsTotal: 300, Attempted: snapshot.Attempted, StatusCodeDist: snapshot.StatusCodeDist,
+		ErrorDist: map[string]int{"connection refused": 5, "timeout": 1}, Lats: snapshot.Lats}
+	view.update(next, start.Add(2*time.Second))
+	out.Reset()
+	view.draw(&out, start.Add(2*time.Second))
+	view.draw(&out, start.Add(2*time.Second))
+	frame := out.String()
+	for _, want := range []string{"Progress:  104 of 1000 requests [##------------------]  10%",
+		"Rps:       200", "Errors:    connection refused: 5 (+2), timeout: 1 (+1)", "\x1b[7A"} {
+		if !strings.Contains(frame, want) {
+			t.Fatalf("frame without %q:\n%s", want, frame)
+		}
+	}
+	if sparkline([]float64{0, 1, 2, 4}) != "▁▂▄█" {
+		t.Fatalf("sparkline %s", sparkline([]float64{0, 1, 2, 4}))
+	}
+
+	// The log lines of the run are drawn in the frame, not over it.
+	view.logs = &liveLog{}
+	logger := log.New(view.logs, "", 0)
+	for i := 0; i < UI_LOG_MAX+2; i++ {
+		logger.Printf("[ERROR] line %d", i)
+	}
+	out.Reset()
+	view.draw(&out, start.Add(2*time.Second))
+	frame = out.String()
+	if !strings.Contains(frame, "Log:       [ERROR] line 99\n") || !strings.Contains(frame, "[ERROR] line 101\n") ||
+		strings.Contains(frame, "line 98") || !strings.Contains(frame, "\x1b[7A") {
+		t.Fatalf("frame without the last log lines:\n%q", frame)
+	}
+	out.Reset()
+	view.logs.flush(&out)
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != UI_LOG_MAX+1 ||
+		lines[0] != "(2 earlier log lines not kept)" || lines[1] != "[ERROR] line 2" {
+		t.Fatalf("flushed %q", out.String())
+	}
+}
+
+func TestWaitReadyExit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close() // Refuses the probes
+
+	code, _ := runMain(t, "-n", "10", "-c", "1", "-wait-ready", "500ms", "http://"+addr+"/")
+	if code != bench.EXIT_NOT_READY {
+		t.Fatalf("exit code %d, want %d", code, bench.EXIT_NOT_READY)
+	}
+}
+
+func TestBaselineRegression(t *testing.T) {
+	checks, err := parseRegression("p99<+10%, rps>-5%")
+	if err != nil || len(checks) != 2 || checks[0].String() != "p99<+10%" || checks[1].String() != "rps>-5%" {
+		t.Fatalf("checks %v, err %v", checks, err)
+	}
+	if _, err := parseRegression("p42<+10%"); err == nil {
+		t.Fatal("unknown metric accepted")
+	}
+	base, current := bench.NewStressResult(), bench.NewStressResult()
+	base.Rps, current.Rps = 1000*bench.SCALE_NUM, 940*bench.SCALE_NUM
+	base.LatsTotal, current.LatsTotal = 10, 10
+	base.Lats, current.Lats = map[string]int64{"0.100": 10}, map[string]int64{"0.105": 10}
+	if failed := checkRegressions(checks, base, current); len(failed) != 1 || !strings.HasPrefix(failed[0], "rps>-5%: -6.00%") {
+		t.Fatalf("failed checks %v", failed)
+	}
+	timeouts, _ := parseRegression("timeout_rate<1%")
+	current.TimedOutTotal, current.ErrorDist = 1, map[string]int{bench.ErrRequestTimeout.Error(): 1}
+	if failed := checkRegressions(timeouts, base, current); len(failed) != 1 || !strings.HasPrefix(failed[0], "timeout_rate<+1%: +Inf%") {
+		t.Fatalf("failed timeout checks %v", failed)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "baseline.json")
+
+	if code, _ := runMain(t, "-n", "20", "-c", "2", "-baseline", path, "-update-baseline", server.URL); code != bench.EXIT_OK {
+		t.Fatalf("baseline run exit code %d", code)
+	}
+	if _, err := loadRun(path); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := runMain(t, "-n", "20", "-c", "2", "-baseline", path, "-regression", "errors<+1%", server.URL); code != bench.EXIT_OK {
+		t.Fatalf("passing run exit code %d", code)
+	}
+	if code, _ := runMain(t, "-n", "20", "-c", "2", "-baseline", path, "-regression", "rps>+100000%", server.URL); code != bench.EXIT_SLA {
+		t.Fatalf("regressed run exit code %d, want %d", code, bench.EXIT_SLA)
+	}
+	if code, _ := runMain(t, "-n", "20", "-c", "2", "-baseline", path, "-regression", "rps>-5%", server.URL+"/other"); code != bench.EXIT_USAGE {
+		t.Fatalf("other url exit code %d, want %d", code, bench.EXIT_USAGE)
+	}
+}
+
+func TestRemoteStopStatus(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	}))
+	defer target.Close()
+	worker := httptest.NewServer(http.HandlerFunc(handleWorker))
+	defer worker.Close()
+	addr := strings.TrimPrefix(worker.URL, "http://")
+
+	params := bench.StressParameters{
+		SequenceId:      time.Now().UnixNano(),
+		Cmd:             bench.CMD_START,
+		RequestMethod:   http.MethodGet,
+		RequestHttpType: bench.TYPE_HTTP1,
+		Urls:            []string{target.URL},
+		C:               2,
+		Duration:        60,
+		Timeout:         3000,
+	}
+	id := strconv.FormatInt(params.SequenceId, 10)
+	startParams := params
+	done := make(chan *bench.StressResult)
+	go func() {
+		res, _ := requestWorker(worker.URL+"/", startParams)
+		done <- res
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, out := runMain(t, "status", "-W", addr, "-id", id)
+		if code == bench.EXIT_OK && strings.Contains(out, " running, ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status exit code %d:\n%s", code, out)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if code, out := runMain(t, "stop", "-W", addr, "-id", id); code != bench.EXIT_OK || !strings.Contains(out, "finished (stopped)") ||
+		!strings.Contains(out, "\nSummary:\n") {
+		t.Fatalf("stop exit code %d:\n%s", code, out)
+	}
+	select {
+	case res := <-done:
+		if res == nil || res.StopReason != bench.STOP_STOPPED {
+			t.Fatalf("run result %+v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run not stopped")
+	}
+	if code, out := runMain(t, "status", "-W", addr, "-id", id); code != bench.EXIT_OK || !strings.Contains(out, "finished (stopped)") {
+		t.Fatalf("finished status exit code %d:\n%s", code, out)
+	}
+	if code, out := runMain(t, "status", "-W", addr, "-id", "1"); code != bench.EXIT_INTERNAL || !strings.Contains(out, ErrUnknownRun.Error()) {
+		t.Fatalf("unknown id exit code %d:\n%s", code, out)
+	}
+}
+
+func TestDuplicateStart(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	}))
+	defer target.Close()
+	worker := httptest.NewServer(http.HandlerFunc(handleWorker))
+	defer worker.Close()
+
+	startParams := bench.StressParameters{
+		SequenceId:      time.Now().UnixNano(),
+		Cmd:             bench.CMD_START,
+		RequestMethod:   http.MethodGet,
+		RequestHttpType: bench.TYPE_HTTP1,
+		Urls:            []string{target.URL},
+		C:               2,
+		Duration:        1,
+		Timeout:         3000,
+	}
+	results := make([]*bench.StressResult, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = requestWorker(worker.URL+"/", startParams)
+		}(i)
+	}
+	wg.Wait()
+	if results[0] == nil || results[1] == nil {
+		t.Fatalf("results %v", results)
+	}
+	ran, rejected := results[0], results[1]
+	if ran.ErrCode != 0 {
+		ran, rejected = rejected, ran
+	}
+	if ran.ErrCode != 0 || ran.LatsTotal == 0 || rejected.ErrCode == 0 || rejected.ErrMsg != ErrRunning.Error() {
+		t.Fatalf("first %+v, second %+v", ran, rejected)
+	}
+}
+
+func TestWorkerCoordinatorLost(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	}))
+	defer target.Close()
+	worker := httptest.NewServer(http.HandlerFunc(handleWorker))
+	defer worker.Close()
+
+	run := func(params bench.StressParameters) (*bench.StressResult, time.Duration) {
+		params.SequenceId = time.Now().UnixNano()
+		params.Cmd = bench.CMD_START
+		params.RequestMethod = http.MethodGet
+		params.RequestHttpType = bench.TYPE_HTTP1
+		params.Urls = []string{target.URL}
+		params.C = 2
+		params.Duration = 60
+		params.Timeout = 3000
+		startParams := params
+		begin := time.Now()
+		done := make(chan *bench.StressResult)
+		go func() {
+			res, _ := requestWorker(worker.URL+"/", startParams)
+			done <- res
+		}()
+		// Keepalives for 500ms, then the coordinator is gone.
+		params.Cmd = bench.CMD_KEEPALIVE
+		keepaliveParams := params
+		for i := 0; i < 10 && params.Keepalive > 0; i++ {
+			time.Sleep(50 * time.Millisecond)
+			requestWorker(worker.URL+"/", keepaliveParams)
+		}
+		select {
+		case res := <-done:
+			return res, time.Since(begin)
+		case <-time.After(5 * time.Second):
+			t.Fatal("run not aborted")
+			return nil, 0
+		}
+	}
+
+	res, elapsed := run(bench.StressParameters{Keepalive: 100})
+	if res == nil || res.StopReason != bench.STOP_LOST || elapsed < 500*time.Millisecond {
+		t.Fatalf("keepalive: after %v, result %+v", elapsed, res)
+	}
+	deadline := time.Now().Add(300 * time.Millisecond)
+	res, elapsed = run(bench.StressParameters{Deadline: deadline.UnixNano() / int64(time.Millisecond)})
+	if res == nil || res.StopReason != bench.STOP_DEADLINE || elapsed < 250*time.Millisecond {
+		t.Fatalf("deadline: after %v, result %+v", elapsed, res)
+	}
+}
+
+func TestDistributedCombine(t *testing.T) {
+	// The shorter run answers first, its result is the one combined into.
+	fakeWorker := func(delay time.Duration, result *bench.StressResult) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var params bench.StressParameters
+			json.NewDecoder(r.Body).Decode(&params)
+			if params.Cmd != bench.CMD_START {
+				return
+			}
+			time.Sleep(delay)
+			json.NewEncoder(w).Encode(result)
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+	workers := []string{
+		fakeWorker(0, &bench.StressResult{LatsTotal: 100, Attempted: 100, Duration: 2 * bench.SCALE_NUM}),
+		fakeWorker(100*time.Millisecond, &bench.StressResult{LatsTotal: 300, Attempted: 300, Duration: 3 * bench.SCALE_NUM}),
+	}
+
+	var running *bench.StressWorker
+	res := execStress(context.Background(), bench.StressParameters{
+		SequenceId:      time.Now().UnixNano(),
+		Cmd:             bench.CMD_START,
+		RequestMethod:   http.MethodGet,
+		RequestHttpType: bench.TYPE_HTTP1,
+		Urls:            []string{"http://127.0.0.1/"},
+		C:               2,
+		Duration:        3,
+		Timeout:         3000,
+		Workers:         workers,
+	}, &running)
+	// 400 requests in 3s, scaled by SCALE_NUM.
+	if res.LatsTotal != 400 || res.Attempted != 400 || res.Duration != 3*bench.SCALE_NUM || res.Rps != 400*bench.SCALE_NUM/3 {
+		t.Fatalf("combined %d requests, %d attempted, duration %d, rps %d", res.LatsTotal, res.Attempted, res.Duration, res.Rps)
+	}
+}
+
+func TestDashboardWorkerShares(t *testing.T) {
+	var requests int32
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(&bench.StressResult{ErrCode: -1, ErrMsg: ErrUnknownRun.Error()})
+	}))
+	defer worker.Close()
+	dashboard := httptest.NewServer(http.HandlerFunc(handleWorker))
+	defer dashboard.Close()
+
+	addr := strings.TrimPrefix(worker.URL, "http://")
+	for _, params := range []bench.StressParameters{
+		{Qps: 2},
+		{Qps: 10, BurstRate: 2, BurstDuration: 100, BurstInterval: 1000},
+	} {
+		params.SequenceId = time.Now().UnixNano()
+		params.Cmd = bench.CMD_START
+		params.Urls = []string{"http://127.0.0.1:1/"}
+		params.Workers = []string{addr, addr, addr}
+		body, _ := json.Marshal(params)
+		resp, err := http.Post(dashboard.URL+"/", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res bench.StressResult
+		json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || res.ErrCode == 0 || !strings.Contains(res.ErrMsg, "-W") {
+			t.Fatalf("qps %d, burst %d: status %d, result %+v", params.Qps, params.BurstRate, resp.StatusCode, &res)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("%d requests to the workers", n)
+	}
+
+	// A burst without a duration is refused before running, with or without
+	// workers.
+	body, _ := json.Marshal(bench.StressParameters{SequenceId: time.Now().UnixNano(), Cmd: bench.CMD_START,
+		Urls: []string{"http://127.0.0.1:1/"}, N: 1, C: 1, Qps: 10, BurstRate: 20, BurstInterval: 1000})
+	resp, err := http.Post(dashboard.URL+"/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res bench.StressResult
+	json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(res.ErrMsg, "invalid burst") {
+		t.Fatalf("burst without a duration: status %d, result %+v", resp.StatusCode, &res)
+	}
+}
+
+func TestDashboardWorkers(t *testing.T) {
+	var started int32
+	release := make(chan struct{})
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params bench.StressParameters
+		json.NewDecoder(r.Body).Decode(&params)
+		switch {
+		case len(params.Workers) > 0:
+			json.NewEncoder(w).Encode(&bench.StressResult{ErrCode: -1, ErrMsg: "workers forwarded"})
+		case params.Cmd == bench.CMD_START:
+			atomic.StoreInt32(&started, 1)
+			<-release
+			json.NewEncoder(w).Encode(&bench.StressResult{LatsTotal: 10, Attempted: 10, StopReason: bench.STOP_REQUESTS})
+		case atomic.LoadInt32(&started) == 0:
+			json.NewEncoder(w).Encode(&bench.StressResult{ErrCode: -1, ErrMsg: ErrUnknownRun.Error()})
+		default:
+			json.NewEncoder(w).Encode(&bench.StressResult{LatsTotal: 4, Attempted: 5})
+		}
+	}))
+	defer worker.Close()
+	addr := strings.TrimPrefix(worker.URL, "http://")
+	dashboard := httptest.NewServer(http.HandlerFunc(handleWorker))
+	defer dashboard.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := listener.Addr().String()
+	listener.Close()
+
+	params := bench.StressParameters{
+		SequenceId:      time.Now().UnixNano(),
+		Cmd:             bench.CMD_START,
+		RequestMethod:   http.MethodGet,
+		RequestHttpType: bench.TYPE_HTTP1,
+		Urls:            []string{"http://127.0.0.1/"},
+		C:               2,
+		Duration:        60,
+		Timeout:         3000,
+		Workers:         []string{addr, gone},
+	}
+	startParams := params
+	if res, err := requestWorker(dashboard.URL+"/", startParams); err != nil || res.ErrCode == 0 || !strings.Contains(res.ErrMsg, gone) {
+		t.Fatalf("run with a dead worker: %+v, err %v", res, err)
+	}
+
+	params.Workers = []string{addr}
+	startParams = params
+	done := make(chan *bench.StressResult)
+	go func() {
+		res, _ := requestWorker(dashboard.URL+"/", startParams)
+		done <- res
+	}()
+	// Only the id, as the dashboard polls the progress.
+	metricsParams := bench.StressParameters{SequenceId: params.SequenceId, Cmd: bench.CMD_METRICS}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := requestWorker(dashboard.URL+"/", metricsParams)
+		if err == nil && len(res.Nodes) == 1 && res.Nodes[0].Node == addr && res.Nodes[0].Attempted == 5 && res.Nodes[0].ErrCode == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("progress %+v, err %v", res, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(release)
+	if res := <-done; res == nil || res.ErrCode != 0 || res.LatsTotal != 10 {
+		t.Fatalf("run result %+v", res)
+	}
+
+	progress := sumProgress([]string{"a", "b"}, []*bench.StressResult{{Node: "a", LatsTotal: 3}})
+	if progress.LatsTotal != 3 || len(progress.Nodes) != 2 || progress.Nodes[1].ErrMsg != ErrNoAnswer.Error() {
+		t.Fatalf("progress %+v", progress)
+	}
+}
+
+func TestStopPartialResult(t *testing.T) {
+	// Fake -listen workers whose runs end on the stop with their partial result.
+	fakeWorker := func(lats int64) string {
+		stopped := make(chan struct{})
+		var once sync.Once
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var params bench.StressParameters
+			json.NewDecoder(r.Body).Decode(&params)
+			switch params.Cmd {
+			case bench.CMD_START:
+				<-stopped
+				json.NewEncoder(w).Encode(&bench.StressResult{LatsTotal: lats, Attempted: lats, Duration: bench.SCALE_NUM,
+					Lats: map[string]int64{"0.010": lats}, StopReason: bench.STOP_STOPPED})
+			case bench.CMD_STOP:
+				once.Do(func() { close(stopped) })
+				json.NewEncoder(w).Encode(&bench.StressResult{LatsTotal: lats, Attempted: lats})
+			default:
+				json.NewEncoder(w).Encode(&bench.StressResult{ErrCode: -1, ErrMsg: ErrUnknownRun.Error()})
+			}
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+	coordinator := httptest.NewServer(http.HandlerFunc(handleWorker))
+	defer coordinator.Close()
+
+	params := bench.StressParameters{
+		SequenceId:      time.Now().UnixNano(),
+		Cmd:             bench.CMD_START,
+		RequestMethod:   http.MethodGet,
+		RequestHttpType: bench.TYPE_HTTP1,
+		Urls:            []string{"http://127.0.0.1/"},
+		C:               2,
+		Duration:        60,
+		Timeout:         3000,
+		Workers:         []string{fakeWorker(10), fakeWorker(30)},
+	}
+	startParams := params
+	go requestWorker(coordinator.URL+"/", startParams)
+	time.Sleep(100 * time.Millisecond)
+
+	stopParams := bench.StressParameters{SequenceId: params.SequenceId, Cmd: bench.CMD_STOP}
+	res, err := requestWorker(coordinator.URL+"/", stopParams)
+	if err != nil || res.LatsTotal != 40 || res.Lats["0.010"] != 40 || res.StopReason != bench.STOP_STOPPED {
+		t.Fatalf("stop result %+v, err %v", res, err)
+	}
+}
+
+func TestSecondSignalForcesStop(t *testing.T) {
+	release := make(chan struct{})
+	var served int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&served, 1) <= 10 {
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "HTTP_BENCH_TEST_MAIN=1",
+		"HTTP_BENCH_TEST_ARGS=-c 2 -d 60s -t 300000 -max-error-rate 100 "+server.URL)
+	// A file, not a buffer, so it can be read while the child writes it.
+	stderr, err := ioutil.TempFile("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	time.Sleep(500 * time.Millisecond)
+	cmd.Process.Signal(os.Interrupt)
+	select {
+	case err := <-exited:
+		t.Fatalf("exited on the first signal, requests still in flight: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if out, _ := ioutil.ReadFile(stderr.Name()); !strings.Contains(string(out), "press Ctrl-C again to force") {
+		t.Fatalf("stderr %q", out)
+	}
+	cmd.Process.Signal(os.Interrupt)
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("forced stop: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("not stopped by the second signal")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers, err := parseHeaders([]string{
+		"Cookie: a=1",
+		"cookie: b=2",
+		"Referer: http://127.0.0.1:8080/path?q=1",
+		"Authorization: Basic dXNlcjpwYXNz==",
+		"x-request-id:abc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"Cookie":        {"a=1", "b=2"},
+		"Referer":       {"http://127.0.0.1:8080/path?q=1"},
+		"Authorization": {"Basic dXNlcjpwYXNz=="},
+		"X-Request-Id":  {"abc"},
+	}
+	if len(headers) != len(want) {
+		t.Fatalf("headers %v", headers)
+	}
+	for name, values := range want {
+		if strings.Join(headers[name], "|") != strings.Join(values, "|") {
+			t.Fatalf("%s: %q, want %q", name, headers[name], values)
+		}
+	}
+	if _, err := parseHeaders([]string{"no colon"}); err == nil {
+		t.Fatal("header without a colon accepted")
+	}
+
+	// Every value reaches the server, in order.
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header["Cookie"]
+	}))
+	defer server.Close()
+	b := newTestWorker(bench.StressParameters{Urls: []string{server.URL}, N: 1, C: 1, Headers: headers})
+	b.Start()
+	b.Wait()
+	if strings.Join(got, "|") != "a=1|b=2" {
+		t.Fatalf("server got cookies %q", got)
+	}
+}
+
+func TestHeaderFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "headers.txt")
+	content := "# copied from a browser\r\naccept: text/html\r\n\r\nX-Request-Id: req-{{ randomNum 6 }}\r\nReferer: http://127.0.0.1:8080/a\r\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	headers, err := parseHeaderFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 3 || headers["Accept"][0] != "text/html" || headers["Referer"][0] != "http://127.0.0.1:8080/a" {
+		t.Fatalf("headers %v", headers)
+	}
+
+	var lock sync.Mutex
+	ids := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		ids[r.Header.Get("X-Request-Id")] = true
+		lock.Unlock()
+	}))
+	defer server.Close()
+	b := newTestWorker(bench.StressParameters{Urls: []string{server.URL}, N: 20, C: 2, Headers: headers})
+	b.Start()
+	b.Wait()
+	if len(ids) < 2 {
+		t.Fatalf("header functions not run per request: %v", ids)
+	}
+	for id := range ids {
+		if !regexp.MustCompile(`^req-\d{6}$`).MatchString(id) {
+			t.Fatalf("unexpected X-Request-Id %q", id)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte("Accept: */*\n# ok\nnot a header\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseHeaderFile(path); err == nil || !strings.Contains(err.Error(), "headers.txt:3:") {
+		t.Fatalf("error %v, want line 3", err)
+	}
+}
+
+func TestHeaderPools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http_bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.txt")
+	if err := ioutil.WriteFile(path, []byte("# devices\r\ndev-a\r\n\r\ndev-b\r\ndev-c\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	name, lines, err := parseHeaderPool("x-device-id: @" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "X-Device-Id" || strings.Join(lines, ",") != "dev-a,dev-b,dev-c" {
+		t.Fatalf("pool %s %v", name, lines)
+	}
+	if _, _, err := parseHeaderPool("X-Device-Id: dev-a"); err == nil {
+		t.Fatal("value without @ accepted")
+	}
+
+	var lock sync.Mutex
+	devices := make(map[string]bool)
+	agents := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		devices[r.Header.Get("X-Device-Id")] = true
+		agents[r.Header.Get("User-Agent")] = true
+		lock.Unlock()
+	}))
+	defer server.Close()
+	b := newTestWorker(bench.StressParameters{Urls: []string{server.URL}, N: 60, C: 2,
+		HeaderPools: map[string][]string{name: lines, "User-Agent": {"agent/1", "agent/2"}}})
+	b.Start()
+	b.Wait()
+	if len(devices) != 3 || len(agents) != 2 || !agents["agent/1"] || !devices["dev-b"] {
+		t.Fatalf("devices %v agents %v", devices, agents)
+	}
+}
+
+func TestParseAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	log := `127.0.0.1 - - [10/Oct/2023:13:55:36 +0000] "GET /a?x=1 HTTP/1.1" 200 12 "-" "curl/8.0"
+127.0.0.1 - frank [10/Oct/2023:13:55:38 +0000] "POST /b HTTP/1.1" 201 0
+garbage line
+127.0.0.1 - - [bad time] "GET /a?x=1 HTTP/1.1" 200 12
+127.0.0.1 - - [10/Oct/2023:13:55:37 +0000] "GET /a?x=1 HTTP/1.1" 200 12 "-" "curl/8.0"
+`
+	if err := ioutil.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	urls, entries, malformed, err := parseAccessLog(path, ACCESS_LOG_COMBINED, "http://127.0.0.1:8080/", true)
+	if err != nil || malformed != 3 || len(urls) != 1 || urls[0] != "http://127.0.0.1:8080/a?x=1" {
+		t.Fatalf("parseAccessLog: %v %d %v", urls, malformed, err)
+	}
+	want := []bench.ReplayEntry{{Method: "GET", Url: 0}, {Method: "GET", Url: 0, Offset: 1000}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("entries %v, want %v", entries, want)
+	}
+	// The common format takes only the lines without referer and user agent.
+	urls, entries, malformed, err = parseAccessLog(path, ACCESS_LOG_COMMON, "http://127.0.0.1:8080", true)
+	want = []bench.ReplayEntry{{Method: "POST", Url: 0}}
+	if err != nil || malformed != 4 || len(urls) != 1 || urls[0] != "http://127.0.0.1:8080/b" || !reflect.DeepEqual(entries, want) {
+		t.Fatalf("common: %v %v %d %v", urls, entries, malformed, err)
+	}
+	// Without timing the timestamp is not needed.
+	if _, entries, malformed, _ = parseAccessLog(path, ACCESS_LOG_COMMON, "http://127.0.0.1:8080", false); len(entries) != 2 || malformed != 3 {
+		t.Fatalf("%d entries, %d malformed without timing", len(entries), malformed)
+	}
+}
+
+func TestReplayShare(t *testing.T) {
+	entries := make([]bench.ReplayEntry, 10)
+	for i := range entries {
+		entries[i].Offset = int64(i)
+	}
+	seen := make(map[int64]bool)
+	for i := 0; i < 3; i++ {
+		share := replayShare(entries, i, 3)
+		if len(share) < 3 || len(share) > 4 {
+			t.Fatalf("worker %d: %d entries", i, len(share))
+		}
+		for j, entry := range share {
+			if seen[entry.Offset] || (j > 0 && entry.Offset <= share[j-1].Offset) {
+				t.Fatalf("worker %d: entry %d twice or out of order", i, entry.Offset)
+			}
+			seen[entry.Offset] = true
+		}
+	}
+	if len(seen) != len(entries) {
+		t.Fatalf("%d of %d entries replayed", len(seen), len(entries))
+	}
+}
+
+func TestParseTargetConcurrency(t *testing.T) {
+	groups, err := parseTargetConcurrency("/slow=2, /fast=6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0].Prefix != "/slow" || groups[0].C != 2 || groups[1].Prefix != "/fast" || groups[1].C != 6 {
+		t.Fatalf("groups %+v", groups)
+	}
+	for _, bad := range []string{"/slow", "=2", "/slow=two"} {
+		if _, err := parseTargetConcurrency(bad); err == nil {
+			t.Fatalf("parseTargetConcurrency(%q) accepted", bad)
+		}
+	}
+}
+
+func TestHosts(t *testing.T) {
+	params := bench.StressParameters{Urls: []string{"http://a/", "http://b/", "http://c/"}, C: 8, N: 100, SequenceId: 10}
+	hosts, err := hostParams(params, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A later run started at 11 must not share the ids of the hosts.
+	ids := map[int64]bool{11: true}
+	for i, want := range []struct{ c, n int }{{3, 34}, {3, 33}, {2, 33}} {
+		if host := hosts[i]; host.Urls[0] != params.Urls[i] || len(host.Urls) != 1 || host.C != want.c ||
+			host.N != want.n || ids[host.SequenceId] || (i == 0) != (host.SequenceId == 10) {
+			t.Fatalf("host %d: %+v", i, host)
+		}
+		ids[hosts[i].SequenceId] = true
+	}
+	if hosts, _ = hostParams(params, 5); hosts[2].C != 5 {
+		t.Fatalf("-c-per-url: %d connections", hosts[2].C)
+	}
+	params.C = 2
+	if _, err = hostParams(params, 0); err == nil {
+		t.Fatal("-c below the number of hosts accepted")
+	}
+
+	var requests [2]int32
+	servers := make([]*httptest.Server, 2)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests[i], 1)
+		}))
+		defer servers[i].Close()
+	}
+	code, out := runMain(t, "-n", "30", "-c", "4", "-o", "json", "-url", servers[0].URL, servers[1].URL)
+	if code != bench.EXIT_OK || requests[0] != 15 || requests[1] != 15 {
+		t.Fatalf("exit code %d, requests %v:\n%s", code, requests, out)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	var combined bench.StressResult
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &combined); err != nil {
+		t.Fatal(err)
+	}
+	if combined.LatsTotal != 30 || len(combined.Nodes) != 2 || combined.Nodes[0].LatsTotal != 15 ||
+		combined.Nodes[0].Node != servers[0].URL && combined.Nodes[0].Node != servers[1].URL {
+		t.Fatalf("combined %d requests, nodes %d", combined.LatsTotal, len(combined.Nodes))
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := parseQuery("page=randint:-1:500")
+	if err != nil || q.Name != "page" || q.Min != -1 || q.Max != 500 || q.Choices != nil {
+		t.Fatalf("randint %+v, err %v", q, err)
+	}
+	if q, err = parseQuery("sort=choice:asc,desc"); err != nil || !reflect.DeepEqual(q.Choices, []string{"asc", "desc"}) {
+		t.Fatalf("choice %+v, err %v", q, err)
+	}
+	for _, bad := range []string{"page", "=randint:1:2", "page=randint:2:1", "page=randint:1", "page=randint:a:b",
+		"page=choice:", "page=random:1:2", "page=randint:-9223372036854775808:9223372036854775807"} {
+		if _, err := parseQuery(bad); err == nil {
+			t.Fatalf("parseQuery(%q) accepted", bad)
+		}
+	}
+}
+
+func TestCors(t *testing.T) {
+	if _, err := parseCorsOrigins("*", true); err == nil || !strings.Contains(err.Error(), "-cors-credentials") {
+		t.Fatalf("wildcard with credentials: %v", err)
+	}
+	for _, bad := range []string{"ui.internal", "https://ui.internal/app", ""} {
+		if _, err := parseCorsOrigins(bad, false); err == nil {
+			t.Fatalf("parseCorsOrigins(%q) accepted", bad)
+		}
+	}
+	origins, err := parseCorsOrigins("https://ui.internal/, http://127.0.0.1:3000", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served int32
+	h := withCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+	}), origins, true)
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api", nil)
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			r.Header.Set("Access-Control-Request-Headers", "content-type")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := request(http.MethodOptions, "https://ui.internal")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://ui.internal" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		!strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "POST") ||
+		w.Header().Get("Access-Control-Allow-Headers") != "content-type" || atomic.LoadInt32(&served) != 0 {
+		t.Fatalf("preflight %d %v", w.Code, w.Header())
+	}
+	if w = request(http.MethodOptions, "https://evil.example"); w.Code != http.StatusForbidden {
+		t.Fatalf("disallowed preflight %d", w.Code)
+	}
+	if w = request(http.MethodPost, "https://evil.example"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("disallowed origin %v", w.Header())
+	}
+	if w = request(http.MethodPost, "http://127.0.0.1:3000"); w.Header().Get("Access-Control-Allow-Origin") != "http://127.0.0.1:3000" ||
+		w.Header().Get("Vary") != "Origin" || atomic.LoadInt32(&served) != 2 {
+		t.Fatalf("allowed origin %v", w.Header())
+	}
+
+	any, _ := parseCorsOrigins("*", false)
+	h = withCors(http.NotFoundHandler(), any, false)
+	r := httptest.NewRequest(http.MethodGet, "/api", nil)
+	r.Header.Set("Origin", "https://other.example")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("wildcard %v", w.Header())
+	}
+}
+
+func TestDashboardAssets(t *testing.T) {
+	root := t.TempDir()
+	assets := filepath.Join(root, "ui")
+	os.MkdirAll(filepath.Join(assets, "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(assets, "index.html"), []byte("<html>custom</html>"), 0644)
+	ioutil.WriteFile(filepath.Join(assets, "app.css"), []byte("body{}"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0644)
+	h := dashboardHandler(assets)
+	get := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path = target
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("/"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "custom") {
+		t.Fatalf("index %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/app.css"); w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") {
+		t.Fatalf("css %d %v", w.Code, w.Header())
+	}
+	if w := get("/../secret.txt"); strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("path traversal served %q", w.Body.String())
+	}
+	// a directory without index.html is not listed, the default page serves it
+	if w := get("/empty/"); w.Code != http.StatusNotFound {
+		t.Fatalf("empty dir %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/README.md"); w.Code != http.StatusOK {
+		t.Fatalf("fallback %d", w.Code)
+	}
+	if w := get("/missing.js"); w.Code != http.StatusNotFound {
+		t.Fatalf("missing %d", w.Code)
+	}
+}
+
+func TestResultDownload(t *testing.T) {
+	result := bench.NewStressResult()
+	result.Output = bench.OUTPUT_CSV
+	finishedList.Store(int64(921), result)
+	defer finishedList.Delete(int64(921))
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleResult(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	w := get("/api/result/921")
+	var decoded bench.StressResult
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" ||
+		w.Header().Get("Content-Disposition") != `attachment; filename="http_bench-921.json"` ||
+		json.Unmarshal(w.Body.Bytes(), &decoded) != nil {
+		t.Fatalf("json %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	w = get("/api/result/921?format=csv")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") ||
+		!strings.HasSuffix(w.Header().Get("Content-Disposition"), `.csv"`) || !strings.HasPrefix(w.Body.String(), "Duration,Count\n") {
+		t.Fatalf("csv %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	for target, code := range map[string]int{
+		"/api/result/922":             http.StatusNotFound,
+		"/api/result/abc":             http.StatusBadRequest,
+		"/api/result/921?format=yaml": http.StatusBadRequest,
+	} {
+		if w := get(target); w.Code != code {
+			t.Fatalf("%s %d, want %d", target, w.Code, code)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	for method, want := range map[string]bool{"PATCH": true, "GET": true, "GTE": false, "PURGE": false} {
+		if known, err := checkMethod(method); err != nil || known != want {
+			t.Fatalf("checkMethod(%q) = %v, %v", method, known, err)
+		}
+	}
+	for _, bad := range []string{"GET /", "G(ET", ""} {
+		if _, err := checkMethod(bad); err == nil {
+			t.Fatalf("checkMethod(%q) accepted", bad)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "urls.txt")
+	ioutil.WriteFile(path, []byte("http://a/1 http://a/2\npatch http://a/3\r\n\nDELETE http://a/4\n"), 0644)
+	entries, err := parseUrlFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries.urls, []string{"http://a/1", "http://a/2", "http://a/3", "http://a/4"}) ||
+		!reflect.DeepEqual(entries.methods, []string{"", "", "PATCH", "DELETE"}) || entries.hosts != nil {
+		t.Fatalf("urls %v, methods %v, hosts %v", entries.urls, entries.methods, entries.hosts)
+	}
+	ioutil.WriteFile(path, []byte("http://a/1\nhttp://a/2 http://a/3\n"), 0644)
+	if entries, _ = parseUrlFile(path); len(entries.urls) != 3 || entries.methods != nil {
+		t.Fatalf("without methods: urls %v, methods %v", entries.urls, entries.methods)
+	}
+
+	ioutil.WriteFile(path, []byte("https://10.0.0.5/a https://10.0.0.5/b host=shop.example.com sni=shop.example.com\n"+
+		"POST https://10.0.0.5/c host=blog.example.com weight=2 weight=3 tag=x\nhttps://10.0.0.5/d\n"), 0644)
+	if entries, err = parseUrlFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries.methods, []string{"", "", "POST", ""}) ||
+		!reflect.DeepEqual(entries.hosts, []string{"shop.example.com", "shop.example.com", "blog.example.com", ""}) ||
+		!reflect.DeepEqual(entries.serverNames, []string{"shop.example.com", "shop.example.com", "", ""}) ||
+		!reflect.DeepEqual(entries.unknown, []string{"weight", "tag"}) {
+		t.Fatalf("options: %+v", entries)
+	}
+	for content, want := range map[string]string{
+		"http://a/1\nhttp://a/2 host=\n":     "urls.txt:2: empty host option",
+		"http://a/1 sni=10.0.0.5\n":          "urls.txt:1: sni 10.0.0.5 must be a host name",
+		"\nhost=a.example.com\nhttp://a/1\n": "urls.txt:2: options without a url",
+	} {
+		ioutil.WriteFile(path, []byte(content), 0644)
+		if _, err = parseUrlFile(path); err == nil || !strings.HasSuffix(err.Error(), want) {
+			t.Fatalf("%q: err %v, want %s", content, err, want)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build go1.19
+// +build go1.19
+
+package main
+
+import "runtime/debug"
+
+// setMemoryLimit sets the soft memory limit of the runtime, see -memlimit.
+func setMemoryLimit(limit int64) error {
+	debug.SetMemoryLimit(limit)
+	return nil
+}
+
+// memoryLimit returns the current soft memory limit, -1 if unsupported.
+func memoryLimit() int64 {
+	return debug.SetMemoryLimit(-1)
+}
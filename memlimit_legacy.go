@@ -0,0 +1,15 @@
+//go:build !go1.19
+// +build !go1.19
+
+package main
+
+import "errors"
+
+// setMemoryLimit is not available before go1.19, see memlimit.go.
+func setMemoryLimit(limit int64) error {
+	return errors.New("-memlimit requires http_bench built with go1.19 or later")
+}
+
+func memoryLimit() int64 {
+	return -1
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkxzhou/http_bench/bench"
+)
+
+const (
+	UI_REFRESH = 250 * time.Millisecond // Between the frames of -ui on a terminal
+	UI_LINE    = time.Second            // Between the lines of -ui when stdout is not a terminal
+	UI_HISTORY = 40                     // Frames in the sparklines
+	UI_ERRORS  = 3                      // Errors shown, the most frequent ones
+	UI_WIDTH   = 48                     // Longest error shown
+	UI_LOGS    = 3                      // Log lines shown, the last ones
+	UI_LOG_MAX = 100                    // Log lines kept for stderr once the dashboard is gone
+)
+
+var (
+	uiLock sync.Mutex
+	uiLogs *liveLog // Of the dashboard on a terminal, see runStderr
+)
+
+var sparkRunes = []rune("▁▂▃▄▅▆▇█")
+
+// liveSample is the completed count of a snapshot, for the current rps.
+type liveSample struct {
+	at        time.Time
+	completed int64
+}
+
+// liveView renders the snapshots of a -ui run.
+type liveView struct {
+	params   bench.StressParameters
+	start    time.Time
+	samples  []liveSample   // Of the last second, the first one is the base of rps
+	rps, p99 []float64      // Histories of the sparklines
+	errors   map[string]int // Of the previous frame, for the new errors
+	lines    int            // Of the last frame, drawn over by the next one
+	snapshot *bench.StressResult
+	logs     *liveLog // The stderr lines of the run, drawn in the frame
+}
+
+// liveLog keeps the log and stderr lines written while the dashboard is
+// redrawn, which would otherwise scroll it and break the redraw.
+type liveLog struct {
+	lock    sync.Mutex
+	lines   []string
+	dropped int // Lines past UI_LOG_MAX, the oldest ones
+}
+
+func (l *liveLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.lines = append(l.lines, line)
+	}
+	if len(l.lines) > UI_LOG_MAX {
+		l.dropped += len(l.lines) - UI_LOG_MAX
+		l.lines = l.lines[len(l.lines)-UI_LOG_MAX:]
+	}
+	return len(p), nil
+}
+
+// last returns the n last lines.
+func (l *liveLog) last(n int) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.lines) < n {
+		n = len(l.lines)
+	}
+	return append([]string(nil), l.lines[len(l.lines)-n:]...)
+}
+
+// flush writes the lines kept to w.
+func (l *liveLog) flush(w io.Writer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.dropped > 0 {
+		fmt.Fprintf(w, "(%d earlier log lines not kept)\n", l.dropped)
+	}
+	for _, line := range l.lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// runStderr is where the messages of a run go instead of stderr, the log
+// of the dashboard while one is drawn.
+func runStderr() io.Writer {
+	uiLock.Lock()
+	defer uiLock.Unlock()
+	if uiLogs != nil {
+		return uiLogs
+	}
+	return os.Stderr
+}
+
+// startUI shows the live stats of stressTest until the returned func is
+// called: a dashboard redrawn every UI_REFRESH when stdout is a terminal,
+// otherwise a line every UI_LINE on stderr. The dashboard takes the log
+// lines written to stderr meanwhile and shows the last ones. The func waits
+// for the last frame, restores the cursor and writes the log lines kept to
+// stderr, so the summary printed next follows them.
+func startUI(params bench.StressParameters, stressTest *bench.StressWorker) func() {
+	terminal := isTerminal(os.Stdout)
+	interval := UI_LINE
+	view := &liveView{params: params, start: time.Now()}
+	if terminal {
+		interval = UI_REFRESH
+		fmt.Fprint(os.Stdout, "\x1b[?25l") // Hides the cursor
+		view.logs = &liveLog{}
+		uiLock.Lock()
+		uiLogs = view.logs
+		uiLock.Unlock()
+		if benchLog.Writer() == os.Stderr {
+			benchLog.SetOutput(view.logs)
+		}
+	}
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				view.update(stressTest.Snapshot(), now)
+				if terminal {
+					view.draw(os.Stdout, now)
+				} else {
+					view.line(os.Stderr, now)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		if terminal {
+			fmt.Fprint(os.Stdout, "\x1b[?25h")
+			uiLock.Lock()
+			uiLogs = nil
+			uiLock.Unlock()
+			if benchLog.Writer() == view.logs {
+				benchLog.SetOutput(os.Stderr)
+			}
+			view.logs.flush(os.Stderr)
+		}
+	}
+}
+
+// isTerminal reports whether f is a terminal which understands the escape
+// sequences of the -ui dashboard.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// update adds snapshot, taken at now, to the histories.
+func (v *liveView) update(snapshot *bench.StressResult, now time.Time) {
+	v.snapshot = snapshot
+	v.samples = append(v.samples, liveSample{at: now, completed: snapshot.LatsTotal})
+	for len(v.samples) > 2 && now.Sub(v.samples[1].at) >= time.Second {
+		v.samples = v.samples[1:]
+	}
+	v.rps = appendHistory(v.rps, v.currentRps())
+	p99, _ := strconv.ParseFloat(strings.TrimSpace(v.percentiles()[2]), 64)
+	v.p99 = appendHistory(v.p99, p99)
+}
+
+func appendHistory(history []float64, value float64) []float64 {
+	if history = append(history, value); len(history) > UI_HISTORY {
+		history = history[1:]
+	}
+	return history
+}
+
+// currentRps returns the responses per second over the last second.
+func (v *liveView) currentRps() float64 {
+	first, last := v.samples[0], v.samples[len(v.samples)-1]
+	if elapsed := last.at.Sub(first.at).Seconds(); elapsed > 0 {
+		return float64(last.completed-first.completed) / elapsed
+	}
+	if elapsed := last.at.Sub(v.start).Seconds(); elapsed > 0 {
+		return float64(last.completed) / elapsed
+	}
+	return 0
+}
+
+// percentiles returns p50, p95 and p99 in secs of the latencies of the last
+// LIVE_WINDOW seconds, "-" without any.
+func (v *liveView) percentiles() []string {
+	var total int64
+	for _, n := range v.snapshot.Lats {
+		total += n
+	}
+	if total == 0 {
+		return []string{"-", "-", "-"}
+	}
+	return bench.LatencyPercentiles(v.snapshot.Lats, total, []int{50, 95, 99})
+}
+
+// progress returns how far the run is toward -n or -d, and the fraction
+// done, -1 when unbounded.
+func (v *liveView) progress(now time.Time) (string, float64) {
+	elapsed := now.Sub(v.start)
+	switch {
+	case v.params.N > 0:
+		return fmt.Sprintf("%d of %d requests", v.snapshot.Attempted, v.params.N),
+			float64(v.snapshot.Attempted) / float64(v.params.N)
+	case v.params.Duration > 0:
+		duration := time.Duration(v.params.Duration) * time.Second
+		return fmt.Sprintf("%.1fs of %v", elapsed.Seconds(), duration), elapsed.Seconds() / duration.Seconds()
+	}
+	return fmt.Sprintf("%.1fs", elapsed.Seconds()), -1
+}
+
+// draw redraws the dashboard over the previous frame.
+func (v *liveView) draw(w io.Writer, now time.Time) {
+	var lines []string
+	text, done := v.progress(now)
+	if done >= 0 {
+		text += " " + progressBar(done, 20)
+	}
+	lines = append(lines, "  Progress:  "+text)
+	failed := 0
+	for _, n := range v.snapshot.ErrorDist {
+		failed += n
+	}
+	lines = append(lines, fmt.Sprintf("  Requests:  %d sent, %d completed, %d failed",
+		v.snapshot.Attempted, v.snapshot.LatsTotal, failed))
+	lines = append(lines, fmt.Sprintf("  Rps:       %-10.0f %s", v.rps[len(v.rps)-1], sparkline(v.rps)))
+	pctls := v.percentiles()
+	lines = append(lines, fmt.Sprintf("  Latency:   p50 %ss, p95 %ss, p99 %ss (last %ds)",
+		strings.TrimSpace(pctls[0]), strings.TrimSpace(pctls[1]), strings.TrimSpace(pctls[2]), bench.LIVE_WINDOW))
+	lines = append(lines, fmt.Sprintf("  p99:       %-10s %s", strings.TrimSpace(pctls[2]), sparkline(v.p99)))
+	lines = append(lines, "  Status:    "+v.statusCodes())
+	lines = append(lines, "  Errors:    "+v.newErrors())
+	if v.logs != nil {
+		for i, line := range v.logs.last(UI_LOGS) {
+			if len(line) > 2*UI_WIDTH {
+				line = line[:2*UI_WIDTH-3] + "..."
+			}
+			if i == 0 {
+				lines = append(lines, "  Log:       "+line)
+			} else {
+				lines = append(lines, "             "+line)
+			}
+		}
+	}
+
+	if v.lines > 0 {
+		fmt.Fprintf(w, "\x1b[%dA", v.lines) // Back to the first line of the previous frame
+	}
+	for _, line := range lines {
+		fmt.Fprintf(w, "\x1b[K%s\n", line)
+	}
+	fmt.Fprint(w, "\x1b[J")
+	v.lines = len(lines)
+}
+
+// line prints the state of the run on one line, for a log or a pipe.
+func (v *liveView) line(w io.Writer, now time.Time) {
+	text, done := v.progress(now)
+	if done >= 0 {
+		text += fmt.Sprintf(" (%.0f%%)", done*100)
+	}
+	pctls := v.percentiles()
+	fmt.Fprintf(w, "[%s] %d completed, %.0f rps, p50 %ss p95 %ss p99 %ss, status %s, errors %s\n",
+		text, v.snapshot.LatsTotal, v.rps[len(v.rps)-1], strings.TrimSpace(pctls[0]),
+		strings.TrimSpace(pctls[1]), strings.TrimSpace(pctls[2]), v.statusCodes(), v.newErrors())
+}
+
+func (v *liveView) statusCodes() string {
+	codes := make([]int, 0, len(v.snapshot.StatusCodeDist))
+	for code := range v.snapshot.StatusCodeDist {
+		codes = append(codes, code)
+	}
+	if len(codes) == 0 {
+		return "-"
+	}
+	sort.Ints(codes)
+	parts := make([]string, len(codes))
+	for i, code := range codes {
+		parts[i] = fmt.Sprintf("%d: %d", code, v.snapshot.StatusCodeDist[code])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// newErrors returns the UI_ERRORS most frequent errors, with how many of them
+// came since the previous frame.
+func (v *liveView) newErrors() string {
+	keys := make([]string, 0, len(v.snapshot.ErrorDist))
+	for err := range v.snapshot.ErrorDist {
+		keys = append(keys, err)
+	}
+	if len(keys) == 0 {
+		return "-"
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := v.snapshot.ErrorDist[keys[i]], v.snapshot.ErrorDist[keys[j]]
+		return a > b || (a == b && keys[i] < keys[j])
+	})
+	var parts []string
+	for i, err := range keys {
+		if i == UI_ERRORS {
+			parts = append(parts, fmt.Sprintf("%d more", len(keys)-UI_ERRORS))
+			break
+		}
+		n, text := v.snapshot.ErrorDist[err], err
+		if len(text) > UI_WIDTH {
+			text = text[:UI_WIDTH-3] + "..."
+		}
+		if added := n - v.errors[err]; added > 0 && v.errors != nil {
+			parts = append(parts, fmt.Sprintf("%s: %d (+%d)", text, n, added))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s: %d", text, n))
+		}
+	}
+	v.errors = v.snapshot.ErrorDist
+	return strings.Join(parts, ", ")
+}
+
+// progressBar draws the fraction done of width cells.
+func progressBar(done float64, width int) string {
+	if done > 1 {
+		done = 1
+	}
+	filled := int(done * float64(width))
+	return fmt.Sprintf("[%s%s] %3.0f%%", strings.Repeat("#", filled), strings.Repeat("-", width-filled), done*100)
+}
+
+// sparkline draws values scaled to the largest one.
+func sparkline(values []float64) string {
+	var max float64
+	for _, value := range values {
+		if value > max {
+			max = value
+		}
+	}
+	spark := make([]rune, len(values))
+	for i, value := range values {
+		level := 0
+		if max > 0 {
+			level = int(value / max * float64(len(sparkRunes)-1))
+		}
+		spark[i] = sparkRunes[level]
+	}
+	return string(spark)
+}